@@ -23,7 +23,10 @@ func init() {
 			} else if err := config.Init(path); err != nil {
 				return err
 			}
-			b := broker.NewBroker()
+			b, err := broker.NewBroker(config.Def, &broker.Options{Admin: true, Database: true})
+			if err != nil {
+				return err
+			}
 			ctx := context.TODO()
 			if err := b.Run(ctx); err != nil {
 				panic(err)
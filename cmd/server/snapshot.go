@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	msgStore "github.com/jin06/mercury/internal/server/message/store"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/internal/snapshot"
+	"github.com/spf13/cobra"
+)
+
+// The backup and restore commands open the stores of the configured mode, the broker must be
+// stopped. A serving broker is backed up through the admin API at /admin/api/snapshot. The
+// snapshot holds the payloads of the queued messages, --key-file or --key-env encrypt it.
+var (
+	backupCmd = cobra.Command{
+		Use:   "backup",
+		Short: "Export the state of the stopped broker to a file",
+		Long: `Export the sessions, subscriptions, retained and queued messages of the stopped broker to a
+file. Only the badger and sql message store modes persist them and are backed up.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			out, err := c.Flags().GetString("out")
+			if err != nil {
+				return err
+			}
+			key, err := snapshotKey(c)
+			if err != nil {
+				return err
+			}
+			return withStores(c, func(stores *snapshot.Stores) error {
+				snap, err := snapshot.Take(stores)
+				if err != nil {
+					return err
+				}
+				file, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+				if err != nil {
+					return err
+				}
+				if err := snapshot.Write(file, snap, key); err != nil {
+					file.Close()
+					return err
+				}
+				if err := file.Close(); err != nil {
+					return err
+				}
+				fmt.Printf("%d sessions, %d subscriptions, %d retained and %d messages written to %s\n",
+					len(snap.Sessions), len(snap.Subscriptions), len(snap.Retained), len(snap.Messages), out)
+				return nil
+			})
+		},
+	}
+	restoreCmd = cobra.Command{
+		Use:   "restore",
+		Short: "Import a snapshot file into the stores of the stopped broker",
+		Long: `Import a snapshot file into the stores of the stopped broker, in the badger or sql message
+store mode.`,
+		RunE: func(c *cobra.Command, args []string) error {
+			in, err := c.Flags().GetString("in")
+			if err != nil {
+				return err
+			}
+			key, err := snapshotKey(c)
+			if err != nil {
+				return err
+			}
+			file, err := os.Open(in)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			snap, err := snapshot.Read(file, key)
+			if err != nil {
+				return err
+			}
+			return withStores(c, func(stores *snapshot.Stores) error {
+				sum, err := snapshot.Restore(snap, stores)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%d sessions, %d subscriptions, %d retained and %d messages restored, %d skipped\n",
+					sum.Sessions, sum.Subscriptions, sum.Retained, sum.Messages, sum.Skipped)
+				return nil
+			})
+		},
+	}
+)
+
+func init() {
+	backupCmd.Flags().String("out", "mercury-snapshot.json", "Snapshot file to write")
+	restoreCmd.Flags().String("in", "mercury-snapshot.json", "Snapshot file to read")
+	for _, c := range []*cobra.Command{&backupCmd, &restoreCmd} {
+		c.Flags().String("key-file", "", "File holding the 16, 24 or 32 byte key encrypting the snapshot")
+		c.Flags().String("key-env", "", "Environment variable holding the key, used when --key-file is empty")
+	}
+	cmd.AddCommand(&backupCmd, &restoreCmd)
+}
+
+// withStores runs fn with the stores of the configured message store mode.
+func withStores(c *cobra.Command, fn func(stores *snapshot.Stores) error) error {
+	path, err := c.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	if err := config.Init(path); err != nil {
+		return err
+	}
+	cfg := config.Def
+	factory, err := msgStore.NewFactory(cfg.MessageStore, cfg.MQTTConfig.MessageExpiryInterval, retry.New(cfg.MQTTConfig.Retry))
+	if err != nil {
+		return err
+	}
+	defer factory.Close()
+	stores, err := snapshot.NewStores(factory)
+	if err != nil {
+		return err
+	}
+	return fn(stores)
+}
+
+// snapshotKey loads the key of the --key-file or --key-env flag, nil when both are empty.
+func snapshotKey(c *cobra.Command) ([]byte, error) {
+	file, err := c.Flags().GetString("key-file")
+	if err != nil {
+		return nil, err
+	}
+	env, err := c.Flags().GetString("key-env")
+	if err != nil {
+		return nil, err
+	}
+	return badgerStore.LoadKey(file, env)
+}
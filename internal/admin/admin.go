@@ -1,11 +1,18 @@
 package admin
 
-import "context"
+import (
+	"context"
 
-func Run(ctx context.Context) error {
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+)
+
+func Run(ctx context.Context, srv server.Server, cfg config.Admin) error {
 	// Initialize the admin server
 	adminServer := &adminServer{
-		ctx: ctx,
+		ctx:    ctx,
+		server: srv,
+		config: cfg,
 	}
 
 	// Start the admin server
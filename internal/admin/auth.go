@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jin06/mercury/internal/admin/http"
+)
+
+var ErrNoToken = errors.New("admin token file or environment variable is empty")
+
+// loadToken reads the admin token from file, or from the environment variable env when file
+// is empty. It returns nil when both are empty.
+func loadToken(file, env string) ([]byte, error) {
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		token := bytes.TrimSpace(data)
+		if len(token) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrNoToken, file)
+		}
+		return token, nil
+	case env != "":
+		token := strings.TrimSpace(os.Getenv(env))
+		if token == "" {
+			return nil, fmt.Errorf("%w: %s", ErrNoToken, env)
+		}
+		return []byte(token), nil
+	}
+	return nil, nil
+}
+
+// authorize rejects requests without the bearer token.
+func authorize(token []byte) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		got, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), token) != 1 {
+			ctx.Header("WWW-Authenticate", "Bearer")
+			ctx.AbortWithStatusJSON(401, http.Error(40100, "unauthorized"))
+			return
+		}
+		ctx.Next()
+	}
+}
@@ -0,0 +1,74 @@
+package admin
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/snapshot"
+)
+
+type snapshotServer struct {
+	server.Server
+}
+
+func (snapshotServer) Snapshot() (*snapshot.Snapshot, error) {
+	return &snapshot.Snapshot{Version: snapshot.Version, Created: time.Now()}, nil
+}
+
+func get(t *testing.T, r *gin.Engine, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/admin/api/snapshot", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSnapshotAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &adminServer{server: snapshotServer{}}
+	r, err := s.router()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := get(t, r, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected no snapshot route without a token, got %d", w.Code)
+	}
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "admin.token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	keyFile := filepath.Join(dir, "snapshot.key")
+	if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s.config = config.Admin{TokenFile: tokenFile, SnapshotKeyFile: keyFile}
+	if r, err = s.router(); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if w := get(t, r, token); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for token %q, got %d", token, w.Code)
+		}
+	}
+	w := get(t, r, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if _, err := snapshot.Read(w.Body, nil); !errors.Is(err, snapshot.ErrEncrypted) {
+		t.Fatalf("expected an encrypted snapshot, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jin06/mercury/internal/admin/http"
+	"github.com/jin06/mercury/internal/server"
+)
+
+type Clients struct {
+	Server server.Server
+}
+
+type ClientInfo struct {
+	ClientID   string `json:"client_id"`
+	Username   string `json:"username"`
+	Address    string `json:"address"`
+	QueueDepth int    `json:"queue_depth"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+func (h *Clients) List(ctx *gin.Context) {
+	list := []ClientInfo{}
+	for _, c := range h.Server.Clients() {
+		info := ClientInfo{
+			ClientID:   c.ClientID(),
+			Username:   c.Username(),
+			QueueDepth: c.QueueDepth(),
+			Dropped:    c.Dropped(),
+		}
+		if addr := c.RemoteAddr(); addr != nil {
+			info.Address = addr.String()
+		}
+		list = append(list, info)
+	}
+	ctx.JSON(200, http.Success(list))
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jin06/mercury/internal/admin/http"
+	"github.com/jin06/mercury/internal/server"
+)
+
+type Connections struct {
+	Server server.Server
+}
+
+func (h *Connections) Stats(ctx *gin.Context) {
+	ctx.JSON(200, http.Success(h.Server.Connections().Stats()))
+}
+
+func (h *Connections) PublishQuotas(ctx *gin.Context) {
+	ctx.JSON(200, http.Success(h.Server.PublishQuotas().Stats()))
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jin06/mercury/internal/admin/http"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/snapshot"
+)
+
+type Snapshot struct {
+	Server server.Server
+	// Key encrypts the snapshot when not nil.
+	Key []byte
+}
+
+// Get downloads a snapshot of the serving broker, it is restored with the restore command. An
+// encrypted snapshot is restored with the same key.
+func (h *Snapshot) Get(ctx *gin.Context) {
+	snap, err := h.Server.Snapshot()
+	if err != nil {
+		ctx.JSON(500, http.Error(50000, err.Error()))
+		return
+	}
+	ext := "json"
+	if h.Key != nil {
+		ext = "snap"
+		ctx.Header("Content-Type", "application/octet-stream")
+	} else {
+		ctx.Header("Content-Type", "application/json")
+	}
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=mercury-%s.%s", snap.Created.Format("20060102-150405"), ext))
+	if err := snapshot.Write(ctx.Writer, snap, h.Key); err != nil {
+		ctx.Error(err)
+	}
+}
@@ -5,10 +5,16 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jin06/mercury/internal/admin/handlers"
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/rs/zerolog/log"
 )
 
 type adminServer struct {
-	ctx context.Context
+	ctx    context.Context
+	server server.Server
+	config config.Admin
 }
 
 func (s *adminServer) start() (err error) {
@@ -24,6 +30,14 @@ func (s *adminServer) stop() error {
 }
 
 func (s *adminServer) startAPI(ctx context.Context) error {
+	r, err := s.router()
+	if err != nil {
+		return err
+	}
+	return r.Run(":8080") // Start the server on port 8080
+}
+
+func (s *adminServer) router() (*gin.Engine, error) {
 	r := gin.Default()
 	r.GET("health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -36,6 +50,33 @@ func (s *adminServer) startAPI(ctx context.Context) error {
 		userGroup.GET("/login", user.Login)
 		userGroup.GET("/info", user.Info)
 	}
-
-	return r.Run(":8080") // Start the server on port 8080
+	{
+		clients := handlers.Clients{Server: s.server}
+		clientGroup := r.Group("/admin/api/clients")
+		clientGroup.GET("", clients.List)
+	}
+	{
+		connections := handlers.Connections{Server: s.server}
+		r.GET("/admin/api/connections", connections.Stats)
+		r.GET("/admin/api/publish_quotas", connections.PublishQuotas)
+	}
+	token, err := loadToken(s.config.TokenFile, s.config.TokenEnv)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		// the routes exposing broker state fail closed
+		log.Warn().Msg("no admin token configured, the snapshot API is disabled")
+		return r, nil
+	}
+	key, err := badgerStore.LoadKey(s.config.SnapshotKeyFile, s.config.SnapshotKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	secured := r.Group("/admin/api", authorize(token))
+	{
+		snapshot := handlers.Snapshot{Server: s.server, Key: key}
+		secured.GET("/snapshot", snapshot.Get)
+	}
+	return r, nil
 }
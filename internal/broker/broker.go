@@ -2,8 +2,14 @@ package broker
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -11,84 +17,284 @@ import (
 	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/server"
 	"github.com/jin06/mercury/internal/server/clients"
-	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/internal/server/gateway"
+	"github.com/jin06/mercury/internal/server/limits"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	msgStore "github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/server/proxy"
 	"github.com/jin06/mercury/internal/server/servers"
 	"github.com/jin06/mercury/internal/store"
+	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-func NewBroker() *Broker {
+// NewBroker creates a broker serving the listeners of cfg, it opens the message store.
+func NewBroker(cfg *config.Config, options *Options) (*Broker, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	rate, err := limits.NewRate(cfg.MQTTConfig.ConnectionRate)
+	if err != nil {
+		return nil, err
+	}
+	stores, err := msgStore.NewFactory(cfg.MessageStore, cfg.MQTTConfig.MessageExpiryInterval, retry.New(cfg.MQTTConfig.Retry))
+	if err != nil {
+		return nil, err
+	}
+	srv, err := servers.NewServer(cfg, stores.New, servers.Persistence{
+		Subscriptions: stores.Subscriptions(),
+		Sessions:      stores.Sessions(),
+		Retained:      stores.Retained(),
+		History:       stores.History(),
+	})
+	if err != nil {
+		stores.Close()
+		return nil, err
+	}
 	b := &Broker{
-		Server:  servers.NewServer(config.Def.Mode),
-		closing: make(chan struct{}),
-		closed:  make(chan struct{}),
-		options: &Options{},
+		Server:     srv,
+		cfg:        cfg,
+		stores:     stores,
+		rate:       rate,
+		closing:    make(chan struct{}),
+		closed:     make(chan struct{}),
+		options:    options,
+		refusing:   make(chan struct{}, maxRefusing),
+		proxyReads: make(chan struct{}, maxProxyReads),
 	}
-	return b
+	return b, nil
 }
 
 type Broker struct {
 	Server    server.Server
+	cfg       *config.Config
+	stores    *msgStore.Factory
 	options   *Options
 	closeOnce sync.Once
 	closing   chan struct{}
 	closed    chan struct{}
+	connSeq   atomic.Uint64
+	rate      *limits.Rate
+	// refusing holds a slot for each connection being refused
+	refusing chan struct{}
+	// proxyReads holds a slot for each connection whose PROXY protocol header is being read
+	proxyReads chan struct{}
 }
 
+const (
+	// maxRefusing bounds the connections refused at the same time, beyond it they are closed at once
+	maxRefusing = 64
+	// refuseTimeout bounds the time a refused connection is kept open
+	refuseTimeout = time.Second
+	// maxProxyReads bounds the PROXY protocol headers read at the same time, beyond it
+	// connections are closed at once
+	maxProxyReads = 256
+	// proxyTimeout bounds the time to read a PROXY protocol header
+	proxyTimeout = 5 * time.Second
+)
+
 func (b *Broker) Run(ctx context.Context) (err error) {
 	defer close(b.closed)
+	defer b.stores.Close()
 	defer b.close()
-	if err = badgerStore.Init(config.Def.MessageStore.BadgerConfig); err != nil {
-		return
+	if b.options.Database {
+		if err = store.Init(&b.cfg.Database); err != nil {
+			return
+		}
 	}
-	if err = store.Init(); err != nil {
-		return
+	if b.options.Admin {
+		go func() {
+			if err := admin.Run(ctx, b.Server, b.cfg.Admin); err != nil {
+				log.Error().Err(err).Msg("server run error")
+			}
+		}()
+	}
+	if len(b.cfg.Listeners) == 0 {
+		// an embedded broker may serve in-process clients only
+		<-ctx.Done()
+		return nil
 	}
-	go func() {
-		if err := admin.Run(ctx); err != nil {
-			log.Error().Err(err).Msg("server run error")
-		}
-	}()
 	return b.listen(ctx)
 }
 
 func (b *Broker) listen(ctx context.Context) error {
 	wg := sync.WaitGroup{}
-	for _, l := range config.Def.Listeners {
+	for _, l := range b.cfg.Listeners {
+		var listen func(context.Context, config.Listener) error
 		switch l.Type {
 		case "tcp":
-			wg.Add(1)
-			go func() {
-				if err := b.listenTCP(ctx, l.Addr); err != nil {
-					log.Error().Err(err).Msg("listen tcp error")
-				}
-				b.close()
-				wg.Done()
-			}()
-		case "mqtt":
+			listen = b.listenTCP
+		case "unix":
+			listen = b.listenUnix
+		case "quic":
+			listen = b.listenQUIC
+		case "mqttsn":
+			listen = b.listenMQTTSN
+		default:
+			continue
 		}
+		wg.Add(1)
+		go func() {
+			if err := listen(ctx, l); err != nil {
+				log.Error().Err(err).Str("type", l.Type).Str("addr", l.Addr).Msg("listen error")
+			}
+			b.close()
+			wg.Done()
+		}()
 	}
 	wg.Wait()
 	return nil
 }
 
-func (b *Broker) listenTCP(ctx context.Context, addr string) error {
-	listener, err := net.Listen("tcp", addr)
+func (b *Broker) listenTCP(ctx context.Context, l config.Listener) error {
+	trusted, err := proxy.ParseTrusted(l.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if l.ProxyProtocol && len(trusted) == 0 {
+		return fmt.Errorf("%w on %s", proxy.ErrNoTrusted, l.Addr)
+	}
+	listener, err := net.Listen("tcp", l.Addr)
 	if err != nil {
 		return err
 	}
+	go closeOnDone(ctx, listener)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			panic(err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
 		}
-		client := clients.NewClient(b.Server, conn)
-		go func() {
-			if err := client.Run(ctx); err != nil {
-				log.Error().Err(err).Msg("client run error")
+		if !l.ProxyProtocol {
+			b.serve(ctx, l, conn)
+			continue
+		}
+		b.readProxy(ctx, l, conn, trusted)
+	}
+}
+
+// readProxy reads the PROXY protocol header of conn on its own goroutine, then serves it. The
+// header must arrive within proxyTimeout and the connect timeout, beyond maxProxyReads headers
+// read at the same time conn is closed at once.
+func (b *Broker) readProxy(ctx context.Context, l config.Listener, conn net.Conn, trusted []netip.Prefix) {
+	select {
+	case b.proxyReads <- struct{}{}:
+	default:
+		log.Warn().Str("listener", l.Addr).Str("proxy", conn.RemoteAddr().String()).Msg("too many proxy protocol headers pending")
+		conn.Close()
+		return
+	}
+	timeout := proxyTimeout
+	if t := b.cfg.MQTTConfig.ConnectTimeout; t > 0 {
+		timeout = min(timeout, t)
+	}
+	go func() {
+		pc, err := proxy.Read(conn, trusted, timeout)
+		<-b.proxyReads
+		if err != nil {
+			log.Warn().Err(err).Str("listener", l.Addr).Str("proxy", conn.RemoteAddr().String()).Msg("proxy protocol error")
+			conn.Close()
+			return
+		}
+		b.serve(ctx, l, pc)
+	}()
+}
+
+func (b *Broker) listenUnix(ctx context.Context, l config.Listener) error {
+	// remove the socket left behind by a previous run
+	if info, err := os.Lstat(l.Addr); err == nil && info.Mode().Type() == os.ModeSocket {
+		if err := os.Remove(l.Addr); err != nil {
+			return err
+		}
+	}
+	listener, err := net.Listen("unix", l.Addr)
+	if err != nil {
+		return err
+	}
+	go closeOnDone(ctx, listener)
+	if l.Permissions != "" {
+		perm, err := strconv.ParseUint(l.Permissions, 8, 32)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(l.Addr, os.FileMode(perm)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-		}()
+			return err
+		}
+		b.serve(ctx, l, conn)
+	}
+}
+
+// closeOnDone closes listener once ctx is done, which stops its accept loop.
+func closeOnDone(ctx context.Context, listener net.Listener) {
+	<-ctx.Done()
+	listener.Close()
+}
+
+// listenMQTTSN runs an MQTT-SN gateway on a UDP address.
+func (b *Broker) listenMQTTSN(ctx context.Context, l config.Listener) error {
+	conn, err := net.ListenPacket("udp", l.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return gateway.New(b.Server, conn, l, b.rate).Serve(ctx)
+}
+
+// serve applies the connection limits to conn accepted on l and runs its client.
+func (b *Broker) serve(ctx context.Context, l config.Listener, conn net.Conn) {
+	id := strconv.FormatUint(b.connSeq.Add(1), 10)
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !b.rate.Allow(ip) {
+		log.Warn().Str("listener", l.Addr).Str("ip", ip).Msg("connection rate exceeded")
+		b.refuse(conn, mqtt.V5_Connection_Rate_Exceeded)
+		return
+	}
+	if !b.Server.Connections().Accept(id, l.Addr, ip) {
+		log.Warn().Str("listener", l.Addr).Str("ip", ip).Msg("connection limit reached")
+		conn.Close()
+		return
 	}
+	options := clients.DefaultOptions()
+	options.Listener = l
+	options.Config = b.cfg
+	client := clients.NewClient(b.Server, conn, options)
+	go func() {
+		defer b.Server.Connections().Close(id)
+		if err := client.Run(ctx); err != nil {
+			log.Error().Err(err).Str("client_id", client.ClientID()).Str("ip", ip).Msg("client run error")
+		}
+	}()
+}
+
+// refuse answers the CONNECT of conn with code, or closes it at once when too many connections
+// are being refused already.
+func (b *Broker) refuse(conn net.Conn, code mqtt.ReasonCode) {
+	select {
+	case b.refusing <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	timeout := refuseTimeout
+	if t := b.cfg.MQTTConfig.ConnectTimeout; t > 0 {
+		timeout = min(timeout, t)
+	}
+	go func() {
+		defer func() { <-b.refusing }()
+		clients.Refuse(conn, code, timeout)
+	}()
 }
 
 func (b *Broker) close() error {
@@ -1,4 +1,8 @@
 package broker
 
 type Options struct {
+	// Admin runs the admin HTTP API.
+	Admin bool
+	// Database connects the SQL database of the config, which the user service needs.
+	Database bool
 }
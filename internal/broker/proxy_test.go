@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+// TestProxyReadsBounded holds the PROXY protocol header back, the reads are bounded in number
+// and time.
+func TestProxyReadsBounded(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	b := &Broker{
+		cfg:        &config.Config{MQTTConfig: config.MQTTConfig{ConnectTimeout: 100 * time.Millisecond}},
+		proxyReads: make(chan struct{}, 1),
+	}
+	trusted := []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.readProxy(context.Background(), config.Listener{Addr: listener.Addr().String(), ProxyProtocol: true}, conn, trusted)
+		return c
+	}
+	closed := func(c net.Conn, within time.Duration) {
+		c.SetReadDeadline(time.Now().Add(within))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the connection closed, got %v", err)
+		}
+	}
+
+	idle := dial()
+	// the second header read is over the bound
+	closed(dial(), 50*time.Millisecond)
+	// the idle one times out and releases its slot
+	closed(idle, time.Second)
+	deadline := time.Now().Add(time.Second)
+	for len(b.proxyReads) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
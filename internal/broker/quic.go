@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+// quicALPN is the application protocol negotiated on QUIC listeners.
+const quicALPN = "mqtt"
+
+var errQUICCertificate = errors.New("quic listener requires cert_file and key_file")
+
+func (b *Broker) listenQUIC(ctx context.Context, l config.Listener) error {
+	if l.CertFile == "" || l.KeyFile == "" {
+		return errQUICCertificate
+	}
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return err
+	}
+	listener, err := quic.ListenAddr(l.Addr, quicTLSConfig(cert), quicConfig())
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	return b.serveQUIC(ctx, l, listener)
+}
+
+func quicTLSConfig(cert tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+	}
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		// longer than common MQTT keep alive intervals, clients ping within it
+		MaxIdleTimeout: time.Minute * 5,
+	}
+}
+
+// serveQUIC serves a client on every bidirectional stream of the accepted connections.
+// The clients survive address changes of the connection.
+func (b *Broker) serveQUIC(ctx context.Context, l config.Listener, listener *quic.Listener) error {
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(ctx)
+				if err != nil {
+					log.Debug().Err(err).Str("listener", l.Addr).Msg("quic connection closed")
+					return
+				}
+				b.serve(ctx, l, &quicStream{Stream: stream, conn: conn})
+			}
+		}()
+	}
+}
+
+// quicStream adapts a QUIC stream to a net.Conn.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// Close closes both directions of the stream, the connection may carry other streams.
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr is the current address of the peer, it changes when the connection migrates.
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
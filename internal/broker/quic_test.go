@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func udpConn(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func roundTrip(t *testing.T, c *mqtt.Connection, p mqtt.Packet) mqtt.Packet {
+	if err := c.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestQUICMigration(t *testing.T) {
+	cfg := &config.Config{
+		Mode:         config.MemoryMode,
+		Capabilities: config.DefaultCapabilities(),
+		MessageStore: config.MessageStore{Mode: "memory"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b, err := NewBroker(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := quic.Listen(udpConn(t), quicTLSConfig(testCertificate(t)), quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.serveQUIC(ctx, config.Listener{Type: "quic"}, listener)
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{quicALPN}}
+	conn, err := (&quic.Transport{Conn: udpConn(t)}).Dial(ctx, listener.Addr(), tlsConf, quicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := mqtt.NewConnection(stream)
+	c.Version = mqtt.MQTT5
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = "vehicle"
+	if resp, ok := roundTrip(t, c, cp).(*mqtt.Connack); !ok || resp.ReasonCode != mqtt.V5_SUCCESS {
+		t.Fatalf("unexpected connect response %v", resp)
+	}
+
+	// move the connection to a new local address, as when a vehicle changes cells
+	path, err := conn.AddPath(&quic.Transport{Conn: udpConn(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := path.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := path.Switch(); err != nil {
+		t.Fatal(err)
+	}
+	ping := mqtt.NewPingreq(&mqtt.FixedHeader{PacketType: mqtt.PINGREQ}, mqtt.MQTT5)
+	if _, ok := roundTrip(t, c, ping).(*mqtt.Pingresp); !ok {
+		t.Fatal("session did not survive the migration")
+	}
+	if client := b.Server.Clients(); len(client) != 1 || client[0].RemoteAddr().String() != conn.LocalAddr().String() {
+		t.Errorf("client address not updated to %s", conn.LocalAddr())
+	}
+}
@@ -29,7 +29,14 @@ func Parse(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	cfg := &Config{}
+	cfg := &Config{
+		Capabilities: DefaultCapabilities(),
+		MQTTConfig: MQTTConfig{
+			SlowConsumer:   DefaultSlowConsumer(),
+			ConnectTimeout: time.Second * 10,
+			Retry:          DefaultRetry(),
+		},
+	}
 	err = yaml.NewDecoder(file).Decode(cfg)
 	return cfg, err
 }
@@ -40,6 +47,9 @@ type Config struct {
 	Database     Database     `yaml:"database"`
 	Mode         Mode         `yaml:"mode"`
 	MessageStore MessageStore `yaml:"message_store"`
+	Capabilities Capabilities `yaml:"capabilities"`
+	ACL          ACL          `yaml:"acl"`
+	Admin        Admin        `yaml:"admin"`
 }
 
 func (cfg *Config) Valid() (err error) {
@@ -59,25 +69,219 @@ func (m Mode) Valid() error {
 }
 
 type Listener struct {
+	// Type is tcp, unix, quic or mqttsn.
 	Type string `yaml:"type"`
+	// Addr is the host and port to listen on, the socket path for unix listeners.
 	Addr string `yaml:"addr"`
+	// MaxConnections on this listener, 0 means no limit.
+	MaxConnections int `yaml:"max_connections"`
+	// MaxConnectTime disconnects clients connected longer, 0 means no limit.
+	MaxConnectTime time.Duration `yaml:"max_connect_time"`
+	// ProxyProtocol expects a PROXY protocol v1 or v2 header on every connection, within 5
+	// seconds or the connect timeout if shorter.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// TrustedProxies lists the IPs and CIDRs proxies may connect from, it must not be empty with
+	// ProxyProtocol.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Permissions of a unix socket in octal, e.g. "0660".
+	Permissions string `yaml:"permissions"`
+	// PeerAuth authenticates unix socket clients by their OS user, which becomes their username.
+	PeerAuth bool `yaml:"peer_auth"`
+	// CertFile and KeyFile are the PEM encoded TLS certificate and key, required by quic listeners.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// MQTTSN configures the MQTT-SN gateway of mqttsn listeners.
+	MQTTSN MQTTSN `yaml:"mqttsn"`
+}
+
+type MQTTSN struct {
+	GatewayID byte `yaml:"gateway_id"`
+	// PredefinedTopics are topic IDs known to clients in advance.
+	PredefinedTopics map[uint16]string `yaml:"predefined_topics"`
+	// BufferSize is the number of messages kept for a sleeping client, 0 means 100.
+	BufferSize int `yaml:"buffer_size"`
 }
 
 type MQTTConfig struct {
 	// MaxConnections is the maximum number of connections the server will accept.
 	MaxConnections int `yaml:"max_connections"`
+	// MaxConnectionsPerIP and MaxConnectionsPerUser limit the connections from one source IP
+	// and of one username, 0 means no limit.
+	MaxConnectionsPerIP   int `yaml:"max_connections_per_ip"`
+	MaxConnectionsPerUser int `yaml:"max_connections_per_user"`
+	// ConnectionRate limits how fast new connections are accepted.
+	ConnectionRate ConnectionRate `yaml:"connection_rate"`
+	// MaxConnectTimePerUser overrides the listener MaxConnectTime for a username, 0 means no limit.
+	MaxConnectTimePerUser map[string]time.Duration `yaml:"max_connect_time_per_user"`
+	// IdleTimeout disconnects clients that have not published for this long, 0 means no timeout.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ConnectTimeout closes connections that do not send CONNECT in time, 0 means no timeout.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// PublishQuotas limit the publish rate of clients.
+	PublishQuotas PublishQuotas `yaml:"publish_quotas"`
 	// MessageDeliveryTimeout is the maximum time in seconds the server will wait for a message to be delivered.
 	MessageDeliveryTimeout time.Duration `yaml:"message_delivery_timeout"`
 	MessageExpiryInterval  time.Duration `yaml:"message_expiry_interval"`
+	// ResponseInformation is returned in CONNACK to MQTT 5 clients requesting it,
+	// %c is replaced with the client ID and %u with the username, e.g. "reply/%c/".
+	ResponseInformation string `yaml:"response_information"`
+	// SlowConsumer decides what happens to messages for a client whose output queue is full.
+	SlowConsumer SlowConsumer `yaml:"slow_consumer"`
+	// Retry decides when unacknowledged QoS 1 and 2 messages are sent again.
+	Retry Retry `yaml:"retry"`
+}
+
+// Retry is the policy for sending unacknowledged messages again. MQTT 5 clients only get them
+// again when they reconnect, as the specification requires.
+type Retry struct {
+	// InitialDelay is the wait for an acknowledgement before the first resend.
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	// Multiplier grows the delay after each resend, values below 1 keep it constant.
+	Multiplier float64 `yaml:"multiplier"`
+	// MaxDelay caps the delay, 0 means no cap.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// MaxAttempts is how often a message is sent including the first time, 0 means no limit.
+	MaxAttempts int `yaml:"max_attempts"`
+	// ReconnectOnly resends to MQTT 3 clients only when they reconnect too.
+	ReconnectOnly bool `yaml:"reconnect_only"`
+	// DeadLetterTopic receives the messages out of attempts with the reason as user properties,
+	// empty drops them.
+	DeadLetterTopic string `yaml:"dead_letter_topic"`
+}
+
+func DefaultRetry() Retry {
+	return Retry{
+		InitialDelay: time.Second * 5,
+		Multiplier:   2,
+		MaxDelay:     time.Minute * 5,
+		MaxAttempts:  5,
+	}
+}
+
+const (
+	// DropQoS0 drops QoS 0 publishes, other packets are handled like Disconnect.
+	DropQoS0 = "drop_qos0"
+	// DropOldest discards the oldest queued QoS 0 publish, or else the oldest publish, to make room.
+	// Acknowledgements are never discarded, without a queued publish it is handled like Disconnect.
+	DropOldest = "drop_oldest"
+	// Disconnect drops packets and disconnects the client once the queue stayed full for the grace period.
+	// Dropped QoS 1 and 2 publishes are kept in the message store and sent again.
+	Disconnect = "disconnect"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst tokens, 0 Rate means no limit.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type CIDRRateLimit struct {
+	CIDR      string `yaml:"cidr"`
+	RateLimit `yaml:",inline"`
+}
+
+type ConnectionRate struct {
+	Global RateLimit `yaml:"global"`
+	// PerIP is applied to each source IP separately.
+	PerIP RateLimit `yaml:"per_ip"`
+	// CIDRs share one bucket per network, the first matching network applies.
+	CIDRs []CIDRRateLimit `yaml:"cidrs"`
+	// Allow lists IPs and CIDRs exempt from connection rate limits, e.g. trusted gateways.
+	Allow []string `yaml:"allow"`
+}
+
+const (
+	// Throttle stops reading from the client until it is within its quota again.
+	Throttle = "throttle"
+	// Reject drops the publish, QoS 1 and 2 publishes are answered with Quota Exceeded.
+	Reject = "reject"
+)
+
+// PublishQuota limits publishes per second and payload bytes per second.
+type PublishQuota struct {
+	Messages RateLimit `yaml:"messages"`
+	Bytes    RateLimit `yaml:"bytes"`
+}
+
+type TopicQuota struct {
+	Prefix       string `yaml:"prefix"`
+	PublishQuota `yaml:",inline"`
+}
+
+type PublishQuotas struct {
+	// Action for a client over quota is throttle, reject or disconnect with Message Rate Too High.
+	// Empty means throttle.
+	Action string `yaml:"action"`
+	// Client applies to each client, Username to all clients of a username together.
+	Client   PublishQuota `yaml:"client"`
+	Username PublishQuota `yaml:"username"`
+	// Topics apply to all publishes to topics starting with the prefix together,
+	// the longest matching prefix applies.
+	Topics []TopicQuota `yaml:"topics"`
+}
+
+type SlowConsumer struct {
+	Policy string `yaml:"policy"`
+	// QueueSize is the capacity of each client output queue.
+	QueueSize   int           `yaml:"queue_size"`
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// SessionQueueBytes bounds the topic and payload bytes of the QoS 1 and 2 publishes a session
+	// keeps while all its packet IDs are inflight, 0 means 16 MiB. Beyond it drop_oldest discards
+	// the oldest of them, the other policies drop the publish and disconnect the client.
+	SessionQueueBytes int `yaml:"session_queue_bytes"`
+}
+
+func DefaultSlowConsumer() SlowConsumer {
+	return SlowConsumer{
+		Policy:            DropQoS0,
+		QueueSize:         2000,
+		GracePeriod:       time.Second * 10,
+		SessionQueueBytes: 16 << 20,
+	}
 }
 
 type Database struct {
+	// Type is mysql, postgres or sqlite.
 	Type string `json:"type"`
 	DSN  string `json:"dsn"`
 }
 
 type BadgerConfig struct {
 	Dir string `yaml:"dir"`
+	// GCInterval is how often the value log is garbage collected, 0 means 10 minutes.
+	GCInterval time.Duration `yaml:"gc_interval"`
+	// Encryption encrypts the database at rest, it is off without a key.
+	Encryption Encryption `yaml:"encryption"`
+}
+
+// Encryption configures the encryption of the badger database. The master key has 16, 24 or
+// 32 bytes for AES-128, 192 or 256, raw or hex or base64 encoded. It is read from KeyFile,
+// or from the environment variable KeyEnv when no file is set.
+type Encryption struct {
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+	// OldKeyFile and OldKeyEnv hold the previous master key while rotating it, the database
+	// is encrypted with the new key when it opens. They may stay set until the next rotation.
+	OldKeyFile string `yaml:"old_key_file"`
+	OldKeyEnv  string `yaml:"old_key_env"`
+	// DataKeyRotation is how often badger replaces the data key encrypting new files, 0 means 10 days.
+	DataKeyRotation time.Duration `yaml:"data_key_rotation"`
+	// Envelope also encrypts each stored message, session and subscription with its own data
+	// key, which is stored encrypted with the master key. The values written before it was
+	// enabled are sealed when the database opens.
+	Envelope bool `yaml:"envelope"`
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// TLS connects over TLS, CAFile verifies the server with a custom CA instead of the system roots.
+	TLS    bool   `yaml:"tls"`
+	CAFile string `yaml:"ca_file"`
+	// KeyPrefix is prepended to every key, it separates brokers sharing a database. Empty means "mercury:".
+	KeyPrefix string `yaml:"key_prefix"`
 }
 
 type MemoryConfig struct {
@@ -87,7 +291,85 @@ type MemoryConfig struct {
 }
 
 type MessageStore struct {
+	// Mode is memory, badger, redis or sql. The badger and sql modes also keep the sessions
+	// outliving their connection, their subscriptions and the retained messages across restarts.
 	Mode         string       `yaml:"mode"`
 	BadgerConfig BadgerConfig `yaml:"badger"`
+	RedisConfig  RedisConfig  `yaml:"redis"`
+	SQLConfig    Database     `yaml:"sql"`
 	MemoryConfig MemoryConfig `yaml:"moeory"`
+	// History keeps the messages of topic prefixes for replay, in the badger mode only.
+	History []HistoryStream `yaml:"history"`
+}
+
+// HistoryStream keeps the messages published below a topic prefix, a message is kept once in
+// the stream with the longest matching prefix. At least one of the limits is required.
+type HistoryStream struct {
+	// Prefix is the start of the topics kept, e.g. "sensors/".
+	Prefix string `yaml:"prefix"`
+	// MaxMessages keeps the last messages of the stream, 0 means no limit.
+	MaxMessages int `yaml:"max_messages"`
+	// MaxAge keeps the messages of the last duration, 0 means no limit.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Capabilities are the broker features advertised to MQTT 5 clients in CONNACK
+// and enforced for every client.
+type Capabilities struct {
+	// MaximumQoS is the highest QoS accepted on PUBLISH and granted on SUBSCRIBE.
+	MaximumQoS                      byte `yaml:"maximum_qos"`
+	RetainAvailable                 bool `yaml:"retain_available"`
+	WildcardSubscriptionAvailable   bool `yaml:"wildcard_subscription_available"`
+	SubscriptionIdentifierAvailable bool `yaml:"subscription_identifier_available"`
+	SharedSubscriptionAvailable     bool `yaml:"shared_subscription_available"`
+	// MaximumPacketSize in bytes, 0 means no limit.
+	MaximumPacketSize uint32 `yaml:"maximum_packet_size"`
+	// TopicAliasMaximum is the highest topic alias a client may use, 0 disables topic aliases.
+	TopicAliasMaximum uint16 `yaml:"topic_alias_maximum"`
+	// ReceiveMaximum is the number of QoS 1 and 2 publishes a client may have unacknowledged at once.
+	ReceiveMaximum uint16 `yaml:"receive_maximum"`
+}
+
+func DefaultCapabilities() Capabilities {
+	return Capabilities{
+		MaximumQoS:                      2,
+		RetainAvailable:                 true,
+		WildcardSubscriptionAvailable:   true,
+		SubscriptionIdentifierAvailable: true,
+		ReceiveMaximum:                  65535,
+	}
+}
+
+// ACL authorizes publishing and subscribing, rules are checked in order and the first match wins.
+type ACL struct {
+	// Default is the permission when no rule matches, allow or deny. Empty means allow.
+	Default string    `yaml:"default"`
+	Rules   []ACLRule `yaml:"rules"`
+}
+
+type ACLRule struct {
+	// Permission is allow or deny.
+	Permission string `yaml:"permission"`
+	// Action is publish, subscribe or empty for both.
+	Action string `yaml:"action"`
+	// ClientID and Username restrict the rule to a client, empty matches any.
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	// Address restricts the rule to clients from comma separated IPs or CIDRs, empty matches any.
+	Address string `yaml:"address"`
+	// Topic is a topic filter, %c and %u are replaced with the client ID and username.
+	Topic string `yaml:"topic"`
+}
+
+// Admin configures the admin HTTP API.
+type Admin struct {
+	// TokenFile holds the bearer token of the routes exposing broker state, e.g. the snapshot
+	// download, TokenEnv names the environment variable holding it when TokenFile is empty.
+	// Without a token those routes are not served.
+	TokenFile string `yaml:"token_file"`
+	TokenEnv  string `yaml:"token_env"`
+	// SnapshotKeyFile and SnapshotKeyEnv hold a 16, 24 or 32 byte key encrypting the downloaded
+	// snapshot with AES-GCM, the payloads are in plain text without one.
+	SnapshotKeyFile string `yaml:"snapshot_key_file"`
+	SnapshotKeyEnv  string `yaml:"snapshot_key_env"`
 }
@@ -12,3 +12,18 @@ func TestParse(t *testing.T) {
 	}
 	t.Log(cfg)
 }
+
+func TestParseCapabilities(t *testing.T) {
+	cfg, err := Parse("mercury_test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.Capabilities
+	if c.MaximumQoS != 1 || c.RetainAvailable || c.TopicAliasMaximum != 10 {
+		t.Errorf("configured capabilities not parsed: %+v", c)
+	}
+	// unset fields keep their defaults
+	if !c.WildcardSubscriptionAvailable || c.ReceiveMaximum != 65535 {
+		t.Errorf("default capabilities lost: %+v", c)
+	}
+}
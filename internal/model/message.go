@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Message is an inflight record of a client in the sql message store.
+type Message struct {
+	ID       uint64 `gorm:"primaryKey"`
+	ClientID string `gorm:"size:255;not null;uniqueIndex:idx_messages_client_packet;index:idx_messages_client_resend"`
+	PacketID uint16 `gorm:"not null;uniqueIndex:idx_messages_client_packet"`
+	// Record is the record encoded by Record.Encode.
+	Record []byte `gorm:"not null"`
+	// ResendAt is when the record is sent again unless it is acknowledged before.
+	ResendAt time.Time `gorm:"index:idx_messages_client_resend"`
+	Created  time.Time
+}
+
+func (m *Message) TableName() string {
+	return "messages"
+}
+
+// HeldMessage is an incoming QoS 2 publish of a client in the sql message store, it is kept
+// until the client releases it with PUBREL.
+type HeldMessage struct {
+	ClientID string `gorm:"primaryKey;size:255"`
+	PacketID uint16 `gorm:"primaryKey"`
+	// Record is the record of the publish encoded by Record.Encode.
+	Record  []byte `gorm:"not null"`
+	Created time.Time
+}
+
+func (m *HeldMessage) TableName() string {
+	return "held_messages"
+}
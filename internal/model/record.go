@@ -1,6 +1,8 @@
 package model
 
 import (
+	"encoding/binary"
+	"errors"
 	"time"
 
 	"github.com/jin06/mercury/pkg/mqtt"
@@ -38,3 +40,72 @@ func NewRecord(cid string, p mqtt.Message, expiry time.Duration) *Record {
 	}
 	return r
 }
+
+// recordEncoding is the version of the record encoding, it is the first byte of an encoded record.
+const recordEncoding byte = 1
+
+var (
+	ErrRecordEncoding  = errors.New("unknown record encoding")
+	ErrRecordTruncated = errors.New("truncated record")
+)
+
+// Encode serializes the record for the persistent message stores. After the encoding version
+// come the protocol version, Times, Expiry, the client ID, the receive and send times as
+// unix nanoseconds and the encoded packet.
+func (r *Record) Encode() ([]byte, error) {
+	data := []byte{recordEncoding, byte(r.Version)}
+	data = binary.BigEndian.AppendUint64(data, r.Times)
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Expiry))
+	if raw, err := mqtt.EncodeUTF8(r.ClientID); err != nil {
+		return nil, err
+	} else {
+		data = append(data, raw...)
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Receive.UnixNano()))
+	data = binary.BigEndian.AppendUint64(data, uint64(r.Send.UnixNano()))
+	if raw, err := r.Content.Encode(); err != nil {
+		return nil, err
+	} else {
+		data = append(data, raw...)
+	}
+	return data, nil
+}
+
+// DecodeRecord parses a record serialized by Encode.
+func DecodeRecord(data []byte) (*Record, error) {
+	if len(data) == 0 {
+		return nil, ErrRecordTruncated
+	}
+	if data[0] != recordEncoding {
+		return nil, ErrRecordEncoding
+	}
+	// encoding and protocol version, Times and Expiry
+	const head = 2 + 8 + 8
+	if len(data) < head {
+		return nil, ErrRecordTruncated
+	}
+	r := &Record{
+		Version: mqtt.ProtocolVersion(data[1]),
+		Times:   binary.BigEndian.Uint64(data[2:]),
+		Expiry:  time.Duration(binary.BigEndian.Uint64(data[10:])),
+	}
+	i := head
+	if clientID, n, err := mqtt.DecodeUTF8(data[i:]); err != nil {
+		return nil, err
+	} else {
+		r.ClientID = clientID
+		i += n
+	}
+	if len(data) < i+16 {
+		return nil, ErrRecordTruncated
+	}
+	r.Receive = time.Unix(0, int64(binary.BigEndian.Uint64(data[i:])))
+	r.Send = time.Unix(0, int64(binary.BigEndian.Uint64(data[i+8:])))
+	i += 16
+	if packet, err := mqtt.Decode(r.Version, data[i:]); err != nil {
+		return nil, err
+	} else {
+		r.Content = packet
+	}
+	return r, nil
+}
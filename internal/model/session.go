@@ -7,13 +7,17 @@ import (
 )
 
 type Session struct {
-	ClientID    string     `json:"client_id"`
-	Will        *mqtt.Will `json:"will"`
+	ClientID    string     `json:"client_id" gorm:"primaryKey;size:255"`
+	Will        *mqtt.Will `json:"will" gorm:"serializer:json"`
 	ConnectTime time.Time  `json:"connect_time"`
 	//KeepTime last keep time or messaging time
-	KeepTime time.Time `json:"keep_time"`
-	Username string    `json:"username"`
+	KeepTime time.Time `json:"keep_time" gorm:"index"`
+	Username string    `json:"username" gorm:"size:255"`
 	Clean    bool      `json:"clean"`
 	// Session Expiry Interval inseconds
 	Expiry uint32 `json:"expiry"`
 }
+
+func (s *Session) TableName() string {
+	return "sessions"
+}
@@ -1,6 +1,22 @@
 package model
 
+import "time"
+
+// Subscription is a persisted subscription of a client.
 type Subscription struct {
+	ClientID          string `json:"client_id" gorm:"primaryKey;size:255"`
+	TopicFilter       string `json:"topic_filter" gorm:"primaryKey;size:1024"`
+	QoS               byte   `json:"qos"`
+	NoLocal           bool   `json:"no_local"`
+	RetainAsPublished bool   `json:"retain_as_published"`
+	RetainHandling    byte   `json:"retain_handling"`
+	// Identifier is the MQTT 5 subscription identifier, 0 means none.
+	Identifier int       `json:"identifier"`
+	Created    time.Time `json:"created"`
+}
+
+func (s *Subscription) TableName() string {
+	return "subscriptions"
 }
 
 type TopicFilter struct {
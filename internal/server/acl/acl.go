@@ -0,0 +1,156 @@
+package acl
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+type Action string
+
+const (
+	Publish   Action = "publish"
+	Subscribe Action = "subscribe"
+
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+func New(cfg config.ACL) *ACL {
+	a := &ACL{
+		allow: cfg.Default != Deny,
+	}
+	for _, r := range cfg.Rules {
+		a.rules = append(a.rules, newRule(r))
+	}
+	return a
+}
+
+type ACL struct {
+	rules []rule
+	allow bool
+}
+
+// Client is who publishes or subscribes.
+type Client struct {
+	ID       string
+	Username string
+	// Addr is the source IP of the client, the zero Addr when unknown
+	Addr netip.Addr
+}
+
+type rule struct {
+	config.ACLRule
+	// networks parsed from Address, a rule with an invalid address never matches
+	networks []netip.Prefix
+	invalid  bool
+}
+
+func newRule(r config.ACLRule) rule {
+	n := rule{ACLRule: r}
+	for _, s := range strings.Split(r.Address, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if !strings.Contains(s, "/") {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			n.invalid = true
+			continue
+		}
+		n.networks = append(n.networks, prefix.Masked())
+	}
+	return n
+}
+
+func (r *rule) matchAddr(addr netip.Addr) bool {
+	if r.invalid {
+		return false
+	}
+	if len(r.networks) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepend adds a rule checked before the configured ones.
+func (a *ACL) Prepend(r config.ACLRule) {
+	a.rules = append([]rule{newRule(r)}, a.rules...)
+}
+
+// Allow reports whether the client may publish to a topic name or subscribe to a topic filter.
+func (a *ACL) Allow(action Action, c Client, topic string) bool {
+	for _, rule := range a.rules {
+		if rule.Action != "" && Action(rule.Action) != action {
+			continue
+		}
+		if rule.ClientID != "" && rule.ClientID != c.ID {
+			continue
+		}
+		if rule.Username != "" && rule.Username != c.Username {
+			continue
+		}
+		if !rule.matchAddr(c.Addr) {
+			continue
+		}
+		filter, ok := Expand(rule.Topic, c.ID, c.Username)
+		if !ok || !Covers(filter, topic) {
+			continue
+		}
+		return rule.Permission == Allow
+	}
+	return a.allow
+}
+
+// Expand replaces %c with the client ID and %u with the username. It fails when
+// a value contains topic separators or wildcards, which would widen the template.
+func Expand(template, clientID, username string) (string, bool) {
+	if strings.Contains(template, "%c") {
+		if strings.ContainsAny(clientID, "/+#") || clientID == "" {
+			return "", false
+		}
+		template = strings.ReplaceAll(template, "%c", clientID)
+	}
+	if strings.Contains(template, "%u") {
+		if strings.ContainsAny(username, "/+#") || username == "" {
+			return "", false
+		}
+		template = strings.ReplaceAll(template, "%u", username)
+	}
+	return template, true
+}
+
+// Covers reports whether every topic matched by topic is also matched by filter,
+// topic may be a topic name or a topic filter.
+func Covers(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		switch {
+		case f == "+":
+			if ts[i] == "#" {
+				return false
+			}
+		case f != ts[i]:
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
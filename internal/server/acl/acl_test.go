@@ -0,0 +1,66 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func TestCovers(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"reply/c1/#", "reply/c1/a/b", true},
+		{"reply/c1/#", "reply/c1/#", true},
+		{"reply/c1/#", "reply/c1", true},
+		{"reply/c1/#", "reply/c2/a", false},
+		{"reply/+/a", "reply/c1/a", true},
+		{"reply/+/a", "reply/+/a", true},
+		{"reply/+/a", "reply/#", false},
+		{"a/b", "a/b/c", false},
+	}
+	for _, tc := range cases {
+		if got := Covers(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("Covers(%q, %q) = %t", tc.filter, tc.topic, got)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	a := New(config.ACL{
+		Default: Deny,
+		Rules: []config.ACLRule{
+			{Permission: Allow, Action: string(Subscribe), Topic: "reply/%c/#"},
+			{Permission: Allow, Action: string(Publish), Username: "admin", Topic: "#"},
+		},
+	})
+	if !a.Allow(Subscribe, Client{ID: "c1"}, "reply/c1/x") {
+		t.Error("client should subscribe to its own prefix")
+	}
+	if a.Allow(Subscribe, Client{ID: "c1"}, "reply/c2/x") || a.Allow(Subscribe, Client{ID: "+"}, "reply/c2/x") {
+		t.Error("client should not subscribe to another prefix")
+	}
+	if !a.Allow(Publish, Client{ID: "c1", Username: "admin"}, "reply/c2/x") || a.Allow(Publish, Client{ID: "c1", Username: "guest"}, "a") {
+		t.Error("publish rule not applied")
+	}
+}
+
+func TestAllowAddress(t *testing.T) {
+	a := New(config.ACL{
+		Default: Deny,
+		Rules: []config.ACLRule{
+			{Permission: Allow, Address: "10.0.0.0/8, 192.168.1.1", Topic: "#"},
+			{Permission: Allow, Address: "bad", Topic: "#"},
+		},
+	})
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.168.1.1": true, "::ffff:10.0.0.1": true, "192.168.1.2": false} {
+		if got := a.Allow(Publish, Client{ID: "c1", Addr: netip.MustParseAddr(ip)}, "a"); got != want {
+			t.Errorf("Allow from %s = %t", ip, got)
+		}
+	}
+	if a.Allow(Publish, Client{ID: "c1"}, "a") {
+		t.Error("client without address matched an address rule")
+	}
+}
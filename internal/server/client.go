@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"net"
 
 	"github.com/jin06/mercury/pkg/mqtt"
 )
@@ -10,8 +11,17 @@ type Client interface {
 	Run(ctx context.Context) error
 	Close(ctx context.Context) error
 	ClientID() string
+	Username() string
 	UUID() string
+	// RemoteAddr is the client address, behind a proxy the one sent with the PROXY protocol. It may be nil.
+	RemoteAddr() net.Addr
+	// PeerCredentials of a client connected over a unix socket, nil for other clients.
+	PeerCredentials() *PeerCredentials
 	Write(p mqtt.Packet) (err error)
 	Read() (mqtt.Packet, error)
 	KeepAlive()
+	// QueueDepth is the number of packets waiting to be written to the client.
+	QueueDepth() int
+	// Dropped is the number of packets dropped because the queue was full.
+	Dropped() uint64
 }
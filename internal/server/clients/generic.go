@@ -4,42 +4,65 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/google/uuid"
 	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/server"
-	"github.com/jin06/mercury/internal/server/message/store"
 	"github.com/jin06/mercury/internal/utils"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-func NewClient(handler server.Server, conn io.ReadWriteCloser) *generic {
+// NewClient creates a client for conn, nil options mean DefaultOptions.
+func NewClient(handler server.Server, conn io.ReadWriteCloser, options *Options) *generic {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	cfg := options.Config
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	slow := cfg.MQTTConfig.SlowConsumer
+	if slow.QueueSize <= 0 {
+		slow.QueueSize = config.DefaultSlowConsumer().QueueSize
+	}
 	c := generic{
 		handler:    handler,
 		Connection: mqtt.NewConnection(conn),
 		stopping:   make(chan struct{}),
 		closed:     make(chan struct{}),
 		closeOnce:  sync.Once{},
-		options:    DefaultOptions(),
+		options:    options,
+		cfg:        cfg,
 		input:      make(chan mqtt.Packet, 2000),
-		output:     make(chan mqtt.Packet, 2000),
+		output:     newOutputQueue(slow.QueueSize),
+		slow:       slow,
 		uuid:       uuid.New().String(),
+		unreleased: map[mqtt.PacketID]struct{}{},
 		keep:       time.Now(),
-		db:         newRecordDB(),
 	}
+	if a, ok := conn.(addresser); ok {
+		c.addr = a
+	}
+	c.peer = peerCredentials(conn)
 	return &c
 }
 
+type addresser interface {
+	RemoteAddr() net.Addr
+}
+
 type generic struct {
-	id string
+	id       string
+	username string
 	*mqtt.Connection
 	handler   server.Server
 	connected bool
 	options   *Options
+	cfg       *config.Config
 	stopping  chan struct{}
 	stopOnce  sync.Once
 	closed    chan struct{}
@@ -48,24 +71,54 @@ type generic struct {
 	err       error // first error that occurs exits the client
 	// packet channels
 	input         chan mqtt.Packet
-	output        chan mqtt.Packet
+	output        *outputQueue
 	uuid          string
+	addr          addresser // asked each time, the address changes when a QUIC connection migrates
+	peer          *server.PeerCredentials
 	keep          time.Time
-	db            *recordDB
 	connectedTime time.Time
-	msgStore      store.Store
-	cleanSession  bool
-	will          *mqtt.Will
+	// maxConnectTime limits how long the client stays connected, 0 means no limit
+	maxConnectTime time.Duration
+	// lastPublish is the unix nano time the client last published
+	lastPublish  atomic.Int64
+	cleanSession bool
+	will         *mqtt.Will
+	capabilities config.Capabilities
+	// topic aliases set by the client, MQTT 5 only
+	aliases map[uint16]mqtt.Topic
+	slow    config.SlowConsumer
+	// fullSince is the unix nano time the output queue first overflowed, 0 when it has room
+	fullSince atomic.Int64
+	dropped   atomic.Uint64
+	// receiving counts the QoS 1 and 2 publishes read from the connection and not answered yet,
+	// unreleased holds the QoS 2 publishes answered with PUBREC until their PUBREL
+	receiving  atomic.Int32
+	unreleased map[mqtt.PacketID]struct{}
 }
 
 func (c *generic) ClientID() string {
 	return c.id
 }
 
+func (c *generic) Username() string {
+	return c.username
+}
+
 func (c *generic) UUID() string {
 	return c.uuid
 }
 
+func (c *generic) RemoteAddr() net.Addr {
+	if c.addr == nil {
+		return nil
+	}
+	return c.addr.RemoteAddr()
+}
+
+func (c *generic) PeerCredentials() *server.PeerCredentials {
+	return c.peer
+}
+
 func (c *generic) Run(ctx context.Context) (err error) {
 	defer close(c.closed)
 	defer c.Close(ctx)
@@ -84,42 +137,85 @@ func (c *generic) Run(ctx context.Context) (err error) {
 
 func (c *generic) connect() (err error) {
 	var p mqtt.Packet
-	var response mqtt.Packet
+	var response *mqtt.Connack
 
+	if timeout := c.cfg.MQTTConfig.ConnectTimeout; timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
 	if p, err = c.ReadPacket(); err != nil {
 		return
 	}
+	c.SetReadDeadline(time.Time{})
 	cp, ok := p.(*mqtt.Connect)
 	if !ok {
 		return utils.ErrMalformedPacket
 	}
 
 	c.Reader.Version = cp.Version
+	if c.options.Listener.PeerAuth {
+		// local services authenticate by their OS user instead of a username and password
+		if c.peer == nil {
+			c.refuse(cp, mqtt.V5_Not_Authorized)
+			return utils.ErrConnectRefused
+		}
+		cp.Username, cp.Password = c.peer.Username, ""
+	}
 	c.id = cp.ClientID
+	c.username = cp.Username
 	c.cleanSession = cp.Clean
+	c.capabilities = c.cfg.Capabilities
+	c.Reader.MaximumPacketSize = c.capabilities.MaximumPacketSize
 
-	c.msgStore = store.NewStore(config.Def.MessageStore.Mode, c.id)
-
-	fmt.Printf("[IN] - [%s] | %v \n", cp.ClientID, cp)
+	fmt.Printf("[IN] - [%s] [%v] | %v \n", cp.ClientID, c.RemoteAddr(), cp)
 
 	if response, err = c.handler.HandleConnect(cp, c); err != nil {
 		return
 	}
+	// RET_CONNACK_ACCEPT and V5_SUCCESS are both 0
+	if response.ReasonCode != mqtt.V5_SUCCESS {
+		// the output loop is not running yet
+		c.WritePacket(response)
+		return utils.ErrConnectRefused
+	}
 
-	if err = c.Write(response); err != nil {
+	// the output loop is not running yet, the CONNACK goes out before the messages
+	// of the resumed session queued by HandleConnect
+	if err = c.WritePacket(response); err != nil {
 		return
 	}
 
 	c.connected = true
 	c.connectedTime = time.Now()
+	c.lastPublish.Store(c.connectedTime.UnixNano())
+	c.maxConnectTime = c.options.Listener.MaxConnectTime
+	if d, ok := c.cfg.MQTTConfig.MaxConnectTimePerUser[c.username]; ok {
+		c.maxConnectTime = d
+	}
 	c.will = cp.Will
 
 	return nil
 }
 
-func (c *generic) disconnect(p *mqtt.Disconnect) (err error) {
+// refuse writes a CONNACK refusing cp straight to the connection, MQTT 3 clients get Not Authorized.
+func (c *generic) refuse(cp *mqtt.Connect, code mqtt.ReasonCode) error {
+	resp := cp.Response()
+	resp.ReasonCode = code
+	if !cp.Version.IsMQTT5() {
+		resp.ReasonCode = mqtt.RET_CONNACK_NOT_AUTHORIZED
+	}
+	return c.WritePacket(resp)
+}
+
+// disconnectTimeout bounds writing the DISCONNECT, a slow consumer may not read it at all.
+const disconnectTimeout = time.Second
+
+// disconnect writes a DISCONNECT straight to the connection, the output loop may already be stopped.
+func (c *generic) disconnect(code mqtt.ReasonCode) (err error) {
 	c.disOnce.Do(func() {
-		c.Write(p)
+		p := mqtt.NewDisconnect(&mqtt.FixedHeader{PacketType: mqtt.DISCONNECT}, c.Version)
+		p.ResionCode = code
+		c.SetWriteDeadline(time.Now().Add(disconnectTimeout))
+		err = c.WritePacket(p)
 	})
 	return
 }
@@ -141,24 +237,22 @@ func (c *generic) runloop(ctx context.Context) error {
 		err := c.keepLoop(ctx)
 		c.stop(err)
 	}()
-	go func() {
-		err := c.recordLoop(ctx)
-		c.stop(err)
-	}()
-	go func() {
-		err := c.msgStore.Run(ctx, c.output)
-		c.stop(err)
-	}()
 	<-c.stopping
 	return nil
 }
 
 func (c *generic) inputLoop(ctx context.Context) error {
 	for {
+		if !c.throttle(ctx) {
+			return nil
+		}
 		p, err := c.ReadPacket()
 		if err != nil {
 			return err
 		}
+		if publish, ok := p.(*mqtt.Publish); ok && publish.Qos.NotZero() {
+			c.receiving.Add(1)
+		}
 		select {
 		case <-ctx.Done():
 			return nil
@@ -172,21 +266,45 @@ func (c *generic) inputLoop(ctx context.Context) error {
 	}
 }
 
-func (c *generic) outputLoop(ctx context.Context) error {
+// maxThrottle caps a single pause of the input loop, the publish quotas are asked again after it.
+const maxThrottle = time.Second
+
+// throttle stops reading from the client while the publish quotas hold it back, it reports false
+// once the client stops.
+func (c *generic) throttle(ctx context.Context) bool {
 	for {
+		wait := min(c.handler.PublishQuotas().Wait(c.id), maxThrottle)
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
-			return nil
+			timer.Stop()
+			return false
 		case <-c.stopping:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *generic) outputLoop(ctx context.Context) error {
+	for {
+		p, ok := c.output.take(ctx, c.stopping)
+		if !ok {
 			return nil
-		case p, ok := <-c.output:
-			if !ok {
-				return nil
-			}
-			fmt.Printf("[OUT] - [%s] | %v \n", c.id, p)
-			if err := c.WritePacket(p); err != nil {
-				return err
-			}
+		}
+		fmt.Printf("[OUT] - [%s] | %v \n", c.id, p)
+		// publishes are shared by all subscribers and keep the version of the publisher
+		if publish, ok := p.(*mqtt.Publish); ok && publish.Version != c.Version {
+			publish = publish.Clone()
+			publish.Version = c.Version
+			p = publish
+		}
+		if err := c.WritePacket(p); err != nil {
+			return err
 		}
 	}
 }
@@ -209,23 +327,25 @@ func (c *generic) handleLoop(ctx context.Context) error {
 			case *mqtt.Pingreq:
 				resp, err = c.handler.HandlePacket(val, c.id)
 			case *mqtt.Publish:
+				err = c.receivePublish(val)
+				if val.Qos.NotZero() {
+					c.receiving.Add(-1)
+				}
+				if err != nil {
+					break
+				}
+				c.lastPublish.Store(time.Now().UnixNano())
 				resp, err = c.handler.HandlePacket(val, c.id)
-				if err == nil {
-					if val.Qos == mqtt.QoS2 {
-						c.db.save(val, resp)
-					}
+				if rec, ok := resp.(*mqtt.Pubrec); ok && err == nil && rec.ReasonCode < mqtt.V5_Unspecified_Error {
+					c.unreleased[val.PacketID] = struct{}{}
 				}
 			case *mqtt.Puback:
 				resp, err = c.handler.HandlePacket(val, c.id)
 			case *mqtt.Pubrec:
 				resp, err = c.handler.HandlePacket(val, c.id)
 			case *mqtt.Pubrel:
-				if resp, err = c.handler.HandlePacket(val, c.id); err != nil {
-					break
-				}
-				err = c.db.dispatch(val.PacketID, func(p *mqtt.Publish) error {
-					return c.handler.Dispatch(c.id, p)
-				})
+				resp, err = c.handler.HandlePacket(val, c.id)
+				delete(c.unreleased, val.PacketID)
 			case *mqtt.Pubcomp:
 				resp, err = c.handler.HandlePacket(val, c.id)
 			case *mqtt.Subscribe:
@@ -238,17 +358,56 @@ func (c *generic) handleLoop(ctx context.Context) error {
 			}
 		}
 		if err != nil {
+			if _, ok := mqtt.ErrorCode(err); ok {
+				return err
+			}
 			fmt.Println(err)
 		}
 		c.KeepAlive()
 		if resp != nil {
-			c.Write(resp)
+			c.respond(resp)
 		}
 	}
 }
 
+// setError is only called once under stopOnce, closing stopping publishes c.err to Close.
 func (c *generic) setError(err error) {
-	atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&c.err)), nil, unsafe.Pointer(&err))
+	c.err = err
+}
+
+// receivePublish checks the receive maximum and resolves the topic alias of an incoming publish.
+func (c *generic) receivePublish(p *mqtt.Publish) error {
+	if !c.Version.IsMQTT5() {
+		return nil
+	}
+	if p.Qos.NotZero() && c.capabilities.ReceiveMaximum > 0 {
+		// a publish sent again before its PUBREL is not counted twice
+		if _, again := c.unreleased[p.PacketID]; !again && int(c.receiving.Load())+len(c.unreleased) > int(c.capabilities.ReceiveMaximum) {
+			return mqtt.Err_V5_Receive_Maximum_Exceeded
+		}
+	}
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *p.Properties.TopicAlias
+	if alias == 0 || alias > c.capabilities.TopicAliasMaximum {
+		return mqtt.Err_V5_Topic_Alias_Invalid
+	}
+	if c.aliases == nil {
+		c.aliases = make(map[uint16]mqtt.Topic)
+	}
+	if p.Topic == "" {
+		topic, ok := c.aliases[alias]
+		if !ok {
+			return mqtt.Err_V5_Topic_Alias_Invalid
+		}
+		p.Topic = topic
+	} else {
+		c.aliases[alias] = p.Topic
+	}
+	// aliases are per connection, subscribers must not see it
+	p.Properties.TopicAlias = nil
+	return nil
 }
 
 func (c *generic) Read() (mqtt.Packet, error) {
@@ -259,16 +418,74 @@ func (c *generic) Read() (mqtt.Packet, error) {
 	return p, nil
 }
 
+// Write queues a packet without blocking, a full queue is handled by the slow consumer policy.
 func (c *generic) Write(p mqtt.Packet) error {
-	// defer func(e *error) {
-	// 	if r := recover(); r != nil {
-	// 		*e = utils.ErrClosedChannel
-	// 	}
-	// }(&err)
-	c.output <- p
+	if c.output.offer(p) {
+		if c.fullSince.Load() != 0 {
+			c.fullSince.Store(0)
+		}
+		return nil
+	}
+	if _, ok := p.(*mqtt.Publish); !ok {
+		// acknowledgements and PUBRELs are never dropped, they may exceed the queue size
+		c.output.push(p)
+		return nil
+	}
+	return c.overflow(p)
+}
+
+// respond queues a response to the client's own packet, it only blocks the client itself.
+func (c *generic) respond(p mqtt.Packet) {
+	c.output.put(p, c.stopping)
+}
+
+// overflow counts each dropped packet, either p or a queued publish evicted for it.
+func (c *generic) overflow(p mqtt.Packet) error {
+	c.dropped.Add(1)
+	switch c.slow.Policy {
+	case config.DropOldest:
+		if c.output.evict(p) {
+			return nil
+		}
+	case config.DropQoS0:
+		if publish, ok := p.(*mqtt.Publish); ok && publish.Qos.Zero() {
+			return nil
+		}
+	}
+	now := time.Now().UnixNano()
+	if c.fullSince.CompareAndSwap(0, now) && c.slow.GracePeriod > 0 {
+		time.AfterFunc(c.slow.GracePeriod, c.checkFull)
+	}
+	if time.Duration(now-c.fullSince.Load()) >= c.slow.GracePeriod {
+		c.stop(mqtt.Err_V5_Quota_Exceeded)
+	}
 	return nil
 }
 
+// checkFull disconnects the client whose output queue is still full at the end of the grace
+// period, without waiting for another packet to be dropped.
+func (c *generic) checkFull() {
+	since := c.fullSince.Load()
+	if since == 0 || time.Since(time.Unix(0, since)) < c.slow.GracePeriod {
+		// the queue had room meanwhile, the timer of the new overflow decides
+		return
+	}
+	if c.output.len() < c.output.size {
+		// the client caught up without a packet written since
+		c.fullSince.CompareAndSwap(since, 0)
+		return
+	}
+	c.stop(mqtt.Err_V5_Quota_Exceeded)
+}
+
+func (c *generic) QueueDepth() int {
+	return c.output.len()
+}
+
+func (c *generic) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
 func (c *generic) stop(err error) {
 	c.stopOnce.Do(func() {
 		c.setError(err)
@@ -276,21 +493,35 @@ func (c *generic) stop(err error) {
 	})
 }
 
+// keepLoop disconnects the client once it reaches its maximum connect time or stays idle too long.
 func (c *generic) keepLoop(ctx context.Context) error {
-	// ticker := time.NewTicker(time.Minute)
-	ch := make(chan time.Time, 1)
-	defer close(ch)
+	var expired, idle <-chan time.Time
+	if c.maxConnectTime > 0 {
+		timer := time.NewTimer(time.Until(c.connectedTime.Add(c.maxConnectTime)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	idleTimeout := c.cfg.MQTTConfig.IdleTimeout
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-c.stopping:
 			return nil
-		case <-ch:
-			duration := time.Since(c.keep)
-			if duration > time.Hour {
-				panic("keep alive")
+		case <-expired:
+			return mqtt.Err_V5_Maximum_Connect_Time
+		case <-idle:
+			since := time.Since(time.Unix(0, c.lastPublish.Load()))
+			if since >= idleTimeout {
+				return mqtt.Err_V5_Administrative_Action
 			}
+			idleTimer.Reset(idleTimeout - since)
 		}
 	}
 }
@@ -305,34 +536,14 @@ func (c *generic) Close(ctx context.Context) (err error) {
 			if c.will != nil {
 				c.handler.HandlePacket(c.will.ToPublish(), c.id)
 			}
-			if c.err != nil {
-				c.disconnect(mqtt.NewDisconnect(&mqtt.FixedHeader{}, c.Version))
+			if code, ok := mqtt.ErrorCode(c.err); ok && c.Version.IsMQTT5() {
+				c.disconnect(code)
 			}
 		}
 		if c.Connection != nil {
 			c.Connection.Close()
 		}
-		if c.msgStore != nil {
-			c.msgStore.Close()
-			c.msgStore.Clean()
-		}
 		err = c.handler.Deregister(c)
 	})
 	return
 }
-
-func (c *generic) recordLoop(ctx context.Context) error {
-	ticker := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			c.db.iter(c.Write)
-		case <-c.stopping:
-			return nil
-		case <-c.closed:
-			return nil
-		}
-	}
-}
@@ -0,0 +1,259 @@
+package clients
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newTestClient(t *testing.T, slow config.SlowConsumer) *generic {
+	options := DefaultOptions()
+	options.Config = &config.Config{MQTTConfig: config.MQTTConfig{SlowConsumer: slow}}
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return NewClient(nil, conn, options)
+}
+
+func testPublish(qos mqtt.QoS, payload string) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Qos = qos
+	p.Payload = []byte(payload)
+	return p
+}
+
+func TestSlowConsumerDropQoS0(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{Policy: config.DropQoS0, QueueSize: 2, GracePeriod: time.Hour})
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := c.Write(testPublish(mqtt.QoS0, payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.QueueDepth() != 2 || c.Dropped() != 1 {
+		t.Errorf("expected 2 queued and 1 dropped, got %d and %d", c.QueueDepth(), c.Dropped())
+	}
+	// QoS 1 is kept in the message store, the client is only disconnected after the grace period
+	c.Write(testPublish(mqtt.QoS1, "4"))
+	select {
+	case <-c.stopping:
+		t.Error("client stopped within the grace period")
+	default:
+	}
+}
+
+func TestSlowConsumerDropOldest(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{Policy: config.DropOldest, QueueSize: 4, GracePeriod: time.Hour})
+	suback := &mqtt.Suback{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.SUBACK}, Version: mqtt.MQTT5}}
+	c.respond(suback)
+	c.Write(testPublish(mqtt.QoS1, "1"))
+	c.Write(testPublish(mqtt.QoS0, "2"))
+	c.Write(testPublish(mqtt.QoS1, "3"))
+	// QoS 0 goes first, then the oldest publish, the SUBACK stays
+	c.Write(testPublish(mqtt.QoS1, "4"))
+	c.Write(testPublish(mqtt.QoS1, "5"))
+	if c.Dropped() != 2 {
+		t.Errorf("expected 2 dropped, got %d", c.Dropped())
+	}
+	if p, _ := c.output.take(context.Background(), c.stopping); p != suback {
+		t.Fatalf("expected the SUBACK first, got %v", p)
+	}
+	for _, want := range []string{"3", "4", "5"} {
+		p, _ := c.output.take(context.Background(), c.stopping)
+		if got := string(p.(*mqtt.Publish).Payload); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+
+	// only acknowledgements queued, the publish is dropped
+	for i := 0; i < 4; i++ {
+		c.respond(suback)
+	}
+	c.Write(testPublish(mqtt.QoS1, "6"))
+	if c.Dropped() != 3 || c.QueueDepth() != 4 {
+		t.Errorf("expected 3 dropped and 4 queued, got %d and %d", c.Dropped(), c.QueueDepth())
+	}
+}
+
+func TestDisconnectSlowConsumer(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{})
+	c.Version = mqtt.MQTT5
+	// the peer never reads
+	done := make(chan error, 1)
+	go func() { done <- c.disconnect(mqtt.V5_Quota_Exceeded) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the write to time out")
+		}
+	case <-time.After(3 * disconnectTimeout):
+		t.Fatal("disconnect blocked on a client not reading")
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{Policy: config.Disconnect, QueueSize: 1})
+	c.Write(testPublish(mqtt.QoS0, "1"))
+	c.Write(testPublish(mqtt.QoS0, "2"))
+	select {
+	case <-c.stopping:
+	default:
+		t.Fatal("client not stopped")
+	}
+	if code, _ := mqtt.ErrorCode(c.err); code != mqtt.V5_Quota_Exceeded {
+		t.Errorf("expected quota exceeded, got %v", c.err)
+	}
+}
+
+func TestSlowConsumerGracePeriod(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{Policy: config.Disconnect, QueueSize: 1, GracePeriod: 50 * time.Millisecond})
+	c.Write(testPublish(mqtt.QoS1, "1"))
+	c.Write(testPublish(mqtt.QoS1, "2"))
+	// acknowledgements are queued beyond the size
+	ack := &mqtt.Puback{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBACK}}, PacketID: 1}
+	if err := c.Write(ack); err != nil {
+		t.Fatal(err)
+	}
+	if depth := c.QueueDepth(); depth != 2 {
+		t.Fatalf("expected the publish and the acknowledgement queued, got %d", depth)
+	}
+	if c.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped packet, got %d", c.Dropped())
+	}
+	// no packet is dropped after the first, the client is disconnected anyway
+	select {
+	case <-c.stopping:
+	case <-time.After(time.Second):
+		t.Fatal("client not stopped after the grace period")
+	}
+	if code, _ := mqtt.ErrorCode(c.err); code != mqtt.V5_Quota_Exceeded {
+		t.Errorf("expected quota exceeded, got %v", c.err)
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go Refuse(conn, mqtt.V5_Connection_Rate_Exceeded, time.Second)
+
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = "c1"
+	data, err := cp.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	r := mqtt.NewConnection(peer)
+	r.Version = mqtt.MQTT5
+	p, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := p.(*mqtt.Connack).ReasonCode; code != mqtt.V5_Connection_Rate_Exceeded {
+		t.Errorf("expected connection rate exceeded, got %v", code)
+	}
+}
+
+func TestRefuseDeadline(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- Refuse(conn, mqtt.V5_Connection_Rate_Exceeded, 100*time.Millisecond) }()
+
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = "c1"
+	data, err := cp.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// the CONNACK is never read
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("expected the write to time out")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("refuse blocked on a peer not reading")
+	}
+}
+
+func TestKeepLoopMaxConnectTime(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{})
+	c.connectedTime = time.Now()
+	c.maxConnectTime = 10 * time.Millisecond
+	if err := c.keepLoop(context.Background()); err != mqtt.Err_V5_Maximum_Connect_Time {
+		t.Errorf("expected maximum connect time, got %v", err)
+	}
+}
+
+func TestKeepLoopIdle(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{})
+	c.cfg.MQTTConfig.IdleTimeout = 50 * time.Millisecond
+	start := time.Now()
+	c.lastPublish.Store(start.Add(30 * time.Millisecond).UnixNano())
+	if err := c.keepLoop(context.Background()); err != mqtt.Err_V5_Administrative_Action {
+		t.Errorf("expected administrative action, got %v", err)
+	}
+	if since := time.Since(start); since < 80*time.Millisecond {
+		t.Errorf("disconnected %v after start, before the idle timeout", since)
+	}
+}
+
+func TestConnectPeerAuthWithoutCredentials(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	options := DefaultOptions()
+	options.Listener.PeerAuth = true
+	c := NewClient(nil, conn, options)
+	errs := make(chan error, 1)
+	go func() { errs <- c.connect() }()
+
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = "c1"
+	data, _ := cp.Encode()
+	peer.Write(data)
+	r := mqtt.NewConnection(peer)
+	r.Version = mqtt.MQTT5
+	p, err := r.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := p.(*mqtt.Connack).ReasonCode; code != mqtt.V5_Not_Authorized {
+		t.Errorf("expected not authorized, got %v", code)
+	}
+	if err := <-errs; err != utils.ErrConnectRefused {
+		t.Errorf("expected connect refused, got %v", err)
+	}
+}
+
+func TestReceiveMaximum(t *testing.T) {
+	c := newTestClient(t, config.SlowConsumer{})
+	c.Version = mqtt.MQTT5
+	c.capabilities.ReceiveMaximum = 2
+	// a QoS 1 publish waits in the input queue behind the one handled
+	c.receiving.Store(2)
+	p := testPublish(mqtt.QoS1, "1")
+	if err := c.receivePublish(p); err != nil {
+		t.Fatalf("publish within the receive maximum refused: %v", err)
+	}
+	// a QoS 2 publish is unacknowledged until its PUBREL
+	c.unreleased[7] = struct{}{}
+	if err := c.receivePublish(p); err != mqtt.Err_V5_Receive_Maximum_Exceeded {
+		t.Fatalf("expected receive maximum exceeded, got %v", err)
+	}
+	p.Qos, p.PacketID = mqtt.QoS2, 7
+	if err := c.receivePublish(p); err != nil {
+		t.Fatalf("publish sent again refused: %v", err)
+	}
+}
@@ -1,15 +1,17 @@
 package clients
 
-import "time"
+import (
+	"github.com/jin06/mercury/internal/config"
+)
 
 func DefaultOptions() *Options {
-	return &Options{
-		PublishTimeout:  time.Second * 2,
-		MaxPublishTimes: 5,
-	}
+	return &Options{}
 }
 
+// Options of a client connection, the retries of its messages follow Config.MQTTConfig.Retry.
 type Options struct {
-	PublishTimeout  time.Duration
-	MaxPublishTimes int
+	// Listener the connection was accepted on
+	Listener config.Listener
+	// Config is the broker configuration, nil means the defaults.
+	Config *config.Config
 }
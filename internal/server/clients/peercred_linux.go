@@ -0,0 +1,32 @@
+//go:build linux
+
+package clients
+
+import (
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/jin06/mercury/internal/server"
+)
+
+// peerCredentials returns the SO_PEERCRED credentials of a unix socket connection, nil for other connections.
+func peerCredentials(conn io.ReadWriteCloser) *server.PeerCredentials {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return nil
+	}
+	return server.NewPeerCredentials(cred.Uid, cred.Gid, cred.Pid)
+}
@@ -0,0 +1,34 @@
+package clients
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "mercury.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := net.Dial("unix", l.Addr().String()); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cred := peerCredentials(conn)
+	if cred == nil {
+		t.Fatal("no peer credentials")
+	}
+	if cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) || cred.PID != int32(os.Getpid()) {
+		t.Errorf("unexpected credentials %+v", cred)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package clients
+
+import (
+	"io"
+
+	"github.com/jin06/mercury/internal/server"
+)
+
+// peerCredentials is only supported on linux.
+func peerCredentials(conn io.ReadWriteCloser) *server.PeerCredentials {
+	return nil
+}
@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// outputQueue holds the packets waiting to be written to the client, in order. Packets of the
+// server are only queued while there is room, the responses to the client's own packets always
+// are and the client waits for room afterwards.
+type outputQueue struct {
+	mu      sync.Mutex
+	packets []mqtt.Packet
+	size    int
+	// ready is signalled when a packet is queued, space when one is taken
+	ready chan struct{}
+	space chan struct{}
+}
+
+func newOutputQueue(size int) *outputQueue {
+	return &outputQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+func (q *outputQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.packets)
+}
+
+// offer queues p if there is room.
+func (q *outputQueue) offer(p mqtt.Packet) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.packets) >= q.size {
+		return false
+	}
+	q.add(p)
+	return true
+}
+
+// put queues p even if the queue is full, then waits until there is room or done is closed.
+func (q *outputQueue) put(p mqtt.Packet, done <-chan struct{}) {
+	q.mu.Lock()
+	q.add(p)
+	q.mu.Unlock()
+	for q.len() > q.size {
+		select {
+		case <-q.space:
+		case <-done:
+			return
+		}
+	}
+}
+
+// push queues p even if the queue is full, without waiting.
+func (q *outputQueue) push(p mqtt.Packet) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.add(p)
+}
+
+// evict drops the oldest queued QoS 0 publish, or else the oldest publish, and queues p. It
+// reports false when no publish is queued, acknowledgements and PUBRELs are never dropped.
+func (q *outputQueue) evict(p mqtt.Packet) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.IndexFunc(q.packets, func(p mqtt.Packet) bool {
+		publish, ok := p.(*mqtt.Publish)
+		return ok && publish.Qos.Zero()
+	})
+	if i < 0 {
+		i = slices.IndexFunc(q.packets, func(p mqtt.Packet) bool {
+			_, ok := p.(*mqtt.Publish)
+			return ok
+		})
+	}
+	if i < 0 {
+		return false
+	}
+	q.packets = slices.Delete(q.packets, i, i+1)
+	q.add(p)
+	return true
+}
+
+// take waits for the oldest packet and removes it, ok is false once ctx or stopping is done.
+func (q *outputQueue) take(ctx context.Context, stopping <-chan struct{}) (p mqtt.Packet, ok bool) {
+	for {
+		q.mu.Lock()
+		if len(q.packets) > 0 {
+			p = q.packets[0]
+			q.packets[0] = nil
+			q.packets = q.packets[1:]
+			q.mu.Unlock()
+			signal(q.space)
+			return p, true
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, false
+		case <-stopping:
+			return nil, false
+		}
+	}
+}
+
+// add appends p, q.mu must be held.
+func (q *outputQueue) add(p mqtt.Packet) {
+	q.packets = append(q.packets, p)
+	signal(q.ready)
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,36 @@
+package clients
+
+import (
+	"io"
+	"time"
+
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Refuse answers the CONNECT of a connection that will not be served with code and closes it,
+// without allocating a client. MQTT 3 clients get Server Unavailable instead. Reading the CONNECT
+// and writing the CONNACK take at most timeout together, 0 means no limit.
+func Refuse(conn io.ReadWriteCloser, code mqtt.ReasonCode, timeout time.Duration) error {
+	defer conn.Close()
+	c := mqtt.NewConnection(conn)
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		c.SetReadDeadline(deadline)
+		c.SetWriteDeadline(deadline)
+	}
+	p, err := c.ReadPacket()
+	if err != nil {
+		return err
+	}
+	cp, ok := p.(*mqtt.Connect)
+	if !ok {
+		return utils.ErrMalformedPacket
+	}
+	resp := cp.Response()
+	resp.ReasonCode = code
+	if !cp.Version.IsMQTT5() {
+		resp.ReasonCode = mqtt.RET_CONNACK_SERVER_UNAVAILABLE
+	}
+	return c.WritePacket(resp)
+}
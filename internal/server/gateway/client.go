@@ -0,0 +1,313 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/pkg/mqtt"
+	"github.com/jin06/mercury/pkg/mqttsn"
+)
+
+var errClientClosed = errors.New("mqtt-sn client closed")
+
+type state int
+
+const (
+	connecting state = iota
+	active
+	asleep
+	// awake is a sleeping client receiving its buffered messages
+	awake
+	closed
+)
+
+// regackTimeout is how long a publish waits for the client to acknowledge the REGISTER of its topic.
+const regackTimeout = time.Second * 5
+
+func newClient(g *Gateway, addr net.Addr, id string) *client {
+	return &client{
+		gw:       g,
+		id:       id,
+		uuid:     uuid.New().String(),
+		addr:     addr,
+		topics:   newRegistry(g.predefined),
+		lastSeen: time.Now(),
+		notify:   make(chan struct{}, 1),
+		input:    make(chan mqttsn.Message, g.bufferSize),
+		stopping: make(chan struct{}),
+		regacks:  make(map[uint16]chan struct{}),
+	}
+}
+
+// client is an MQTT-SN client connected through the gateway, it implements server.Client.
+type client struct {
+	gw   *Gateway
+	id   string
+	uuid string
+
+	mu       sync.Mutex
+	addr     net.Addr
+	state    state
+	keep     time.Duration
+	sleep    time.Duration
+	lastSeen time.Time
+	topics   *registry
+	will     *mqtt.Will
+	connect  *mqtt.Connect
+	// queue holds the packets waiting to be sent, for a sleeping client until it wakes up
+	queue   []mqtt.Packet
+	regacks map[uint16]chan struct{}
+	msgID   uint16
+
+	notify chan struct{}
+	// input holds the messages read for the client until its handle loop takes them
+	input     chan mqttsn.Message
+	stopping  chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+}
+
+func (c *client) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.stopping:
+			return nil
+		case <-c.notify:
+		}
+		for {
+			p, ok := c.next()
+			if !ok {
+				break
+			}
+			if err := c.send(p); err != nil {
+				log.Warn().Err(err).Str("client_id", c.id).Msg("mqtt-sn send error")
+			}
+		}
+	}
+}
+
+// handleLoop handles the messages of the client one by one, apart from the other clients.
+func (c *client) handleLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stopping:
+			return
+		case m := <-c.input:
+			if err := c.gw.handleClient(c, m); err != nil {
+				log.Warn().Err(err).Str("client_id", c.id).Msg("mqtt-sn client error")
+				c.write(&mqttsn.Disconnect{})
+				c.close(true)
+				return
+			}
+		}
+	}
+}
+
+// receive hands m to the handle loop, when the client does not keep up m is dropped like a
+// datagram lost on the way.
+func (c *client) receive(m mqttsn.Message) {
+	select {
+	case c.input <- m:
+	default:
+		log.Debug().Str("client_id", c.id).Msg("mqtt-sn input full, message dropped")
+	}
+}
+
+// next pops the next packet to send, once an awake client has nothing left it goes back to sleep.
+func (c *client) next() (mqtt.Packet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != active && c.state != awake {
+		return nil, false
+	}
+	if len(c.queue) == 0 {
+		if c.state == awake {
+			c.state = asleep
+			c.gw.write(c.addr, &mqttsn.Pingresp{})
+		}
+		return nil, false
+	}
+	p := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	return p, true
+}
+
+func (c *client) send(p mqtt.Packet) error {
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		return c.sendPublish(p)
+	case *mqtt.Pubrel:
+		return c.write(&mqttsn.Pubrel{MsgID: uint16(p.PacketID)})
+	}
+	return nil
+}
+
+func (c *client) sendPublish(p *mqtt.Publish) error {
+	c.mu.Lock()
+	topic := p.Topic.String()
+	id, t, registered := c.topics.id(topic)
+	var regack chan struct{}
+	var register *mqttsn.Register
+	if !registered {
+		id = c.topics.register(topic)
+		c.msgID++
+		register = &mqttsn.Register{TopicID: id, MsgID: c.msgID, TopicName: topic}
+		regack = make(chan struct{})
+		c.regacks[c.msgID] = regack
+	}
+	c.mu.Unlock()
+
+	if register != nil {
+		if err := c.write(register); err != nil {
+			return err
+		}
+		select {
+		case <-regack:
+		case <-time.After(regackTimeout):
+			return errors.New("register not acknowledged")
+		case <-c.stopping:
+			return errClientClosed
+		}
+	}
+	msg := &mqttsn.Publish{
+		Flags:   mqttsn.NewFlags(int(p.Qos), p.Retain, t),
+		TopicID: id,
+		MsgID:   uint16(p.PacketID),
+		Data:    p.Payload,
+	}
+	if p.Dup {
+		msg.Flags |= mqttsn.FlagDUP
+	}
+	return c.write(msg)
+}
+
+func (c *client) regack(m *mqttsn.Regack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.regacks[m.MsgID]; ok {
+		delete(c.regacks, m.MsgID)
+		close(ch)
+	}
+}
+
+func (c *client) write(m mqttsn.Message) error {
+	c.mu.Lock()
+	addr := c.addr
+	c.mu.Unlock()
+	return c.gw.write(addr, m)
+}
+
+// Write queues p for the client, it never blocks the publisher. When the buffer is full the
+// oldest packet is dropped, dropped QoS 1 and 2 publishes stay in the message store.
+func (c *client) Write(p mqtt.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == closed {
+		return errClientClosed
+	}
+	if len(c.queue) >= c.gw.bufferSize {
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.dropped.Add(1)
+	}
+	c.queue = append(c.queue, p)
+	c.wake()
+	return nil
+}
+
+// wake signals the run loop, c.mu must be held.
+func (c *client) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *client) setState(s state) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = s
+	c.wake()
+}
+
+// Close stops the client without publishing its will, e.g. when another client takes over its client ID.
+func (c *client) Close(ctx context.Context) error {
+	return c.close(false)
+}
+
+// close stops the client and removes it from the gateway and the server, lost clients publish their will.
+func (c *client) close(lost bool) (err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.state = closed
+		will := c.will
+		c.mu.Unlock()
+		close(c.stopping)
+		c.gw.remove(c)
+		if lost && will != nil {
+			if _, err := c.gw.server.HandlePacket(will.ToPublish(), c.id); err != nil {
+				log.Warn().Err(err).Str("client_id", c.id).Msg("mqtt-sn will error")
+			}
+		}
+		err = c.gw.server.Deregister(c)
+		c.gw.server.Connections().Close(c.uuid)
+	})
+	return
+}
+
+// expired reports whether the client missed its keep alive or sleep duration.
+func (c *client) expired(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timeout := c.keep
+	if c.state == asleep {
+		timeout = c.sleep
+	}
+	// the spec allows 1.5 times the duration
+	return timeout > 0 && now.Sub(c.lastSeen) > timeout*3/2
+}
+
+func (c *client) seen(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSeen = time.Now()
+	c.addr = addr
+}
+
+func (c *client) ClientID() string                         { return c.id }
+func (c *client) Username() string                         { return "" }
+func (c *client) UUID() string                             { return c.uuid }
+func (c *client) Read() (mqtt.Packet, error)               { return nil, nil }
+func (c *client) PeerCredentials() *server.PeerCredentials { return nil }
+func (c *client) Dropped() uint64                          { return c.dropped.Load() }
+
+func (c *client) KeepAlive() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSeen = time.Now()
+}
+
+func (c *client) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+func (c *client) QueueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
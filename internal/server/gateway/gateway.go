@@ -0,0 +1,461 @@
+// Package gateway translates MQTT-SN 1.2 clients on UDP into server.Server calls.
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/limits"
+	"github.com/jin06/mercury/pkg/mqtt"
+	"github.com/jin06/mercury/pkg/mqttsn"
+)
+
+// New creates a gateway for the MQTT-SN listener l, its clients are counted by the connection
+// limits of srv and their CONNECTs by rate.
+func New(srv server.Server, conn net.PacketConn, l config.Listener, rate *limits.Rate) *Gateway {
+	cfg := l.MQTTSN
+	g := &Gateway{
+		server:     srv,
+		conn:       conn,
+		listener:   l.Addr,
+		rate:       rate,
+		id:         cfg.GatewayID,
+		predefined: newPredefined(cfg.PredefinedTopics),
+		bufferSize: cfg.BufferSize,
+		addrs:      make(map[string]*client),
+		ids:        make(map[string]*client),
+	}
+	if g.bufferSize <= 0 {
+		g.bufferSize = 100
+	}
+	return g
+}
+
+type Gateway struct {
+	server     server.Server
+	conn       net.PacketConn
+	listener   string
+	rate       *limits.Rate
+	id         byte
+	predefined *predefined
+	bufferSize int
+	mu         sync.Mutex
+	// addrs and ids index the connected clients by address and client ID
+	addrs map[string]*client
+	ids   map[string]*client
+}
+
+// Serve reads datagrams until conn is closed or ctx is done, the messages of a connected client
+// are handed to the client and handled apart from the other clients.
+func (g *Gateway) Serve(ctx context.Context) error {
+	go g.expire(ctx)
+	go func() {
+		<-ctx.Done()
+		g.conn.Close()
+	}()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// decoded messages keep slices of the datagram
+		m, err := mqttsn.Decode(bytes.Clone(buf[:n]))
+		if err != nil {
+			log.Debug().Err(err).Str("addr", addr.String()).Msg("mqtt-sn decode error")
+			continue
+		}
+		g.handle(ctx, addr, m)
+	}
+}
+
+// expire closes clients that missed their keep alive or sleep duration, also those that never
+// completed their CONNECT.
+func (g *Gateway) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.mu.Lock()
+			var lost []*client
+			for _, c := range g.addrs {
+				if c.expired(now) {
+					lost = append(lost, c)
+				}
+			}
+			g.mu.Unlock()
+			for _, c := range lost {
+				c.close(true)
+			}
+		}
+	}
+}
+
+func (g *Gateway) write(addr net.Addr, m mqttsn.Message) error {
+	_, err := g.conn.WriteTo(mqttsn.Encode(m), addr)
+	return err
+}
+
+func (g *Gateway) client(addr net.Addr) *client {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.addrs[addr.String()]
+}
+
+func (g *Gateway) remove(c *client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ids[c.id] == c {
+		delete(g.ids, c.id)
+	}
+	for addr, cur := range g.addrs {
+		if cur == c {
+			delete(g.addrs, addr)
+		}
+	}
+}
+
+// move indexes c by addr, a sleeping client may wake up from another address.
+func (g *Gateway) move(c *client, addr net.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for a, cur := range g.addrs {
+		if cur == c {
+			delete(g.addrs, a)
+		}
+	}
+	g.addrs[addr.String()] = c
+	c.seen(addr)
+}
+
+func (g *Gateway) handle(ctx context.Context, addr net.Addr, m mqttsn.Message) {
+	switch m := m.(type) {
+	case *mqttsn.SearchGW:
+		g.write(addr, &mqttsn.GWInfo{GatewayID: g.id})
+		return
+	case *mqttsn.Connect:
+		g.handleConnect(ctx, addr, m)
+		return
+	case *mqttsn.Publish:
+		if m.Flags.QoS() == -1 {
+			// each publish without connection counts as a connection for the rate limit
+			if !g.rate.Allow(host(addr)) {
+				log.Debug().Str("addr", addr.String()).Msg("mqtt-sn QoS -1 publish over connection rate")
+				return
+			}
+			g.publishWithoutConnection(addr, m)
+			return
+		}
+	case *mqttsn.Pingreq:
+		if m.ClientID != "" {
+			g.wakeUp(addr, m)
+			return
+		}
+	}
+	c := g.client(addr)
+	if c == nil {
+		log.Debug().Str("addr", addr.String()).Msg("mqtt-sn message from unknown client")
+		g.write(addr, &mqttsn.Disconnect{})
+		return
+	}
+	c.seen(addr)
+	c.receive(m)
+}
+
+// host returns the IP of addr the connection limits count.
+func host(addr net.Addr) string {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return ip
+}
+
+// handleConnect applies the connection limits to a CONNECT and starts its client, which
+// completes the CONNECT on its own goroutine.
+func (g *Gateway) handleConnect(ctx context.Context, addr net.Addr, m *mqttsn.Connect) {
+	ip := host(addr)
+	if !g.rate.Allow(ip) {
+		log.Warn().Str("listener", g.listener).Str("ip", ip).Msg("connection rate exceeded")
+		g.write(addr, &mqttsn.Connack{ReturnCode: mqttsn.Congestion})
+		return
+	}
+	// a CONNECT sent again, e.g. after a lost WILLTOPICREQ, replaces the client of the address,
+	// which may not be accepted yet and not known to the server
+	if old := g.client(addr); old != nil {
+		old.close(old.id != m.ClientID)
+	}
+	c := newClient(g, addr, m.ClientID)
+	if !g.server.Connections().Accept(c.uuid, g.listener, ip) {
+		log.Warn().Str("listener", g.listener).Str("ip", ip).Msg("connection limit reached")
+		g.write(addr, &mqttsn.Connack{ReturnCode: mqttsn.Congestion})
+		return
+	}
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT4)
+	cp.ClientID = m.ClientID
+	cp.Clean = m.Flags.CleanSession()
+	cp.KeepAlive = m.Duration
+	c.keep = time.Duration(m.Duration) * time.Second
+	c.connect = cp
+	g.mu.Lock()
+	g.addrs[addr.String()] = c
+	g.mu.Unlock()
+	go c.Run(ctx)
+	go c.handleLoop(ctx)
+	c.receive(m)
+}
+
+// accept completes the CONNECT of c, after its will was received when it has one.
+func (g *Gateway) accept(c *client) {
+	c.mu.Lock()
+	cp := c.connect
+	c.connect = nil
+	c.mu.Unlock()
+	if cp == nil {
+		return
+	}
+	resp, err := g.server.HandleConnect(cp, c)
+	if err != nil || resp.ReasonCode != mqtt.RET_CONNACK_ACCEPT {
+		log.Warn().Err(err).Str("client_id", c.id).Msg("mqtt-sn connect refused")
+		c.write(&mqttsn.Connack{ReturnCode: mqttsn.Congestion})
+		c.close(false)
+		return
+	}
+	g.mu.Lock()
+	g.ids[c.id] = c
+	g.mu.Unlock()
+	c.write(&mqttsn.Connack{ReturnCode: mqttsn.Accepted})
+	c.setState(active)
+}
+
+func (g *Gateway) publishWithoutConnection(addr net.Addr, m *mqttsn.Publish) {
+	r := newRegistry(g.predefined)
+	topic, ok := r.topic(m.Flags.TopicIDType(), m.TopicID)
+	if !ok || m.Flags.TopicIDType() == mqttsn.TopicNormal {
+		log.Debug().Str("addr", addr.String()).Uint16("topic_id", m.TopicID).Msg("mqtt-sn QoS -1 publish to unknown topic")
+		return
+	}
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	p.Topic = mqtt.Topic(topic)
+	p.Retain = m.Flags.Retain()
+	p.Payload = m.Data
+	if _, err := g.server.HandlePacket(p, ""); err != nil {
+		log.Warn().Err(err).Str("addr", addr.String()).Msg("mqtt-sn QoS -1 publish error")
+	}
+}
+
+func (g *Gateway) wakeUp(addr net.Addr, m *mqttsn.Pingreq) {
+	g.mu.Lock()
+	c := g.ids[m.ClientID]
+	g.mu.Unlock()
+	if c == nil {
+		g.write(addr, &mqttsn.Disconnect{})
+		return
+	}
+	g.move(c, addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != asleep {
+		g.write(addr, &mqttsn.Pingresp{})
+		return
+	}
+	// the run loop sends the buffered messages, then PINGRESP
+	c.state = awake
+	c.wake()
+}
+
+var errUnexpectedMessage = errors.New("unexpected mqtt-sn message")
+
+func (g *Gateway) handleClient(c *client, m mqttsn.Message) error {
+	switch m := m.(type) {
+	case *mqttsn.Connect:
+		if m.Flags.Will() {
+			return c.write(&mqttsn.WillTopicReq{})
+		}
+		g.accept(c)
+	case *mqttsn.WillTopic:
+		c.mu.Lock()
+		if c.connect == nil {
+			c.mu.Unlock()
+			return errUnexpectedMessage
+		}
+		if m.Topic != "" {
+			c.will = &mqtt.Will{Version: mqtt.MQTT4, Topic: m.Topic, QoS: mqtt.QoS(max(m.Flags.QoS(), 0)), Retain: m.Flags.Retain()}
+		}
+		c.mu.Unlock()
+		if m.Topic == "" {
+			g.accept(c)
+			return nil
+		}
+		return c.write(&mqttsn.WillMsgReq{})
+	case *mqttsn.WillMsg:
+		c.mu.Lock()
+		if c.will != nil {
+			c.will.Message = string(m.Message)
+		}
+		c.mu.Unlock()
+		g.accept(c)
+	case *mqttsn.Register:
+		if topic := mqtt.Topic(m.TopicName); topic == "" || topic.IsWild() {
+			return c.write(&mqttsn.Regack{MsgID: m.MsgID, ReturnCode: mqttsn.NotSupported})
+		}
+		c.mu.Lock()
+		id := c.topics.register(m.TopicName)
+		c.mu.Unlock()
+		return c.write(&mqttsn.Regack{TopicID: id, MsgID: m.MsgID, ReturnCode: mqttsn.Accepted})
+	case *mqttsn.Regack:
+		c.regack(m)
+	case *mqttsn.Publish:
+		return g.handlePublish(c, m)
+	case *mqttsn.Pubrel:
+		// the server dispatches the publish it held since PUBREC
+		if _, err := g.server.HandlePacket(&mqtt.Pubrel{BasePacket: newBase(mqtt.PUBREL), PacketID: mqtt.PacketID(m.MsgID)}, c.id); err != nil {
+			return err
+		}
+		return c.write(&mqttsn.Pubcomp{MsgID: m.MsgID})
+	case *mqttsn.Puback:
+		_, err := g.server.HandlePacket(&mqtt.Puback{BasePacket: newBase(mqtt.PUBACK), PacketID: mqtt.PacketID(m.MsgID)}, c.id)
+		return err
+	case *mqttsn.Pubrec:
+		resp, err := g.server.HandlePacket(&mqtt.Pubrec{BasePacket: newBase(mqtt.PUBREC), PacketID: mqtt.PacketID(m.MsgID)}, c.id)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			return c.write(&mqttsn.Pubrel{MsgID: m.MsgID})
+		}
+	case *mqttsn.Pubcomp:
+		_, err := g.server.HandlePacket(&mqtt.Pubcomp{BasePacket: newBase(mqtt.PUBCOMP), PacketID: mqtt.PacketID(m.MsgID)}, c.id)
+		return err
+	case *mqttsn.Subscribe:
+		return g.handleSubscribe(c, m)
+	case *mqttsn.Unsubscribe:
+		c.mu.Lock()
+		filter, ok := c.topics.filter(m.Flags, m.TopicName, m.TopicID)
+		c.mu.Unlock()
+		if ok {
+			p := mqtt.NewUnsubscribe(&mqtt.FixedHeader{PacketType: mqtt.UNSUBSCRIBE}, mqtt.MQTT4)
+			p.PacketID = mqtt.PacketID(m.MsgID)
+			p.TopicFilters = []string{filter}
+			if _, err := g.server.HandlePacket(p, c.id); err != nil {
+				return err
+			}
+		}
+		return c.write(&mqttsn.Unsuback{MsgID: m.MsgID})
+	case *mqttsn.Pingreq:
+		return c.write(&mqttsn.Pingresp{})
+	case *mqttsn.Disconnect:
+		if m.Duration > 0 {
+			c.mu.Lock()
+			c.sleep = time.Duration(m.Duration) * time.Second
+			c.state = asleep
+			c.mu.Unlock()
+			return c.write(&mqttsn.Disconnect{})
+		}
+		c.mu.Lock()
+		c.will = nil
+		c.mu.Unlock()
+		// closed before the answer, a client reconnecting at once finds its connection released
+		c.close(false)
+		c.write(&mqttsn.Disconnect{})
+	}
+	return nil
+}
+
+func newBase(t mqtt.PacketType) *mqtt.BasePacket {
+	return &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: t}, Version: mqtt.MQTT4}
+}
+
+func (g *Gateway) handlePublish(c *client, m *mqttsn.Publish) error {
+	c.mu.Lock()
+	topic, ok := c.topics.topic(m.Flags.TopicIDType(), m.TopicID)
+	c.mu.Unlock()
+	if !ok {
+		if m.Flags.QoS() == 0 {
+			return nil
+		}
+		return c.write(&mqttsn.Puback{TopicID: m.TopicID, MsgID: m.MsgID, ReturnCode: mqttsn.InvalidTopicID})
+	}
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = mqtt.QoS(m.Flags.QoS())
+	p.Retain = m.Flags.Retain()
+	p.Dup = m.Flags.DUP()
+	p.PacketID = mqtt.PacketID(m.MsgID)
+	p.Payload = m.Data
+	resp, err := g.server.HandlePacket(p, c.id)
+	if err != nil {
+		return err
+	}
+	switch resp := resp.(type) {
+	case *mqtt.Puback:
+		return c.write(&mqttsn.Puback{TopicID: m.TopicID, MsgID: m.MsgID, ReturnCode: returnCode(resp.ReasonCode)})
+	case *mqtt.Pubrec:
+		if resp.ReasonCode >= mqtt.V5_Unspecified_Error {
+			return c.write(&mqttsn.Puback{TopicID: m.TopicID, MsgID: m.MsgID, ReturnCode: returnCode(resp.ReasonCode)})
+		}
+		return c.write(&mqttsn.Pubrec{MsgID: m.MsgID})
+	}
+	return nil
+}
+
+func (g *Gateway) handleSubscribe(c *client, m *mqttsn.Subscribe) error {
+	c.mu.Lock()
+	filter, ok := c.topics.filter(m.Flags, m.TopicName, m.TopicID)
+	c.mu.Unlock()
+	if !ok {
+		return c.write(&mqttsn.Suback{MsgID: m.MsgID, ReturnCode: mqttsn.InvalidTopicID})
+	}
+	p := mqtt.NewSubscribe(&mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, mqtt.MQTT4)
+	p.PacketID = mqtt.PacketID(m.MsgID)
+	p.Subscriptions = []*mqtt.Subscription{{TopicFilter: filter, QoS: mqtt.QoS(max(m.Flags.QoS(), 0))}}
+	resp, err := g.server.HandlePacket(p, c.id)
+	if err != nil {
+		return err
+	}
+	suback, ok := resp.(*mqtt.Suback)
+	if !ok || len(suback.ReasonCodes) != 1 {
+		return errUnexpectedMessage
+	}
+	code := suback.ReasonCodes[0]
+	if code >= mqtt.V5_Unspecified_Error {
+		return c.write(&mqttsn.Suback{MsgID: m.MsgID, ReturnCode: mqttsn.NotSupported})
+	}
+	id := m.TopicID
+	if m.Flags.TopicIDType() == mqttsn.TopicShort {
+		id, _ = mqttsn.ShortTopicID(filter)
+	}
+	c.mu.Lock()
+	id = c.topics.subscribed(m.Flags, filter, id)
+	c.mu.Unlock()
+	return c.write(&mqttsn.Suback{
+		Flags:      mqttsn.NewFlags(int(code), false, m.Flags.TopicIDType()),
+		TopicID:    id,
+		MsgID:      m.MsgID,
+		ReturnCode: mqttsn.Accepted,
+	})
+}
+
+func returnCode(code mqtt.ReasonCode) mqttsn.ReturnCode {
+	switch {
+	case code < mqtt.V5_Unspecified_Error:
+		return mqttsn.Accepted
+	case code == mqtt.V5_Quota_Exceeded:
+		return mqttsn.Congestion
+	}
+	return mqttsn.NotSupported
+}
@@ -0,0 +1,228 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/limits"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	memStore "github.com/jin06/mercury/internal/server/message/store/memory"
+	"github.com/jin06/mercury/internal/server/servers"
+	"github.com/jin06/mercury/pkg/mqttsn"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func (c *testClient) send(m mqttsn.Message) {
+	if _, err := c.conn.Write(mqttsn.Encode(m)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) read() mqttsn.Message {
+	buf := make([]byte, 1024)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m, err := mqttsn.Decode(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *testClient) connect(id string) {
+	c.send(&mqttsn.Connect{Flags: mqttsn.FlagCleanSession, ProtocolID: 1, Duration: 60, ClientID: id})
+	if m, ok := c.read().(*mqttsn.Connack); !ok || m.ReturnCode != mqttsn.Accepted {
+		c.t.Fatalf("expected accepted CONNACK, got %#v", m)
+	}
+}
+
+func startGateway(t *testing.T, cfg config.MQTTSN) net.Addr {
+	addr, _ := startLimitedGateway(t, cfg, config.MQTTConfig{})
+	return addr
+}
+
+func startLimitedGateway(t *testing.T, cfg config.MQTTSN, mqttCfg config.MQTTConfig) (net.Addr, server.Server) {
+	srv, err := servers.NewServer(&config.Config{
+		Mode:         config.MemoryMode,
+		Capabilities: config.DefaultCapabilities(),
+		MQTTConfig:   mqttCfg,
+	}, func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) }, servers.Persistence{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := limits.NewRate(mqttCfg.ConnectionRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go New(srv, conn, config.Listener{Type: "mqttsn", Addr: conn.LocalAddr().String(), MQTTSN: cfg}, rate).Serve(ctx)
+	return conn.LocalAddr(), srv
+}
+
+func dial(t *testing.T, addr net.Addr) *testClient {
+	conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func TestSearchGW(t *testing.T) {
+	c := dial(t, startGateway(t, config.MQTTSN{GatewayID: 7}))
+	c.send(&mqttsn.SearchGW{Radius: 1})
+	if m, ok := c.read().(*mqttsn.GWInfo); !ok || m.GatewayID != 7 {
+		t.Fatalf("expected GWINFO of gateway 7, got %#v", m)
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startGateway(t, config.MQTTSN{})
+	sub, pub := dial(t, addr), dial(t, addr)
+	sub.connect("sub")
+	pub.connect("pub")
+
+	sub.send(&mqttsn.Subscribe{Flags: mqttsn.NewFlags(1, false, mqttsn.TopicNormal), MsgID: 1, TopicName: "sensors/temp"})
+	suback, ok := sub.read().(*mqttsn.Suback)
+	if !ok || suback.ReturnCode != mqttsn.Accepted || suback.TopicID == 0 || suback.Flags.QoS() != 1 {
+		t.Fatalf("unexpected SUBACK %#v", suback)
+	}
+
+	pub.send(&mqttsn.Register{MsgID: 1, TopicName: "sensors/temp"})
+	regack, ok := pub.read().(*mqttsn.Regack)
+	if !ok || regack.ReturnCode != mqttsn.Accepted {
+		t.Fatalf("unexpected REGACK %#v", regack)
+	}
+	pub.send(&mqttsn.Publish{Flags: mqttsn.NewFlags(1, false, mqttsn.TopicNormal), TopicID: regack.TopicID, MsgID: 2, Data: []byte("21.5")})
+	if m, ok := pub.read().(*mqttsn.Puback); !ok || m.MsgID != 2 || m.ReturnCode != mqttsn.Accepted {
+		t.Fatalf("unexpected PUBACK %#v", m)
+	}
+
+	m, ok := sub.read().(*mqttsn.Publish)
+	if !ok || m.TopicID != suback.TopicID || string(m.Data) != "21.5" || m.Flags.QoS() != 1 {
+		t.Fatalf("unexpected PUBLISH %#v", m)
+	}
+	sub.send(&mqttsn.Puback{TopicID: m.TopicID, MsgID: m.MsgID})
+
+	pub.send(&mqttsn.Publish{Flags: mqttsn.NewFlags(1, false, mqttsn.TopicNormal), TopicID: 99, MsgID: 3})
+	if m, ok := pub.read().(*mqttsn.Puback); !ok || m.ReturnCode != mqttsn.InvalidTopicID {
+		t.Fatalf("expected invalid topic ID, got %#v", m)
+	}
+}
+
+func TestRegisterWildcardDelivery(t *testing.T) {
+	addr := startGateway(t, config.MQTTSN{})
+	sub, pub := dial(t, addr), dial(t, addr)
+	sub.connect("sub")
+	pub.connect("pub")
+
+	sub.send(&mqttsn.Subscribe{MsgID: 1, TopicName: "sensors/#"})
+	if m, ok := sub.read().(*mqttsn.Suback); !ok || m.ReturnCode != mqttsn.Accepted || m.TopicID != 0 {
+		t.Fatalf("unexpected SUBACK %#v", m)
+	}
+	pub.send(&mqttsn.Register{MsgID: 1, TopicName: "sensors/hum"})
+	regack := pub.read().(*mqttsn.Regack)
+	pub.send(&mqttsn.Publish{TopicID: regack.TopicID, Data: []byte("40")})
+
+	register, ok := sub.read().(*mqttsn.Register)
+	if !ok || register.TopicName != "sensors/hum" {
+		t.Fatalf("expected REGISTER of sensors/hum, got %#v", register)
+	}
+	sub.send(&mqttsn.Regack{TopicID: register.TopicID, MsgID: register.MsgID})
+	if m, ok := sub.read().(*mqttsn.Publish); !ok || m.TopicID != register.TopicID || string(m.Data) != "40" {
+		t.Fatalf("unexpected PUBLISH %#v", m)
+	}
+}
+
+func TestSleepingClient(t *testing.T) {
+	addr := startGateway(t, config.MQTTSN{PredefinedTopics: map[uint16]string{1: "alerts"}})
+	sub, pub := dial(t, addr), dial(t, addr)
+	sub.connect("sleeper")
+
+	sub.send(&mqttsn.Subscribe{Flags: mqttsn.NewFlags(0, false, mqttsn.TopicPredefined), MsgID: 1, TopicID: 1})
+	if m, ok := sub.read().(*mqttsn.Suback); !ok || m.ReturnCode != mqttsn.Accepted || m.TopicID != 1 {
+		t.Fatalf("unexpected SUBACK %#v", m)
+	}
+	sub.send(&mqttsn.Disconnect{Duration: 60})
+	if _, ok := sub.read().(*mqttsn.Disconnect); !ok {
+		t.Fatal("expected DISCONNECT")
+	}
+
+	// QoS -1 publishes need no connection
+	for _, data := range []string{"a", "b"} {
+		pub.send(&mqttsn.Publish{Flags: mqttsn.NewFlags(-1, false, mqttsn.TopicPredefined), TopicID: 1, Data: []byte(data)})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	sub.send(&mqttsn.Pingreq{ClientID: "sleeper"})
+	for _, want := range []string{"a", "b"} {
+		m, ok := sub.read().(*mqttsn.Publish)
+		if !ok || string(m.Data) != want || m.Flags.TopicIDType() != mqttsn.TopicPredefined {
+			t.Fatalf("expected buffered %q, got %#v", want, m)
+		}
+	}
+	if _, ok := sub.read().(*mqttsn.Pingresp); !ok {
+		t.Fatal("expected PINGRESP after the buffered messages")
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	addr, _ := startLimitedGateway(t, config.MQTTSN{}, config.MQTTConfig{MaxConnections: 1})
+	first := dial(t, addr)
+	first.connect("c1")
+	second := dial(t, addr)
+	second.send(&mqttsn.Connect{Flags: mqttsn.FlagCleanSession, ProtocolID: 1, Duration: 60, ClientID: "c2"})
+	if m, ok := second.read().(*mqttsn.Connack); !ok || m.ReturnCode != mqttsn.Congestion {
+		t.Fatalf("expected congestion CONNACK, got %#v", m)
+	}
+	// the slot is released once the first client disconnects
+	first.send(&mqttsn.Disconnect{})
+	if _, ok := first.read().(*mqttsn.Disconnect); !ok {
+		t.Fatal("expected DISCONNECT")
+	}
+	second.connect("c2")
+}
+
+// TestConnectAgain resends CONNECT as a client does when WILLTOPICREQ was lost, the client of
+// the first one is replaced.
+func TestConnectAgain(t *testing.T) {
+	addr, srv := startLimitedGateway(t, config.MQTTSN{}, config.MQTTConfig{})
+	c := dial(t, addr)
+	for range 2 {
+		c.send(&mqttsn.Connect{Flags: mqttsn.FlagCleanSession | mqttsn.FlagWill, ProtocolID: 1, Duration: 60, ClientID: "c1"})
+		if _, ok := c.read().(*mqttsn.WillTopicReq); !ok {
+			t.Fatal("expected WILLTOPICREQ")
+		}
+	}
+	if total := srv.Connections().Stats().Total; total != 1 {
+		t.Fatalf("expected 1 connection, got %d", total)
+	}
+	c.send(&mqttsn.WillTopic{Topic: "lwt"})
+	if _, ok := c.read().(*mqttsn.WillMsgReq); !ok {
+		t.Fatal("expected WILLMSGREQ")
+	}
+	c.send(&mqttsn.WillMsg{Message: []byte("gone")})
+	if m, ok := c.read().(*mqttsn.Connack); !ok || m.ReturnCode != mqttsn.Accepted {
+		t.Fatalf("expected accepted CONNACK, got %#v", m)
+	}
+	if total := srv.Connections().Stats().Total; total != 1 {
+		t.Fatalf("expected 1 connection, got %d", total)
+	}
+}
@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"github.com/jin06/mercury/pkg/mqtt"
+	"github.com/jin06/mercury/pkg/mqttsn"
+)
+
+func newPredefined(topics map[uint16]string) *predefined {
+	p := &predefined{
+		names: topics,
+		ids:   make(map[string]uint16, len(topics)),
+	}
+	for id, name := range topics {
+		p.ids[name] = id
+	}
+	return p
+}
+
+// predefined topics are shared by all clients and configured in advance.
+type predefined struct {
+	names map[uint16]string
+	ids   map[string]uint16
+}
+
+func newRegistry(p *predefined) *registry {
+	return &registry{
+		predefined: p,
+		names:      make(map[uint16]string),
+		ids:        make(map[string]uint16),
+	}
+}
+
+// registry holds the topic IDs registered by or for one client.
+type registry struct {
+	predefined *predefined
+	names      map[uint16]string
+	ids        map[string]uint16
+	last       uint16
+}
+
+// register returns the topic ID of name, registering it when it has none.
+func (r *registry) register(name string) uint16 {
+	if id, ok := r.ids[name]; ok {
+		return id
+	}
+	for {
+		r.last++
+		if _, ok := r.names[r.last]; !ok && r.last != 0 && r.last != 0xFFFF {
+			break
+		}
+	}
+	r.names[r.last] = name
+	r.ids[name] = r.last
+	return r.last
+}
+
+// topic returns the topic name of a topic ID of type t.
+func (r *registry) topic(t mqttsn.TopicIDType, id uint16) (string, bool) {
+	switch t {
+	case mqttsn.TopicNormal:
+		name, ok := r.names[id]
+		return name, ok
+	case mqttsn.TopicPredefined:
+		name, ok := r.predefined.names[id]
+		return name, ok
+	case mqttsn.TopicShort:
+		return mqttsn.ShortTopic(id), true
+	}
+	return "", false
+}
+
+// id returns the topic ID to publish name with, registered is false when a
+// normal topic ID has to be registered with the client first.
+func (r *registry) id(name string) (id uint16, t mqttsn.TopicIDType, registered bool) {
+	if id, ok := r.predefined.ids[name]; ok {
+		return id, mqttsn.TopicPredefined, true
+	}
+	if id, ok := mqttsn.ShortTopicID(name); ok {
+		return id, mqttsn.TopicShort, true
+	}
+	id, ok := r.ids[name]
+	return id, mqttsn.TopicNormal, ok
+}
+
+// filter returns the topic filter of a SUBSCRIBE or UNSUBSCRIBE.
+func (r *registry) filter(flags mqttsn.Flags, name string, id uint16) (string, bool) {
+	if flags.TopicIDType() == mqttsn.TopicPredefined {
+		return r.topic(mqttsn.TopicPredefined, id)
+	}
+	return name, name != ""
+}
+
+// subscribed returns the topic ID a SUBACK carries for filter, 0 for wildcard filters.
+func (r *registry) subscribed(flags mqttsn.Flags, filter string, id uint16) uint16 {
+	topic := mqtt.Topic(filter)
+	switch {
+	case flags.TopicIDType() != mqttsn.TopicNormal:
+		return id
+	case topic.IsWild():
+		return 0
+	}
+	return r.register(filter)
+}
@@ -0,0 +1,93 @@
+// Package history replays the messages kept for topic prefixes to subscribers asking for them,
+// either with the $replay/<since>/<filter> topic filter or the replay user property of an MQTT 5
+// SUBSCRIBE. Since is a number of messages, a duration back from now or an RFC 3339 time:
+//
+//	$replay/100/sensors/#                   the last 100 messages
+//	$replay/15m/sensors/#                   the messages of the last 15 minutes
+//	$replay/2024-05-01T08:00:00Z/sensors/#  the messages since that time
+package history
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+const (
+	// Prefix starts the topic filters asking for a replay.
+	Prefix = "$replay/"
+	// UserProperty asks for a replay of all topic filters of a SUBSCRIBE.
+	UserProperty = "replay"
+)
+
+var ErrSince = errors.New("invalid replay since, expected a count, a duration or an RFC 3339 time")
+
+// Store keeps the messages of the configured topic prefixes.
+type Store interface {
+	// Keeps reports whether the messages of topic are kept.
+	Keeps(topic string) bool
+	// Append keeps p if its topic is below the prefix of a stream, at the returned time which
+	// identifies it in the history. The time is zero when p is not kept.
+	Append(p *mqtt.Publish) (time.Time, error)
+	// Replay passes the kept messages matching filter to fn with the time they are kept at,
+	// oldest first.
+	Replay(filter string, since Since, fn func(p *mqtt.Publish, at time.Time) error) error
+}
+
+// Since selects the kept messages to replay, the last Count ones or those kept from Time on.
+type Since struct {
+	Count int
+	Time  time.Time
+}
+
+// ParseSince parses a count, a duration back from now or an RFC 3339 time.
+func ParseSince(s string) (Since, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 {
+			return Since{}, ErrSince
+		}
+		return Since{Count: n}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return Since{}, ErrSince
+		}
+		return Since{Time: time.Now().Add(-d)}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return Since{Time: t}, nil
+	}
+	return Since{}, ErrSince
+}
+
+// Split returns the topic filter of a $replay/<since>/<filter> subscription and what to
+// replay, ok is false for other topic filters.
+func Split(topicFilter string) (filter string, since Since, ok bool, err error) {
+	rest, ok := strings.CutPrefix(topicFilter, Prefix)
+	if !ok {
+		return topicFilter, since, false, nil
+	}
+	s, filter, found := strings.Cut(rest, "/")
+	if !found || filter == "" {
+		return "", since, true, ErrSince
+	}
+	since, err = ParseSince(s)
+	return filter, since, true, err
+}
+
+// Requested returns what the replay user property of a SUBSCRIBE asks for.
+func Requested(props *mqtt.Properties) (since Since, ok bool, err error) {
+	if props == nil {
+		return
+	}
+	for _, up := range props.UserProperties {
+		if up.Key == UserProperty {
+			since, err = ParseSince(up.Val)
+			return since, true, err
+		}
+	}
+	return
+}
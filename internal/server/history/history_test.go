@@ -0,0 +1,42 @@
+package history
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestSplit(t *testing.T) {
+	filter, since, ok, err := Split("$replay/100/sensors/#")
+	if err != nil || !ok || filter != "sensors/#" || since.Count != 100 {
+		t.Fatalf("unexpected %q %+v %v %v", filter, since, ok, err)
+	}
+	filter, since, ok, err = Split("$replay/15m/a")
+	if err != nil || !ok || filter != "a" || time.Since(since.Time).Round(time.Minute) != 15*time.Minute {
+		t.Fatalf("unexpected %q %+v %v %v", filter, since, ok, err)
+	}
+	filter, since, ok, err = Split("$replay/2024-05-01T08:00:00Z/a/+")
+	if err != nil || !ok || filter != "a/+" || !since.Time.Equal(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected %q %+v %v %v", filter, since, ok, err)
+	}
+	if filter, _, ok, err = Split("sensors/#"); ok || err != nil || filter != "sensors/#" {
+		t.Fatalf("unexpected %q %v %v", filter, ok, err)
+	}
+	for _, invalid := range []string{"$replay/0/a", "$replay/-5m/a", "$replay/soon/a", "$replay/10", "$replay/10/"} {
+		if _, _, ok, err := Split(invalid); !ok || !errors.Is(err, ErrSince) {
+			t.Errorf("%s: expected ErrSince, got %v %v", invalid, ok, err)
+		}
+	}
+}
+
+func TestRequested(t *testing.T) {
+	if _, ok, err := Requested(nil); ok || err != nil {
+		t.Fatalf("unexpected replay %v %v", ok, err)
+	}
+	props := &mqtt.Properties{UserProperties: mqtt.UserProperties{{Key: "app", Val: "x"}, {Key: UserProperty, Val: "5"}}}
+	if since, ok, err := Requested(props); !ok || err != nil || since.Count != 5 {
+		t.Fatalf("unexpected %+v %v %v", since, ok, err)
+	}
+}
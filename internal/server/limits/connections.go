@@ -0,0 +1,138 @@
+package limits
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func New(cfg *config.Config) *Connections {
+	c := &Connections{
+		global:    newCounter(cfg.MQTTConfig.MaxConnections, cfg.MQTTConfig.MaxConnectionsPerIP),
+		users:     newCounter(0, cfg.MQTTConfig.MaxConnectionsPerUser),
+		listeners: make(map[string]*counter),
+	}
+	for _, l := range cfg.Listeners {
+		c.listeners[l.Addr] = newCounter(l.MaxConnections, 0)
+	}
+	return c
+}
+
+// Connections counts open connections globally, per listener, per source IP and per username.
+type Connections struct {
+	global    *counter
+	users     *counter
+	listeners map[string]*counter
+}
+
+type Stats struct {
+	Total     int            `json:"total"`
+	Max       int            `json:"max"`
+	Listeners map[string]int `json:"listeners"`
+	IPs       map[string]int `json:"ips"`
+	Users     map[string]int `json:"users"`
+}
+
+// Accept counts a connection accepted on listener from ip, it reports false when a limit is reached.
+func (c *Connections) Accept(id, listener, ip string) bool {
+	if !c.global.acquire(id, ip) {
+		return false
+	}
+	if l, ok := c.listeners[listener]; ok && !l.acquire(id, "") {
+		c.global.release(id)
+		return false
+	}
+	return true
+}
+
+// Close releases a connection counted by Accept.
+func (c *Connections) Close(id string) {
+	c.global.release(id)
+	for _, l := range c.listeners {
+		l.release(id)
+	}
+}
+
+// Login counts a connected client of username, it reports false when the username has too many.
+func (c *Connections) Login(id, username string) bool {
+	return c.users.acquire(id, username)
+}
+
+// Logout releases a client counted by Login, it is safe to call for clients never counted.
+func (c *Connections) Logout(id string) {
+	c.users.release(id)
+}
+
+func (c *Connections) Stats() Stats {
+	s := Stats{
+		Max:       c.global.max,
+		Listeners: make(map[string]int, len(c.listeners)),
+	}
+	s.Total, s.IPs = c.global.stats()
+	_, s.Users = c.users.stats()
+	for addr, l := range c.listeners {
+		s.Listeners[addr], _ = l.stats()
+	}
+	return s
+}
+
+func newCounter(max, perKey int) *counter {
+	return &counter{
+		max:    max,
+		perKey: perKey,
+		ids:    make(map[string]string),
+		keys:   make(map[string]int),
+	}
+}
+
+// counter limits the total count and the count per key, 0 means no limit.
+// Empty keys are counted in the total only.
+type counter struct {
+	mu     sync.Mutex
+	max    int
+	perKey int
+	ids    map[string]string // id -> key
+	keys   map[string]int
+}
+
+func (c *counter) acquire(id, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.ids[id]; ok {
+		return true
+	}
+	if c.max > 0 && len(c.ids) >= c.max {
+		return false
+	}
+	if c.perKey > 0 && key != "" && c.keys[key] >= c.perKey {
+		return false
+	}
+	c.ids[id] = key
+	if key != "" {
+		c.keys[key]++
+	}
+	return true
+}
+
+func (c *counter) release(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.ids[id]
+	if !ok {
+		return
+	}
+	delete(c.ids, id)
+	if key == "" {
+		return
+	}
+	if c.keys[key]--; c.keys[key] <= 0 {
+		delete(c.keys, key)
+	}
+}
+
+func (c *counter) stats() (int, map[string]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.ids), maps.Clone(c.keys)
+}
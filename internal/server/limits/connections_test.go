@@ -0,0 +1,52 @@
+package limits
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func TestConnections(t *testing.T) {
+	c := New(&config.Config{
+		Listeners: []config.Listener{{Addr: ":1883", MaxConnections: 2}},
+		MQTTConfig: config.MQTTConfig{
+			MaxConnections:        3,
+			MaxConnectionsPerIP:   1,
+			MaxConnectionsPerUser: 1,
+		},
+	})
+	if !c.Accept("1", ":1883", "10.0.0.1") {
+		t.Fatal("first connection refused")
+	}
+	if c.Accept("2", ":1883", "10.0.0.1") {
+		t.Error("per ip limit not applied")
+	}
+	if !c.Accept("3", ":1883", "10.0.0.2") {
+		t.Fatal("connection from another ip refused")
+	}
+	if c.Accept("4", ":1883", "10.0.0.3") {
+		t.Error("listener limit not applied")
+	}
+	if !c.Accept("5", ":8883", "10.0.0.4") {
+		t.Fatal("connection on another listener refused")
+	}
+	if c.Accept("6", ":8883", "10.0.0.5") {
+		t.Error("global limit not applied")
+	}
+
+	if !c.Login("1", "alice") || c.Login("3", "alice") {
+		t.Error("per user limit not applied")
+	}
+	c.Logout("1")
+	if !c.Login("3", "alice") {
+		t.Error("logout did not release the username")
+	}
+
+	c.Close("1")
+	if s := c.Stats(); s.Total != 2 || s.Listeners[":1883"] != 1 || s.IPs["10.0.0.1"] != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if !c.Accept("7", ":1883", "10.0.0.1") {
+		t.Error("close did not release the connection")
+	}
+}
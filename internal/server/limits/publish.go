@@ -0,0 +1,222 @@
+package limits
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func NewPublish(cfg config.PublishQuotas) *Publish {
+	p := &Publish{
+		action:   cfg.Action,
+		client:   cfg.Client,
+		username: cfg.Username,
+		clients:  make(map[string]*quota),
+		users:    make(map[string]*quota),
+		paused:   make(map[string]time.Time),
+	}
+	if p.action == "" {
+		p.action = config.Throttle
+	}
+	for _, t := range cfg.Topics {
+		p.topics = append(p.topics, topicQuota{t.Prefix, newQuota(t.PublishQuota)})
+	}
+	slices.SortFunc(p.topics, func(a, b topicQuota) int {
+		return len(b.prefix) - len(a.prefix)
+	})
+	return p
+}
+
+// Publish limits the publish rate per client, per username and per topic prefix.
+type Publish struct {
+	action   string
+	client   config.PublishQuota
+	username config.PublishQuota
+	topics   []topicQuota
+	mu       sync.Mutex
+	clients  map[string]*quota
+	users    map[string]*quota
+	// paused holds the time until which throttled clients should not be read from
+	paused map[string]time.Time
+	swept  time.Time
+	// throttled and rejected count publishes over quota
+	throttled atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+type PublishStats struct {
+	Action    string `json:"action"`
+	Throttled uint64 `json:"throttled"`
+	Rejected  uint64 `json:"rejected"`
+	// Clients counts publishes over quota of the clients that recently published
+	Clients map[string]uint64 `json:"clients"`
+}
+
+func newQuota(cfg config.PublishQuota) *quota {
+	return &quota{
+		messages: NewBucket(cfg.Messages),
+		bytes:    NewBucket(cfg.Bytes),
+	}
+}
+
+type quota struct {
+	messages *Bucket
+	bytes    *Bucket
+	// over counts publishes over this quota
+	over atomic.Uint64
+}
+
+type topicQuota struct {
+	prefix string
+	*quota
+}
+
+func (q *quota) buckets(size int) []sized {
+	list := make([]sized, 0, 2)
+	if q.messages != nil {
+		list = append(list, sized{q.messages, 1})
+	}
+	if q.bytes != nil {
+		list = append(list, sized{q.bytes, float64(size)})
+	}
+	return list
+}
+
+func (q *quota) full(now time.Time) bool {
+	return (q.messages == nil || q.messages.full(now)) && (q.bytes == nil || q.bytes.full(now))
+}
+
+type sized struct {
+	*Bucket
+	n float64
+}
+
+func (p *Publish) Action() string {
+	return p.action
+}
+
+// Take counts a publish of size payload bytes to topic. With the throttle action it always
+// succeeds and returns how long the client should wait before reading more, the wait is kept
+// for Wait. Otherwise it reports false and counts nothing when a quota is exceeded.
+func (p *Publish) Take(clientID, username, topic string, size int) (time.Duration, bool) {
+	client := p.quota(p.clients, clientID, p.client)
+	var buckets []sized
+	if client != nil {
+		buckets = append(buckets, client.buckets(size)...)
+	}
+	if q := p.quota(p.users, username, p.username); q != nil {
+		buckets = append(buckets, q.buckets(size)...)
+	}
+	for _, t := range p.topics {
+		if strings.HasPrefix(topic, t.prefix) {
+			buckets = append(buckets, t.buckets(size)...)
+			break
+		}
+	}
+	now := time.Now()
+	if p.action == config.Throttle {
+		var wait time.Duration
+		for _, b := range buckets {
+			wait = max(wait, b.reserve(b.n, now))
+		}
+		if wait > 0 {
+			p.over(client, &p.throttled)
+			p.pause(clientID, now.Add(wait))
+		}
+		return wait, true
+	}
+	for i, b := range buckets {
+		if !b.take(b.n, now) {
+			for _, taken := range buckets[:i] {
+				taken.give(taken.n)
+			}
+			p.over(client, &p.rejected)
+			return 0, false
+		}
+	}
+	return 0, true
+}
+
+// Wait returns how long the client should still wait before reading more after its throttled
+// publishes, 0 when it is not held back.
+func (p *Publish) Wait(clientID string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	until, ok := p.paused[clientID]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(p.paused, clientID)
+		return 0
+	}
+	return wait
+}
+
+func (p *Publish) pause(clientID string, until time.Time) {
+	if clientID == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if until.After(p.paused[clientID]) {
+		p.paused[clientID] = until
+	}
+}
+
+func (p *Publish) over(client *quota, total *atomic.Uint64) {
+	total.Add(1)
+	if client != nil {
+		client.over.Add(1)
+	}
+}
+
+func (p *Publish) quota(m map[string]*quota, key string, cfg config.PublishQuota) *quota {
+	if key == "" || (cfg.Messages.Rate <= 0 && cfg.Bytes.Rate <= 0) {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	// forget quotas unused long enough to have refilled
+	if now.Sub(p.swept) > time.Minute {
+		for _, list := range []map[string]*quota{p.clients, p.users} {
+			maps.DeleteFunc(list, func(_ string, q *quota) bool {
+				return q.full(now)
+			})
+		}
+		maps.DeleteFunc(p.paused, func(_ string, until time.Time) bool {
+			return until.Before(now)
+		})
+		p.swept = now
+	}
+	q, ok := m[key]
+	if !ok {
+		q = newQuota(cfg)
+		m[key] = q
+	}
+	return q
+}
+
+func (p *Publish) Stats() PublishStats {
+	s := PublishStats{
+		Action:    p.action,
+		Throttled: p.throttled.Load(),
+		Rejected:  p.rejected.Load(),
+		Clients:   make(map[string]uint64),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, q := range p.clients {
+		if n := q.over.Load(); n > 0 {
+			s.Clients[id] = n
+		}
+	}
+	return s
+}
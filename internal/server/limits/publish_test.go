@@ -0,0 +1,59 @@
+package limits
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func TestPublishReject(t *testing.T) {
+	p := NewPublish(config.PublishQuotas{
+		Action: config.Reject,
+		Client: config.PublishQuota{Messages: config.RateLimit{Rate: 0.001, Burst: 2}},
+		Topics: []config.TopicQuota{
+			{Prefix: "a/", PublishQuota: config.PublishQuota{Bytes: config.RateLimit{Rate: 0.001, Burst: 10}}},
+			{Prefix: "a/b/", PublishQuota: config.PublishQuota{Bytes: config.RateLimit{Rate: 0.001, Burst: 100}}},
+		},
+	})
+	if _, ok := p.Take("c1", "", "a/x", 8); !ok {
+		t.Fatal("publish within quota rejected")
+	}
+	// the topic quota is exceeded, the client quota must not be charged
+	if _, ok := p.Take("c1", "", "a/y", 8); ok {
+		t.Fatal("topic quota not applied")
+	}
+	if _, ok := p.Take("c1", "", "a/b/c", 50); !ok {
+		t.Fatal("longest prefix not applied")
+	}
+	if _, ok := p.Take("c1", "", "z", 1); ok {
+		t.Error("client quota not applied")
+	}
+	if _, ok := p.Take("c2", "", "z", 1); !ok {
+		t.Error("client quota shared between clients")
+	}
+	if s := p.Stats(); s.Rejected != 2 || s.Clients["c1"] != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestPublishThrottle(t *testing.T) {
+	p := NewPublish(config.PublishQuotas{
+		Username: config.PublishQuota{Bytes: config.RateLimit{Rate: 100, Burst: 100}},
+	})
+	if wait, ok := p.Take("c1", "u", "t", 100); !ok || wait != 0 {
+		t.Fatalf("publish within quota throttled %v", wait)
+	}
+	wait, ok := p.Take("c2", "u", "t", 50)
+	if !ok || wait < 400e6 || wait > 500e6 {
+		t.Errorf("expected about 500ms wait, got %v", wait)
+	}
+	if s := p.Stats(); s.Throttled != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	if wait := p.Wait("c2"); wait < 400e6 || wait > 500e6 {
+		t.Errorf("expected c2 to wait about 500ms, got %v", wait)
+	}
+	if wait := p.Wait("c1"); wait != 0 {
+		t.Errorf("expected c1 not to wait, got %v", wait)
+	}
+}
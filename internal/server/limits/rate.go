@@ -0,0 +1,198 @@
+package limits
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+// NewBucket returns nil when cfg has no rate, a nil bucket allows everything.
+func NewBucket(cfg config.RateLimit) *Bucket {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = max(cfg.Rate, 1)
+	}
+	return &Bucket{
+		rate:   cfg.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Bucket is a token bucket.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes a token, it reports false when the bucket is empty.
+func (b *Bucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	return b.take(1, time.Now())
+}
+
+// take removes n tokens if the bucket holds them, otherwise it leaves the bucket unchanged.
+func (b *Bucket) take(n float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// give returns n tokens removed by take.
+func (b *Bucket) give(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+n)
+}
+
+// reserve removes n tokens even when the bucket holds fewer, it returns how long
+// the bucket needs to refill to no longer be in debt.
+func (b *Bucket) reserve(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// full reports whether the bucket refilled completely, so dropping it changes nothing.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func NewRate(cfg config.ConnectionRate) (*Rate, error) {
+	r := &Rate{
+		global: NewBucket(cfg.Global),
+		perIP:  cfg.PerIP,
+		ips:    make(map[netip.Addr]*Bucket),
+	}
+	for _, c := range cfg.CIDRs {
+		prefix, err := parsePrefix(c.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		if bucket := NewBucket(c.RateLimit); bucket != nil {
+			r.cidrs = append(r.cidrs, cidrBucket{prefix, bucket})
+		}
+	}
+	for _, a := range cfg.Allow {
+		prefix, err := parsePrefix(a)
+		if err != nil {
+			return nil, err
+		}
+		r.allow = append(r.allow, prefix)
+	}
+	return r, nil
+}
+
+// parsePrefix accepts a CIDR or a single IP.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+type cidrBucket struct {
+	prefix netip.Prefix
+	*Bucket
+}
+
+// Rate limits how fast new connections are accepted globally, per network and per source IP.
+type Rate struct {
+	global *Bucket
+	cidrs  []cidrBucket
+	allow  []netip.Prefix
+	perIP  config.RateLimit
+	mu     sync.Mutex
+	ips    map[netip.Addr]*Bucket
+	swept  time.Time
+}
+
+// Allow reports whether a new connection from ip may be accepted now.
+// Allow listed addresses are never limited, unparsable addresses only by the global limit.
+func (r *Rate) Allow(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range r.allow {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	if !r.global.Allow() {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, c := range r.cidrs {
+		if c.prefix.Contains(addr) {
+			if !c.Allow() {
+				return false
+			}
+			break
+		}
+	}
+	return r.ip(addr).Allow()
+}
+
+func (r *Rate) ip(addr netip.Addr) *Bucket {
+	if r.perIP.Rate <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	// forget addresses that have not connected long enough for their bucket to refill
+	if now.Sub(r.swept) > time.Minute {
+		for a, b := range r.ips {
+			if b.full(now) {
+				delete(r.ips, a)
+			}
+		}
+		r.swept = now
+	}
+	b, ok := r.ips[addr]
+	if !ok {
+		b = NewBucket(r.perIP)
+		r.ips[addr] = b
+	}
+	return b
+}
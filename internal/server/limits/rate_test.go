@@ -0,0 +1,50 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(config.RateLimit{Rate: 2, Burst: 2})
+	now := b.last
+	if !b.take(1, now) || !b.take(1, now) || b.take(1, now) {
+		t.Fatal("burst not applied")
+	}
+	if !b.take(1, now.Add(500*time.Millisecond)) || b.take(1, now.Add(500*time.Millisecond)) {
+		t.Error("refill not applied")
+	}
+	if NewBucket(config.RateLimit{}) != nil {
+		t.Error("zero rate should not limit")
+	}
+}
+
+func TestRate(t *testing.T) {
+	r, err := NewRate(config.ConnectionRate{
+		PerIP: config.RateLimit{Rate: 0.001, Burst: 1},
+		CIDRs: []config.CIDRRateLimit{{CIDR: "10.1.0.0/16", RateLimit: config.RateLimit{Rate: 0.001, Burst: 1}}},
+		Allow: []string{"192.168.0.1", "172.16.0.0/12"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Allow("10.0.0.1") || r.Allow("10.0.0.1") {
+		t.Error("per ip limit not applied")
+	}
+	if !r.Allow("10.0.0.2") {
+		t.Error("per ip limit shared between addresses")
+	}
+	if !r.Allow("10.1.0.1") || r.Allow("10.1.0.2") {
+		t.Error("cidr limit not applied")
+	}
+	for range 3 {
+		if !r.Allow("192.168.0.1") || !r.Allow("172.16.3.4") {
+			t.Fatal("allow listed address limited")
+		}
+	}
+	if _, err := NewRate(config.ConnectionRate{Allow: []string{"bad"}}); err == nil {
+		t.Error("invalid allow entry accepted")
+	}
+}
@@ -2,11 +2,7 @@ package server
 
 import (
 	"errors"
-	"math/rand"
 	"sync"
-	"time"
-
-	"github.com/jin06/mercury/pkg/mqtt"
 )
 
 func NewManager() *Manager {
@@ -37,15 +33,15 @@ func (m *Manager) Remove(id string) {
 	delete(m.clients, id)
 }
 
-func (m *Manager) RemoveClient(c Client) {
+// RemoveClient removes c unless its client ID was taken over by another client.
+func (m *Manager) RemoveClient(c Client) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.clients[c.ClientID()]; ok {
-		if m.clients[c.ClientID()].UUID() != c.UUID() {
-			delete(m.clients, c.ClientID())
-		}
+	if cur, ok := m.clients[c.ClientID()]; ok && cur.UUID() == c.UUID() {
+		delete(m.clients, c.ClientID())
+		return true
 	}
-	return
+	return false
 }
 
 func (m *Manager) Get(id string) Client {
@@ -73,9 +69,3 @@ func (m *Manager) Iterator(f func(c Client)) {
 		f(c)
 	}
 }
-
-// todo
-func (m *Manager) GetPacketID() mqtt.PacketID {
-	rand.Seed(time.Now().UnixNano())
-	return mqtt.PacketID(rand.Intn(65535) + 1) // Packet ID is a 16-bit unsigned integer
-}
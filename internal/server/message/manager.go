@@ -1,40 +1,129 @@
 package message
 
 import (
+	"context"
 	"errors"
 	"sync"
 
 	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/logger"
 	"github.com/jin06/mercury/internal/model"
 	"github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/utils"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
+// maxQueued limits the publishes a session keeps waiting for a free packet ID.
+const maxQueued = int(mqtt.MAX_PACKET_ID)
+
+type session struct {
+	store store.Store
+	// stop ends the retries of the connected client
+	stop context.CancelFunc
+	// mu guards write and queue
+	mu sync.Mutex
+	// write sends to the connected client, nil while it is disconnected
+	write func(mqtt.Packet) error
+	// queue holds the publishes waiting for a free packet ID, queued is their size
+	queue  []*mqtt.Publish
+	queued int
+}
+
+// queuedSize is the size of p counted against the queue bound.
+func queuedSize(p *mqtt.Publish) int {
+	return len(p.Topic) + len(p.Payload)
+}
+
+// pop removes the oldest queued publish, s.mu must be held.
+func (s *session) pop() {
+	s.queued -= queuedSize(s.queue[0])
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+}
+
+// clean drops the queued publishes, s.mu must be held.
+func (s *session) clean() {
+	clear(s.queue)
+	s.queue = s.queue[:0]
+	s.queued = 0
+}
+
+// drain stores and sends the queued publishes as far as the free packet IDs allow.
+func (s *session) drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 {
+		record, err := s.store.Publish(s.queue[0])
+		if errors.Is(err, utils.ErrPacketIDExhausted) {
+			return
+		}
+		s.pop()
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if s.write != nil {
+			if err := s.write(record.Content); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
 type Manager struct {
-	clients  map[string]store.Store
+	sessions map[string]*session
 	mu       sync.RWMutex
 	delivery chan *model.Record
 	newStore func(cid string) store.Store
+	// dropOldest discards the oldest queued publishes for a new one beyond maxQueuedBytes
+	dropOldest     bool
+	maxQueuedBytes int
 }
 
-func NewManager(delivery chan *model.Record) *Manager {
+// NewManager creates a manager whose sessions queue publishes as slow allows.
+func NewManager(delivery chan *model.Record, newStore func(cid string) store.Store, slow config.SlowConsumer) *Manager {
 	m := &Manager{
-		clients:  map[string]store.Store{},
-		delivery: delivery,
+		sessions:       map[string]*session{},
+		delivery:       delivery,
+		newStore:       newStore,
+		dropOldest:     slow.Policy == config.DropOldest,
+		maxQueuedBytes: slow.SessionQueueBytes,
 	}
-	m.newStore = func(cid string) store.Store {
-		return store.NewStore(config.Def.MessageStore.Mode, cid)
+	if m.maxQueuedBytes <= 0 {
+		m.maxQueuedBytes = config.DefaultSlowConsumer().SessionQueueBytes
 	}
 	return m
 }
 
+// Publish stores p for the client and returns its record. While all packet IDs of the session
+// are inflight p is queued and the record is nil, it is sent once an acknowledgement frees one.
+// A full queue fails with ErrSessionQueueFull, unless the oldest queued publishes are dropped.
 func (m *Manager) Publish(p *mqtt.Publish, cid string) (*model.Record, error) {
-	if s := m.Get(cid); s == nil {
-		if err := m.Set(cid); err != nil {
-			return nil, err
+	s := m.session(cid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// queued publishes go first
+	if len(s.queue) == 0 {
+		record, err := s.store.Publish(p)
+		if !errors.Is(err, utils.ErrPacketIDExhausted) {
+			return record, err
 		}
 	}
-	return m.Get(cid).Publish(p)
+	size := queuedSize(p)
+	full := func() bool {
+		return len(s.queue) >= maxQueued || s.queued+size > m.maxQueuedBytes
+	}
+	if m.dropOldest && size <= m.maxQueuedBytes {
+		for len(s.queue) > 0 && full() {
+			s.pop()
+		}
+	}
+	if full() {
+		return nil, utils.ErrSessionQueueFull
+	}
+	s.queue = append(s.queue, p)
+	s.queued += size
+	return nil, nil
 }
 
 func (m *Manager) Receive(cid string, p *mqtt.Pubrel) error {
@@ -46,45 +135,175 @@ func (m *Manager) Receive(cid string, p *mqtt.Pubrel) error {
 }
 
 func (m *Manager) Ack(cid string, packetID mqtt.PacketID) error {
-	if s := m.Get(cid); s != nil {
-		return s.Ack(packetID)
+	return m.free(cid, func(s store.Store) error { return s.Ack(packetID) })
+}
+
+// Hold keeps an incoming QoS 2 publish of the client until its PUBREL, a DUP of a held publish
+// is not held twice. Beyond max held publishes, 0 means no limit, it fails with Receive Maximum
+// exceeded.
+func (m *Manager) Hold(cid string, p *mqtt.Publish, max int) error {
+	s := m.session(cid).store
+	held, err := s.Hold(p)
+	if err != nil || !held || max <= 0 {
+		return err
+	}
+	n, err := s.Held()
+	if err != nil {
+		return err
+	}
+	if n > max {
+		if _, err := s.Release(p.PacketID); err != nil {
+			return err
+		}
+		return mqtt.Err_V5_Receive_Maximum_Exceeded
 	}
 	return nil
 }
 
-func (m *Manager) Release(cid string, p *mqtt.Pubcomp) error {
-	if s := m.Get(cid); s != nil {
-		return s.Release(p)
+// Release passes the held publish of a PUBREL to dispatch and removes it once dispatched, after
+// a failed dispatch or a crash it is dispatched on the PUBREL sent again. Nothing is dispatched
+// when it was released before.
+func (m *Manager) Release(cid string, pid mqtt.PacketID, dispatch func(*mqtt.Publish) error) error {
+	s := m.Get(cid)
+	if s == nil {
+		return nil
 	}
-	return nil
+	p, err := s.Peek(pid)
+	if err != nil || p == nil {
+		return err
+	}
+	if err := dispatch(p); err != nil {
+		return err
+	}
+	_, err = s.Release(pid)
+	return err
 }
 
 func (m *Manager) Complete(cid string, pid mqtt.PacketID) error {
-	if s := m.Get(cid); s != nil {
-		return s.Complete(pid)
+	return m.free(cid, func(s store.Store) error { return s.Complete(pid) })
+}
+
+// free runs an acknowledgement that frees a packet ID, the queued publishes may then be sent.
+func (m *Manager) free(cid string, ack func(store.Store) error) error {
+	m.mu.RLock()
+	s := m.sessions[cid]
+	m.mu.RUnlock()
+	if s == nil {
+		return nil
 	}
+	if err := ack(s.store); err != nil {
+		return err
+	}
+	s.drain()
 	return nil
 }
 
 func (m *Manager) Get(cid string) store.Store {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.clients[cid]
+	if s := m.sessions[cid]; s != nil {
+		return s.store
+	}
+	return nil
 }
 
-func (m *Manager) Set(cid string) (err error) {
+// Records passes the messages of the client to fn, also those a persistent store kept for a
+// client unknown since a restart.
+func (m *Manager) Records(cid string, fn func(r *model.Record, held bool) error) error {
+	if s := m.Get(cid); s != nil {
+		return s.Records(fn)
+	}
+	s := m.newStore(cid)
+	defer s.Close()
+	return s.Records(fn)
+}
+
+// session returns the session of the client, it is created with its store on first use.
+func (m *Manager) session(cid string) *session {
+	m.mu.RLock()
+	s := m.sessions[cid]
+	m.mu.RUnlock()
+	if s != nil {
+		return s
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.clients[cid]; ok {
-		return errors.New("exist cid")
+	if s = m.sessions[cid]; s == nil {
+		s = &session{store: m.newStore(cid)}
+		m.sessions[cid] = s
 	}
-	m.clients[cid] = m.newStore(cid)
-	return
+	return s
 }
 
-func (m *Manager) Del(cid string) (err error) {
+// Resume starts sending the inflight messages of a connected client again. A clean session
+// drops those of the previous session, otherwise they are written again at once. With retry
+// they are also written again by the retry policy until the client disconnects.
+// Messages out of attempts are passed to dead.
+func (m *Manager) Resume(cid string, clean bool, retry bool, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := m.session(cid)
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.clients, cid)
+	if s.stop != nil {
+		s.stop()
+	}
+	s.stop = cancel
+	m.mu.Unlock()
+	// a dead letter frees its packet ID
+	deadLetter := func(r *model.Record) {
+		dead(r)
+		s.drain()
+	}
+
+	s.mu.Lock()
+	s.write = write
+	if clean {
+		s.clean()
+	}
+	s.mu.Unlock()
+	if clean {
+		if err := s.store.Clean(); err != nil {
+			return err
+		}
+	} else if err := s.store.Resend(write, deadLetter); err != nil {
+		return err
+	}
+	s.drain()
+	if retry {
+		go s.store.Run(ctx, write, deadLetter)
+	}
 	return nil
 }
+
+// Del stops the retries of a disconnected client. When its session ends the store is closed
+// and its messages dropped, otherwise they are kept for the next connection. Ending the session
+// of a client unknown since a restart drops the messages a persistent store kept for it.
+func (m *Manager) Del(cid string, end bool) (err error) {
+	m.mu.Lock()
+	s := m.sessions[cid]
+	if s == nil && !end {
+		m.mu.Unlock()
+		return nil
+	}
+	if s == nil {
+		s = &session{store: m.newStore(cid)}
+	}
+	if end {
+		delete(m.sessions, cid)
+	}
+	stop := s.stop
+	s.stop = nil
+	m.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	s.mu.Lock()
+	s.write = nil
+	s.mu.Unlock()
+	if !end {
+		return nil
+	}
+	if err := s.store.Close(); err != nil {
+		return err
+	}
+	return s.store.Clean()
+}
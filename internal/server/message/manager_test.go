@@ -0,0 +1,156 @@
+package message
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	memStore "github.com/jin06/mercury/internal/server/message/store/memory"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newPublish(topic string) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = mqtt.QoS1
+	return p
+}
+
+func TestPublishQueuedWhenExhausted(t *testing.T) {
+	m := NewManager(nil, func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) }, config.SlowConsumer{})
+	var written []mqtt.Packet
+	write := func(p mqtt.Packet) error {
+		written = append(written, p)
+		return nil
+	}
+	if err := m.Resume("c1", false, false, write, func(*model.Record) {}); err != nil {
+		t.Fatal(err)
+	}
+	for range mqtt.MAX_PACKET_ID {
+		if r, err := m.Publish(newPublish("a"), "c1"); err != nil || r == nil {
+			t.Fatalf("unexpected result %v, %v", r, err)
+		}
+	}
+	// all IDs are inflight, the publishes wait in order
+	for _, topic := range []string{"b", "c"} {
+		if r, err := m.Publish(newPublish(topic), "c1"); err != nil || r != nil {
+			t.Fatalf("expected %s to be queued, got %v, %v", topic, r, err)
+		}
+	}
+	if err := m.Ack("c1", 7); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("expected 1 queued publish sent, got %v", written)
+	}
+	if p := written[0].(*mqtt.Publish); p.Topic != "b" || p.PacketID != 7 {
+		t.Fatalf("expected b with the freed packet ID 7, got %v", p)
+	}
+
+	// a disconnected client gets the rest when it is back
+	if err := m.Del("c1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Complete("c1", 9); err != nil {
+		t.Fatal(err)
+	}
+	written = nil
+	if err := m.Resume("c1", false, false, write, func(*model.Record) {}); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != int(mqtt.MAX_PACKET_ID) {
+		t.Fatalf("expected all inflight publishes again, got %d", len(written))
+	}
+	if p := written[len(written)-1].(*mqtt.Publish); p.Topic != "c" || p.PacketID != 9 {
+		t.Fatalf("expected c with the freed packet ID 9 last, got %v", p)
+	}
+
+	m.Del("c1", false)
+	written = nil
+	if err := m.Resume("c1", true, false, write, func(*model.Record) {}); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 0 {
+		t.Fatalf("clean session resumed with %d messages", len(written))
+	}
+	if r, err := m.Publish(newPublish("d"), "c1"); err != nil || r.Content.(*mqtt.Publish).PacketID != 1 {
+		t.Fatalf("expected packet ID 1 after the clean start, got %v, %v", r, err)
+	}
+}
+
+func TestSessionQueueBytes(t *testing.T) {
+	for _, policy := range []string{config.DropQoS0, config.DropOldest} {
+		// each queued publish counts its one byte topic
+		m := NewManager(nil, func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) },
+			config.SlowConsumer{Policy: policy, SessionQueueBytes: 2})
+		for range mqtt.MAX_PACKET_ID {
+			if _, err := m.Publish(newPublish("a"), "c1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, topic := range []string{"b", "c"} {
+			if _, err := m.Publish(newPublish(topic), "c1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := m.Publish(newPublish("d"), "c1")
+		if policy == config.DropOldest {
+			if err != nil {
+				t.Fatalf("%s: expected the oldest to be dropped, got %v", policy, err)
+			}
+		} else if !errors.Is(err, utils.ErrSessionQueueFull) {
+			t.Fatalf("%s: expected session queue full, got %v", policy, err)
+		}
+
+		var written []string
+		if err := m.Resume("c1", false, false, func(p mqtt.Packet) error {
+			written = append(written, p.(*mqtt.Publish).Topic.String())
+			return nil
+		}, func(*model.Record) {}); err != nil {
+			t.Fatal(err)
+		}
+		written = nil
+		m.Ack("c1", 1)
+		m.Ack("c1", 2)
+		m.Ack("c1", 3)
+		want := "bc"
+		if policy == config.DropOldest {
+			want = "cd"
+		}
+		if got := strings.Join(written, ""); got != want {
+			t.Errorf("%s: expected %s sent, got %s", policy, want, got)
+		}
+	}
+}
+
+func TestReleaseAfterDispatch(t *testing.T) {
+	m := NewManager(nil, func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) }, config.SlowConsumer{})
+	p := newPublish("a")
+	p.Qos, p.PacketID = mqtt.QoS2, 5
+	if err := m.Hold("c1", p, 0); err != nil {
+		t.Fatal(err)
+	}
+	failed := errors.New("dispatch failed")
+	if err := m.Release("c1", 5, func(*mqtt.Publish) error { return failed }); err != failed {
+		t.Fatalf("expected the dispatch error, got %v", err)
+	}
+	// the publish is kept for the PUBREL sent again, then released once
+	var dispatched []*mqtt.Publish
+	dispatch := func(p *mqtt.Publish) error {
+		dispatched = append(dispatched, p)
+		return nil
+	}
+	for range 2 {
+		if err := m.Release("c1", 5, dispatch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dispatched) != 1 || dispatched[0].Topic != "a" {
+		t.Fatalf("expected a dispatched once, got %v", dispatched)
+	}
+}
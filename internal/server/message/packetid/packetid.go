@@ -0,0 +1,113 @@
+// Package packetid allocates the packet identifiers of a session.
+package packetid
+
+import (
+	"sync"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Allocator hands out the packet IDs of one session round robin, IDs in use are skipped.
+// The message stores restore it with Use and SetNext when a session is resumed, so a
+// reconnected client never gets an ID that is still inflight.
+type Allocator struct {
+	mu   sync.Mutex
+	used *bitset.BitSet
+	// next is where the search for a free ID starts
+	next mqtt.PacketID
+}
+
+func New() *Allocator {
+	a := &Allocator{used: bitset.New(uint(mqtt.MAX_PACKET_ID) + 1)}
+	a.reset()
+	return a
+}
+
+// Get allocates the first free ID from the next one on, false when all IDs are in use.
+func (a *Allocator) Get() (mqtt.PacketID, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id, ok := a.used.NextClear(uint(a.next))
+	if !ok {
+		// 0 is never free, the search wraps to 1
+		if id, ok = a.used.NextClear(1); !ok {
+			return 0, false
+		}
+	}
+	a.used.Set(id)
+	a.next = next(mqtt.PacketID(id))
+	return mqtt.PacketID(id), true
+}
+
+// Use marks id as in use.
+func (a *Allocator) Use(id mqtt.PacketID) {
+	if id == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.used.Set(uint(id))
+}
+
+// Put frees id.
+func (a *Allocator) Put(id mqtt.PacketID) {
+	if id == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.used.Clear(uint(id))
+}
+
+// InUse reports whether id is allocated.
+func (a *Allocator) InUse(id mqtt.PacketID) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return id != 0 && a.used.Test(uint(id))
+}
+
+// Len is the number of IDs in use.
+func (a *Allocator) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// without the reserved 0
+	return int(a.used.Count()) - 1
+}
+
+// Next is the ID the next search starts at, the persistent stores save it with the session.
+func (a *Allocator) Next() mqtt.PacketID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.next
+}
+
+// SetNext restores the ID the next search starts at, 0 means 1.
+func (a *Allocator) SetNext(id mqtt.PacketID) {
+	if id == 0 {
+		id = 1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.next = id
+}
+
+// Reset frees all IDs, when the session is cleaned.
+func (a *Allocator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reset()
+}
+
+func (a *Allocator) reset() {
+	a.used.ClearAll()
+	a.used.Set(0)
+	a.next = 1
+}
+
+func next(id mqtt.PacketID) mqtt.PacketID {
+	if id >= mqtt.MAX_PACKET_ID {
+		return 1
+	}
+	return id + 1
+}
@@ -0,0 +1,54 @@
+package packetid
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestGetSkipsUsed(t *testing.T) {
+	a := New()
+	a.Use(2)
+	a.Use(3)
+	for _, want := range []mqtt.PacketID{1, 4, 5} {
+		if id, ok := a.Get(); !ok || id != want {
+			t.Fatalf("expected %d, got %d %v", want, id, ok)
+		}
+	}
+	// freed IDs are reused only after the search wrapped
+	a.Put(1)
+	if id, _ := a.Get(); id != 6 {
+		t.Fatalf("expected 6, got %d", id)
+	}
+	if n := a.Len(); n != 5 {
+		t.Fatalf("expected 5 IDs in use, got %d", n)
+	}
+}
+
+func TestWrapAndExhaustion(t *testing.T) {
+	a := New()
+	a.SetNext(mqtt.MAX_PACKET_ID)
+	if id, _ := a.Get(); id != mqtt.MAX_PACKET_ID {
+		t.Fatalf("expected %d, got %d", mqtt.MAX_PACKET_ID, id)
+	}
+	if id, _ := a.Get(); id != 1 {
+		t.Fatalf("expected the search to wrap to 1, got %d", id)
+	}
+	for a.Len() < int(mqtt.MAX_PACKET_ID) {
+		if _, ok := a.Get(); !ok {
+			t.Fatalf("exhausted after %d IDs", a.Len())
+		}
+	}
+	if id, ok := a.Get(); ok {
+		t.Fatalf("expected exhaustion, got %d", id)
+	}
+	a.Put(100)
+	if id, ok := a.Get(); !ok || id != 100 {
+		t.Fatalf("expected the freed 100, got %d %v", id, ok)
+	}
+
+	a.Reset()
+	if id, _ := a.Get(); id != 1 || a.Len() != 1 {
+		t.Fatalf("expected 1 after reset, got %d", id)
+	}
+}
@@ -0,0 +1,95 @@
+// Package retry decides when the message stores send unacknowledged messages again.
+package retry
+
+import (
+	"math"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// ReasonMaxAttempts is the failure reason of the messages sent MaxAttempts times.
+const ReasonMaxAttempts = "max attempts exceeded"
+
+const defaultInitialDelay = time.Second * 5
+
+// Policy is the retry policy of config.Retry, the zero value resends every 5 seconds forever.
+type Policy struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+func New(cfg config.Retry) Policy {
+	return Policy{
+		InitialDelay: cfg.InitialDelay,
+		Multiplier:   cfg.Multiplier,
+		MaxDelay:     cfg.MaxDelay,
+		MaxAttempts:  cfg.MaxAttempts,
+	}
+}
+
+// Interval is how often the stores look for records that are due.
+func (p Policy) Interval() time.Duration {
+	if p.InitialDelay <= 0 {
+		return defaultInitialDelay
+	}
+	return p.InitialDelay
+}
+
+// Delay is the wait for an acknowledgement after a message was resent times times.
+func (p Policy) Delay(times uint64) time.Duration {
+	d := float64(p.Interval())
+	if p.Multiplier > 1 {
+		d *= math.Pow(p.Multiplier, float64(times))
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	if d > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// Next is when r is due to be sent again.
+func (p Policy) Next(r *model.Record) time.Time {
+	return r.Send.Add(p.Delay(r.Times))
+}
+
+// Due reports whether r waited long enough for its acknowledgement at now.
+func (p Policy) Due(r *model.Record, now time.Time) bool {
+	return !p.Next(r).After(now)
+}
+
+// Exhausted reports whether r was sent MaxAttempts times.
+func (p Policy) Exhausted(r *model.Record) bool {
+	return p.MaxAttempts > 0 && r.Times+1 >= uint64(p.MaxAttempts)
+}
+
+// Resend writes r again and counts the attempt. It returns false without writing when r has
+// no attempts left, the store then removes it and hands it to the dead letter handler.
+func (p Policy) Resend(r *model.Record, write func(mqtt.Packet) error) (bool, error) {
+	if p.Exhausted(r) {
+		return false, nil
+	}
+	if err := write(Dup(r.Content)); err != nil {
+		return true, err
+	}
+	r.Times++
+	r.Send = time.Now()
+	return true, nil
+}
+
+// Dup returns the packet to send again, publishes are marked as duplicates.
+func Dup(p mqtt.Packet) mqtt.Packet {
+	if publish, ok := p.(*mqtt.Publish); ok && !publish.Dup {
+		publish = publish.Clone()
+		publish.Dup = true
+		return publish
+	}
+	return p
+}
@@ -0,0 +1,62 @@
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	for times, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if d := p.Delay(uint64(times)); d != want {
+			t.Errorf("delay after %d resends: expected %v, got %v", times, want, d)
+		}
+	}
+	// no cap does not overflow
+	p.MaxDelay = 0
+	if d := p.Delay(1000); d <= 0 {
+		t.Errorf("unexpected delay %v", d)
+	}
+	if d := (Policy{}).Delay(3); d != defaultInitialDelay {
+		t.Errorf("zero policy: expected %v, got %v", defaultInitialDelay, d)
+	}
+}
+
+func TestResend(t *testing.T) {
+	p := Policy{InitialDelay: time.Minute, MaxAttempts: 2}
+	publish := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	publish.Qos = mqtt.QoS1
+	r := model.NewRecord("c1", publish, 0)
+	if p.Due(r, time.Now()) {
+		t.Fatal("record due before the initial delay")
+	}
+	if !p.Due(r, time.Now().Add(time.Minute)) {
+		t.Fatal("record not due after the initial delay")
+	}
+
+	var written mqtt.Packet
+	ok, err := p.Resend(r, func(p mqtt.Packet) error {
+		written = p
+		return nil
+	})
+	if !ok || err != nil {
+		t.Fatalf("unexpected result %v, %v", ok, err)
+	}
+	if dup := written.(*mqtt.Publish); !dup.Dup || publish.Dup {
+		t.Fatal("expected a duplicate copy of the publish")
+	}
+	if r.Times != 1 {
+		t.Fatalf("expected 1 resend, got %d", r.Times)
+	}
+	// sent twice, which is MaxAttempts
+	ok, err = p.Resend(r, func(p mqtt.Packet) error {
+		t.Fatal("exhausted record written")
+		return nil
+	})
+	if ok || err != nil {
+		t.Fatalf("unexpected result %v, %v", ok, err)
+	}
+}
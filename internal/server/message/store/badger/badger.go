@@ -3,36 +3,75 @@ package badgerStore
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/logger"
 	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/packetid"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/utils"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-var (
-	def             *badger.DB
-	packetIDKey     = "packetid:%s"  // -> packetid:{clientID}
-	recordKey       = "record:%s:%d" // -> record:{clientID}:{PacketID}
-	recordPrefixKey = "record:%s"
+// Keys start with their kind and the length prefixed client ID, so the keys of a client never
+// share a prefix with those of another client:
+//
+//	recordKind   {len(clientID)}{clientID}{packetID} -> encoded record
+//	packetIDKind {len(clientID)}{clientID}           -> packet ID the allocator searches from
+//	heldKind     {len(clientID)}{clientID}{packetID} -> encoded record of a held incoming publish
+//	historyKind  {len(prefix)}{prefix}{unix nano}    -> encoded record of a kept message, see History
+const (
+	recordKind   byte = 1
+	packetIDKind byte = 2
+	heldKind     byte = 3
+	historyKind  byte = 4
 )
 
-func Init(options config.BadgerConfig) (err error) {
-	def, err = badger.Open(badger.DefaultOptions(options.Dir))
-	return
+// indexCacheSize bounds the memory of the table indices, badger keeps them decrypted in memory
+// when the database is encrypted.
+const indexCacheSize = 100 << 20
+
+// Open opens the database shared by the stores of all clients. With an encryption key badger
+// encrypts everything it writes, the key registry is rotated from an old key first.
+func Open(options config.BadgerConfig) (*badger.DB, error) {
+	opts := badger.DefaultOptions(options.Dir).WithLoggingLevel(badger.WARNING)
+	enc := options.Encryption
+	key, err := LoadKey(enc.KeyFile, enc.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		old, err := LoadKey(enc.OldKeyFile, enc.OldKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		if old != nil {
+			if err := rotate(options.Dir, old, key); err != nil {
+				return nil, err
+			}
+		}
+		opts = opts.WithEncryptionKey(key).WithIndexCacheSize(indexCacheSize)
+		if enc.DataKeyRotation > 0 {
+			opts = opts.WithEncryptionKeyRotationDuration(enc.DataKeyRotation)
+		}
+	}
+	return badger.Open(opts)
 }
 
-func New(cid string) *badgerStore {
+// New creates the store of a client, a non nil envelope encrypts its records.
+func New(db *badger.DB, envelope *Envelope, cid string, expiry time.Duration, policy retry.Policy) *badgerStore {
 	s := &badgerStore{
-		options:        config.Def.MessageStore.BadgerConfig,
-		db:             def,
-		cid:            cid,
-		resendDuration: time.Second * 5,
-		expiry:         config.Def.MQTTConfig.MessageExpiryInterval,
-		closing:        make(chan struct{}),
+		db:       db,
+		envelope: envelope,
+		cid:      cid,
+		ids:      packetid.New(),
+		policy:   policy,
+		expiry:   expiry,
+		closing:  make(chan struct{}),
 	}
 	return s
 }
@@ -51,17 +90,21 @@ func New(cid string) *badgerStore {
 // }
 
 type badgerStore struct {
-	options        config.BadgerConfig
-	db             *badger.DB
-	cid            string
-	expiry         time.Duration
-	resendDuration time.Duration
+	db       *badger.DB
+	envelope *Envelope
+	cid      string
+	expiry   time.Duration
+	policy   retry.Policy
+	// ids is restored from the records of the session by load, mu guards it while loading
+	ids    *packetid.Allocator
+	loaded bool
+	mu     sync.Mutex
 	// delivery       chan *model.Record
 	closing chan struct{}
 }
 
-func (s *badgerStore) Run(ctx context.Context, ch chan mqtt.Packet) error {
-	ticker := time.NewTicker(s.resendDuration)
+func (s *badgerStore) Run(ctx context.Context, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	ticker := time.NewTicker(s.policy.Interval())
 	defer ticker.Stop()
 	for {
 		select {
@@ -70,48 +113,112 @@ func (s *badgerStore) Run(ctx context.Context, ch chan mqtt.Packet) error {
 		case <-s.closing:
 			return nil
 		case <-ticker.C:
-			s.resend(ch)
+			if err := s.resend(false, write, dead); err != nil {
+				logger.Error(err)
+			}
 		}
 	}
 }
 
-func (store *badgerStore) resend(ch chan mqtt.Packet) {
-	store.db.View(func(txn *badger.Txn) error {
-		prefix := store.getRecordPrefix()
+func (s *badgerStore) Resend(write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	return s.resend(true, write, dead)
+}
+
+// resend writes the records that are due again, or all of them, and saves their send count.
+// Records out of attempts are removed and passed to dead.
+func (store *badgerStore) resend(all bool, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	now := time.Now()
+	var records []*model.Record
+	err := store.db.View(func(txn *badger.Txn) error {
+		prefix := store.recordPrefix()
 		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = true
 		opts.Prefix = prefix
-
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
 			if err != nil {
-				logger.Error(err)
-				continue
+				return err
 			}
-			record, err := decodeRecord(v)
+			record, err := decode(store.envelope, v)
 			if err != nil {
 				logger.Error(err)
 				continue
 			}
-			ch <- record.Content
-			record.Times++
+			if all || store.policy.Due(record, now) {
+				records = append(records, record)
+			}
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		ok, err := store.policy.Resend(record, write)
+		if err != nil {
+			return err
+		}
+		key := store.recordKey(packetID(record.Content))
+		acked := false
+		if err := store.db.Update(func(txn *badger.Txn) error {
+			// acknowledged while it was written
+			if _, err := txn.Get(key); err != nil {
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					acked = true
+					return nil
+				}
+				return err
+			}
+			if !ok {
+				return txn.Delete(key)
+			}
+			return store.set(txn, record)
+		}); err != nil {
+			return err
+		}
+		if !ok && !acked {
+			store.free(packetID(record.Content))
+			dead(record)
+		}
+	}
+	return nil
 }
 
-func (store *badgerStore) Clean() (err error) {
-	if err = store.db.DropPrefix([]byte(store.getRecordPrefix())); err != nil {
-		return
+func (store *badgerStore) Clean() error {
+	keys := [][]byte{store.packetIDKey()}
+	err := store.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range [][]byte{store.recordPrefix(), clientKey(heldKind, store.cid)} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := store.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
 	}
-	if err = store.db.DropPrefix([]byte(store.getPacketIDKey())); err != nil {
-		return
+	if err := wb.Flush(); err != nil {
+		return err
 	}
-	return
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.ids.Reset()
+	store.loaded = true
+	return nil
 }
 
 func (store *badgerStore) Publish(p *mqtt.Publish) (*model.Record, error) {
@@ -122,162 +229,321 @@ func (store *badgerStore) Ack(pid mqtt.PacketID) error {
 	return store.delete(pid)
 }
 
+// Receive replaces the PUBLISH of the record with the PUBREL sent after its PUBREC.
 func (store *badgerStore) Receive(p *mqtt.Pubrel) error {
-	return store.update(p)
-}
-
-func (store *badgerStore) Release(p *mqtt.Pubcomp) error {
-	return store.delete(p.PacketID)
-	// return nil
-	// return store.update(p)
-}
-
-func (store *badgerStore) Complete(pid mqtt.PacketID) error {
-	return store.delete(pid)
+	return store.db.Update(func(txn *badger.Txn) error {
+		record, err := store.get(txn, p.PacketID)
+		if record == nil || err != nil {
+			return err
+		}
+		record.Content = p
+		return store.set(txn, record)
+	})
 }
 
-func (store *badgerStore) create(p *mqtt.Publish) (record *model.Record, err error) {
-	if p.Qos.Zero() {
-		return model.NewRecord(store.cid, p.Clone(), store.expiry), nil
+func (store *badgerStore) Hold(p *mqtt.Publish) (held bool, err error) {
+	buf, err := encode(store.envelope, model.NewRecord(store.cid, p, 0))
+	if err != nil {
+		return false, err
 	}
-	err = store.db.Update(func(txn *badger.Txn) (err error) {
-		var currentID mqtt.PacketID
-
-		item, err := txn.Get([]byte(store.getPacketIDKey()))
-
-		switch err {
-		case badger.ErrKeyNotFound:
-			currentID = 1
-			err = nil
-		case nil:
-			if val, err := item.ValueCopy(nil); err != nil {
-				return err
-			} else {
-				if err = currentID.Decode(val); err != nil {
-					return err
-				}
-			}
-		default:
+	key := store.heldKey(p.PacketID)
+	err = store.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(key); err == nil {
+			return nil
+		} else if !errors.Is(err, badger.ErrKeyNotFound) {
 			return err
 		}
+		held = true
+		return txn.Set(key, buf)
+	})
+	return held && err == nil, err
+}
 
-		if currentID == 0 || currentID > mqtt.MAX_PACKET_ID {
-			currentID = 1
+func (store *badgerStore) Peek(pid mqtt.PacketID) (p *mqtt.Publish, err error) {
+	err = store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(store.heldKey(pid))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
 		}
-		nextID := currentID + 1
-		np := p.Clone()
-		np.PacketID = currentID
-		record = model.NewRecord(store.cid, np, config.Def.MQTTConfig.MessageExpiryInterval)
-		buf, err := encodeRecord(record)
 		if err != nil {
 			return err
 		}
-		if err = txn.Set([]byte(store.getRecordKey(currentID)), buf); err != nil {
-			return
-		}
-		if err = txn.Set([]byte(store.getPacketIDKey()), nextID.Encode()); err != nil {
-			return
-		}
-		return
+		return item.Value(func(v []byte) error {
+			record, err := decode(store.envelope, v)
+			if err != nil {
+				return err
+			}
+			p, _ = record.Content.(*mqtt.Publish)
+			return nil
+		})
 	})
-	return
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-func (store *badgerStore) update(p mqtt.Message) error {
-	err := store.db.Update(func(txn *badger.Txn) (err error) {
-		currentID := p.PID()
-		r := model.NewRecord(store.cid, p, store.expiry)
-		buf, err := encodeRecord(r)
+func (store *badgerStore) Release(pid mqtt.PacketID) (p *mqtt.Publish, err error) {
+	key := store.heldKey(pid)
+	err = store.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
 		if err != nil {
 			return err
 		}
-		return txn.Set([]byte(store.getRecordKey(currentID)), buf)
+		record, err := decode(store.envelope, v)
+		if err != nil {
+			return err
+		}
+		p, _ = record.Content.(*mqtt.Publish)
+		return txn.Delete(key)
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-func (store *badgerStore) delete(pid mqtt.PacketID) error {
-	return store.db.DropPrefix([]byte(store.getRecordKey(pid)))
+func (store *badgerStore) Held() (n int, err error) {
+	err = store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = clientKey(heldKind, store.cid)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return
 }
 
-func (store *badgerStore) getPacketIDKey() string {
-	return fmt.Sprintf(packetIDKey, store.cid)
+func (store *badgerStore) Records(fn func(r *model.Record, held bool) error) error {
+	return store.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range [][]byte{store.recordPrefix(), clientKey(heldKind, store.cid)} {
+			held := prefix[0] == heldKind
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				v, err := it.Item().ValueCopy(nil)
+				if err == nil {
+					var record *model.Record
+					if record, err = decode(store.envelope, v); err == nil {
+						err = fn(record, held)
+					}
+				}
+				if err != nil {
+					it.Close()
+					return err
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
 }
 
-func (store *badgerStore) getRecordKey(packetID mqtt.PacketID) string {
-	return fmt.Sprintf(recordKey, store.cid, packetID)
+func (store *badgerStore) Restore(r *model.Record) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(false); err != nil {
+		return err
+	}
+	if err := store.db.Update(func(txn *badger.Txn) error {
+		return store.set(txn, r)
+	}); err != nil {
+		return err
+	}
+	store.ids.Use(packetID(r.Content))
+	return nil
 }
 
-func (store *badgerStore) getRecordPrefix() []byte {
-	return []byte(fmt.Sprintf(recordPrefixKey, store.cid))
+func (store *badgerStore) Complete(pid mqtt.PacketID) error {
+	return store.delete(pid)
 }
 
-func encodeRecord(r *model.Record) ([]byte, error) {
-	data := []byte{}
-	data = append(data, byte(r.Version))
-	data = binary.BigEndian.AppendUint64(data, r.Times)
-	data = binary.BigEndian.AppendUint64(data, uint64(r.Expiry))
-	if raw, err := mqtt.EncodeUTF8(r.ClientID); err != nil {
-		return nil, err
-	} else {
-		data = append(data, raw...)
+func (store *badgerStore) create(p *mqtt.Publish) (record *model.Record, err error) {
+	if p.Qos.Zero() {
+		return model.NewRecord(store.cid, p.Clone(), store.expiry), nil
 	}
-	if raw, err := r.Receive.MarshalBinary(); err != nil {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(false); err != nil {
 		return nil, err
-	} else {
-		data = append(data, raw...)
 	}
-	if raw, err := r.Send.MarshalBinary(); err != nil {
-		return nil, err
-	} else {
-		data = append(data, raw...)
+	id, ok := store.ids.Get()
+	if !ok {
+		// records that expired in the meantime free their IDs
+		if err := store.load(true); err != nil {
+			return nil, err
+		}
+		if id, ok = store.ids.Get(); !ok {
+			return nil, utils.ErrPacketIDExhausted
+		}
 	}
-	if raw, err := r.Content.Encode(); err != nil {
+	err = store.db.Update(func(txn *badger.Txn) error {
+		np := p.Clone()
+		np.PacketID = id
+		record = model.NewRecord(store.cid, np, store.expiry)
+		if err := store.set(txn, record); err != nil {
+			return err
+		}
+		return txn.Set(store.packetIDKey(), store.ids.Next().Encode())
+	})
+	if err != nil {
+		store.ids.Put(id)
 		return nil, err
-	} else {
-		data = append(data, raw...)
 	}
-	return data, nil
+	return record, nil
 }
 
-func decodeRecord(data []byte) (*model.Record, error) {
-	r := &model.Record{}
-	i := 0
+// load restores the packet IDs in use from the records of the session, the first time or
+// again with reload. store.mu must be held.
+func (store *badgerStore) load(reload bool) error {
+	if store.loaded && !reload {
+		return nil
+	}
+	next := store.ids.Next()
+	store.ids.Reset()
+	err := store.db.View(func(txn *badger.Txn) error {
+		if !store.loaded {
+			item, err := txn.Get(store.packetIDKey())
+			switch {
+			case errors.Is(err, badger.ErrKeyNotFound):
+			case err != nil:
+				return err
+			default:
+				if err := item.Value(func(val []byte) error { return next.Decode(val) }); err != nil {
+					return err
+				}
+			}
+		}
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = store.recordPrefix()
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			store.ids.Use(mqtt.PacketID(binary.BigEndian.Uint16(key[len(key)-2:])))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	store.ids.SetNext(next)
+	store.loaded = true
+	return nil
+}
 
-	r.Version = mqtt.ProtocolVersion(data[i])
-	i++
+// free returns the packet ID of a removed record to the allocator.
+func (store *badgerStore) free(pid mqtt.PacketID) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.ids.Put(pid)
+}
 
-	r.Times = binary.BigEndian.Uint64(data[i:])
-	i += 8
+func (store *badgerStore) get(txn *badger.Txn, pid mqtt.PacketID) (*model.Record, error) {
+	item, err := txn.Get(store.recordKey(pid))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return decode(store.envelope, v)
+}
 
-	r.Expiry = time.Duration(binary.BigEndian.Uint64(data[i:]))
-	i += 8
+// set saves record, a PUBLISH expires with the message expiry interval counted from its receive
+// time. A PUBREL never expires, the message was delivered and the client waits for its PUBCOMP.
+func (store *badgerStore) set(txn *badger.Txn, record *model.Record) error {
+	buf, err := encode(store.envelope, record)
+	if err != nil {
+		return err
+	}
+	key := store.recordKey(packetID(record.Content))
+	if _, ok := record.Content.(*mqtt.Publish); !ok || record.Expiry <= 0 {
+		return txn.Set(key, buf)
+	}
+	ttl := time.Until(record.Receive.Add(record.Expiry))
+	if ttl <= 0 {
+		return txn.Delete(key)
+	}
+	return txn.SetEntry(badger.NewEntry(key, buf).WithTTL(ttl))
+}
 
-	if clientID, n, err := mqtt.DecodeUTF8(data[i:]); err != nil {
-		return nil, err
-	} else {
-		r.ClientID = clientID
-		i += n
+// encode serializes record, sealed by the envelope if there is one.
+func encode(envelope *Envelope, record *model.Record) ([]byte, error) {
+	buf, err := record.Encode()
+	if err != nil || envelope == nil {
+		return buf, err
 	}
+	return envelope.Seal(buf)
+}
 
-	// Receive time.Time (binary, variable length, so use UnmarshalBinary)
-	if err := r.Receive.UnmarshalBinary(data[i : i+15]); err != nil { // 15 is typical size, adjust as needed
-		return nil, err
+// decode parses a value of encode. Records stored before the envelope was enabled are read too.
+func decode(envelope *Envelope, v []byte) (*model.Record, error) {
+	if envelope != nil {
+		buf, err := envelope.Open(v)
+		if err != nil {
+			return nil, err
+		}
+		v = buf
 	}
-	i += 15
+	return model.DecodeRecord(v)
+}
 
-	// Send time.Time
-	if err := r.Send.UnmarshalBinary(data[i : i+15]); err != nil {
-		return nil, err
+func (store *badgerStore) delete(pid mqtt.PacketID) error {
+	if err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(store.recordKey(pid))
+	}); err != nil {
+		return err
 	}
-	i += 15
+	store.free(pid)
+	return nil
+}
 
-	if packet, err := mqtt.Decode(r.Version, data[i:]); err != nil {
-		return nil, err
-	} else {
-		r.Content = packet
+func (store *badgerStore) packetIDKey() []byte {
+	return clientKey(packetIDKind, store.cid)
+}
+
+func (store *badgerStore) recordKey(pid mqtt.PacketID) []byte {
+	return binary.BigEndian.AppendUint16(store.recordPrefix(), uint16(pid))
+}
+
+func (store *badgerStore) heldKey(pid mqtt.PacketID) []byte {
+	return binary.BigEndian.AppendUint16(clientKey(heldKind, store.cid), uint16(pid))
+}
+
+func (store *badgerStore) recordPrefix() []byte {
+	return clientKey(recordKind, store.cid)
+}
+
+func clientKey(kind byte, cid string) []byte {
+	key := make([]byte, 0, 3+len(cid)+2)
+	key = append(key, kind)
+	key = binary.BigEndian.AppendUint16(key, uint16(len(cid)))
+	return append(key, cid...)
+}
+
+func packetID(p mqtt.Packet) mqtt.PacketID {
+	if m, ok := p.(mqtt.Message); ok {
+		return m.PID()
 	}
-	return r, nil
+	return 0
 }
 
 func (b *badgerStore) Close() error {
@@ -0,0 +1,278 @@
+package badgerStore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func openTestDB(t *testing.T, dir string) *badger.DB {
+	db, err := Open(config.BadgerConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newPublish(topic string, qos mqtt.QoS) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Payload = []byte("payload")
+	return p
+}
+
+// inflight resends the records of s and returns them by packet ID.
+func inflight(t *testing.T, s *badgerStore) map[mqtt.PacketID]mqtt.Packet {
+	packets := map[mqtt.PacketID]mqtt.Packet{}
+	if err := s.Resend(func(p mqtt.Packet) error {
+		packets[packetID(p)] = p
+		return nil
+	}, func(r *model.Record) { t.Errorf("unexpected dead letter %v", r.Content) }); err != nil {
+		t.Fatal(err)
+	}
+	return packets
+}
+
+func record(t *testing.T, s *badgerStore, pid mqtt.PacketID) *model.Record {
+	var r *model.Record
+	if err := s.db.View(func(txn *badger.Txn) (err error) {
+		r, err = s.get(txn, pid)
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	s := New(db, nil, "c1", time.Hour, retry.Policy{})
+	for range 20 {
+		if _, err := s.Publish(newPublish("a", mqtt.QoS2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a client ID sharing the prefix of the other one
+	other := New(db, nil, "c10", time.Hour, retry.Policy{})
+	if _, err := other.Publish(newPublish("b", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	pubrel := &mqtt.Pubrel{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBREL}, Version: mqtt.MQTT5}, PacketID: 2}
+	if err := s.Receive(pubrel); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(inflight(t, s)); n != 19 {
+		t.Fatalf("expected 19 inflight records after the ack of 1, got %d", n)
+	}
+	// the broker stops without cleaning the session
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	s = New(db, nil, "c1", time.Hour, retry.Policy{})
+	packets := inflight(t, s)
+	if len(packets) != 19 || packets[1] != nil {
+		t.Fatalf("unexpected inflight records after restart %v", packets)
+	}
+	if _, ok := packets[2].(*mqtt.Pubrel); !ok {
+		t.Fatalf("expected PUBREL for packet 2, got %T", packets[2])
+	}
+	if p, ok := packets[3].(*mqtt.Publish); !ok || p.Topic != "a" || string(p.Payload) != "payload" {
+		t.Fatalf("unexpected packet 3 %v", packets[3])
+	}
+	// both resends were saved
+	if r := record(t, s, 3); r.Times != 2 || r.ClientID != "c1" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	r, err := s.Publish(newPublish("a", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := packetID(r.Content); id != 21 {
+		t.Fatalf("expected packet ID 21 after restart, got %d", id)
+	}
+	if n := len(inflight(t, New(db, nil, "c10", time.Hour, retry.Policy{}))); n != 1 {
+		t.Fatalf("expected 1 inflight record of c10, got %d", n)
+	}
+}
+
+func TestPacketIDAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	s := New(db, nil, "c1", time.Hour, retry.Policy{})
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	s.ids.SetNext(mqtt.MAX_PACKET_ID)
+	if r, err := s.Publish(newPublish("b", mqtt.QoS1)); err != nil || packetID(r.Content) != mqtt.MAX_PACKET_ID {
+		t.Fatalf("expected packet ID %d, got %v, %v", mqtt.MAX_PACKET_ID, r, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the search continues at 1 after the restart, which is still inflight
+	db = openTestDB(t, dir)
+	defer db.Close()
+	s = New(db, nil, "c1", time.Hour, retry.Policy{})
+	r, err := s.Publish(newPublish("c", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := packetID(r.Content); id != 2 {
+		t.Fatalf("expected packet ID 2, got %d", id)
+	}
+	if n := s.ids.Len(); n != 3 {
+		t.Fatalf("expected 3 packet IDs in use, got %d", n)
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if s.ids.InUse(1) {
+		t.Fatal("acknowledged packet ID still in use")
+	}
+}
+
+func TestHoldAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	s := New(db, nil, "c1", time.Hour, retry.Policy{})
+	p := newPublish("a", mqtt.QoS2)
+	p.PacketID = 7
+	if held, err := s.Hold(p); err != nil || !held {
+		t.Fatalf("expected the publish held, got %v, %v", held, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openTestDB(t, dir)
+	defer db.Close()
+	s = New(db, nil, "c1", time.Hour, retry.Policy{})
+	// the DUP sent after the reconnect is not held again
+	if held, err := s.Hold(p); err != nil || held {
+		t.Fatalf("expected the DUP not held, got %v, %v", held, err)
+	}
+	if n, err := s.Held(); err != nil || n != 1 {
+		t.Fatalf("expected 1 held publish, got %d, %v", n, err)
+	}
+	released, err := s.Release(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released == nil || released.Topic != "a" || string(released.Payload) != "payload" {
+		t.Fatalf("unexpected released publish %v", released)
+	}
+	if released, err := s.Release(7); err != nil || released != nil {
+		t.Fatalf("released twice %v, %v", released, err)
+	}
+
+	if _, err := s.Hold(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Held(); n != 0 {
+		t.Fatalf("expected no held publishes after clean, got %d", n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	s := New(db, nil, "c1", time.Minute, retry.Policy{})
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(s.recordKey(1))
+		if err != nil {
+			return err
+		}
+		if expires := time.Unix(int64(item.ExpiresAt()), 0); time.Until(expires) > time.Minute || time.Until(expires) < 50*time.Second {
+			t.Errorf("unexpected expiry %v", expires)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// records past their expiry are not saved again
+	r := record(t, s, 1)
+	r.Receive = time.Now().Add(-time.Hour)
+	if err := db.Update(func(txn *badger.Txn) error { return s.set(txn, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if record(t, s, 1) != nil {
+		t.Fatal("expired record kept")
+	}
+
+	// the PUBREL of a delivered QoS 2 message is kept past the expiry
+	r, err := s.Publish(newPublish("a", mqtt.QoS2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := packetID(r.Content)
+	pubrel := &mqtt.Pubrel{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBREL}, Version: mqtt.MQTT5}, PacketID: pid}
+	if err := s.Receive(pubrel); err != nil {
+		t.Fatal(err)
+	}
+	r = record(t, s, pid)
+	r.Receive = time.Now().Add(-time.Hour)
+	if err := db.Update(func(txn *badger.Txn) error { return s.set(txn, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(s.recordKey(pid))
+		if err != nil {
+			return err
+		}
+		if item.ExpiresAt() != 0 {
+			t.Error("PUBREL saved with an expiry")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClean(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	s, other := New(db, nil, "c1", 0, retry.Policy{}), New(db, nil, "c10", 0, retry.Policy{})
+	for _, store := range []*badgerStore{s, s, other} {
+		if _, err := store.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(inflight(t, s)); n != 0 {
+		t.Fatalf("expected no records after clean, got %d", n)
+	}
+	if err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(s.packetIDKey())
+		return err
+	}); !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("packet ID counter left after clean: %v", err)
+	}
+	if n := len(inflight(t, other)); n != 1 {
+		t.Fatalf("clean removed the records of another client")
+	}
+}
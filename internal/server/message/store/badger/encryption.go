@@ -0,0 +1,309 @@
+package badgerStore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+var (
+	ErrNoKey             = errors.New("encryption key file or environment variable is empty")
+	ErrUnknownKey        = errors.New("message sealed with an unknown key")
+	ErrEnvelopeTruncated = errors.New("truncated envelope")
+)
+
+// LoadKey reads a key from file, or from the environment variable env when file is
+// empty. It returns nil when both are empty.
+func LoadKey(file, env string) ([]byte, error) {
+	var raw []byte
+	switch {
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		raw = data
+	case env != "":
+		raw = []byte(os.Getenv(env))
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrNoKey, env)
+		}
+	default:
+		return nil, nil
+	}
+	return parseKey(raw)
+}
+
+// parseKey accepts the key raw or hex or base64 encoded, with surrounding white space.
+func parseKey(raw []byte) ([]byte, error) {
+	if validKey(raw) {
+		return raw, nil
+	}
+	text := string(bytes.TrimSpace(raw))
+	if validKey([]byte(text)) {
+		return []byte(text), nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && validKey(key) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && validKey(key) {
+		return key, nil
+	}
+	return nil, badger.ErrInvalidEncryptionKey
+}
+
+func validKey(key []byte) bool {
+	return len(key) == 16 || len(key) == 24 || len(key) == 32
+}
+
+// rotate encrypts the key registry of the database in dir, which holds its data keys, with
+// key instead of old. A registry already encrypted with key is left as it is.
+func rotate(dir string, old, key []byte) error {
+	if _, err := os.Stat(filepath.Join(dir, badger.KeyRegistryFileName)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	opt := badger.KeyRegistryOptions{Dir: dir, ReadOnly: true, EncryptionKey: old}
+	kr, err := badger.OpenKeyRegistry(opt)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	opt.EncryptionKey = key
+	return badger.WriteKeyRegistry(kr, opt)
+}
+
+// envelopeEncoding is the first byte of a sealed value, encoded records start with their
+// encoding version 1 and json values with '{', so values stored before the envelope was
+// enabled are still read.
+//
+//	{envelopeEncoding}{key ID}{nonce}{data key sealed by the master key}{nonce}{sealed value}
+const envelopeEncoding byte = 0x80
+
+const dataKeySize = 32
+
+// Envelope encrypts each value with a random data key, the data key is stored with the value,
+// encrypted by the master key. Values sealed with an old master key are opened as long as it
+// is known.
+type Envelope struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+// NewEnvelope seals with key, old keys are only used to open values.
+func NewEnvelope(key []byte, old ...[]byte) (*Envelope, error) {
+	e := &Envelope{keys: map[uint32]cipher.AEAD{}}
+	for i, k := range append([][]byte{key}, old...) {
+		if k == nil {
+			continue
+		}
+		aead, err := newAEAD(k)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(k)
+		if i == 0 {
+			e.current = id
+		}
+		e.keys[id] = aead
+	}
+	return e, nil
+}
+
+// OpenEnvelope loads the keys of the envelope of cfg, nil when it is disabled.
+func OpenEnvelope(cfg config.Encryption) (*Envelope, error) {
+	if !cfg.Envelope {
+		return nil, nil
+	}
+	key, err := LoadKey(cfg.KeyFile, cfg.KeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrNoKey
+	}
+	old, err := LoadKey(cfg.OldKeyFile, cfg.OldKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvelope(key, old)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyID identifies a master key without revealing it.
+func keyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:])
+}
+
+func (e *Envelope) Seal(value []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := e.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	mark := len(buf)
+	if buf, err = appendNonce(buf, data.NonceSize()); err != nil {
+		return nil, err
+	}
+	return data.Seal(buf, buf[mark:], value, nil), nil
+}
+
+// Open returns the value sealed by Seal, values that are not sealed are returned as they are.
+func (e *Envelope) Open(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != envelopeEncoding {
+		return buf, nil
+	}
+	dataKey, rest, err := e.unwrap(buf)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < data.NonceSize() {
+		return nil, ErrEnvelopeTruncated
+	}
+	return data.Open(nil, rest[:data.NonceSize()], rest[data.NonceSize():], nil)
+}
+
+// Rewrap seals the data key of buf with the current master key, nil when it already is. A value
+// written before the envelope was enabled is sealed.
+func (e *Envelope) Rewrap(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != envelopeEncoding {
+		return e.Seal(buf)
+	}
+	if len(buf) < 5 || binary.BigEndian.Uint32(buf[1:]) == e.current {
+		return nil, nil
+	}
+	dataKey, rest, err := e.unwrap(buf)
+	if err != nil {
+		return nil, err
+	}
+	out, err := e.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, rest...), nil
+}
+
+// wrap returns the head of a sealed value, the data key sealed by the current master key.
+func (e *Envelope) wrap(dataKey []byte) ([]byte, error) {
+	master := e.keys[e.current]
+	buf := []byte{envelopeEncoding}
+	buf = binary.BigEndian.AppendUint32(buf, e.current)
+	// the key ID is authenticated with the data key
+	header := slices.Clone(buf)
+	buf, err := appendNonce(buf, master.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return master.Seal(buf, buf[len(header):], dataKey, header), nil
+}
+
+// unwrap opens the data key of the sealed value buf and returns it with the rest of buf.
+func (e *Envelope) unwrap(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 5 {
+		return nil, nil, ErrEnvelopeTruncated
+	}
+	master := e.keys[binary.BigEndian.Uint32(buf[1:])]
+	if master == nil {
+		return nil, nil, ErrUnknownKey
+	}
+	header, rest := buf[:5], buf[5:]
+	n := master.NonceSize()
+	sealed := dataKeySize + master.Overhead()
+	if len(rest) < n+sealed {
+		return nil, nil, ErrEnvelopeTruncated
+	}
+	dataKey, err := master.Open(nil, rest[:n], rest[n:n+sealed], header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, rest[n+sealed:], nil
+}
+
+func appendNonce(buf []byte, size int) ([]byte, error) {
+	nonce := make([]byte, size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return append(buf, nonce...), nil
+}
+
+// Rewrap seals the data keys of the records of all clients, of the history and of the values of
+// the other kinds sealed by an old master key with the current one, so the old key is not needed
+// anymore once a rotation finished. The values written before the envelope was enabled are sealed.
+func Rewrap(db *badger.DB, envelope *Envelope, kinds ...byte) error {
+	type rewrapped struct {
+		key, value []byte
+		expiresAt  uint64
+	}
+	var list []rewrapped
+	err := db.View(func(txn *badger.Txn) error {
+		for _, kind := range append([]byte{recordKind, heldKind, historyKind}, kinds...) {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte{kind}
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				var value []byte
+				if err := item.Value(func(v []byte) (err error) {
+					value, err = envelope.Rewrap(v)
+					return
+				}); err != nil {
+					it.Close()
+					return err
+				}
+				if value != nil {
+					list = append(list, rewrapped{key: item.KeyCopy(nil), value: value, expiresAt: item.ExpiresAt()})
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, r := range list {
+		e := badger.NewEntry(r.key, r.value)
+		e.ExpiresAt = r.expiresAt
+		if err := wb.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
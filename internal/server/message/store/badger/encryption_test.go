@@ -0,0 +1,234 @@
+package badgerStore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestParseKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 32)
+	for name, raw := range map[string][]byte{
+		"raw":    key,
+		"hex":    []byte(hex.EncodeToString(key) + "\n"),
+		"base64": []byte(base64.StdEncoding.EncodeToString(key) + "\n"),
+	} {
+		got, err := parseKey(raw)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: unexpected key %x, %v", name, got, err)
+		}
+	}
+	if _, err := parseKey([]byte("short")); !errors.Is(err, badger.ErrInvalidEncryptionKey) {
+		t.Errorf("expected ErrInvalidEncryptionKey, got %v", err)
+	}
+}
+
+func TestEnvelopeRotation(t *testing.T) {
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	e1, err := NewEnvelope(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := e1.Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("value not encrypted")
+	}
+	// unsealed values are read as they are
+	if plain, err := e1.Open([]byte{1, 2, 3}); err != nil || !bytes.Equal(plain, []byte{1, 2, 3}) {
+		t.Fatalf("unexpected plain value %v, %v", plain, err)
+	}
+	// and sealed by a rewrap
+	if sealedPlain, err := e1.Rewrap([]byte{1, 2, 3}); err != nil || sealedPlain[0] != envelopeEncoding {
+		t.Fatalf("plain value not sealed %v, %v", sealedPlain, err)
+	}
+
+	e2, err := NewEnvelope(k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := e2.Open(sealed); err != nil || string(plain) != "secret" {
+		t.Fatalf("old value not opened %q, %v", plain, err)
+	}
+	rewrapped, err := e2.Rewrap(sealed)
+	if err != nil || rewrapped == nil {
+		t.Fatalf("value not rewrapped %v", err)
+	}
+	if again, err := e2.Rewrap(rewrapped); err != nil || again != nil {
+		t.Fatalf("rewrapped twice %v, %v", again, err)
+	}
+
+	// after the rotation the old key is not needed
+	e3, err := NewEnvelope(k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := e3.Open(rewrapped); err != nil || string(plain) != "secret" {
+		t.Fatalf("rewrapped value not opened %q, %v", plain, err)
+	}
+	if _, err := e3.Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	// a tampered value is refused
+	rewrapped[len(rewrapped)-1] ^= 1
+	if _, err := e3.Open(rewrapped); err == nil {
+		t.Fatal("tampered value opened")
+	}
+}
+
+// TestEnableEnvelope enables the envelope on a database written without, the existing values
+// are sealed.
+func TestEnableEnvelope(t *testing.T) {
+	db, err := Open(config.BadgerConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := newPublish("a", mqtt.QoS1)
+	p.Payload = []byte("personal data")
+	if _, err := New(db, nil, "c1", time.Hour, retry.Policy{}).Publish(p); err != nil {
+		t.Fatal(err)
+	}
+	// a value of another store sharing the database
+	const otherKind = 17
+	if err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte{otherKind, 'c'}, []byte(`{"will":"personal data"}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := NewEnvelope(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrap(db, envelope, otherKind); err != nil {
+		t.Fatal(err)
+	}
+	values := 0
+	if err := db.View(func(txn *badger.Txn) error {
+		for _, kind := range []byte{recordKind, otherKind} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte{kind}
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				values++
+				if err := it.Item().Value(func(v []byte) error {
+					if v[0] != envelopeEncoding || bytes.Contains(v, []byte("personal data")) {
+						t.Errorf("value of kind %d not sealed", kind)
+					}
+					return nil
+				}); err != nil {
+					it.Close()
+					return err
+				}
+			}
+			it.Close()
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if values != 2 {
+		t.Fatalf("expected 2 values, got %d", values)
+	}
+	var payloads []string
+	if err := New(db, envelope, "c1", time.Hour, retry.Policy{}).Records(func(r *model.Record, held bool) error {
+		payloads = append(payloads, string(r.Content.(*mqtt.Publish).Payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 || payloads[0] != "personal data" {
+		t.Fatalf("unexpected records %v", payloads)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	keys := t.TempDir()
+	writeKey := func(name string, b byte) string {
+		path := filepath.Join(keys, name)
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(bytes.Repeat([]byte{b}, 32))), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	k1, k2 := writeKey("k1", 1), writeKey("k2", 2)
+	open := func(enc config.Encryption) (*badger.DB, *badgerStore, error) {
+		db, err := Open(config.BadgerConfig{Dir: dir, Encryption: enc})
+		if err != nil {
+			return nil, nil, err
+		}
+		envelope, err := OpenEnvelope(enc)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		if err := Rewrap(db, envelope); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return db, New(db, envelope, "c1", time.Hour, retry.Policy{}), nil
+	}
+
+	db, s, err := open(config.Encryption{KeyFile: k1, Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPublish("a", mqtt.QoS1)
+	p.Payload = []byte("personal data")
+	if _, err := s.Publish(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, file := range files {
+		if data, _ := os.ReadFile(file); bytes.Contains(data, []byte("personal data")) {
+			t.Fatalf("payload stored in plain text in %s", file)
+		}
+	}
+
+	if _, _, err := open(config.Encryption{KeyFile: k2, Envelope: true}); !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		t.Fatalf("expected ErrEncryptionKeyMismatch with the wrong key, got %v", err)
+	}
+
+	// rotate to k2, then k1 is not needed anymore
+	db, _, err = open(config.Encryption{KeyFile: k2, OldKeyFile: k1, Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, s, err = open(config.Encryption{KeyFile: k2, Envelope: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var written []mqtt.Packet
+	if err := s.Resend(func(p mqtt.Packet) error {
+		written = append(written, p)
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || string(written[0].(*mqtt.Publish).Payload) != "personal data" {
+		t.Fatalf("expected the stored publish after the rotation, got %v", written)
+	}
+}
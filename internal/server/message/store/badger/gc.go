@@ -0,0 +1,33 @@
+package badgerStore
+
+import (
+	"context"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// defaultGCInterval is used when the config leaves gc_interval unset.
+const defaultGCInterval = time.Minute * 10
+
+// gcDiscardRatio is the share of stale data that makes a value log file worth rewriting.
+const gcDiscardRatio = 0.5
+
+// RunGC reclaims the value log space of deleted and expired records every interval until ctx is done.
+func RunGC(ctx context.Context, db *badger.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultGCInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// every call rewrites at most one file
+			for ctx.Err() == nil && db.RunValueLogGC(gcDiscardRatio) == nil {
+			}
+		}
+	}
+}
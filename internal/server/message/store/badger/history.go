@@ -0,0 +1,228 @@
+package badgerStore
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+var ErrHistoryLimit = errors.New("history stream without max_messages or max_age")
+
+// History keeps the messages published below the topic prefixes of its streams for replay, the
+// keys of a stream are ordered by the time the messages were kept. Messages older than the max
+// age are dropped when the next message of the stream is kept and never replayed.
+type History struct {
+	db       *badger.DB
+	envelope *Envelope
+	// streams are ordered by descending prefix length, the first matching one keeps a message
+	streams []*stream
+	mu      sync.Mutex
+	// last is the time of the latest key, messages kept within the same nanosecond get the next one
+	last int64
+}
+
+type stream struct {
+	config.HistoryStream
+	// count is the number of messages kept
+	count int
+}
+
+// NewHistory opens the streams of the history in db, a non nil envelope encrypts the messages.
+func NewHistory(db *badger.DB, envelope *Envelope, streams []config.HistoryStream) (*History, error) {
+	h := &History{db: db, envelope: envelope}
+	for _, cfg := range streams {
+		if cfg.MaxMessages <= 0 && cfg.MaxAge <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrHistoryLimit, cfg.Prefix)
+		}
+		if slices.ContainsFunc(h.streams, func(s *stream) bool { return s.Prefix == cfg.Prefix }) {
+			return nil, fmt.Errorf("duplicate history stream %q", cfg.Prefix)
+		}
+		h.streams = append(h.streams, &stream{HistoryStream: cfg})
+	}
+	slices.SortStableFunc(h.streams, func(a, b *stream) int {
+		return len(b.Prefix) - len(a.Prefix)
+	})
+	err := db.View(func(txn *badger.Txn) error {
+		for _, s := range h.streams {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = s.prefix()
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+			for it.Rewind(); it.Valid(); it.Next() {
+				s.count++
+				h.last = max(h.last, s.time(it.Item().Key()))
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) Keeps(topic string) bool {
+	return h.stream(topic) != nil
+}
+
+func (h *History) Append(p *mqtt.Publish) (time.Time, error) {
+	s := h.stream(p.Topic.String())
+	if s == nil {
+		return time.Time{}, nil
+	}
+	np := p.Clone()
+	np.PacketID, np.Dup, np.Retain = 0, false, false
+	if np.Properties != nil {
+		np.Properties.TopicAlias = nil
+		np.Properties.SubscriptionIdentifier = nil
+	}
+	buf, err := encode(h.envelope, model.NewRecord("", np, 0))
+	if err != nil {
+		return time.Time{}, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := max(time.Now().UnixNano(), h.last+1)
+	count := s.count + 1
+	if err := h.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(s.key(now), buf); err != nil {
+			return err
+		}
+		return s.trim(txn, &count, now)
+	}); err != nil {
+		return time.Time{}, err
+	}
+	h.last, s.count = now, count
+	return time.Unix(0, now), nil
+}
+
+func (h *History) Replay(filter string, since history.Since, fn func(p *mqtt.Publish, at time.Time) error) error {
+	type kept struct {
+		time int64
+		p    *mqtt.Publish
+	}
+	var list []kept
+	now := time.Now().UnixNano()
+	err := h.db.View(func(txn *badger.Txn) error {
+		for _, s := range h.streams {
+			if !s.overlaps(filter) {
+				continue
+			}
+			var from int64
+			if !since.Time.IsZero() {
+				from = max(from, since.Time.UnixNano())
+			}
+			if s.MaxAge > 0 {
+				from = max(from, now-int64(s.MaxAge))
+			}
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = s.prefix()
+			it := txn.NewIterator(opts)
+			for it.Seek(s.key(from)); it.Valid(); it.Next() {
+				item := it.Item()
+				var record *model.Record
+				if err := item.Value(func(v []byte) (err error) {
+					record, err = decode(h.envelope, v)
+					return
+				}); err != nil {
+					it.Close()
+					return err
+				}
+				if p, ok := record.Content.(*mqtt.Publish); ok && p.Topic.Match(filter) {
+					list = append(list, kept{time: s.time(item.Key()), p: p})
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(list, func(a, b kept) int {
+		return cmp.Compare(a.time, b.time)
+	})
+	if since.Count > 0 && len(list) > since.Count {
+		list = list[len(list)-since.Count:]
+	}
+	for _, k := range list {
+		if err := fn(k.p, time.Unix(0, k.time)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stream returns the stream keeping the messages of topic, nil if there is none.
+func (h *History) stream(topic string) *stream {
+	for _, s := range h.streams {
+		if strings.HasPrefix(topic, s.Prefix) {
+			return s
+		}
+	}
+	return nil
+}
+
+// trim drops the oldest messages beyond the limits of the stream, count includes the message
+// just kept at now.
+func (s *stream) trim(txn *badger.Txn, count *int, now int64) error {
+	var cutoff int64
+	if s.MaxAge > 0 {
+		cutoff = now - int64(s.MaxAge)
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = s.prefix()
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if (s.MaxMessages <= 0 || *count-len(keys) <= s.MaxMessages) && s.time(key) >= cutoff {
+			break
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	*count -= len(keys)
+	return nil
+}
+
+// overlaps reports whether the stream may keep messages matching filter, comparing the prefix
+// with the filter up to its first wildcard.
+func (s *stream) overlaps(filter string) bool {
+	t := mqtt.Topic(filter)
+	literal := t.TopicFilter()
+	if i := strings.IndexAny(literal, "+#"); i >= 0 {
+		literal = literal[:i]
+	}
+	return strings.HasPrefix(literal, s.Prefix) || strings.HasPrefix(s.Prefix, literal)
+}
+
+func (s *stream) prefix() []byte {
+	return clientKey(historyKind, s.Prefix)
+}
+
+func (s *stream) key(t int64) []byte {
+	return binary.BigEndian.AppendUint64(s.prefix(), uint64(t))
+}
+
+func (s *stream) time(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
@@ -0,0 +1,118 @@
+package badgerStore
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func replayed(t *testing.T, h *History, filter string, since history.Since) (topics []string) {
+	if err := h.Replay(filter, since, func(p *mqtt.Publish, at time.Time) error {
+		topics = append(topics, p.Topic.String()+":"+string(p.Payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	streams := []config.HistoryStream{
+		{Prefix: "a/", MaxMessages: 3},
+		{Prefix: "a/b/", MaxMessages: 10},
+		{Prefix: "t/", MaxAge: 200 * time.Millisecond},
+	}
+	db, err := Open(config.BadgerConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHistory(db, nil, streams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(topic, payload string) {
+		p := newPublish(topic, mqtt.QoS1)
+		p.PacketID, p.Retain, p.Payload = 7, true, []byte(payload)
+		at, err := h.Append(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if at.IsZero() != (topic == "other") {
+			t.Fatalf("unexpected time %v for %s", at, topic)
+		}
+	}
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		publish("a/x", payload)
+	}
+	publish("a/b/c", "5")
+	publish("other", "6")
+
+	// the a/ stream keeps its last 3, a/b/c is kept once by the longer prefix
+	if got, want := replayed(t, h, "a/#", history.Since{}), []string{"a/x:2", "a/x:3", "a/x:4", "a/b/c:5"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got, want := replayed(t, h, "a/#", history.Since{Count: 2}), []string{"a/x:4", "a/b/c:5"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got := replayed(t, h, "#", history.Since{Time: time.Now()}); len(got) != 0 {
+		t.Fatalf("expected nothing since now, got %v", got)
+	}
+	var first *mqtt.Publish
+	h.Replay("a/b/c", history.Since{}, func(p *mqtt.Publish, at time.Time) error {
+		first = p
+		return nil
+	})
+	if first == nil || first.PacketID != 0 || first.Retain {
+		t.Fatalf("expected the kept publish without packet ID and retain, got %v", first)
+	}
+
+	publish("t/1", "old")
+	time.Sleep(300 * time.Millisecond)
+	publish("t/2", "new")
+	if got, want := replayed(t, h, "t/+", history.Since{}), []string{"t/2:new"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the counts survive a restart
+	db, err = Open(config.BadgerConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if h, err = NewHistory(db, nil, streams); err != nil {
+		t.Fatal(err)
+	}
+	publish("a/x", "7")
+	if got, want := replayed(t, h, "a/x", history.Since{}), []string{"a/x:3", "a/x:4", "a/x:7"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	var keys int
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{historyKind}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys++
+		}
+		return nil
+	})
+	if keys != 5 {
+		t.Fatalf("expected 5 kept messages, got %d", keys)
+	}
+
+	if _, err := NewHistory(db, nil, []config.HistoryStream{{Prefix: "x/"}}); !errors.Is(err, ErrHistoryLimit) {
+		t.Fatalf("expected ErrHistoryLimit, got %v", err)
+	}
+}
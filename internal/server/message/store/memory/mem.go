@@ -2,24 +2,27 @@ package memStore
 
 import (
 	"context"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/packetid"
+	"github.com/jin06/mercury/internal/server/message/retry"
 	"github.com/jin06/mercury/internal/utils"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-func New(cid string) *memStore {
+func New(cid string, expiry time.Duration, policy retry.Policy) *memStore {
 	s := &memStore{
-		cid:        cid,
-		used:       make(map[mqtt.PacketID]*model.Record, mqtt.MAX_PACKET_ID),
-		nextFreeID: 1,
+		cid:  cid,
+		used: make(map[mqtt.PacketID]*model.Record),
+		held: make(map[mqtt.PacketID]*mqtt.Publish),
+		ids:  packetid.New(),
 		// max:            mqtt.MAX_PACKET_ID,
-		expiry:         config.Def.MQTTConfig.MessageExpiryInterval,
-		resendDuration: time.Second * 5,
-		closing:        make(chan struct{}),
+		expiry:  expiry,
+		policy:  policy,
+		closing: make(chan struct{}),
 	}
 	return s
 }
@@ -39,15 +42,17 @@ func New(cid string) *memStore {
 // }
 
 type memStore struct {
-	cid        string
-	used       map[mqtt.PacketID]*model.Record
-	nextFreeID mqtt.PacketID
+	cid  string
+	used map[mqtt.PacketID]*model.Record
+	// held are the incoming QoS 2 publishes waiting for their PUBREL
+	held map[mqtt.PacketID]*mqtt.Publish
+	ids  *packetid.Allocator
 	// max            mqtt.PacketID
 	mu     sync.Mutex
 	expiry time.Duration
 	// delivery       chan *model.Record
-	closing        chan struct{}
-	resendDuration time.Duration
+	closing chan struct{}
+	policy  retry.Policy
 }
 
 func (s *memStore) Receive(p *mqtt.Pubrel) error {
@@ -60,16 +65,42 @@ func (s *memStore) Receive(p *mqtt.Pubrel) error {
 }
 
 func (s *memStore) Clean() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.used)
+	clear(s.held)
+	s.ids.Reset()
 	return nil
 }
 
-func (s *memStore) Release(p *mqtt.Pubcomp) error {
+func (s *memStore) Hold(p *mqtt.Publish) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.used[p.PacketID] != nil {
-		s.used[p.PacketID].Content = p
+	if _, ok := s.held[p.PacketID]; ok {
+		return false, nil
 	}
-	return nil
+	s.held[p.PacketID] = p
+	return true, nil
+}
+
+func (s *memStore) Peek(pid mqtt.PacketID) (*mqtt.Publish, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.held[pid], nil
+}
+
+func (s *memStore) Release(pid mqtt.PacketID) (*mqtt.Publish, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.held[pid]
+	delete(s.held, pid)
+	return p, nil
+}
+
+func (s *memStore) Held() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.held), nil
 }
 
 func (s *memStore) Ack(pid mqtt.PacketID) (err error) {
@@ -92,18 +123,15 @@ func (s *memStore) save(p *mqtt.Publish) (*model.Record, error) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.used[s.nextFreeID] == nil {
-		id := s.nextFreeID
-		if s.nextFreeID++; s.nextFreeID > mqtt.MAX_PACKET_ID {
-			s.nextFreeID = 1
-		}
-		np := p.Clone()
-		np.PacketID = id
-		r := model.NewRecord(s.cid, np, s.expiry)
-		s.used[id] = r
-		return r, nil
+	id, ok := s.ids.Get()
+	if !ok {
+		return nil, utils.ErrPacketIDExhausted
 	}
-	return nil, utils.ErrPacketIDUsed
+	np := p.Clone()
+	np.PacketID = id
+	r := model.NewRecord(s.cid, np, s.expiry)
+	s.used[id] = r
+	return r, nil
 }
 
 func (s *memStore) delete(pid mqtt.PacketID) (bool, error) {
@@ -112,12 +140,13 @@ func (s *memStore) delete(pid mqtt.PacketID) (bool, error) {
 	var has bool
 	if _, has = s.used[pid]; has {
 		delete(s.used, pid)
+		s.ids.Put(pid)
 	}
 	return has, nil
 }
 
-func (s *memStore) Run(ctx context.Context, ch chan mqtt.Packet) error {
-	ticker := time.NewTicker(s.resendDuration)
+func (s *memStore) Run(ctx context.Context, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	ticker := time.NewTicker(s.policy.Interval())
 	defer ticker.Stop()
 	for {
 		select {
@@ -126,24 +155,89 @@ func (s *memStore) Run(ctx context.Context, ch chan mqtt.Packet) error {
 		case <-s.closing:
 			return nil
 		case <-ticker.C:
-			s.resend(ch)
+			s.resend(false, write, dead)
 		}
 	}
 }
 
-func (s *memStore) resend(ch chan mqtt.Packet) {
+func (s *memStore) Resend(write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	return s.resend(true, write, dead)
+}
+
+// resend writes the records that are due again, or all of them, in the order they were received.
+// Records out of attempts are removed and passed to dead.
+func (s *memStore) resend(all bool, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	now := time.Now()
+	var exhausted []*model.Record
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	records := make([]*model.Record, 0, len(s.used))
 	for _, record := range s.used {
-		// if publish, ok := record.Content.(*mqtt.Publish); ok {
-		// publish.Dup = true
-		// record.Content = publish
-		// s.delivery <- record
-		// }
-		// s.delivery <- record
-		ch <- record.Content
-		record.Times++
+		if all || s.policy.Due(record, now) {
+			records = append(records, record)
+		}
 	}
+	slices.SortFunc(records, func(a, b *model.Record) int {
+		if c := a.Receive.Compare(b.Receive); c != 0 {
+			return c
+		}
+		return int(a.Content.(mqtt.Message).PID()) - int(b.Content.(mqtt.Message).PID())
+	})
+	for _, record := range records {
+		ok, err := s.policy.Resend(record, write)
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		if !ok {
+			pid := record.Content.(mqtt.Message).PID()
+			delete(s.used, pid)
+			s.ids.Put(pid)
+			exhausted = append(exhausted, record)
+		}
+	}
+	s.mu.Unlock()
+	for _, record := range exhausted {
+		dead(record)
+	}
+	return nil
+}
+
+func (s *memStore) Records(fn func(r *model.Record, held bool) error) error {
+	s.mu.Lock()
+	records := make([]*model.Record, 0, len(s.used))
+	for _, record := range s.used {
+		records = append(records, record)
+	}
+	held := make([]*model.Record, 0, len(s.held))
+	for _, p := range s.held {
+		held = append(held, model.NewRecord(s.cid, p, 0))
+	}
+	s.mu.Unlock()
+	byPacketID := func(a, b *model.Record) int {
+		return int(a.Content.(mqtt.Message).PID()) - int(b.Content.(mqtt.Message).PID())
+	}
+	slices.SortFunc(records, byPacketID)
+	slices.SortFunc(held, byPacketID)
+	for _, record := range records {
+		if err := fn(record, false); err != nil {
+			return err
+		}
+	}
+	for _, record := range held {
+		if err := fn(record, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Restore(r *model.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pid := r.Content.(mqtt.Message).PID()
+	s.ids.Use(pid)
+	s.used[pid] = r
+	return nil
 }
 
 func (s *memStore) Close() error {
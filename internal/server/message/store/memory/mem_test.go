@@ -0,0 +1,88 @@
+package memStore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newPublish(topic string, qos mqtt.QoS) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	return p
+}
+
+func TestBackoff(t *testing.T) {
+	s := New("c1", 0, retry.Policy{InitialDelay: 20 * time.Millisecond, Multiplier: 3, MaxAttempts: 3})
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan time.Time, 10)
+	dead := make(chan *model.Record, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	go s.Run(ctx, func(p mqtt.Packet) error {
+		written <- time.Now()
+		return nil
+	}, func(r *model.Record) { dead <- r })
+
+	var sent []time.Time
+	for range 2 {
+		select {
+		case at := <-written:
+			sent = append(sent, at)
+		case <-time.After(2 * time.Second):
+			t.Fatal("record not resent")
+		}
+	}
+	// 20ms after the publish, then 60ms after the first resend
+	if d := sent[0].Sub(start); d < 20*time.Millisecond {
+		t.Errorf("first resend after %v", d)
+	}
+	if d := sent[1].Sub(sent[0]); d < 60*time.Millisecond {
+		t.Errorf("second resend %v after the first", d)
+	}
+	select {
+	case r := <-dead:
+		if r.Content.(*mqtt.Publish).Topic != "a" {
+			t.Fatalf("unexpected dead letter %v", r.Content)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("record not dead lettered")
+	}
+	if len(s.used) != 0 {
+		t.Fatal("dead letter left in the store")
+	}
+}
+
+func TestReconnectResend(t *testing.T) {
+	s := New("c1", 0, retry.Policy{InitialDelay: time.Hour})
+	for _, topic := range []string{"a", "b", "c"} {
+		if _, err := s.Publish(newPublish(topic, mqtt.QoS1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	if err := s.Resend(func(p mqtt.Packet) error {
+		publish := p.(*mqtt.Publish)
+		if !publish.Dup {
+			t.Errorf("resend of %s without DUP", publish.Topic)
+		}
+		topics = append(topics, publish.Topic.String())
+		return nil
+	}, func(r *model.Record) { t.Errorf("unexpected dead letter %v", r.Content) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 2 || topics[0] != "a" || topics[1] != "c" {
+		t.Fatalf("expected a and c in order, got %v", topics)
+	}
+}
@@ -0,0 +1,431 @@
+package redisStore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/logger"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/packetid"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+const defaultKeyPrefix = "mercury:"
+
+// Keys of a client, after the key prefix:
+//
+//	packetid:{clientID} the packet ID the allocator searches from
+//	record:{clientID}   hash of packet ID -> encoded record
+//	resend:{clientID}   sorted set of packet IDs scored by their next resend time in milliseconds
+//	held:{clientID}     hash of packet ID -> encoded record of a held incoming publish
+const (
+	packetIDKey = "packetid:"
+	recordKey   = "record:"
+	resendKey   = "resend:"
+	heldKey     = "held:"
+)
+
+// Open connects the client shared by the stores of all clients and checks the server is reachable.
+func Open(options config.RedisConfig) (*redis.Client, error) {
+	opts := &redis.Options{
+		Addr:     options.Addr,
+		Username: options.Username,
+		Password: options.Password,
+		DB:       options.DB,
+	}
+	if options.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if options.CAFile != "" {
+			pem, err := os.ReadFile(options.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("redis ca_file contains no certificate")
+			}
+			opts.TLSConfig.RootCAs = pool
+		}
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func New(client *redis.Client, prefix string, cid string, expiry time.Duration, policy retry.Policy) *redisStore {
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+	return &redisStore{
+		client:      client,
+		cid:         cid,
+		packetIDKey: prefix + packetIDKey + cid,
+		recordKey:   prefix + recordKey + cid,
+		resendKey:   prefix + resendKey + cid,
+		heldKey:     prefix + heldKey + cid,
+		expiry:      expiry,
+		policy:      policy,
+		ids:         packetid.New(),
+		closing:     make(chan struct{}),
+	}
+}
+
+type redisStore struct {
+	client      *redis.Client
+	cid         string
+	packetIDKey string
+	recordKey   string
+	resendKey   string
+	heldKey     string
+	expiry      time.Duration
+	policy      retry.Policy
+	// ids is restored from the records of the session by load, mu guards it while loading
+	ids     *packetid.Allocator
+	loaded  bool
+	mu      sync.Mutex
+	closing chan struct{}
+}
+
+func (s *redisStore) Publish(p *mqtt.Publish) (*model.Record, error) {
+	if p.Qos.Zero() {
+		return model.NewRecord(s.cid, p.Clone(), s.expiry), nil
+	}
+	ctx := context.Background()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	for {
+		id, ok := s.ids.Get()
+		if !ok {
+			return nil, utils.ErrPacketIDExhausted
+		}
+		np := p.Clone()
+		np.PacketID = id
+		record := model.NewRecord(s.cid, np, s.expiry)
+		buf, err := record.Encode()
+		if err != nil {
+			s.ids.Put(id)
+			return nil, err
+		}
+		if ok, err := s.client.HSetNX(ctx, s.recordKey, field(id), buf).Result(); err != nil {
+			s.ids.Put(id)
+			return nil, err
+		} else if !ok {
+			// written by another broker the session was connected to, the ID stays in use
+			continue
+		}
+		if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, s.resendKey, s.schedule(record))
+			pipe.Set(ctx, s.packetIDKey, uint16(s.ids.Next()), 0)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+}
+
+// load restores the packet IDs in use from the records of the session once. s.mu must be held.
+func (s *redisStore) load(ctx context.Context) error {
+	if s.loaded {
+		return nil
+	}
+	next, err := s.client.Get(ctx, s.packetIDKey).Uint64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	fields, err := s.client.HKeys(ctx, s.recordKey).Result()
+	if err != nil {
+		return err
+	}
+	s.ids.Reset()
+	for _, f := range fields {
+		if id, err := strconv.ParseUint(f, 10, 16); err == nil {
+			s.ids.Use(mqtt.PacketID(id))
+		}
+	}
+	s.ids.SetNext(mqtt.PacketID(next))
+	s.loaded = true
+	return nil
+}
+
+// free returns the packet ID of a removed record to the allocator.
+func (s *redisStore) free(pid mqtt.PacketID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids.Put(pid)
+}
+
+func (s *redisStore) Ack(pid mqtt.PacketID) error {
+	return s.delete(pid)
+}
+
+func (s *redisStore) Complete(pid mqtt.PacketID) error {
+	return s.delete(pid)
+}
+
+// Receive replaces the PUBLISH of the record with the PUBREL sent after its PUBREC.
+func (s *redisStore) Receive(p *mqtt.Pubrel) error {
+	ctx := context.Background()
+	record, err := s.get(ctx, p.PacketID)
+	if record == nil || err != nil {
+		return err
+	}
+	record.Content = p
+	return s.set(ctx, p.PacketID, record)
+}
+
+func (s *redisStore) Hold(p *mqtt.Publish) (bool, error) {
+	buf, err := model.NewRecord(s.cid, p, 0).Encode()
+	if err != nil {
+		return false, err
+	}
+	return s.client.HSetNX(context.Background(), s.heldKey, field(p.PacketID), buf).Result()
+}
+
+func (s *redisStore) Peek(pid mqtt.PacketID) (*mqtt.Publish, error) {
+	buf, err := s.client.HGet(context.Background(), s.heldKey, field(pid)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := model.DecodeRecord(buf)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := record.Content.(*mqtt.Publish)
+	return p, nil
+}
+
+func (s *redisStore) Release(pid mqtt.PacketID) (*mqtt.Publish, error) {
+	ctx := context.Background()
+	var get *redis.StringCmd
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(ctx, s.heldKey, field(pid))
+		pipe.HDel(ctx, s.heldKey, field(pid))
+		return nil
+	}); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	buf, err := get.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := model.DecodeRecord(buf)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := record.Content.(*mqtt.Publish)
+	return p, nil
+}
+
+func (s *redisStore) Held() (int, error) {
+	n, err := s.client.HLen(context.Background(), s.heldKey).Result()
+	return int(n), err
+}
+
+func (s *redisStore) Run(ctx context.Context, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	ticker := time.NewTicker(s.policy.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.closing:
+			return nil
+		case <-ticker.C:
+			if err := s.resend(ctx, strconv.FormatInt(time.Now().UnixMilli(), 10), write, dead); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+func (s *redisStore) Resend(write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	return s.resend(context.Background(), "+inf", write, dead)
+}
+
+// resend writes the records scheduled up to max again and schedules them by the retry policy.
+// Records out of attempts are removed and passed to dead.
+func (s *redisStore) resend(ctx context.Context, max string, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	due, err := s.client.ZRangeByScore(ctx, s.resendKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: max,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range due {
+		id, err := strconv.ParseUint(member, 10, 16)
+		if err != nil {
+			s.client.ZRem(ctx, s.resendKey, member)
+			continue
+		}
+		pid := mqtt.PacketID(id)
+		record, err := s.get(ctx, pid)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			// acknowledged in the meantime
+			s.client.ZRem(ctx, s.resendKey, member)
+			continue
+		}
+		ok, err := s.policy.Resend(record, write)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := s.delete(pid); err != nil {
+				return err
+			}
+			dead(record)
+			continue
+		}
+		if err := s.set(ctx, pid, record); err != nil {
+			return err
+		}
+		if err := s.client.ZAdd(ctx, s.resendKey, s.schedule(record)).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) Clean() error {
+	if err := s.client.Del(context.Background(), s.packetIDKey, s.recordKey, s.resendKey, s.heldKey).Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids.Reset()
+	s.loaded = true
+	return nil
+}
+
+func (s *redisStore) Records(fn func(r *model.Record, held bool) error) error {
+	ctx := context.Background()
+	for _, key := range []string{s.recordKey, s.heldKey} {
+		values, err := s.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		records := make([]*model.Record, 0, len(values))
+		for _, v := range values {
+			record, err := model.DecodeRecord([]byte(v))
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		slices.SortFunc(records, func(a, b *model.Record) int {
+			return int(packetID(a.Content)) - int(packetID(b.Content))
+		})
+		for _, record := range records {
+			if err := fn(record, key == s.heldKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) Restore(r *model.Record) error {
+	ctx := context.Background()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(ctx); err != nil {
+		return err
+	}
+	buf, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.recordKey, field(packetID(r.Content)), buf)
+		pipe.ZAdd(ctx, s.resendKey, s.schedule(r))
+		return nil
+	}); err != nil {
+		return err
+	}
+	s.ids.Use(packetID(r.Content))
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	close(s.closing)
+	return nil
+}
+
+func (s *redisStore) get(ctx context.Context, pid mqtt.PacketID) (*model.Record, error) {
+	buf, err := s.client.HGet(ctx, s.recordKey, field(pid)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return model.DecodeRecord(buf)
+}
+
+func (s *redisStore) set(ctx context.Context, pid mqtt.PacketID, record *model.Record) error {
+	buf, err := record.Encode()
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, s.recordKey, field(pid), buf).Err()
+}
+
+func (s *redisStore) delete(pid mqtt.PacketID) error {
+	_, err := s.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.HDel(context.Background(), s.recordKey, field(pid))
+		pipe.ZRem(context.Background(), s.resendKey, field(pid))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.free(pid)
+	return nil
+}
+
+// schedule is the entry of the resend sorted set for the next send of record.
+func (s *redisStore) schedule(record *model.Record) redis.Z {
+	return redis.Z{
+		Score:  float64(s.policy.Next(record).UnixMilli()),
+		Member: field(packetID(record.Content)),
+	}
+}
+
+func packetID(p mqtt.Packet) mqtt.PacketID {
+	if m, ok := p.(mqtt.Message); ok {
+		return m.PID()
+	}
+	return 0
+}
+
+func field(pid mqtt.PacketID) string {
+	return strconv.FormatUint(uint64(pid), 10)
+}
@@ -0,0 +1,243 @@
+package redisStore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newTestStore(t *testing.T) (*redisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client, err := Open(config.RedisConfig{Addr: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return New(client, "test:", "c1", time.Hour, retry.Policy{}), mr
+}
+
+func newPublish(topic string, qos mqtt.QoS) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Payload = []byte("payload")
+	return p
+}
+
+func TestPublishAck(t *testing.T) {
+	s, mr := newTestStore(t)
+	r1, err := s.Publish(newPublish("a", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := s.Publish(newPublish("b", mqtt.QoS2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.Content.(mqtt.Message).PID() != 1 || r2.Content.(mqtt.Message).PID() != 2 {
+		t.Fatalf("unexpected packet IDs %d, %d", r1.Content.(mqtt.Message).PID(), r2.Content.(mqtt.Message).PID())
+	}
+	if keys, _ := mr.HKeys("test:record:c1"); len(keys) != 2 {
+		t.Fatalf("expected 2 records, got %v", keys)
+	}
+
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Receive(&mqtt.Pubrel{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBREL}, Version: mqtt.MQTT5}, PacketID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.get(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record.Content.(*mqtt.Pubrel); !ok {
+		t.Fatalf("expected PUBREL record, got %T", record.Content)
+	}
+	if err := s.Complete(2); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("test:record:c1") || mr.Exists("test:resend:c1") {
+		t.Fatal("acknowledged records left behind")
+	}
+
+	// QoS 0 publishes are not stored
+	if _, err := s.Publish(newPublish("c", mqtt.QoS0)); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("test:record:c1") {
+		t.Fatal("QoS 0 publish stored")
+	}
+}
+
+func TestPacketIDWrap(t *testing.T) {
+	s, mr := newTestStore(t)
+	mr.Set("test:packetid:c1", "65535")
+	var ids []mqtt.PacketID
+	for _, topic := range []string{"a", "b"} {
+		r, err := s.Publish(newPublish(topic, mqtt.QoS1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, r.Content.(mqtt.Message).PID())
+	}
+	if ids[0] != mqtt.MAX_PACKET_ID || ids[1] != 1 {
+		t.Fatalf("expected packet IDs %d and 1, got %v", mqtt.MAX_PACKET_ID, ids)
+	}
+	if next, _ := mr.Get("test:packetid:c1"); next != "2" {
+		t.Fatalf("expected the search to continue at 2, got %s", next)
+	}
+
+	// the store of a reconnected client skips the inflight IDs
+	mr.Set("test:packetid:c1", "65535")
+	s = New(s.client, "test:", "c1", time.Hour, retry.Policy{})
+	r, err := s.Publish(newPublish("c", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := r.Content.(mqtt.Message).PID(); id != 2 {
+		t.Fatalf("expected packet ID 2, got %d", id)
+	}
+	for id := mqtt.PacketID(3); id < mqtt.MAX_PACKET_ID; id++ {
+		s.ids.Use(id)
+	}
+	if _, err := s.Publish(newPublish("d", mqtt.QoS1)); !errors.Is(err, utils.ErrPacketIDExhausted) {
+		t.Fatalf("expected ErrPacketIDExhausted, got %v", err)
+	}
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := s.Publish(newPublish("d", mqtt.QoS1)); err != nil || r.Content.(mqtt.Message).PID() != 1 {
+		t.Fatalf("expected the acknowledged ID 1, got %v, %v", r, err)
+	}
+}
+
+func TestResend(t *testing.T) {
+	s, _ := newTestStore(t)
+	s.policy = retry.Policy{InitialDelay: 10 * time.Millisecond}
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan mqtt.Packet, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, func(p mqtt.Packet) error {
+		written <- p
+		return nil
+	}, func(r *model.Record) { t.Errorf("unexpected dead letter %v", r.Content) })
+	for range 2 {
+		select {
+		case p := <-written:
+			if p.(mqtt.Message).PID() != 1 {
+				t.Fatalf("unexpected packet %v", p)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("record not resent")
+		}
+	}
+	record, err := s.get(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Times < 2 {
+		t.Fatalf("expected at least 2 sends, got %d", record.Times)
+	}
+
+	if err := s.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for len(written) > 0 {
+		<-written
+	}
+	select {
+	case p := <-written:
+		t.Fatalf("acknowledged record resent %v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReconnectResend(t *testing.T) {
+	s, mr := newTestStore(t)
+	s.policy = retry.Policy{InitialDelay: time.Hour, MaxAttempts: 2}
+	for _, topic := range []string{"a", "b"} {
+		if _, err := s.Publish(newPublish(topic, mqtt.QoS1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var written []mqtt.Packet
+	var dead []*model.Record
+	write := func(p mqtt.Packet) error {
+		written = append(written, p)
+		return nil
+	}
+	deadLetter := func(r *model.Record) { dead = append(dead, r) }
+
+	// a reconnect resends everything, the resend time has not passed
+	if err := s.Resend(write, deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || len(dead) != 0 {
+		t.Fatalf("expected 2 resends, got %v and dead letters %v", written, dead)
+	}
+	if p := written[0].(*mqtt.Publish); p.Topic != "a" || !p.Dup {
+		t.Fatalf("unexpected resend %v", p)
+	}
+	// both were sent twice, the next reconnect makes them dead letters
+	if err := s.Resend(write, deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 || len(dead) != 2 {
+		t.Fatalf("expected 2 dead letters, got %v", dead)
+	}
+	if mr.Exists("test:record:c1") || mr.Exists("test:resend:c1") {
+		t.Fatal("dead letters left in the store")
+	}
+}
+
+func TestHold(t *testing.T) {
+	s, mr := newTestStore(t)
+	p := newPublish("a", mqtt.QoS2)
+	p.PacketID = 7
+	for i, want := range []bool{true, false} {
+		if held, err := s.Hold(p); err != nil || held != want {
+			t.Fatalf("hold %d: expected %v, got %v, %v", i, want, held, err)
+		}
+	}
+	if n, err := s.Held(); err != nil || n != 1 {
+		t.Fatalf("expected 1 held publish, got %d, %v", n, err)
+	}
+	released, err := s.Release(7)
+	if err != nil || released == nil || released.Topic != "a" {
+		t.Fatalf("unexpected released publish %v, %v", released, err)
+	}
+	if released, err := s.Release(7); err != nil || released != nil {
+		t.Fatalf("released twice %v, %v", released, err)
+	}
+	if mr.Exists("test:held:c1") {
+		t.Fatal("released publish left behind")
+	}
+}
+
+func TestClean(t *testing.T) {
+	s, mr := newTestStore(t)
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Fatalf("keys left after clean %v", keys)
+	}
+}
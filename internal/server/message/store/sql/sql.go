@@ -0,0 +1,375 @@
+package sqlStore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	gormLogger "gorm.io/gorm/logger"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/logger"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/packetid"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/store"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Open connects the database shared by the stores of all clients and migrates the message tables.
+func Open(options config.Database) (*gorm.DB, error) {
+	db, err := store.NewClient(&options)
+	if err != nil {
+		return nil, err
+	}
+	// every publish is a statement, only slow and failed ones are logged
+	db = db.Session(&gorm.Session{Logger: db.Logger.LogMode(gormLogger.Warn)})
+	if err := db.AutoMigrate(&model.Message{}, &model.HeldMessage{}); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func New(db *gorm.DB, cid string, expiry time.Duration, policy retry.Policy) *sqlStore {
+	return &sqlStore{
+		db:      db,
+		cid:     cid,
+		ids:     packetid.New(),
+		expiry:  expiry,
+		policy:  policy,
+		closing: make(chan struct{}),
+	}
+}
+
+type sqlStore struct {
+	db  *gorm.DB
+	cid string
+	// ids is restored from the records of the session by load, mu guards it while loading
+	ids     *packetid.Allocator
+	loaded  bool
+	mu      sync.Mutex
+	expiry  time.Duration
+	policy  retry.Policy
+	closing chan struct{}
+}
+
+func (s *sqlStore) Publish(p *mqtt.Publish) (*model.Record, error) {
+	if p.Qos.Zero() {
+		return model.NewRecord(s.cid, p.Clone(), s.expiry), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	id, ok := s.ids.Get()
+	if !ok {
+		return nil, utils.ErrPacketIDExhausted
+	}
+	np := p.Clone()
+	np.PacketID = id
+	record := model.NewRecord(s.cid, np, s.expiry)
+	buf, err := record.Encode()
+	if err == nil {
+		err = s.db.Create(&model.Message{
+			ClientID: s.cid,
+			PacketID: uint16(id),
+			Record:   buf,
+			ResendAt: s.policy.Next(record),
+			Created:  record.Receive,
+		}).Error
+	}
+	if err != nil {
+		s.ids.Put(id)
+		return nil, err
+	}
+	return record, nil
+}
+
+// load restores the packet IDs in use from the records of the session once, the search
+// continues after the newest one. s.mu must be held.
+func (s *sqlStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	var ids []uint16
+	if err := s.db.Model(&model.Message{}).Where("client_id = ?", s.cid).Order("id").Pluck("packet_id", &ids).Error; err != nil {
+		return err
+	}
+	s.ids.Reset()
+	for _, id := range ids {
+		s.ids.Use(mqtt.PacketID(id))
+	}
+	if len(ids) > 0 {
+		s.ids.SetNext(next(mqtt.PacketID(ids[len(ids)-1])))
+	}
+	s.loaded = true
+	return nil
+}
+
+// free returns the packet ID of a removed record to the allocator.
+func (s *sqlStore) free(pid mqtt.PacketID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids.Put(pid)
+}
+
+func (s *sqlStore) Ack(pid mqtt.PacketID) error {
+	return s.delete(pid)
+}
+
+func (s *sqlStore) Complete(pid mqtt.PacketID) error {
+	return s.delete(pid)
+}
+
+// Receive replaces the PUBLISH of the record with the PUBREL sent after its PUBREC.
+func (s *sqlStore) Receive(p *mqtt.Pubrel) error {
+	var m model.Message
+	err := s.db.Where("client_id = ? AND packet_id = ?", s.cid, uint16(p.PacketID)).Take(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	record, err := model.DecodeRecord(m.Record)
+	if err != nil {
+		return err
+	}
+	record.Content = p
+	buf, err := record.Encode()
+	if err != nil {
+		return err
+	}
+	return s.db.Model(&m).Update("record", buf).Error
+}
+
+func (s *sqlStore) Hold(p *mqtt.Publish) (bool, error) {
+	record := model.NewRecord(s.cid, p, 0)
+	buf, err := record.Encode()
+	if err != nil {
+		return false, err
+	}
+	res := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.HeldMessage{
+		ClientID: s.cid,
+		PacketID: uint16(p.PacketID),
+		Record:   buf,
+		Created:  record.Receive,
+	})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *sqlStore) Peek(pid mqtt.PacketID) (*mqtt.Publish, error) {
+	var m model.HeldMessage
+	err := s.db.Where("client_id = ? AND packet_id = ?", s.cid, uint16(pid)).Take(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record, err := model.DecodeRecord(m.Record)
+	if err != nil {
+		return nil, err
+	}
+	p, _ := record.Content.(*mqtt.Publish)
+	return p, nil
+}
+
+func (s *sqlStore) Release(pid mqtt.PacketID) (p *mqtt.Publish, err error) {
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var m model.HeldMessage
+		err := tx.Where("client_id = ? AND packet_id = ?", s.cid, uint16(pid)).Take(&m).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			return err
+		}
+		p, _ = record.Content.(*mqtt.Publish)
+		return tx.Delete(&m).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *sqlStore) Held() (int, error) {
+	var n int64
+	err := s.db.Model(&model.HeldMessage{}).Where("client_id = ?", s.cid).Count(&n).Error
+	return int(n), err
+}
+
+func (s *sqlStore) Run(ctx context.Context, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	ticker := time.NewTicker(s.policy.Interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.closing:
+			return nil
+		case <-ticker.C:
+			if err := s.resend(s.db.Where("resend_at <= ?", time.Now()), write, dead); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+func (s *sqlStore) Resend(write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	return s.resend(s.db, write, dead)
+}
+
+// resend writes the records selected by query again and schedules them by the retry policy.
+// Records out of attempts are removed and passed to dead.
+func (s *sqlStore) resend(query *gorm.DB, write func(mqtt.Packet) error, dead func(*model.Record)) error {
+	var due []model.Message
+	if err := query.Where("client_id = ?", s.cid).Order("id").Find(&due).Error; err != nil {
+		return err
+	}
+	for _, m := range due {
+		record, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		ok, err := s.policy.Resend(record, write)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// a record acknowledged in the meantime is no dead letter
+			res := s.db.Delete(&m)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				s.free(mqtt.PacketID(m.PacketID))
+				dead(record)
+			}
+			continue
+		}
+		buf, err := record.Encode()
+		if err != nil {
+			return err
+		}
+		if err := s.db.Model(&m).Updates(map[string]any{
+			"record":    buf,
+			"resend_at": s.policy.Next(record),
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Clean() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.db.Where("client_id = ?", s.cid).Delete(&model.Message{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where("client_id = ?", s.cid).Delete(&model.HeldMessage{}).Error; err != nil {
+		return err
+	}
+	s.ids.Reset()
+	s.loaded = true
+	return nil
+}
+
+func (s *sqlStore) Records(fn func(r *model.Record, held bool) error) error {
+	var messages []model.Message
+	if err := s.db.Where("client_id = ?", s.cid).Order("packet_id").Find(&messages).Error; err != nil {
+		return err
+	}
+	for _, m := range messages {
+		record, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			return err
+		}
+		if err := fn(record, false); err != nil {
+			return err
+		}
+	}
+	var held []model.HeldMessage
+	if err := s.db.Where("client_id = ?", s.cid).Order("packet_id").Find(&held).Error; err != nil {
+		return err
+	}
+	for _, m := range held {
+		record, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			return err
+		}
+		if err := fn(record, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) Restore(r *model.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	buf, err := r.Encode()
+	if err != nil {
+		return err
+	}
+	pid := packetID(r.Content)
+	// a record of the packet ID is replaced
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("client_id = ? AND packet_id = ?", s.cid, uint16(pid)).Delete(&model.Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.Message{
+			ClientID: s.cid,
+			PacketID: uint16(pid),
+			Record:   buf,
+			ResendAt: s.policy.Next(r),
+			Created:  r.Receive,
+		}).Error
+	}); err != nil {
+		return err
+	}
+	s.ids.Use(pid)
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	close(s.closing)
+	return nil
+}
+
+func (s *sqlStore) delete(pid mqtt.PacketID) error {
+	if err := s.db.Where("client_id = ? AND packet_id = ?", s.cid, uint16(pid)).Delete(&model.Message{}).Error; err != nil {
+		return err
+	}
+	s.free(pid)
+	return nil
+}
+
+func packetID(p mqtt.Packet) mqtt.PacketID {
+	if m, ok := p.(mqtt.Message); ok {
+		return m.PID()
+	}
+	return 0
+}
+
+func next(id mqtt.PacketID) mqtt.PacketID {
+	if id >= mqtt.MAX_PACKET_ID {
+		return 1
+	}
+	return id + 1
+}
@@ -0,0 +1,201 @@
+package sqlStore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/utils"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	db, err := Open(config.Database{Type: "sqlite", DSN: filepath.Join(t.TempDir(), "mercury.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func newPublish(topic string, qos mqtt.QoS) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Payload = []byte("payload")
+	return p
+}
+
+func count(t *testing.T, db *gorm.DB, cid string) int64 {
+	var n int64
+	if err := db.Model(&model.Message{}).Where("client_id = ?", cid).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPublishAck(t *testing.T) {
+	db := openTestDB(t)
+	s := New(db, "c1", time.Hour, retry.Policy{})
+	for want := mqtt.PacketID(1); want <= 2; want++ {
+		r, err := s.Publish(newPublish("a", mqtt.QoS2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := r.Content.(*mqtt.Publish).PacketID; id != want {
+			t.Fatalf("expected packet ID %d, got %d", want, id)
+		}
+	}
+	if n := count(t, db, "c1"); n != 2 {
+		t.Fatalf("expected 2 records, got %d", n)
+	}
+
+	pubrel := &mqtt.Pubrel{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBREL}, Version: mqtt.MQTT5}, PacketID: 1}
+	if err := s.Receive(pubrel); err != nil {
+		t.Fatal(err)
+	}
+	var m model.Message
+	if err := db.Where("client_id = ? AND packet_id = ?", "c1", 1).Take(&m).Error; err != nil {
+		t.Fatal(err)
+	}
+	if r, err := model.DecodeRecord(m.Record); err != nil {
+		t.Fatal(err)
+	} else if _, ok := r.Content.(*mqtt.Pubrel); !ok {
+		t.Fatalf("expected PUBREL record, got %T", r.Content)
+	}
+
+	if err := s.Complete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, "c1"); n != 0 {
+		t.Fatalf("expected no records, got %d", n)
+	}
+}
+
+func TestPacketIDAfterRestart(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := New(db, "c1", time.Hour, retry.Policy{}).Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	// a new store of the client continues after the inflight record
+	r, err := New(db, "c1", time.Hour, retry.Policy{}).Publish(newPublish("b", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := r.Content.(*mqtt.Publish).PacketID; id != 2 {
+		t.Fatalf("expected packet ID 2, got %d", id)
+	}
+
+	// after the wrap the ID still inflight is skipped
+	s := New(db, "c2", time.Hour, retry.Policy{})
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	s.ids.SetNext(mqtt.MAX_PACKET_ID)
+	ids := []mqtt.PacketID{}
+	for _, topic := range []string{"b", "c"} {
+		r, err := s.Publish(newPublish(topic, mqtt.QoS1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, r.Content.(*mqtt.Publish).PacketID)
+	}
+	if ids[0] != mqtt.MAX_PACKET_ID || ids[1] != 2 {
+		t.Fatalf("expected packet IDs %d and 2, got %v", mqtt.MAX_PACKET_ID, ids)
+	}
+	for id := mqtt.PacketID(1); id < mqtt.MAX_PACKET_ID; id++ {
+		s.ids.Use(id)
+	}
+	s.ids.Use(mqtt.MAX_PACKET_ID)
+	if _, err := s.Publish(newPublish("d", mqtt.QoS1)); !errors.Is(err, utils.ErrPacketIDExhausted) {
+		t.Fatalf("expected ErrPacketIDExhausted, got %v", err)
+	}
+}
+
+func TestHold(t *testing.T) {
+	db := openTestDB(t)
+	p := newPublish("a", mqtt.QoS2)
+	p.PacketID = 7
+	if held, err := New(db, "c1", time.Hour, retry.Policy{}).Hold(p); err != nil || !held {
+		t.Fatalf("expected the publish held, got %v, %v", held, err)
+	}
+	// the store of the reconnected client knows the publish
+	s := New(db, "c1", time.Hour, retry.Policy{})
+	if held, err := s.Hold(p); err != nil || held {
+		t.Fatalf("expected the DUP not held, got %v, %v", held, err)
+	}
+	if n, err := s.Held(); err != nil || n != 1 {
+		t.Fatalf("expected 1 held publish, got %d, %v", n, err)
+	}
+	released, err := s.Release(7)
+	if err != nil || released == nil || released.Topic != "a" {
+		t.Fatalf("unexpected released publish %v, %v", released, err)
+	}
+	if released, err := s.Release(7); err != nil || released != nil {
+		t.Fatalf("released twice %v, %v", released, err)
+	}
+}
+
+func TestResendAndClean(t *testing.T) {
+	db := openTestDB(t)
+	s := New(db, "c1", time.Hour, retry.Policy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 3})
+	if _, err := s.Publish(newPublish("a", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan mqtt.Packet, 10)
+	dead := make(chan *model.Record, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, func(p mqtt.Packet) error {
+		written <- p
+		return nil
+	}, func(r *model.Record) { dead <- r })
+	for range 2 {
+		select {
+		case p := <-written:
+			if p := p.(*mqtt.Publish); p.PacketID != 1 || !p.Dup {
+				t.Fatalf("unexpected packet %v", p)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("record not resent")
+		}
+	}
+	// the third attempt is the last, the record is then a dead letter
+	select {
+	case r := <-dead:
+		if r.Times != 2 {
+			t.Fatalf("expected 2 resends of the dead letter, got %d", r.Times)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("record not dead lettered")
+	}
+	if n := count(t, db, "c1"); n != 0 {
+		t.Fatalf("expected the dead letter removed, got %d records", n)
+	}
+	s.Close()
+
+	if _, err := s.Publish(newPublish("b", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clean(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, "c1"); n != 0 {
+		t.Fatalf("expected no records after clean, got %d", n)
+	}
+}
@@ -2,26 +2,169 @@ package store
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
 
 	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/internal/server/message/retry"
 	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
 	memStore "github.com/jin06/mercury/internal/server/message/store/memory"
+	redisStore "github.com/jin06/mercury/internal/server/message/store/redis"
+	sqlStore "github.com/jin06/mercury/internal/server/message/store/sql"
+	"github.com/jin06/mercury/internal/server/retained"
+	"github.com/jin06/mercury/internal/server/sessions"
+	"github.com/jin06/mercury/internal/server/subscriptions"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-func NewStore(mode string, cid string) Store {
-	var s Store
-	switch mode {
-	case "memory":
-		s = memStore.New(cid)
+var ErrHistoryMode = errors.New("message history is only kept in the badger mode")
+
+// NewFactory opens the database of the message store mode, it is shared by the stores of all clients.
+func NewFactory(cfg config.MessageStore, expiry time.Duration, policy retry.Policy) (*Factory, error) {
+	f := &Factory{mode: cfg.Mode, expiry: expiry, policy: policy}
+	if len(cfg.History) > 0 && cfg.Mode != "badger" {
+		return nil, ErrHistoryMode
+	}
+	switch cfg.Mode {
+	case "", "memory":
 	case "badger":
-		s = badgerStore.New(cid)
+		db, err := badgerStore.Open(cfg.BadgerConfig)
+		if err != nil {
+			return nil, err
+		}
+		f.badger = db
+		if f.envelope, err = badgerStore.OpenEnvelope(cfg.BadgerConfig.Encryption); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if f.envelope != nil {
+			if err := badgerStore.Rewrap(db, f.envelope, subscriptions.BadgerKind, sessions.BadgerKind, retained.BadgerKind); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		f.subscriptions = subscriptions.NewBadgerStore(db, f.envelope)
+		f.sessions = sessions.NewBadgerStore(db, f.envelope)
+		f.retained = retained.NewBadgerStore(db, f.envelope)
+		if len(cfg.History) > 0 {
+			h, err := badgerStore.NewHistory(db, f.envelope, cfg.History)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			f.history = h
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		f.stopGC = cancel
+		f.gc.Add(1)
+		go func() {
+			defer f.gc.Done()
+			badgerStore.RunGC(ctx, db, cfg.BadgerConfig.GCInterval)
+		}()
 	case "redis":
+		client, err := redisStore.Open(cfg.RedisConfig)
+		if err != nil {
+			return nil, err
+		}
+		f.redis = client
+		f.prefix = cfg.RedisConfig.KeyPrefix
+	case "sql":
+		db, err := sqlStore.Open(cfg.SQLConfig)
+		if err != nil {
+			return nil, err
+		}
+		f.sql = db
+		if f.subscriptions, err = subscriptions.NewSQLStore(db); err != nil {
+			return nil, err
+		}
+		if f.sessions, err = sessions.NewSQLStore(db); err != nil {
+			return nil, err
+		}
+		if f.retained, err = retained.NewSQLStore(db); err != nil {
+			return nil, err
+		}
 	default:
-		panic("memory store: " + config.Def.MessageStore.Mode)
+		return nil, fmt.Errorf("unsupported message store: %q", cfg.Mode)
+	}
+	return f, nil
+}
+
+// Factory creates the message store of each client. The badger and sql modes also keep the
+// subscriptions, sessions and retained messages in their database.
+type Factory struct {
+	mode          string
+	expiry        time.Duration
+	policy        retry.Policy
+	badger        *badger.DB
+	envelope      *badgerStore.Envelope
+	stopGC        context.CancelFunc
+	gc            sync.WaitGroup
+	redis         *redis.Client
+	prefix        string
+	sql           *gorm.DB
+	subscriptions subscriptions.Store
+	sessions      sessions.Store
+	retained      retained.Store
+	history       history.Store
+}
+
+// Subscriptions returns the subscription store of the database, nil when the mode has none.
+func (f *Factory) Subscriptions() subscriptions.Store {
+	return f.subscriptions
+}
+
+// Sessions returns the session store of the database, nil when the mode has none.
+func (f *Factory) Sessions() sessions.Store {
+	return f.sessions
+}
+
+// Retained returns the retained message store of the database, nil when the mode has none.
+func (f *Factory) Retained() retained.Store {
+	return f.retained
+}
+
+// History returns the message history, nil unless the badger mode keeps one.
+func (f *Factory) History() history.Store {
+	return f.history
+}
+
+func (f *Factory) New(cid string) Store {
+	switch f.mode {
+	case "badger":
+		return badgerStore.New(f.badger, f.envelope, cid, f.expiry, f.policy)
+	case "redis":
+		return redisStore.New(f.redis, f.prefix, cid, f.expiry, f.policy)
+	case "sql":
+		return sqlStore.New(f.sql, cid, f.expiry, f.policy)
+	}
+	return memStore.New(cid, f.expiry, f.policy)
+}
+
+func (f *Factory) Close() error {
+	if f.badger != nil {
+		f.stopGC()
+		f.gc.Wait()
+		return f.badger.Close()
+	}
+	if f.redis != nil {
+		return f.redis.Close()
+	}
+	if f.sql != nil {
+		db, err := f.sql.DB()
+		if err != nil {
+			return err
+		}
+		return db.Close()
 	}
-	return s
+	return nil
 }
 
 type Store interface {
@@ -29,8 +172,26 @@ type Store interface {
 	Ack(mqtt.PacketID) error
 	Receive(*mqtt.Pubrel) error
 	Complete(mqtt.PacketID) error
-	Release(*mqtt.Pubcomp) error
-	Run(ctx context.Context, ch chan mqtt.Packet) error
+	// Hold keeps an incoming QoS 2 publish until its PUBREL, false when a publish with the packet
+	// ID is already held, e.g. p is a DUP.
+	Hold(p *mqtt.Publish) (bool, error)
+	// Peek returns the held publish of a PUBREL without removing it, nil when none is held.
+	Peek(mqtt.PacketID) (*mqtt.Publish, error)
+	// Release removes the held publish of a PUBREL and returns it, nil when none is held.
+	Release(mqtt.PacketID) (*mqtt.Publish, error)
+	// Held is the number of held publishes.
+	Held() (int, error)
+	// Run writes the inflight records again as the retry policy allows until the store is closed,
+	// records out of attempts are removed and passed to dead.
+	Run(ctx context.Context, write func(mqtt.Packet) error, dead func(*model.Record)) error
+	// Resend writes all inflight records again at once, when the client resumes its session.
+	Resend(write func(mqtt.Packet) error, dead func(*model.Record)) error
+	// Clean drops the inflight records and the held publishes, when a clean session starts.
 	Clean() error
+	// Records passes the inflight records to fn, then the held publishes as records with held set.
+	Records(fn func(r *model.Record, held bool) error) error
+	// Restore saves an inflight record of a snapshot with its packet ID, held publishes of a
+	// snapshot are restored by Hold.
+	Restore(r *model.Record) error
 	Close() error
 }
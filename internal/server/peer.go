@@ -0,0 +1,28 @@
+package server
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// PeerCredentials identify the local process connected over a unix socket.
+type PeerCredentials struct {
+	UID uint32
+	GID uint32
+	PID int32
+	// Username is the OS user name of UID, or UID when it has none.
+	Username string
+}
+
+func NewPeerCredentials(uid, gid uint32, pid int32) *PeerCredentials {
+	p := &PeerCredentials{
+		UID:      uid,
+		GID:      gid,
+		PID:      pid,
+		Username: strconv.FormatUint(uint64(uid), 10),
+	}
+	if u, err := user.LookupId(p.Username); err == nil {
+		p.Username = u.Username
+	}
+	return p
+}
@@ -0,0 +1,194 @@
+// Package proxy reads PROXY protocol v1 and v2 headers sent by load balancers
+// in front of a listener, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidHeader = errors.New("invalid proxy protocol header")
+	ErrUntrusted     = errors.New("connection not from a trusted proxy")
+	ErrNoTrusted     = errors.New("proxy protocol without trusted proxies")
+)
+
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Conn is a connection whose RemoteAddr is the client address sent by the proxy.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Trusted reports whether addr is in one of the trusted networks, no networks trust no address.
+func Trusted(addr net.Addr, trusted []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrusted parses CIDRs and single IPs.
+func ParseTrusted(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Read reads the PROXY protocol header from conn, which must come from a trusted proxy.
+// The header must arrive within timeout, 0 means no timeout.
+func Read(conn net.Conn, trusted []netip.Prefix, timeout time.Duration) (*Conn, error) {
+	if !Trusted(conn.RemoteAddr(), trusted) {
+		return nil, ErrUntrusted
+	}
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	c := &Conn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+	}
+	prefix, err := c.reader.Peek(len(signature))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	if bytes.Equal(prefix, signature) {
+		remote, err = readV2(c.reader)
+	} else {
+		remote, err = readV1(c.reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil {
+		c.remote = remote
+	}
+	return c, nil
+}
+
+// readV1 reads a text header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1883\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	// a v1 header is at most 107 bytes
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrInvalidHeader
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readV2 reads a binary header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0F {
+	case 0x0:
+		// LOCAL, e.g. health checks of the proxy itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, ErrInvalidHeader
+	}
+	var addr netip.Addr
+	var port []byte
+	switch header[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		addr = netip.AddrFrom4([4]byte(body[0:4]))
+		port = body[8:10]
+	case 0x2:
+		if len(body) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		addr = netip.AddrFrom16([16]byte(body[0:16]))
+		port = body[32:34]
+	default:
+		// AF_UNSPEC or AF_UNIX, keep the connection address
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port))), nil
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// trusted holds the address of the connections returned by pipe.
+var trusted = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+// pipe returns a connection from 192.0.2.10, as if accepted from a proxy, and its peer.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return &addrConn{conn, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 4000}}, peer
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func read(t *testing.T, header []byte, trusted []netip.Prefix) (*Conn, error) {
+	conn, peer := pipe(t)
+	go peer.Write(append(header, "mqtt"...))
+	c, err := Read(conn, trusted, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// the bytes after the header are left for the client
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(c, data); err != nil || string(data) != "mqtt" {
+		t.Errorf("expected payload after header, got %q %v", data, err)
+	}
+	return c, nil
+}
+
+func TestReadV1(t *testing.T) {
+	c, err := read(t, []byte("PROXY TCP4 198.51.100.7 192.0.2.1 56324 1883\r\n"), trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "198.51.100.7:56324" {
+		t.Errorf("unexpected remote address %s", got)
+	}
+	c, err = read(t, []byte("PROXY UNKNOWN\r\n"), trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "192.0.2.10:4000" {
+		t.Errorf("unknown should keep the connection address, got %s", got)
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	header := append([]byte{}, signature...)
+	header = append(header, 0x21, 0x21) // v2 PROXY, TCP over IPv6
+	header = binary.BigEndian.AppendUint16(header, 36+3)
+	header = append(header, netip.MustParseAddr("2001:db8::7").AsSlice()...)
+	header = append(header, netip.MustParseAddr("2001:db8::1").AsSlice()...)
+	header = binary.BigEndian.AppendUint16(header, 56324)
+	header = binary.BigEndian.AppendUint16(header, 1883)
+	header = append(header, 0x04, 0x00, 0x00) // empty NOOP TLV
+	c, err := read(t, header, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "[2001:db8::7]:56324" {
+		t.Errorf("unexpected remote address %s", got)
+	}
+}
+
+func TestReadUntrusted(t *testing.T) {
+	conn, _ := pipe(t)
+	if _, err := Read(conn, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, time.Second); err != ErrUntrusted {
+		t.Errorf("expected untrusted, got %v", err)
+	}
+	// no trusted proxies trust nobody
+	if _, err := Read(conn, nil, time.Second); err != ErrUntrusted {
+		t.Errorf("expected untrusted without trusted proxies, got %v", err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	if _, err := read(t, []byte("GET / HTTP/1.1\r\n"), trusted); err != ErrInvalidHeader {
+		t.Errorf("expected invalid header, got %v", err)
+	}
+}
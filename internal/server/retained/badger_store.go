@@ -0,0 +1,88 @@
+package retained
+
+import (
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/model"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// BadgerKind starts the keys of the retained messages, the other stores sharing the database
+// use the kinds below 18:
+//
+//	BadgerKind {topic} -> encoded model.Record of the publish
+const BadgerKind byte = 18
+
+// NewBadgerStore creates a retained message store in db, a non nil envelope encrypts the messages.
+func NewBadgerStore(db *badger.DB, envelope *badgerStore.Envelope) *BadgerStore {
+	return &BadgerStore{db: db, envelope: envelope}
+}
+
+type BadgerStore struct {
+	db       *badger.DB
+	envelope *badgerStore.Envelope
+}
+
+func (s *BadgerStore) Save(p *mqtt.Publish) error {
+	buf, err := model.NewRecord("", p, 0).Encode()
+	if err != nil {
+		return err
+	}
+	if s.envelope != nil {
+		if buf, err = s.envelope.Seal(buf); err != nil {
+			return err
+		}
+	}
+	e := badger.NewEntry(key(p.Topic.String()), buf)
+	if ttl := expiry(p); ttl > 0 {
+		e = e.WithTTL(ttl)
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+func (s *BadgerStore) Delete(topic string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key(topic))
+	})
+}
+
+func (s *BadgerStore) All() (list []*mqtt.Publish, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{BadgerKind}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := it.Item().Value(func(val []byte) error {
+				p, err := s.unmarshal(val)
+				if err != nil {
+					return err
+				}
+				list = append(list, p)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// unmarshal decodes a saved message, opening it with the envelope if there is one.
+func (s *BadgerStore) unmarshal(val []byte) (*mqtt.Publish, error) {
+	if s.envelope != nil {
+		var err error
+		if val, err = s.envelope.Open(val); err != nil {
+			return nil, err
+		}
+	}
+	return decode(val)
+}
+
+func key(topic string) []byte {
+	return append([]byte{BadgerKind}, topic...)
+}
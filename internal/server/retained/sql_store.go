@@ -0,0 +1,73 @@
+package retained
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// message is a row of the retained messages table.
+type message struct {
+	Topic string `gorm:"primaryKey;size:1024"`
+	// Record is the encoded model.Record of the publish.
+	Record []byte
+	// ExpiresAt is when the message expires, nil when it does not.
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+func (m *message) TableName() string {
+	return "retained_messages"
+}
+
+// NewSQLStore creates the retained messages table if needed.
+func NewSQLStore(db *gorm.DB) (*SQLStore, error) {
+	if err := db.AutoMigrate(&message{}); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+type SQLStore struct {
+	db *gorm.DB
+}
+
+func (s *SQLStore) Save(p *mqtt.Publish) error {
+	buf, err := model.NewRecord("", p, 0).Encode()
+	if err != nil {
+		return err
+	}
+	row := &message{Topic: p.Topic.String(), Record: buf}
+	if ttl := expiry(p); ttl > 0 {
+		at := time.Now().Add(ttl)
+		row.ExpiresAt = &at
+	}
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(row).Error
+}
+
+func (s *SQLStore) Delete(topic string) error {
+	return s.db.Where("topic = ?", topic).Delete(&message{}).Error
+}
+
+// All deletes the expired messages and returns the others.
+func (s *SQLStore) All() ([]*mqtt.Publish, error) {
+	if err := s.db.Where("expires_at <= ?", time.Now()).Delete(&message{}).Error; err != nil {
+		return nil, err
+	}
+	var rows []*message
+	if err := s.db.Order("topic").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	list := make([]*mqtt.Publish, 0, len(rows))
+	for _, row := range rows {
+		p, err := decode(row.Record)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
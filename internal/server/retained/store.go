@@ -0,0 +1,41 @@
+package retained
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Store persists the retained messages so they survive a restart of the broker. A message
+// with a message expiry interval is dropped once it expired.
+type Store interface {
+	// Save adds the message or replaces the one retained for the same topic.
+	Save(p *mqtt.Publish) error
+	// Delete removes the message retained for topic, if any.
+	Delete(topic string) error
+	// All returns the messages that did not expire.
+	All() ([]*mqtt.Publish, error)
+}
+
+// expiry returns the message expiry interval of p, 0 when it does not expire.
+func expiry(p *mqtt.Publish) time.Duration {
+	if p.Properties == nil || p.Properties.MessageExpiryInterval == nil {
+		return 0
+	}
+	return time.Duration(*p.Properties.MessageExpiryInterval) * time.Second
+}
+
+// decode returns the publish of an encoded model.Record.
+func decode(buf []byte) (*mqtt.Publish, error) {
+	r, err := model.DecodeRecord(buf)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := r.Content.(*mqtt.Publish)
+	if !ok {
+		return nil, fmt.Errorf("retained message is a %T", r.Content)
+	}
+	return p, nil
+}
@@ -0,0 +1,115 @@
+package retained
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestSQLStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "mercury.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testStore(t, NewBadgerStore(db, nil))
+}
+
+func TestEncryptedBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	envelope, err := badgerStore.NewEnvelope(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, NewBadgerStore(db, envelope))
+	// the payloads are sealed
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte{BadgerKind}, "a/b"...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if bytes.Contains(val, []byte("second")) {
+				t.Error("retained message stored in plain text")
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newPublish(topic, payload string) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = mqtt.QoS1
+	p.Retain = true
+	p.Payload = []byte(payload)
+	return p
+}
+
+func testStore(t *testing.T, s Store) {
+	for _, p := range []*mqtt.Publish{newPublish("a/b", "first"), newPublish("c", "other"), newPublish("a/b", "second")} {
+		if err := s.Save(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(list, func(a, b *mqtt.Publish) int {
+		return strings.Compare(a.Topic.String(), b.Topic.String())
+	})
+	// saving again replaces the message of the topic
+	if len(list) != 2 || string(list[0].Payload) != "second" || list[0].Qos != mqtt.QoS1 || list[1].Topic != "c" {
+		t.Fatalf("unexpected retained messages %v", list)
+	}
+
+	expiring := newPublish("e", "soon")
+	interval := uint32(1)
+	expiring.Properties = &mqtt.Properties{MessageExpiryInterval: &interval}
+	if err := s.Save(expiring); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.All(); err != nil || len(list) != 2 {
+		t.Fatalf("expected a/b and e, got %v, %v", list, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if list, err := s.All(); err != nil || len(list) != 1 || list[0].Topic != "a/b" {
+		t.Fatalf("expected the expired message dropped, got %v, %v", list, err)
+	}
+}
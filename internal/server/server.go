@@ -1,6 +1,8 @@
 package server
 
 import (
+	"github.com/jin06/mercury/internal/server/limits"
+	"github.com/jin06/mercury/internal/snapshot"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
@@ -11,4 +13,9 @@ type Server interface {
 	HandleConnect(p *mqtt.Connect, c Client) (resp *mqtt.Connack, err error)
 	Dispatch(cid string, p *mqtt.Publish) error
 	Delivery(cid string, msg *mqtt.Publish) error
+	Clients() []Client
+	Connections() *limits.Connections
+	PublishQuotas() *limits.Publish
+	// Snapshot takes a snapshot of the sessions outliving their connection while serving.
+	Snapshot() (*snapshot.Snapshot, error)
 }
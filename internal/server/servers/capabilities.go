@@ -0,0 +1,90 @@
+package servers
+
+import (
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newCapabilities(cfg config.Capabilities) *capabilities {
+	return &capabilities{cfg}
+}
+
+type capabilities struct {
+	config.Capabilities
+}
+
+func (c *capabilities) maximumQoS() mqtt.QoS {
+	if c.MaximumQoS > byte(mqtt.QoS2) {
+		return mqtt.QoS2
+	}
+	return mqtt.QoS(c.MaximumQoS)
+}
+
+// properties returns the CONNACK properties advertising the broker capabilities.
+func (c *capabilities) properties() *mqtt.Properties {
+	props := &mqtt.Properties{
+		RetainAvailable:                 &c.RetainAvailable,
+		WildcardSubscriptionAvailable:   &c.WildcardSubscriptionAvailable,
+		SubscriptionIdentifierAvailable: &c.SubscriptionIdentifierAvailable,
+		SharedSubscriptionAvailable:     &c.SharedSubscriptionAvailable,
+	}
+	// Maximum QoS must not be sent when QoS 2 is supported
+	if qos := c.maximumQoS(); qos < mqtt.QoS2 {
+		props.MaximumQoS = &qos
+	}
+	if c.ReceiveMaximum > 0 {
+		props.ReceiveMaximum = &c.ReceiveMaximum
+	}
+	if c.TopicAliasMaximum > 0 {
+		props.TopicAliasMaximum = &c.TopicAliasMaximum
+	}
+	if c.MaximumPacketSize > 0 {
+		props.MaximumPacketSize = &c.MaximumPacketSize
+	}
+	return props
+}
+
+func (c *capabilities) checkPublish(p *mqtt.Publish) error {
+	if p.Qos > c.maximumQoS() {
+		return mqtt.Err_V5_QoS_Not_Supported
+	}
+	if p.Retain && !c.RetainAvailable {
+		return mqtt.Err_V5_Retain_Not_Supported
+	}
+	return nil
+}
+
+// grant returns the SUBACK reason code for a subscription, either the granted QoS or a failure code.
+func (c *capabilities) grant(p *mqtt.Subscribe, sub *mqtt.Subscription) mqtt.ReasonCode {
+	code := c.check(p, sub)
+	if code == mqtt.V5_SUCCESS {
+		return mqtt.ReasonCode(min(sub.QoS, c.maximumQoS()))
+	}
+	return subackFailure(p, code)
+}
+
+func subackFailure(p *mqtt.Subscribe, code mqtt.ReasonCode) mqtt.ReasonCode {
+	if !p.Version.IsMQTT5() {
+		// v3,v4 only have a single failure return code
+		return mqtt.V5_Unspecified_Error
+	}
+	return code
+}
+
+func (c *capabilities) check(p *mqtt.Subscribe, sub *mqtt.Subscription) mqtt.ReasonCode {
+	tf, err := subscriptions.NewTF(sub.TopicFilter)
+	if err != nil {
+		return mqtt.V5_Topic_Filter_Invalid
+	}
+	if tf.Type == subscriptions.TypeShare && !c.SharedSubscriptionAvailable {
+		return mqtt.V5_Shared_Subscriptions_Not_Supported
+	}
+	if topic := mqtt.Topic(tf.TopicName); topic.IsWild() && !c.WildcardSubscriptionAvailable {
+		return mqtt.V5_Wildcard_Subscriptions_Not_Supported
+	}
+	if p.Properties != nil && p.Properties.SubscriptionIdentifier != nil && !c.SubscriptionIdentifierAvailable {
+		return mqtt.V5_Subscription_Identifiers_Not_Supported
+	}
+	return mqtt.V5_SUCCESS
+}
@@ -0,0 +1,58 @@
+package servers
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestCapabilitiesCheckPublish(t *testing.T) {
+	cfg := config.DefaultCapabilities()
+	cfg.MaximumQoS = 1
+	cfg.RetainAvailable = false
+	c := newCapabilities(cfg)
+
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Qos = mqtt.QoS2
+	if code, _ := mqtt.ErrorCode(c.checkPublish(p)); code != mqtt.V5_QoS_Not_Supported {
+		t.Errorf("expected QoS not supported, got %#x", code)
+	}
+	p.Qos = mqtt.QoS1
+	p.Retain = true
+	if code, _ := mqtt.ErrorCode(c.checkPublish(p)); code != mqtt.V5_Retain_Not_Supported {
+		t.Errorf("expected retain not supported, got %#x", code)
+	}
+	p.Retain = false
+	if err := c.checkPublish(p); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCapabilitiesGrant(t *testing.T) {
+	cfg := config.DefaultCapabilities()
+	cfg.MaximumQoS = 1
+	cfg.WildcardSubscriptionAvailable = false
+	c := newCapabilities(cfg)
+
+	s := mqtt.NewSubscribe(&mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, mqtt.MQTT5)
+	cases := []struct {
+		sub  *mqtt.Subscription
+		want mqtt.ReasonCode
+	}{
+		{&mqtt.Subscription{TopicFilter: "a/b", QoS: mqtt.QoS2}, mqtt.V5_Granted_QoS1},
+		{&mqtt.Subscription{TopicFilter: "a/b", QoS: mqtt.QoS0}, mqtt.V5_Granted_QoS0},
+		{&mqtt.Subscription{TopicFilter: "a/+"}, mqtt.V5_Wildcard_Subscriptions_Not_Supported},
+		{&mqtt.Subscription{TopicFilter: "$share/g/a"}, mqtt.V5_Shared_Subscriptions_Not_Supported},
+	}
+	for _, tc := range cases {
+		if got := c.grant(s, tc.sub); got != tc.want {
+			t.Errorf("%s: expected %#x, got %#x", tc.sub.TopicFilter, tc.want, got)
+		}
+	}
+
+	s.Version = mqtt.MQTT4
+	if got := c.grant(s, &mqtt.Subscription{TopicFilter: "a/#"}); got != mqtt.V5_Unspecified_Error {
+		t.Errorf("expected v4 failure code, got %#x", got)
+	}
+}
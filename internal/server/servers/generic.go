@@ -3,34 +3,82 @@ package servers
 import (
 	"context"
 	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/logger"
 	"github.com/jin06/mercury/internal/model"
 	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/acl"
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/internal/server/limits"
 	"github.com/jin06/mercury/internal/server/message"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/server/retained"
+	"github.com/jin06/mercury/internal/server/sessions"
 	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/internal/utils"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
-func newGeneric() *generic {
+func newGeneric(cfg *config.Config, newStore func(cid string) store.Store, persist Persistence) *generic {
 	ch := make(chan *model.Record, 2000)
+	access := acl.New(cfg.ACL)
+	if info := cfg.MQTTConfig.ResponseInformation; info != "" {
+		// clients may always subscribe to their own response topics
+		access.Prepend(config.ACLRule{
+			Permission: acl.Allow,
+			Action:     string(acl.Subscribe),
+			Topic:      strings.TrimSuffix(info, "/") + "/#",
+		})
+	}
 	server := &generic{
+		cfg:           cfg,
 		manager:       server.NewManager(),
 		subManager:    subscriptions.NewTrie(),
-		msgManager:    message.NewManager(ch),
+		msgManager:    message.NewManager(ch, newStore, cfg.MQTTConfig.SlowConsumer),
 		retainManager: subscriptions.NewTrieRetain(),
 		ch:            ch,
 		closing:       make(chan struct{}),
+		capabilities:  newCapabilities(cfg.Capabilities),
+		acl:           access,
+		connections:   limits.New(cfg),
+		quotas:        limits.NewPublish(cfg.MQTTConfig.PublishQuotas),
+		subStore:      persist.Subscriptions,
+		sessStore:     persist.Sessions,
+		retainStore:   persist.Retained,
+		history:       persist.History,
+		expiries:      newExpiries(),
+		replays:       newReplays(),
 	}
 	return server
 }
 
 type generic struct {
+	cfg           *config.Config
 	manager       *server.Manager
 	subManager    subscriptions.SubManager
 	msgManager    *message.Manager
 	retainManager subscriptions.RetainManager
 	ch            chan *model.Record
 	closing       chan struct{}
+	capabilities  *capabilities
+	acl           *acl.ACL
+	connections   *limits.Connections
+	quotas        *limits.Publish
+	// subStore and sessStore persist the sessions outliving their connection, both or none are set
+	subStore  subscriptions.Store
+	sessStore sessions.Store
+	// retainStore persists the retained messages, nil keeps them in memory only
+	retainStore retained.Store
+	expiries    *expiries
+	history     history.Store
+	// replays holds back the live messages of the clients being replayed to
+	replays *replays
 }
 
 func (g *generic) Run(ctx context.Context) error {
@@ -57,21 +105,19 @@ func (g *generic) Register(c server.Client) error {
 			return err
 		}
 	}
-	if err := g.manager.Set(c); err != nil {
-		return err
-	}
-	if err := g.msgManager.Set(c.ClientID()); err != nil {
-		return err
-	}
-	return nil
+	return g.manager.Set(c)
 }
 
 func (g *generic) Deregister(c server.Client) error {
 	if c == nil {
 		return errors.New("client is nil")
 	}
-	g.manager.RemoveClient(c)
-	g.msgManager.Del(c.ClientID())
+	g.connections.Logout(c.UUID())
+	if g.manager.RemoveClient(c) {
+		if err := g.endConnection(c.ClientID()); err != nil {
+			logger.Error(err)
+		}
+	}
 	return nil
 }
 
@@ -101,32 +147,162 @@ func (g *generic) HandlePacket(packet mqtt.Packet, cid string) (resp mqtt.Packet
 }
 
 func (g *generic) HandleConnect(p *mqtt.Connect, c server.Client) (resp *mqtt.Connack, err error) {
+	resp = p.Response()
+	if !g.connections.Login(c.UUID(), p.Username) {
+		resp.ReasonCode = mqtt.V5_Quota_Exceeded
+		if !p.Version.IsMQTT5() {
+			resp.ReasonCode = mqtt.RET_CONNACK_SERVER_UNAVAILABLE
+		}
+		return
+	}
 	if err = g.Register(c); err != nil {
 		return
 	}
-	resp = p.Response()
+	if err = g.startSession(p); err != nil {
+		return
+	}
+	if err = g.resume(p); err != nil {
+		return
+	}
+	if p.Version.IsMQTT5() {
+		resp.Properties = g.capabilities.properties()
+		if info, ok := g.responseInformation(p); ok {
+			resp.Properties.ResponseInformation = &info
+		}
+	}
 	return
 }
 
+// resume sends the inflight messages of the session again. MQTT 5 clients get them only now,
+// MQTT 3 clients also by the retry policy unless it is reconnect only.
+func (g *generic) resume(p *mqtt.Connect) error {
+	cid := p.ClientID
+	retry := !p.Version.IsMQTT5() && !g.cfg.MQTTConfig.Retry.ReconnectOnly
+	write := func(packet mqtt.Packet) error { return g.write(cid, packet) }
+	dead := func(r *model.Record) { g.deadLetter(cid, r) }
+	return g.msgManager.Resume(cid, p.Clean, retry, write, dead)
+}
+
+// deadLetter publishes a message out of delivery attempts to the dead letter topic, the user
+// properties tell the failure reason, the original topic, the client and the attempts.
+func (g *generic) deadLetter(cid string, r *model.Record) {
+	topic := g.cfg.MQTTConfig.Retry.DeadLetterTopic
+	publish, ok := r.Content.(*mqtt.Publish)
+	if topic == "" || !ok {
+		// a PUBREL means the message was received, only its completion is missing
+		return
+	}
+	np := publish.Clone()
+	np.Topic = mqtt.Topic(topic)
+	np.PacketID = 0
+	np.Dup = false
+	np.Retain = false
+	if np.Properties == nil {
+		np.Properties = new(mqtt.Properties)
+	}
+	np.Properties.TopicAlias = nil
+	np.Properties.SubscriptionIdentifier = nil
+	np.Properties.UserProperties = append(np.Properties.UserProperties,
+		mqtt.UserProperty{Key: "reason", Val: retry.ReasonMaxAttempts},
+		mqtt.UserProperty{Key: "topic", Val: publish.Topic.String()},
+		mqtt.UserProperty{Key: "client_id", Val: cid},
+		mqtt.UserProperty{Key: "attempts", Val: strconv.FormatUint(r.Times+1, 10)},
+	)
+	if err := g.Dispatch("", np); err != nil {
+		logger.Error(err)
+	}
+}
+
+func (g *generic) responseInformation(p *mqtt.Connect) (string, bool) {
+	template := g.cfg.MQTTConfig.ResponseInformation
+	if template == "" || p.Properties == nil || p.Properties.RequestResponseInformation == nil || !*p.Properties.RequestResponseInformation {
+		return "", false
+	}
+	return acl.Expand(template, p.ClientID, p.Username)
+}
+
+// allow checks the acl with the username of the connected client.
+func (g *generic) allow(action acl.Action, cid string, topic string) bool {
+	who := acl.Client{ID: cid}
+	if c := g.manager.Get(cid); c != nil {
+		who.Username = c.Username()
+		if addr := c.RemoteAddr(); addr != nil {
+			if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+				who.Addr = ap.Addr()
+			}
+		}
+	}
+	return g.acl.Allow(action, who, topic)
+}
+
+func (g *generic) username(cid string) string {
+	if c := g.manager.Get(cid); c != nil {
+		return c.Username()
+	}
+	return ""
+}
+
+// refuse sets the reason code of a PUBACK or PUBREC, QoS 0 publishes have no response.
+func refuse(resp mqtt.Packet, code mqtt.ReasonCode) {
+	switch r := resp.(type) {
+	case *mqtt.Puback:
+		r.ReasonCode = code
+	case *mqtt.Pubrec:
+		r.ReasonCode = code
+	}
+}
+
 func (g *generic) HandleConnack(p *mqtt.Connack) error {
 	panic("implement me")
 }
 
 func (g *generic) HandlePublish(p *mqtt.Publish, cid string) (resp mqtt.Packet, err error) {
+	if err = g.capabilities.checkPublish(p); err != nil {
+		return
+	}
 	if resp, err = p.Response(); err != nil {
 		return
 	}
-	if p.Qos != mqtt.QoS2 {
-		if err = g.Dispatch(cid, p); err != nil {
+	if !g.allow(acl.Publish, cid, p.Topic.String()) {
+		refuse(resp, mqtt.V5_Not_Authorized)
+		return
+	}
+	// a throttled client is paused by its connection, asking PublishQuotas().Wait before reading
+	if _, ok := g.quotas.Take(cid, g.username(cid), p.Topic.String(), len(p.Payload)); !ok {
+		if g.quotas.Action() == config.Disconnect {
+			return nil, mqtt.Err_V5_Message_Rate_Too_High
+		}
+		refuse(resp, mqtt.V5_Quota_Exceeded)
+		return
+	}
+	if p.Qos == mqtt.QoS2 {
+		// dispatched once when the client releases it, also after a reconnect
+		if err = g.msgManager.Hold(cid, p, int(g.cfg.Capabilities.ReceiveMaximum)); err != nil {
 			return
 		}
+	} else if err = g.Dispatch(cid, p); err != nil {
+		return
 	}
 	if p.Retain {
-		g.retainManager.Insert(p)
+		err = g.retain(p)
 	}
 	return
 }
 
+// retain keeps p as the retained message of its topic, a publish without payload clears it.
+func (g *generic) retain(p *mqtt.Publish) error {
+	if _, err := g.retainManager.Insert(p); err != nil {
+		return err
+	}
+	if g.retainStore == nil {
+		return nil
+	}
+	if len(p.Payload) == 0 {
+		return g.retainStore.Delete(p.Topic.String())
+	}
+	return g.retainStore.Save(p)
+}
+
 func (g *generic) HandlePuback(p *mqtt.Puback, cid string) (err error) {
 	return g.msgManager.Ack(cid, p.PacketID)
 }
@@ -137,10 +313,12 @@ func (g *generic) HandlePubrec(p *mqtt.Pubrec, cid string) (mqtt.Packet, error)
 	return resp, err
 }
 
+// HandlePubrel dispatches the held publish of p, a PUBREL sent again finds nothing to dispatch.
 func (g *generic) HandlePubrel(p *mqtt.Pubrel, cid string) (mqtt.Packet, error) {
 	resp := p.Response()
-	// err = g.msgManager.Change(cid, p.PacketID, model.ReleasedState)
-	err := g.msgManager.Release(cid, resp)
+	err := g.msgManager.Release(cid, p.PacketID, func(publish *mqtt.Publish) error {
+		return g.Dispatch(cid, publish)
+	})
 	return resp, err
 }
 
@@ -149,15 +327,62 @@ func (g *generic) HandlePubcomp(p *mqtt.Pubcomp, cid string) (resp mqtt.Packet,
 	return
 }
 
+// HandleSubscribe makes the subscriptions of p. Subscriptions asking for a replay get the kept
+// messages matching them before any message dispatched later, instead of the retained messages
+// the history keeps.
 func (g *generic) HandleSubscribe(p *mqtt.Subscribe, cid string) (resp *mqtt.Suback, err error) {
 	list := []*mqtt.Publish{}
-	for _, sub := range p.Subscriptions {
-		if _, err = g.subManager.Sub(sub.TopicFilter, cid); err != nil {
+	resp = p.Response()
+	if g.history != nil && wantsReplay(p) {
+		// live messages for cid wait until the replay finished
+		g.replays.start(cid)
+		defer g.replays.finish(cid, func(publish *mqtt.Publish) {
+			if err := g.deliver(cid, publish); err != nil {
+				logger.Error(err)
+			}
+		})
+	}
+	for i, sub := range p.Subscriptions {
+		sub, since, replay, rerr := replayOf(p, sub)
+		code := g.capabilities.grant(p, sub)
+		if code < mqtt.V5_Unspecified_Error && replay && rerr != nil {
+			code = subackFailure(p, mqtt.V5_Topic_Filter_Invalid)
+		}
+		if code < mqtt.V5_Unspecified_Error && replay && g.history == nil {
+			code = subackFailure(p, mqtt.V5_Implementation_Specific_Error)
+		}
+		if code < mqtt.V5_Unspecified_Error && !g.allow(acl.Subscribe, cid, sub.TopicFilter) {
+			code = subackFailure(p, mqtt.V5_Not_Authorized)
+		}
+		resp.ReasonCodes[i] = code
+		if code >= mqtt.V5_Unspecified_Error {
+			continue
+		}
+		suber := subscriptions.NewSubscriber(cid, sub)
+		if p.Properties != nil && len(p.Properties.SubscriptionIdentifier) > 0 {
+			suber.Identifier = p.Properties.SubscriptionIdentifier[0].Int()
+		}
+		if _, err = g.subManager.Sub(suber); err != nil {
+			return nil, err
+		}
+		if err = g.saveSubscription(suber); err != nil {
 			return nil, err
 		}
 
-		if publishes := g.retainManager.Get(sub.TopicFilter); len(publishes) > 0 {
-			list = append(list, publishes...)
+		if replay {
+			if err := g.history.Replay(sub.TopicFilter, since, func(publish *mqtt.Publish, at time.Time) error {
+				g.replays.replayed(cid, at)
+				return g.deliver(cid, withIdentifiers(publish, []*subscriptions.Subscriber{suber}))
+			}); err != nil {
+				// the subscription stands, the rest of the replay is lost
+				logger.Error(err)
+			}
+		}
+		for _, publish := range g.retainManager.Get(sub.TopicFilter) {
+			if replay && g.history.Keeps(publish.Topic.String()) {
+				continue
+			}
+			list = append(list, withIdentifiers(publish, []*subscriptions.Subscriber{suber}))
 		}
 	}
 
@@ -167,7 +392,6 @@ func (g *generic) HandleSubscribe(p *mqtt.Subscribe, cid string) (resp *mqtt.Sub
 		}
 	}
 
-	resp = p.Response()
 	return
 }
 
@@ -178,6 +402,11 @@ func (g *generic) HandleSuback(p *mqtt.Suback) error {
 func (g *generic) HandleUnsubscribe(p *mqtt.Unsubscribe, cid string) (resp *mqtt.Unsuback, err error) {
 	for _, v := range p.TopicFilters {
 		g.subManager.Unsub(v, cid)
+		if g.persistent() {
+			if err = g.subStore.Delete(cid, v); err != nil {
+				return nil, err
+			}
+		}
 	}
 	resp = p.Response()
 	return
@@ -196,8 +425,18 @@ func (g *generic) HandlePingresp(p *mqtt.Pingresp) error {
 	return nil
 }
 
+// HandleDisconnect takes the session expiry interval an MQTT 5 client may set on disconnect,
+// the session ends or starts to expire once the connection is closed.
 func (g *generic) HandleDisconnect(p *mqtt.Disconnect, cid string) error {
-	g.manager.Remove(cid)
+	if p.Properties == nil || p.Properties.SessionExpiryInterval == nil {
+		return nil
+	}
+	g.expiries.mu.Lock()
+	defer g.expiries.mu.Unlock()
+	// a session ending with the connection cannot be extended
+	if session := g.expiries.connected[cid]; session != nil && session.Expiry > 0 {
+		session.Expiry = *p.Properties.SessionExpiryInterval
+	}
 	return nil
 }
 
@@ -206,25 +445,92 @@ func (g *generic) HandleAuth(p *mqtt.Auth) error {
 }
 
 func (g *generic) Dispatch(cid string, p *mqtt.Publish) error {
-	subers := g.subManager.GetSubers(p.Topic.String())
-	for _, s := range subers {
-		if p.Qos.Zero() {
-			go g.write(s.ClientID, p)
-		} else {
-			record, err := g.msgManager.Publish(p, s.ClientID)
-			if err != nil {
-				return err
-			}
-			go g.write(s.ClientID, record.Content)
+	var at time.Time
+	if g.history != nil {
+		var err error
+		if at, err = g.history.Append(p); err != nil {
+			logger.Error(err)
+		}
+	}
+	// a client with overlapping subscriptions receives the message once
+	clients := map[string][]*subscriptions.Subscriber{}
+	for _, s := range g.subManager.GetSubers(p.Topic.String()) {
+		clients[s.ClientID] = append(clients[s.ClientID], s)
+	}
+	// publishes are queued on each client in the order they are dispatched,
+	// the client's single output loop keeps that order on the wire
+	for clientID, subers := range clients {
+		publish := withIdentifiers(p, subers)
+		if g.history != nil && g.replays.hold(clientID, at, publish) {
+			continue
+		}
+		// one failing subscriber must not stop the fan-out
+		if err := g.deliver(clientID, publish); err != nil {
+			logger.Error(err)
 		}
 	}
 	return nil
 }
 
+func (g *generic) deliver(cid string, p *mqtt.Publish) error {
+	var packet mqtt.Packet = p
+	if p.Qos.NotZero() {
+		record, err := g.msgManager.Publish(p, cid)
+		if errors.Is(err, utils.ErrSessionQueueFull) {
+			// the client does not acknowledge its publishes, the session keeps those queued
+			if client := g.manager.Get(cid); client != nil {
+				go client.Close(context.Background())
+			}
+		}
+		if err != nil || record == nil {
+			// a nil record is queued until a packet ID is free
+			return err
+		}
+		packet = record.Content
+	}
+	return g.write(cid, packet)
+}
+
+// withIdentifiers returns the publish carrying the subscription identifiers of subers,
+// p is cloned rather than modified when the identifiers differ.
+func withIdentifiers(p *mqtt.Publish, subers []*subscriptions.Subscriber) *mqtt.Publish {
+	var ids []mqtt.VariableByteInteger
+	for _, s := range subers {
+		if s.Identifier > 0 {
+			ids = append(ids, mqtt.VariableByteInteger(s.Identifier))
+		}
+	}
+	if len(ids) == 0 && (p.Properties == nil || len(p.Properties.SubscriptionIdentifier) == 0) {
+		return p
+	}
+	np := p.Clone()
+	if np.Properties == nil {
+		np.Properties = new(mqtt.Properties)
+	}
+	np.Properties.SubscriptionIdentifier = ids
+	return np
+}
+
 func (g *generic) Delivery(cid string, publish *mqtt.Publish) error {
 	return g.write(cid, publish)
 }
 
+func (g *generic) Clients() []server.Client {
+	list := make([]server.Client, 0, g.manager.Len())
+	g.manager.Iterator(func(c server.Client) {
+		list = append(list, c)
+	})
+	return list
+}
+
+func (g *generic) Connections() *limits.Connections {
+	return g.connections
+}
+
+func (g *generic) PublishQuotas() *limits.Publish {
+	return g.quotas
+}
+
 func (g *generic) write(cid string, p mqtt.Packet) error {
 	if client := g.manager.Get(cid); client != nil {
 		return client.Write(p)
@@ -0,0 +1,636 @@
+package servers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/limits"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	memStore "github.com/jin06/mercury/internal/server/message/store/memory"
+	"github.com/jin06/mercury/internal/server/retained"
+	"github.com/jin06/mercury/internal/server/sessions"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestWithIdentifiers(t *testing.T) {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	if np := withIdentifiers(p, []*subscriptions.Subscriber{{ClientID: "c1"}}); np != p {
+		t.Error("publish without identifiers should not be cloned")
+	}
+
+	subers := []*subscriptions.Subscriber{{ClientID: "c1", Identifier: 3}, {ClientID: "c1"}, {ClientID: "c1", Identifier: 7}}
+	np := withIdentifiers(p, subers)
+	if want := []mqtt.VariableByteInteger{3, 7}; !slices.Equal(np.Properties.SubscriptionIdentifier, want) {
+		t.Errorf("expected %v, got %v", want, np.Properties.SubscriptionIdentifier)
+	}
+	if len(p.Properties.SubscriptionIdentifier) != 0 {
+		t.Error("original publish was modified")
+	}
+
+	data, err := np.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := mqtt.Decode(mqtt.MQTT5, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.(*mqtt.Publish).Properties.SubscriptionIdentifier; !slices.Equal(got, np.Properties.SubscriptionIdentifier) {
+		t.Errorf("identifiers lost in encoding, got %v", got)
+	}
+}
+
+func newTestServer() *generic {
+	cfg := &config.Config{
+		Capabilities: config.DefaultCapabilities(),
+		MessageStore: config.MessageStore{Mode: "memory"},
+	}
+	return newGeneric(cfg, func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) }, Persistence{})
+}
+
+type testClient struct {
+	id       string
+	mu       sync.Mutex
+	received []mqtt.Packet
+}
+
+func (c *testClient) Run(ctx context.Context) error            { return nil }
+func (c *testClient) Close(ctx context.Context) error          { return nil }
+func (c *testClient) ClientID() string                         { return c.id }
+func (c *testClient) Username() string                         { return "" }
+func (c *testClient) UUID() string                             { return c.id }
+func (c *testClient) RemoteAddr() net.Addr                     { return nil }
+func (c *testClient) Read() (mqtt.Packet, error)               { return nil, nil }
+func (c *testClient) KeepAlive()                               {}
+func (c *testClient) QueueDepth() int                          { return 0 }
+func (c *testClient) Dropped() uint64                          { return 0 }
+func (c *testClient) PeerCredentials() *server.PeerCredentials { return nil }
+
+func (c *testClient) Write(p mqtt.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received = append(c.received, p)
+	return nil
+}
+
+func (c *testClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received = c.received[:0]
+}
+
+func subscribeTestClients(tb testing.TB, g *generic, n int, topic string) []*testClient {
+	list := make([]*testClient, n)
+	for i := range list {
+		list[i] = &testClient{id: fmt.Sprintf("client-%d", i)}
+		if err := g.Register(list[i]); err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := g.subManager.Sub(subscriptions.NewSubscriber(list[i].id, &mqtt.Subscription{TopicFilter: topic})); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return list
+}
+
+func TestDispatchOrdered(t *testing.T) {
+	g := newTestServer()
+	clients := subscribeTestClients(t, g, 3, "a/b")
+	for i := range 1000 {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+		p.Topic = "a/b"
+		p.Qos = mqtt.QoS(i % 2)
+		p.Payload = []byte(strconv.Itoa(i))
+		if err := g.Dispatch("publisher", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range clients {
+		if len(c.received) != 1000 {
+			t.Fatalf("%s received %d of 1000", c.id, len(c.received))
+		}
+		for i, p := range c.received {
+			if got := string(p.(*mqtt.Publish).Payload); got != strconv.Itoa(i) {
+				t.Fatalf("%s received %s at position %d", c.id, got, i)
+			}
+		}
+	}
+}
+
+func BenchmarkDispatchFanOut(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("subscribers-%d", n), func(b *testing.B) {
+			g := newTestServer()
+			clients := subscribeTestClients(b, g, n, "bench/topic")
+			p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+			p.Topic = "bench/topic"
+			p.Payload = []byte("payload")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := g.Dispatch("publisher", p); err != nil {
+					b.Fatal(err)
+				}
+				if i%100 == 99 {
+					b.StopTimer()
+					for _, c := range clients {
+						c.reset()
+					}
+					b.StartTimer()
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePublishQuota(t *testing.T) {
+	g := newTestServer()
+	quotas := config.PublishQuotas{
+		Action: config.Reject,
+		Client: config.PublishQuota{Messages: config.RateLimit{Rate: 0.001, Burst: 1}},
+	}
+	g.quotas = limits.NewPublish(quotas)
+	publish := func() (mqtt.Packet, error) {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+		p.Qos = mqtt.QoS1
+		p.Topic = "a"
+		return g.HandlePublish(p, "c1")
+	}
+	if resp, err := publish(); err != nil || resp.(*mqtt.Puback).ReasonCode != mqtt.V5_SUCCESS {
+		t.Fatalf("publish within quota refused: %v %v", resp, err)
+	}
+	if resp, err := publish(); err != nil || resp.(*mqtt.Puback).ReasonCode != mqtt.V5_Quota_Exceeded {
+		t.Errorf("expected quota exceeded, got %v %v", resp, err)
+	}
+
+	quotas.Action = config.Disconnect
+	g.quotas = limits.NewPublish(quotas)
+	publish()
+	if _, err := publish(); err != mqtt.Err_V5_Message_Rate_Too_High {
+		t.Errorf("expected message rate too high, got %v", err)
+	}
+}
+
+func TestResumeDeadLetter(t *testing.T) {
+	cfg := &config.Config{Capabilities: config.DefaultCapabilities()}
+	cfg.MQTTConfig.Retry.DeadLetterTopic = "$dead-letter"
+	policy := retry.Policy{InitialDelay: time.Hour, MaxAttempts: 2}
+	g := newGeneric(cfg, func(cid string) store.Store { return memStore.New(cid, 0, policy) }, Persistence{})
+	watcher := subscribeTestClients(t, g, 1, "$dead-letter")[0]
+	if _, err := g.subManager.Sub(subscriptions.NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "a", QoS: mqtt.QoS1})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session outlives the connections
+	expiry := uint32(3600)
+	connect := func() *testClient {
+		c := &testClient{id: "c1"}
+		cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+		cp.ClientID = "c1"
+		cp.Properties = &mqtt.Properties{SessionExpiryInterval: &expiry}
+		if resp, err := g.HandleConnect(cp, c); err != nil || resp.ReasonCode != mqtt.V5_SUCCESS {
+			t.Fatalf("connect refused: %v, %v", resp, err)
+		}
+		return c
+	}
+	c := connect()
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic, p.Qos, p.Payload = "a", mqtt.QoS1, []byte("payload")
+	if err := g.Dispatch("publisher", p); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.received) != 1 {
+		t.Fatalf("expected the publish, got %v", c.received)
+	}
+	g.Deregister(c)
+
+	// the resumed session gets the unacknowledged publish again
+	c = connect()
+	if len(c.received) != 1 || !c.received[0].(*mqtt.Publish).Dup {
+		t.Fatalf("expected a duplicate of the publish, got %v", c.received)
+	}
+	g.Deregister(c)
+
+	// sent twice, the next connection makes it a dead letter
+	c = connect()
+	if len(c.received) != 0 {
+		t.Fatalf("exhausted publish sent again %v", c.received)
+	}
+	if len(watcher.received) != 1 {
+		t.Fatalf("expected the dead letter, got %v", watcher.received)
+	}
+	dead := watcher.received[0].(*mqtt.Publish)
+	want := map[string]string{"reason": retry.ReasonMaxAttempts, "topic": "a", "client_id": "c1", "attempts": "2"}
+	for _, up := range dead.Properties.UserProperties {
+		if want[up.Key] != up.Val {
+			t.Errorf("user property %s: expected %q, got %q", up.Key, want[up.Key], up.Val)
+		}
+		delete(want, up.Key)
+	}
+	if len(want) != 0 || dead.Topic != "$dead-letter" || string(dead.Payload) != "payload" {
+		t.Fatalf("unexpected dead letter %v, missing %v", dead, want)
+	}
+}
+
+func TestInboundQoS2Reconnect(t *testing.T) {
+	g := newTestServer()
+	subscriber := subscribeTestClients(t, g, 1, "q2")[0]
+	expiry := uint32(3600)
+	connect := func() *testClient {
+		c := &testClient{id: "publisher"}
+		cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+		cp.ClientID = c.id
+		cp.Properties = &mqtt.Properties{SessionExpiryInterval: &expiry}
+		if resp, err := g.HandleConnect(cp, c); err != nil || resp.ReasonCode != mqtt.V5_SUCCESS {
+			t.Fatalf("connect refused: %v, %v", resp, err)
+		}
+		return c
+	}
+	publish := func(pid mqtt.PacketID, payload string, dup bool) {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+		p.Topic, p.Qos, p.PacketID, p.Dup, p.Payload = "q2", mqtt.QoS2, pid, dup, []byte(payload)
+		resp, err := g.HandlePacket(p, "publisher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec, ok := resp.(*mqtt.Pubrec); !ok || rec.ReasonCode != mqtt.V5_SUCCESS {
+			t.Fatalf("expected PUBREC, got %v", resp)
+		}
+	}
+	release := func(pid mqtt.PacketID) {
+		rel := &mqtt.Pubrel{BasePacket: &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.PUBREL}, Version: mqtt.MQTT5}, PacketID: pid}
+		resp, err := g.HandlePacket(rel, "publisher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := resp.(*mqtt.Pubcomp); !ok {
+			t.Fatalf("expected PUBCOMP, got %v", resp)
+		}
+	}
+	reconnect := func(c *testClient) *testClient {
+		g.Deregister(c)
+		return connect()
+	}
+
+	c := connect()
+	// the PUBREC is lost, the client sends the publish again with DUP
+	publish(1, "lost pubrec", false)
+	c = reconnect(c)
+	publish(1, "lost pubrec", true)
+	release(1)
+
+	// the connection drops between PUBREC and PUBREL
+	publish(2, "before pubrel", false)
+	c = reconnect(c)
+	release(2)
+
+	// the PUBCOMP is lost, the client sends the PUBREL again
+	publish(3, "lost pubcomp", false)
+	release(3)
+	c = reconnect(c)
+	release(3)
+
+	// a DUP within the connection
+	publish(4, "dup", false)
+	publish(4, "dup", true)
+	release(4)
+	g.Deregister(c)
+
+	var got []string
+	for _, p := range subscriber.received {
+		got = append(got, string(p.(*mqtt.Publish).Payload))
+	}
+	if want := []string{"lost pubrec", "before pubrel", "lost pubcomp", "dup"}; !slices.Equal(got, want) {
+		t.Fatalf("expected each message once %v, got %v", want, got)
+	}
+}
+
+func TestPersistentSessionRestart(t *testing.T) {
+	dir := t.TempDir()
+	start := func() (*generic, *badger.DB) {
+		db, err := badgerStore.Open(config.BadgerConfig{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := &config.Config{Capabilities: config.DefaultCapabilities()}
+		g := newGeneric(cfg, func(cid string) store.Store { return badgerStore.New(db, nil, cid, time.Hour, retry.Policy{}) }, Persistence{
+			Subscriptions: subscriptions.NewBadgerStore(db, nil),
+			Sessions:      sessions.NewBadgerStore(db, nil),
+			Retained:      retained.NewBadgerStore(db, nil),
+		})
+		if err := g.restore(); err != nil {
+			t.Fatal(err)
+		}
+		return g, db
+	}
+	connect := func(g *generic, id string, clean bool) *testClient {
+		c := &testClient{id: id}
+		cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT4)
+		cp.ClientID, cp.Clean = id, clean
+		if _, err := g.HandleConnect(cp, c); err != nil {
+			t.Fatal(err)
+		}
+		sp := &mqtt.Subscribe{
+			BasePacket:    &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, Version: mqtt.MQTT4},
+			Subscriptions: []*mqtt.Subscription{{TopicFilter: "a", QoS: mqtt.QoS1}},
+		}
+		if _, err := g.HandleSubscribe(sp, id); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	g, db := start()
+	g.Deregister(connect(g, "persistent", false))
+	g.Deregister(connect(g, "clean", true))
+	status := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	status.Topic, status.Retain, status.Payload = "status", true, []byte("up")
+	if _, err := g.HandlePublish(status, "publisher"); err != nil {
+		t.Fatal(err)
+	}
+	// a retained message cleared before the restart is not restored
+	for _, payload := range []string{"temporary", ""} {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+		p.Topic, p.Retain, p.Payload = "cleared", true, []byte(payload)
+		if _, err := g.HandlePublish(p, "publisher"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a session that expired while the broker was down is not restored
+	if err := g.sessStore.Save(&model.Session{ClientID: "expired", KeepTime: time.Now().Add(-time.Hour), Expiry: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.subStore.Save(subscriptions.NewSubscriber("expired", &mqtt.Subscription{TopicFilter: "a"})); err != nil {
+		t.Fatal(err)
+	}
+	// the expiry of a client connected when the broker stopped counts from the restart
+	crashed := time.Now().Add(-time.Hour)
+	if err := g.sessStore.Save(&model.Session{ClientID: "connected", ConnectTime: crashed, KeepTime: crashed, Expiry: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.subStore.Save(subscriptions.NewSubscriber("connected", &mqtt.Subscription{TopicFilter: "a"})); err != nil {
+		t.Fatal(err)
+	}
+	// one expiring soon is restored until then
+	if err := g.sessStore.Save(&model.Session{ClientID: "expiring", KeepTime: time.Now().Add(-time.Second), Expiry: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.subStore.Save(subscriptions.NewSubscriber("expiring", &mqtt.Subscription{TopicFilter: "a"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	g, db = start()
+	defer db.Close()
+	subscribed := func() []string {
+		var list []string
+		for _, s := range g.subManager.GetSubers("a") {
+			list = append(list, s.ClientID)
+		}
+		slices.Sort(list)
+		return list
+	}
+	if got := subscribed(); !slices.Equal(got, []string{"connected", "expiring", "persistent"}) {
+		t.Fatalf("unexpected subscribers after the restart %v", got)
+	}
+	if list := g.retainManager.Get("#"); len(list) != 1 || string(list[0].Payload) != "up" {
+		t.Fatalf("expected the retained message after the restart, got %v", list)
+	}
+	if list, err := g.retainStore.All(); err != nil || len(list) != 1 {
+		t.Fatalf("expected one persisted retained message, got %v, %v", list, err)
+	}
+	// the message for the disconnected client waits in its message store
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	p.Topic, p.Qos, p.Payload = "a", mqtt.QoS1, []byte("payload")
+	if err := g.Dispatch("publisher", p); err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{id: "persistent"}
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT4)
+	cp.ClientID = c.id
+	if _, err := g.HandleConnect(cp, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.received) != 1 || string(c.received[0].(*mqtt.Publish).Payload) != "payload" {
+		t.Fatalf("expected the publish after the reconnect, got %v", c.received)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if got := subscribed(); !slices.Equal(got, []string{"connected", "persistent"}) {
+		t.Fatalf("unexpected subscribers after the expiry %v", got)
+	}
+	if session, err := g.sessStore.Get("expiring"); err != nil || session != nil {
+		t.Fatalf("expired session left behind %v, %v", session, err)
+	}
+	if list, err := g.subStore.All(); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected persisted subscriptions %v, %v", list, err)
+	}
+}
+
+func TestOnlineSnapshot(t *testing.T) {
+	g := newTestServer()
+	connect := func(id string, clean bool) *testClient {
+		c := &testClient{id: id}
+		cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT4)
+		cp.ClientID, cp.Clean = id, clean
+		if _, err := g.HandleConnect(cp, c); err != nil {
+			t.Fatal(err)
+		}
+		sp := &mqtt.Subscribe{
+			BasePacket:    &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, Version: mqtt.MQTT4},
+			Subscriptions: []*mqtt.Subscription{{TopicFilter: "a", QoS: mqtt.QoS1}},
+		}
+		if _, err := g.HandleSubscribe(sp, id); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	g.Deregister(connect("away", false))
+	connect("online", false)
+	connect("clean", true)
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT4)
+	p.Topic, p.Qos, p.Retain, p.Payload = "a", mqtt.QoS1, true, []byte("payload")
+	if _, err := g.retainManager.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Dispatch("publisher", p); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := g.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions, subscribers, queued []string
+	for _, s := range snap.Sessions {
+		sessions = append(sessions, s.ClientID)
+	}
+	for _, s := range snap.Subscriptions {
+		subscribers = append(subscribers, s.ClientID)
+	}
+	slices.Sort(subscribers)
+	for _, m := range snap.Messages {
+		queued = append(queued, m.ClientID)
+	}
+	slices.Sort(queued)
+	// the clean session ends with its connection and is left out
+	if want := []string{"away", "online"}; !slices.Equal(sessions, want) || !slices.Equal(subscribers, want) || !slices.Equal(queued, want) {
+		t.Fatalf("unexpected snapshot sessions %v, subscriptions %v, messages %v", sessions, subscribers, queued)
+	}
+	if len(snap.Retained) != 1 {
+		t.Fatalf("expected the retained message, got %d", len(snap.Retained))
+	}
+}
+
+func TestReplayOnSubscribe(t *testing.T) {
+	db, err := badgerStore.Open(config.BadgerConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h, err := badgerStore.NewHistory(db, nil, []config.HistoryStream{{Prefix: "s/", MaxMessages: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTestServer()
+	g.history = h
+	publish := func(payload string, retain bool) {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+		p.Topic, p.Qos, p.Retain, p.Payload = "s/1", mqtt.QoS1, retain, []byte(payload)
+		if _, err := g.HandlePublish(p, "publisher"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("1", false)
+	publish("2", false)
+	publish("3", true)
+
+	subscribe := func(id string, filter string, props *mqtt.Properties) *testClient {
+		c := &testClient{id: id}
+		cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+		cp.ClientID = id
+		if _, err := g.HandleConnect(cp, c); err != nil {
+			t.Fatal(err)
+		}
+		sp := &mqtt.Subscribe{
+			BasePacket:    &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, Version: mqtt.MQTT5},
+			Subscriptions: []*mqtt.Subscription{{TopicFilter: filter, QoS: mqtt.QoS1}},
+			Properties:    props,
+		}
+		resp, err := g.HandleSubscribe(sp, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ReasonCodes[0] >= mqtt.V5_Unspecified_Error {
+			t.Fatalf("subscription refused %v", resp.ReasonCodes[0])
+		}
+		return c
+	}
+	payloads := func(c *testClient) (list []string) {
+		for _, p := range c.received {
+			list = append(list, string(p.(*mqtt.Publish).Payload))
+		}
+		return
+	}
+	// the replay replaces the retained message it keeps
+	prefixed := subscribe("prefixed", "$replay/2/s/#", nil)
+	property := subscribe("property", "s/+", &mqtt.Properties{UserProperties: mqtt.UserProperties{{Key: "replay", Val: "1h"}}})
+	plain := subscribe("plain", "s/#", nil)
+	publish("4", false)
+
+	if got, want := payloads(prefixed), []string{"2", "3", "4"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got, want := payloads(property), []string{"1", "2", "3", "4"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if got, want := payloads(plain), []string{"3", "4"}; !slices.Equal(got, want) {
+		t.Fatalf("expected the retained message and the live one %v, got %v", want, got)
+	}
+	var subscribers []string
+	for _, s := range g.subManager.GetSubers("s/1") {
+		subscribers = append(subscribers, s.ClientID+" "+s.TopicFilter)
+	}
+	slices.Sort(subscribers)
+	if want := []string{"plain s/#", "prefixed s/#", "property s/+"}; !slices.Equal(subscribers, want) {
+		t.Fatalf("expected %v, got %v", want, subscribers)
+	}
+}
+
+// TestReplayDuringPublishes subscribes with a replay while messages are published, the client
+// gets each message once and in order, without the publishes waiting for the replay.
+func TestReplayDuringPublishes(t *testing.T) {
+	db, err := badgerStore.Open(config.BadgerConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h, err := badgerStore.NewHistory(db, nil, []config.HistoryStream{{Prefix: "s/", MaxMessages: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newTestServer()
+	g.history = h
+	const total = 300
+	published := make(chan int, total)
+	go func() {
+		defer close(published)
+		for i := 1; i <= total; i++ {
+			p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+			p.Topic, p.Payload = "s/1", []byte(strconv.Itoa(i))
+			if err := g.Dispatch("publisher", p); err != nil {
+				t.Error(err)
+				return
+			}
+			published <- i
+		}
+	}()
+	for i := range published {
+		if i == total/3 {
+			break
+		}
+	}
+
+	c := &testClient{id: "replayed"}
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = c.id
+	if _, err := g.HandleConnect(cp, c); err != nil {
+		t.Fatal(err)
+	}
+	sp := &mqtt.Subscribe{
+		BasePacket:    &mqtt.BasePacket{FixedHeader: &mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, Version: mqtt.MQTT5},
+		Subscriptions: []*mqtt.Subscription{{TopicFilter: "$replay/1000/s/#"}},
+	}
+	if _, err := g.HandleSubscribe(sp, c.id); err != nil {
+		t.Fatal(err)
+	}
+	for range published {
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.received) != total {
+		t.Fatalf("expected %d messages, got %d", total, len(c.received))
+	}
+	for i, p := range c.received {
+		if got := string(p.(*mqtt.Publish).Payload); got != strconv.Itoa(i+1) {
+			t.Fatalf("expected message %d at %d, got %s", i+1, i, got)
+		}
+	}
+}
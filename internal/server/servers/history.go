@@ -0,0 +1,110 @@
+package servers
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// wantsReplay reports whether a subscription of p asks for a replay of the history.
+func wantsReplay(p *mqtt.Subscribe) bool {
+	if _, ok, _ := history.Requested(p.Properties); ok {
+		return true
+	}
+	return slices.ContainsFunc(p.Subscriptions, func(sub *mqtt.Subscription) bool {
+		return strings.HasPrefix(sub.TopicFilter, history.Prefix)
+	})
+}
+
+// replayOf returns sub without the $replay prefix and what it asks to replay, the replay user
+// property of p applies to the subscriptions without the prefix.
+func replayOf(p *mqtt.Subscribe, sub *mqtt.Subscription) (*mqtt.Subscription, history.Since, bool, error) {
+	filter, since, ok, err := history.Split(sub.TopicFilter)
+	if !ok {
+		since, ok, err = history.Requested(p.Properties)
+	} else if err == nil {
+		c := *sub
+		c.TopicFilter = filter
+		sub = &c
+	}
+	return sub, since, ok, err
+}
+
+// replays holds back the live deliveries to the clients being replayed to, so each client gets
+// the replayed messages first and a message dispatched meanwhile once.
+type replays struct {
+	mu      sync.Mutex
+	clients map[string]*replay
+}
+
+type replay struct {
+	// replayed are the history times of the replayed messages
+	replayed map[int64]bool
+	// held are the live deliveries, in the order they were dispatched
+	held []heldDelivery
+}
+
+type heldDelivery struct {
+	// at is the history time of the message, zero when the history does not keep it
+	at time.Time
+	p  *mqtt.Publish
+}
+
+func newReplays() *replays {
+	return &replays{clients: map[string]*replay{}}
+}
+
+// start marks cid as being replayed to.
+func (r *replays) start(cid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[cid] = &replay{replayed: map[int64]bool{}}
+}
+
+// replayed records that the message kept at at was replayed to cid.
+func (r *replays) replayed(cid string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c := r.clients[cid]; c != nil {
+		c.replayed[at.UnixNano()] = true
+	}
+}
+
+// hold keeps the live delivery of p kept at at until the replay to cid finished, it returns
+// false when cid is not being replayed to.
+func (r *replays) hold(cid string, at time.Time, p *mqtt.Publish) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.clients[cid]
+	if c == nil {
+		return false
+	}
+	c.held = append(c.held, heldDelivery{at: at, p: p})
+	return true
+}
+
+// finish passes the deliveries held for cid to deliver, but the replayed ones, until none are
+// left and cid is not replayed to anymore.
+func (r *replays) finish(cid string, deliver func(p *mqtt.Publish)) {
+	for {
+		r.mu.Lock()
+		c := r.clients[cid]
+		held := c.held
+		c.held = nil
+		if len(held) == 0 {
+			delete(r.clients, cid)
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+		for _, d := range held {
+			if d.at.IsZero() || !c.replayed[d.at.UnixNano()] {
+				deliver(d.p)
+			}
+		}
+	}
+}
@@ -3,12 +3,32 @@ package servers
 import (
 	"github.com/jin06/mercury/internal/config"
 	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/history"
+	"github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/server/retained"
+	"github.com/jin06/mercury/internal/server/sessions"
+	"github.com/jin06/mercury/internal/server/subscriptions"
 )
 
-func NewServer(mode config.Mode) server.Server {
-	switch mode {
+// Persistence keeps the subscriptions of sessions outliving their connection across restarts,
+// the zero value keeps them in memory only. History keeps messages for replay, nil keeps none.
+type Persistence struct {
+	Subscriptions subscriptions.Store
+	Sessions      sessions.Store
+	Retained      retained.Store
+	History       history.Store
+}
+
+// NewServer creates the server of cfg.Mode, newStore creates the message store of each client.
+// The sessions, subscriptions and retained messages of persist are restored.
+func NewServer(cfg *config.Config, newStore func(cid string) store.Store, persist Persistence) (server.Server, error) {
+	switch cfg.Mode {
 	case config.MemoryMode:
-		return newGeneric()
+		g := newGeneric(cfg, newStore, persist)
+		if err := g.restore(); err != nil {
+			return nil, err
+		}
+		return g, nil
 	}
-	return nil
+	return nil, nil
 }
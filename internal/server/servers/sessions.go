@@ -0,0 +1,239 @@
+package servers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jin06/mercury/internal/logger"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/sessions"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// expiries holds the sessions of the connected clients, those of disconnected ones outliving
+// the connection and the timers ending them.
+type expiries struct {
+	mu           sync.Mutex
+	connected    map[string]*model.Session
+	disconnected map[string]*model.Session
+	timers       map[string]*time.Timer
+}
+
+func newExpiries() *expiries {
+	return &expiries{
+		connected:    map[string]*model.Session{},
+		disconnected: map[string]*model.Session{},
+		timers:       map[string]*time.Timer{},
+	}
+}
+
+// sessionExpiry is how many seconds the session of p outlives the connection. MQTT 3 sessions
+// end with the connection when they are clean and never otherwise.
+func sessionExpiry(p *mqtt.Connect) uint32 {
+	if !p.Version.IsMQTT5() {
+		if p.Clean {
+			return 0
+		}
+		return math.MaxUint32
+	}
+	if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+		return *p.Properties.SessionExpiryInterval
+	}
+	return 0
+}
+
+func (g *generic) persistent() bool {
+	return g.subStore != nil && g.sessStore != nil
+}
+
+// startSession stops the expiry of the session of p. A clean start discards the subscriptions
+// of the previous session, only sessions outliving the connection are persisted.
+func (g *generic) startSession(p *mqtt.Connect) error {
+	cid := p.ClientID
+	now := time.Now()
+	session := &model.Session{
+		ClientID:    cid,
+		ConnectTime: now,
+		KeepTime:    now,
+		Username:    p.Username,
+		Clean:       p.Clean,
+		Expiry:      sessionExpiry(p),
+	}
+	g.expiries.mu.Lock()
+	if t := g.expiries.timers[cid]; t != nil {
+		t.Stop()
+		delete(g.expiries.timers, cid)
+	}
+	g.expiries.connected[cid] = session
+	delete(g.expiries.disconnected, cid)
+	g.expiries.mu.Unlock()
+
+	if p.Clean {
+		g.subManager.UnsubAll(cid)
+	}
+	if !g.persistent() {
+		return nil
+	}
+	if p.Clean || session.Expiry == 0 {
+		if err := g.subStore.DeleteClient(cid); err != nil {
+			return err
+		}
+	}
+	if session.Expiry == 0 {
+		return g.sessStore.Delete(cid)
+	}
+	return g.sessStore.Save(session)
+}
+
+// endConnection ends the session of a disconnected client or starts its expiry.
+func (g *generic) endConnection(cid string) error {
+	g.expiries.mu.Lock()
+	session := g.expiries.connected[cid]
+	delete(g.expiries.connected, cid)
+	if session != nil && session.Expiry > 0 {
+		g.expiries.disconnected[cid] = session
+		if session.Expiry != math.MaxUint32 {
+			g.expireAfter(cid, time.Duration(session.Expiry)*time.Second)
+		}
+	}
+	g.expiries.mu.Unlock()
+	if session == nil {
+		// the client never started a session
+		return g.msgManager.Del(cid, false)
+	}
+	if session.Expiry == 0 {
+		return g.endSession(cid)
+	}
+	if err := g.msgManager.Del(cid, false); err != nil {
+		return err
+	}
+	if !g.persistent() {
+		return nil
+	}
+	// the expiry interval counts from the disconnect
+	session.KeepTime = time.Now()
+	return g.sessStore.Save(session)
+}
+
+// expireAfter ends the session of the disconnected client after d, g.expiries.mu must be held.
+func (g *generic) expireAfter(cid string, d time.Duration) {
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		g.expiries.mu.Lock()
+		// the client reconnected or disconnected again in the meantime
+		if g.expiries.timers[cid] != t {
+			g.expiries.mu.Unlock()
+			return
+		}
+		delete(g.expiries.timers, cid)
+		g.expiries.mu.Unlock()
+		if err := g.endSession(cid); err != nil {
+			logger.Error(err)
+		}
+	})
+	g.expiries.timers[cid] = t
+}
+
+// endSession drops the subscriptions, the inflight messages and the persisted session of the client.
+func (g *generic) endSession(cid string) error {
+	g.expiries.mu.Lock()
+	delete(g.expiries.disconnected, cid)
+	g.expiries.mu.Unlock()
+	g.subManager.UnsubAll(cid)
+	if g.persistent() {
+		if err := g.subStore.DeleteClient(cid); err != nil {
+			return err
+		}
+		if err := g.sessStore.Delete(cid); err != nil {
+			return err
+		}
+	}
+	return g.msgManager.Del(cid, true)
+}
+
+// saveSubscription writes s through to the subscription store when the session of its client
+// outlives the connection.
+func (g *generic) saveSubscription(s *subscriptions.Subscriber) error {
+	if !g.persistent() {
+		return nil
+	}
+	g.expiries.mu.Lock()
+	session := g.expiries.connected[s.ClientID]
+	g.expiries.mu.Unlock()
+	if session == nil || session.Expiry == 0 {
+		return nil
+	}
+	return g.subStore.Save(s)
+}
+
+// restore rebuilds the subscriptions of the persisted sessions after a restart. The sessions
+// that expired meanwhile are ended, the others expire as if their clients just disconnected
+// at their keep time. Clients still connected when the broker stopped disconnect at the restart.
+// The persisted retained messages are retained again.
+func (g *generic) restore() error {
+	if g.retainStore != nil {
+		list, err := g.retainStore.All()
+		if err != nil {
+			return err
+		}
+		for _, p := range list {
+			if _, err := g.retainManager.Insert(p); err != nil {
+				return err
+			}
+		}
+	}
+	if !g.persistent() {
+		return nil
+	}
+	list, err := g.sessStore.All()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	alive := map[string]bool{}
+	for _, session := range list {
+		// only the disconnect moves the keep time past the connect time
+		if !session.KeepTime.After(session.ConnectTime) {
+			session.KeepTime = now
+			if err := g.sessStore.Save(session); err != nil {
+				return err
+			}
+		}
+		if sessions.Expired(session, now) {
+			if err := g.endSession(session.ClientID); err != nil {
+				return err
+			}
+			continue
+		}
+		alive[session.ClientID] = true
+		g.expiries.mu.Lock()
+		g.expiries.disconnected[session.ClientID] = session
+		if session.Expiry != math.MaxUint32 {
+			g.expireAfter(session.ClientID, session.KeepTime.Add(time.Duration(session.Expiry)*time.Second).Sub(now))
+		}
+		g.expiries.mu.Unlock()
+	}
+	subs, err := g.subStore.All()
+	if err != nil {
+		return err
+	}
+	orphans := map[string]bool{}
+	for _, s := range subs {
+		if !alive[s.ClientID] {
+			orphans[s.ClientID] = true
+			continue
+		}
+		if _, err := g.subManager.Sub(s); err != nil {
+			return err
+		}
+	}
+	// subscriptions left behind by sessions that ended while the broker went down
+	for cid := range orphans {
+		if err := g.subStore.DeleteClient(cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
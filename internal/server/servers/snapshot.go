@@ -0,0 +1,63 @@
+package servers
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/internal/snapshot"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func (g *generic) Snapshot() (*snapshot.Snapshot, error) {
+	return snapshot.Take(online{g})
+}
+
+// online is the snapshot.Source of a serving broker, the sessions ending with their connection
+// are left out.
+type online struct {
+	g *generic
+}
+
+func (o online) Sessions() ([]*model.Session, error) {
+	o.g.expiries.mu.Lock()
+	defer o.g.expiries.mu.Unlock()
+	list := make([]*model.Session, 0, len(o.g.expiries.connected)+len(o.g.expiries.disconnected))
+	for _, session := range o.g.expiries.connected {
+		if session.Expiry > 0 {
+			c := *session
+			list = append(list, &c)
+		}
+	}
+	for _, session := range o.g.expiries.disconnected {
+		c := *session
+		list = append(list, &c)
+	}
+	slices.SortFunc(list, func(a, b *model.Session) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+	return list, nil
+}
+
+func (o online) Subscriptions() ([]*subscriptions.Subscriber, error) {
+	o.g.expiries.mu.Lock()
+	defer o.g.expiries.mu.Unlock()
+	var list []*subscriptions.Subscriber
+	for _, s := range o.g.subManager.All() {
+		if session := o.g.expiries.connected[s.ClientID]; session != nil && session.Expiry > 0 {
+			list = append(list, s)
+		} else if o.g.expiries.disconnected[s.ClientID] != nil {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+}
+
+func (o online) Retained() ([]*mqtt.Publish, error) {
+	return o.g.retainManager.Get("#"), nil
+}
+
+func (o online) Records(cid string, fn func(r *model.Record, held bool) error) error {
+	return o.g.msgManager.Records(cid, fn)
+}
@@ -0,0 +1,118 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/model"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+)
+
+// BadgerKind starts the keys of the sessions, the message and subscription stores share the
+// database and use the kinds below 17:
+//
+//	BadgerKind {clientID} -> json encoded model.Session
+const BadgerKind byte = 17
+
+// NewBadgerStore creates a session store in db, a non nil envelope encrypts the sessions.
+func NewBadgerStore(db *badger.DB, envelope *badgerStore.Envelope) *BadgerStore {
+	return &BadgerStore{db: db, envelope: envelope}
+}
+
+type BadgerStore struct {
+	db       *badger.DB
+	envelope *badgerStore.Envelope
+}
+
+func (s *BadgerStore) Save(session *model.Session) error {
+	buf, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if s.envelope != nil {
+		if buf, err = s.envelope.Seal(buf); err != nil {
+			return err
+		}
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key(session.ClientID), buf)
+	})
+}
+
+func (s *BadgerStore) Get(clientID string) (session *model.Session, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key(clientID))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session = new(model.Session)
+		return item.Value(func(val []byte) error {
+			return s.unmarshal(val, session)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *BadgerStore) Delete(clientID string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key(clientID))
+	})
+}
+
+func (s *BadgerStore) All() (list []*model.Session, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{BadgerKind}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			session := new(model.Session)
+			if err := it.Item().Value(func(val []byte) error {
+				return s.unmarshal(val, session)
+			}); err != nil {
+				return err
+			}
+			list = append(list, session)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *BadgerStore) Expired(now time.Time) ([]*model.Session, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	var list []*model.Session
+	for _, session := range all {
+		if Expired(session, now) {
+			list = append(list, session)
+		}
+	}
+	return list, nil
+}
+
+// unmarshal decodes a saved session, opening it with the envelope if there is one.
+func (s *BadgerStore) unmarshal(val []byte, session *model.Session) error {
+	if s.envelope != nil {
+		var err error
+		if val, err = s.envelope.Open(val); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(val, session)
+}
+
+func key(cid string) []byte {
+	return append([]byte{BadgerKind}, cid...)
+}
@@ -0,0 +1,66 @@
+package sessions
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jin06/mercury/internal/model"
+)
+
+// NewSQLStore creates the sessions table if needed.
+func NewSQLStore(db *gorm.DB) (*SQLStore, error) {
+	if err := db.AutoMigrate(&model.Session{}); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+type SQLStore struct {
+	db *gorm.DB
+}
+
+func (s *SQLStore) Save(session *model.Session) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(session).Error
+}
+
+func (s *SQLStore) Get(clientID string) (*model.Session, error) {
+	var session model.Session
+	err := s.db.Where("client_id = ?", clientID).Take(&session).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *SQLStore) Delete(clientID string) error {
+	return s.db.Where("client_id = ?", clientID).Delete(&model.Session{}).Error
+}
+
+func (s *SQLStore) All() ([]*model.Session, error) {
+	var list []*model.Session
+	if err := s.db.Order("client_id").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *SQLStore) Expired(now time.Time) ([]*model.Session, error) {
+	// the expiry is checked here, date arithmetic differs between the databases
+	var candidates []*model.Session
+	if err := s.db.Where("keep_time < ?", now).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	var list []*model.Session
+	for _, session := range candidates {
+		if Expired(session, now) {
+			list = append(list, session)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,29 @@
+package sessions
+
+import (
+	"math"
+	"time"
+
+	"github.com/jin06/mercury/internal/model"
+)
+
+// Store persists the sessions of clients so they survive a restart of the broker.
+type Store interface {
+	// Save adds the session or replaces the one of the same client ID.
+	Save(s *model.Session) error
+	// Get returns nil when the client has no session.
+	Get(clientID string) (*model.Session, error)
+	Delete(clientID string) error
+	All() ([]*model.Session, error)
+	// Expired returns the sessions whose expiry interval passed since their keep time before now.
+	Expired(now time.Time) ([]*model.Session, error)
+}
+
+// Expired reports whether the expiry interval of s passed since its keep time before now,
+// the maximum interval means the session does not expire.
+func Expired(s *model.Session, now time.Time) bool {
+	if s.Expiry == math.MaxUint32 {
+		return false
+	}
+	return s.KeepTime.Add(time.Duration(s.Expiry) * time.Second).Before(now)
+}
@@ -0,0 +1,122 @@
+package sessions
+
+import (
+	"bytes"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/jin06/mercury/internal/model"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestSQLStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "mercury.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testStore(t, NewBadgerStore(db, nil))
+}
+
+func TestEncryptedBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	envelope, err := badgerStore.NewEnvelope(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewBadgerStore(db, envelope)
+	testStore(t, s)
+	// the will payload is sealed
+	if err := s.Save(&model.Session{ClientID: "c1", Will: &mqtt.Will{Topic: "lwt", Message: "gone"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key("c1"))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if bytes.Contains(val, []byte("gone")) {
+				t.Error("will stored in plain text")
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	now := time.Now()
+	sessions := []*model.Session{
+		{ClientID: "expired", KeepTime: now.Add(-time.Hour), Expiry: 60},
+		{ClientID: "alive", KeepTime: now.Add(-time.Minute), Expiry: 3600, Will: &mqtt.Will{Topic: "lwt", Message: "gone", QoS: mqtt.QoS1}},
+		{ClientID: "forever", KeepTime: now.Add(-time.Hour), Expiry: math.MaxUint32},
+	}
+	for _, session := range sessions {
+		if err := s.Save(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Get("alive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Will == nil || got.Will.Topic != "lwt" || got.Will.QoS != mqtt.QoS1 {
+		t.Fatalf("unexpected session %+v", got)
+	}
+	if got, err := s.Get("unknown"); got != nil || err != nil {
+		t.Fatalf("expected no session, got %+v, %v", got, err)
+	}
+	if all, err := s.All(); err != nil || len(all) != 3 {
+		t.Fatalf("expected 3 sessions, got %v, %v", all, err)
+	}
+
+	expired, err := s.Expired(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].ClientID != "expired" {
+		t.Fatalf("unexpected expired sessions %v", expired)
+	}
+
+	// saving again replaces the session
+	sessions[0].KeepTime = now
+	if err := s.Save(sessions[0]); err != nil {
+		t.Fatal(err)
+	}
+	if expired, _ := s.Expired(now); len(expired) != 0 {
+		t.Fatalf("unexpected expired sessions %v", expired)
+	}
+	if err := s.Delete("alive"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get("alive"); got != nil {
+		t.Fatal("session not deleted")
+	}
+}
@@ -1,4 +1,106 @@
 package subscriptions
 
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/dgraph-io/badger/v4"
+
+	"github.com/jin06/mercury/internal/model"
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+)
+
+// BadgerKind starts the keys of the subscriptions, the message store shares the database
+// and uses the kinds below 16:
+//
+//	BadgerKind {len(clientID)}{clientID}{topicFilter} -> json encoded model.Subscription
+const BadgerKind byte = 16
+
+// NewBadgerStore creates a subscription store in db, a non nil envelope encrypts the subscriptions.
+func NewBadgerStore(db *badger.DB, envelope *badgerStore.Envelope) *BadgerStore {
+	return &BadgerStore{db: db, envelope: envelope}
+}
+
 type BadgerStore struct {
+	db       *badger.DB
+	envelope *badgerStore.Envelope
+}
+
+func (s *BadgerStore) Save(sub *Subscriber) error {
+	buf, err := json.Marshal(sub.Model())
+	if err != nil {
+		return err
+	}
+	if s.envelope != nil {
+		if buf, err = s.envelope.Seal(buf); err != nil {
+			return err
+		}
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(clientKey(sub.ClientID), sub.TopicFilter...), buf)
+	})
+}
+
+func (s *BadgerStore) Delete(clientID string, topicFilter string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append(clientKey(clientID), topicFilter...))
+	})
+}
+
+func (s *BadgerStore) DeleteClient(clientID string) error {
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = clientKey(clientID)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (s *BadgerStore) All() (list []*Subscriber, err error) {
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte{BadgerKind}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var row model.Subscription
+			if err := it.Item().Value(func(val []byte) (err error) {
+				if s.envelope != nil {
+					if val, err = s.envelope.Open(val); err != nil {
+						return err
+					}
+				}
+				return json.Unmarshal(val, &row)
+			}); err != nil {
+				return err
+			}
+			list = append(list, FromModel(&row))
+		}
+		return nil
+	})
+	return
+}
+
+func clientKey(cid string) []byte {
+	key := make([]byte, 0, 3+len(cid))
+	key = append(key, BadgerKind)
+	key = binary.BigEndian.AppendUint16(key, uint16(len(cid)))
+	return append(key, cid...)
 }
@@ -2,7 +2,10 @@ package subscriptions
 
 // todo test
 type SubManager interface {
-	Sub(topic string, clientID string) (bool, error)
+	Sub(s *Subscriber) (bool, error)
 	Unsub(topic string, clientID string) bool
+	// UnsubAll removes every subscription of the client, when its session ends.
+	UnsubAll(clientID string) []string
 	GetSubers(topic string) []*Subscriber
+	All() []*Subscriber
 }
@@ -45,10 +45,8 @@ func (t *trieNodeRetain) Get(topic string) (list []*mqtt.Publish) {
 	if len(parts) == 0 {
 		return
 	}
-	var p0, p1 string
-
+	p0 := parts[0]
 	if len(parts) == 1 {
-		p0 = parts[0]
 		switch p0 {
 		case "#":
 			list = node.GetAll()
@@ -67,7 +65,7 @@ func (t *trieNodeRetain) Get(topic string) (list []*mqtt.Publish) {
 		}
 		return
 	}
-	p1 = parts[1]
+	p1 := parts[1]
 	switch p0 {
 	case "#":
 		panic("invalid topic: " + topic)
@@ -100,6 +98,11 @@ func (t *trieNodeRetain) insert(topic string, p *mqtt.Publish) (ok bool, err err
 		if t.children[parts[0]].content != nil {
 			ok = true
 		}
+		if len(p.Payload) == 0 {
+			// a retained publish without payload clears the retained message
+			t.children[parts[0]].content = nil
+			return
+		}
 		t.children[parts[0]].content = model.NewRetain(*p)
 		return
 	}
@@ -0,0 +1,40 @@
+package subscriptions
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestRetainGet(t *testing.T) {
+	r := NewTrieRetain()
+	for _, topic := range []string{"a", "s/1", "s/2/x"} {
+		p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+		p.Topic, p.Payload = mqtt.Topic(topic), []byte("x")
+		if _, err := r.Insert(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for filter, want := range map[string]int{"a": 1, "s/1": 1, "s/+": 1, "s/2/x": 1, "s/+/x": 1, "s/#": 2, "#": 3, "b/1": 0} {
+		if got := len(r.Get(filter)); got != want {
+			t.Errorf("%s: expected %d retained messages, got %d", filter, want, got)
+		}
+	}
+}
+
+func TestRetainClear(t *testing.T) {
+	r := NewTrieRetain()
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic, p.Payload = "a/b", []byte("x")
+	if _, err := r.Insert(p); err != nil {
+		t.Fatal(err)
+	}
+	clear := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	clear.Topic = "a/b"
+	if _, err := r.Insert(clear); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Get("#"); len(got) != 0 {
+		t.Fatalf("expected the retained message cleared, got %v", got)
+	}
+}
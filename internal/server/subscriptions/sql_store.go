@@ -0,0 +1,44 @@
+package subscriptions
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/jin06/mercury/internal/model"
+)
+
+// NewSQLStore creates the subscriptions table if needed.
+func NewSQLStore(db *gorm.DB) (*SQLStore, error) {
+	if err := db.AutoMigrate(&model.Subscription{}); err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db}, nil
+}
+
+type SQLStore struct {
+	db *gorm.DB
+}
+
+func (s *SQLStore) Save(sub *Subscriber) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(sub.Model()).Error
+}
+
+func (s *SQLStore) Delete(clientID string, topicFilter string) error {
+	return s.db.Where("client_id = ? AND topic_filter = ?", clientID, topicFilter).Delete(&model.Subscription{}).Error
+}
+
+func (s *SQLStore) DeleteClient(clientID string) error {
+	return s.db.Where("client_id = ?", clientID).Delete(&model.Subscription{}).Error
+}
+
+func (s *SQLStore) All() ([]*Subscriber, error) {
+	var rows []model.Subscription
+	if err := s.db.Order("client_id, topic_filter").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	list := make([]*Subscriber, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, FromModel(&row))
+	}
+	return list, nil
+}
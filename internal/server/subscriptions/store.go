@@ -1,4 +1,11 @@
 package subscriptions
 
+// Store persists the subscriptions of clients so they survive a restart of the broker.
 type Store interface {
+	// Save adds the subscription or replaces the one of the same client and topic filter.
+	Save(s *Subscriber) error
+	Delete(clientID string, topicFilter string) error
+	// DeleteClient removes every subscription of a client, e.g. when its session ends.
+	DeleteClient(clientID string) error
+	All() ([]*Subscriber, error)
 }
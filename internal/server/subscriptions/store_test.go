@@ -0,0 +1,103 @@
+package subscriptions
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	badgerStore "github.com/jin06/mercury/internal/server/message/store/badger"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestSQLStore(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "mercury.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSQLStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testStore(t, NewBadgerStore(db, nil))
+}
+
+func TestEncryptedBadgerStore(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	envelope, err := badgerStore.NewEnvelope(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, NewBadgerStore(db, envelope))
+}
+
+func testStore(t *testing.T, s Store) {
+	sub := NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "sensors/+", QoS: mqtt.QoS1, NoLocal: true})
+	sub.Identifier = 7
+	for _, sub := range []*Subscriber{
+		sub,
+		NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "alerts", QoS: mqtt.QoS0}),
+		NewSubscriber("c2", &mqtt.Subscription{TopicFilter: "$share/g/jobs", QoS: mqtt.QoS2}),
+	} {
+		if err := s.Save(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// saving the same filter again updates the options
+	if err := s.Save(NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "alerts", QoS: mqtt.QoS2})); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("expected 3 subscriptions, got %d", len(list))
+	}
+	got := map[string]*Subscriber{}
+	for _, sub := range list {
+		got[sub.ClientID+" "+sub.TopicFilter] = sub
+	}
+	if s := got["c1 sensors/+"]; s == nil || s.Qos != mqtt.QoS1 || !s.NoLocal || s.Identifier != 7 {
+		t.Errorf("unexpected subscription %+v", s)
+	}
+	if s := got["c1 alerts"]; s == nil || s.Qos != mqtt.QoS2 {
+		t.Errorf("unexpected subscription %+v", s)
+	}
+
+	if err := s.Delete("c1", "alerts"); err != nil {
+		t.Fatal(err)
+	}
+	// the subscriptions of a client whose ID has c2 as prefix are kept
+	if err := s.Save(NewSubscriber("c22", &mqtt.Subscription{TopicFilter: "jobs"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteClient("c2"); err != nil {
+		t.Fatal(err)
+	}
+	list, err = s.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].TopicFilter != "sensors/+" || list[1].ClientID != "c22" {
+		t.Fatalf("unexpected subscriptions after delete %v", list)
+	}
+}
@@ -3,18 +3,62 @@ package subscriptions
 import (
 	"time"
 
+	"github.com/jin06/mercury/internal/model"
 	"github.com/jin06/mercury/pkg/mqtt"
 )
 
+func NewSubscriber(clientID string, sub *mqtt.Subscription) *Subscriber {
+	return &Subscriber{
+		ClientID:          clientID,
+		TopicFilter:       sub.TopicFilter,
+		Time:              time.Now(),
+		RetainAsPublished: sub.RetainAsPublished,
+		NoLocal:           sub.NoLocal,
+		RetainHandling:    sub.RetainHandling,
+		Qos:               sub.QoS,
+	}
+}
+
 type Subscriber struct {
-	Type     Type
-	ClientID string
-	Group    string
-	Time     time.Time
+	Type        Type
+	ClientID    string
+	TopicFilter string
+	Group       string
+	Time        time.Time
 
 	RetainAsPublished bool
 	NoLocal           bool
 
 	RetainHandling byte
 	Qos            mqtt.QoS
+	// Identifier is the MQTT 5 subscription identifier, 0 means none.
+	Identifier int
+}
+
+// FromModel returns the subscriber of a persisted subscription.
+func FromModel(row *model.Subscription) *Subscriber {
+	sub := NewSubscriber(row.ClientID, &mqtt.Subscription{
+		TopicFilter:       row.TopicFilter,
+		QoS:               mqtt.QoS(row.QoS),
+		NoLocal:           row.NoLocal,
+		RetainAsPublished: row.RetainAsPublished,
+		RetainHandling:    row.RetainHandling,
+	})
+	sub.Identifier = row.Identifier
+	sub.Time = row.Created
+	return sub
+}
+
+// Model returns the subscription to persist.
+func (s *Subscriber) Model() *model.Subscription {
+	return &model.Subscription{
+		ClientID:          s.ClientID,
+		TopicFilter:       s.TopicFilter,
+		QoS:               byte(s.Qos),
+		NoLocal:           s.NoLocal,
+		RetainAsPublished: s.RetainAsPublished,
+		RetainHandling:    s.RetainHandling,
+		Identifier:        s.Identifier,
+		Created:           s.Time,
+	}
 }
@@ -3,7 +3,6 @@ package subscriptions
 import (
 	"errors"
 	"strings"
-	"time"
 
 	"github.com/jin06/mercury/internal/utils"
 )
@@ -76,11 +75,7 @@ func (tf *TopicFilter) init() error {
 	return nil
 }
 
-func (tf *TopicFilter) subscriber(clientID string) *Subscriber {
-	return &Subscriber{
-		Type:     tf.Type,
-		ClientID: clientID,
-		Group:    tf.Group,
-		Time:     time.Now(),
-	}
+func (tf *TopicFilter) bind(s *Subscriber) {
+	s.Type = tf.Type
+	s.Group = tf.Group
 }
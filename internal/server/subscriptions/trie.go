@@ -13,6 +13,9 @@ type trieNode struct {
 
 type trieSub struct {
 	root *trieNode
+	// clients holds the topic filters of each client, mu guards it
+	clients map[string]map[string]struct{}
+	mu      sync.Mutex
 }
 
 func NewTrie() *trieSub {
@@ -21,14 +24,16 @@ func NewTrie() *trieSub {
 			children: make(map[string]*trieNode),
 			subs:     make(map[string]*Subscriber),
 		},
+		clients: make(map[string]map[string]struct{}),
 	}
 }
 
-func (t *trieSub) Sub(topic string, clientID string) (bool, error) {
-	tf, err := NewTF(topic)
+func (t *trieSub) Sub(s *Subscriber) (bool, error) {
+	tf, err := NewTF(s.TopicFilter)
 	if err != nil {
 		return false, err
 	}
+	tf.bind(s)
 	node := t.root
 	var has bool
 
@@ -47,14 +52,48 @@ func (t *trieSub) Sub(topic string, clientID string) (bool, error) {
 	}
 
 	node.mu.Lock()
-	defer node.mu.Unlock()
-	_, has = node.subs[clientID]
-	node.subs[clientID] = tf.subscriber(clientID)
+	_, has = node.subs[s.ClientID]
+	node.subs[s.ClientID] = s
+	node.mu.Unlock()
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	filters := t.clients[s.ClientID]
+	if filters == nil {
+		filters = make(map[string]struct{})
+		t.clients[s.ClientID] = filters
+	}
+	filters[s.TopicFilter] = struct{}{}
 	return has, nil
 }
 
 func (t *trieSub) Unsub(topic string, clientID string) bool {
+	t.mu.Lock()
+	if filters := t.clients[clientID]; filters != nil {
+		delete(filters, topic)
+		if len(filters) == 0 {
+			delete(t.clients, clientID)
+		}
+	}
+	t.mu.Unlock()
+	return t.unsub(topic, clientID)
+}
+
+// UnsubAll removes every subscription of the client and returns their topic filters.
+func (t *trieSub) UnsubAll(clientID string) []string {
+	t.mu.Lock()
+	filters := t.clients[clientID]
+	delete(t.clients, clientID)
+	t.mu.Unlock()
+	list := make([]string, 0, len(filters))
+	for filter := range filters {
+		t.unsub(filter, clientID)
+		list = append(list, filter)
+	}
+	return list
+}
+
+func (t *trieSub) unsub(topic string, clientID string) bool {
 	parts := strings.Split(topic, "/")
 	node := t.root
 	var parent *trieNode
@@ -89,27 +128,67 @@ func (t *trieSub) Unsub(topic string, clientID string) bool {
 	return true
 }
 
+// All returns every subscription.
+func (t *trieSub) All() []*Subscriber {
+	return t.root.all(nil)
+}
+
+func (n *trieNode) all(subs []*Subscriber) []*Subscriber {
+	n.mu.RLock()
+	for _, suber := range n.subs {
+		subs = append(subs, suber)
+	}
+	children := make([]*trieNode, 0, len(n.children))
+	for _, child := range n.children {
+		children = append(children, child)
+	}
+	n.mu.RUnlock()
+	for _, child := range children {
+		subs = child.all(subs)
+	}
+	return subs
+}
+
+// GetSubers returns the subscribers of every topic filter matching the topic,
+// a client with overlapping subscriptions appears once per matching filter.
 func (t *trieSub) GetSubers(topic string) []*Subscriber {
 	parts := strings.Split(topic, "/")
-	node := t.root
-	for _, part := range parts {
-		if found := func() bool {
-			node.mu.RLock()
-			defer node.mu.RUnlock()
-			if _, ok := node.children[part]; !ok {
-				return false
-			}
-			node = node.children[part]
-			return true
-		}(); !found {
-			return nil
+	// topics beginning with $ are not matched by a leading wildcard
+	return t.root.match(parts, strings.HasPrefix(topic, "$"), nil)
+}
+
+func (n *trieNode) match(parts []string, noWild bool, subs []*Subscriber) []*Subscriber {
+	var multi, single, exact *trieNode
+	n.mu.RLock()
+	if len(parts) == 0 {
+		for _, suber := range n.subs {
+			subs = append(subs, suber)
 		}
+	} else {
+		if !noWild {
+			single = n.children["+"]
+		}
+		exact = n.children[parts[0]]
 	}
-	node.mu.RLock()
-	defer node.mu.RUnlock()
-	subs := make([]*Subscriber, 0, len(node.subs))
-	for _, suber := range node.subs {
-		subs = append(subs, suber)
+	if !noWild {
+		// "a/#" matches "a" too
+		multi = n.children["#"]
+	}
+	n.mu.RUnlock()
+
+	// children are visited without holding the parent lock, Unsub locks child before parent
+	if multi != nil {
+		multi.mu.RLock()
+		for _, suber := range multi.subs {
+			subs = append(subs, suber)
+		}
+		multi.mu.RUnlock()
+	}
+	if single != nil {
+		subs = single.match(parts[1:], false, subs)
+	}
+	if exact != nil {
+		subs = exact.match(parts[1:], false, subs)
 	}
 	return subs
 }
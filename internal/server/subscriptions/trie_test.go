@@ -0,0 +1,67 @@
+package subscriptions
+
+import (
+	"testing"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func TestTrieGetSubers(t *testing.T) {
+	trie := NewTrie()
+	for i, filter := range []string{"a/b", "a/+", "a/#", "#", "+/b/c"} {
+		s := NewSubscriber("c1", &mqtt.Subscription{TopicFilter: filter})
+		s.Identifier = i + 1
+		if _, err := trie.Sub(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[string][]int{
+		"a/b":     {1, 2, 3, 4},
+		"a":       {3, 4},
+		"x/b/c":   {4, 5},
+		"$SYS/b":  nil,
+		"b/c/d/e": {4},
+	}
+	for topic, want := range cases {
+		got := map[int]bool{}
+		for _, s := range trie.GetSubers(topic) {
+			got[s.Identifier] = true
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: expected %v, got %v", topic, want, got)
+			continue
+		}
+		for _, id := range want {
+			if !got[id] {
+				t.Errorf("%s: missing subscription %d", topic, id)
+			}
+		}
+	}
+}
+
+func TestTrieUnsubAll(t *testing.T) {
+	trie := NewTrie()
+	for _, sub := range []*Subscriber{
+		NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "a/b"}),
+		NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "a/#"}),
+		NewSubscriber("c2", &mqtt.Subscription{TopicFilter: "a/b"}),
+	} {
+		if _, err := trie.Sub(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trie.Unsub("a/#", "c1")
+	if filters := trie.UnsubAll("c1"); len(filters) != 1 || filters[0] != "a/b" {
+		t.Fatalf("unexpected topic filters %v", filters)
+	}
+	subs := trie.GetSubers("a/b")
+	if len(subs) != 1 || subs[0].ClientID != "c2" {
+		t.Fatalf("expected only c2 subscribed, got %v", subs)
+	}
+	if all := trie.All(); len(all) != 1 || all[0].ClientID != "c2" {
+		t.Fatalf("expected only the subscription of c2, got %v", all)
+	}
+	if filters := trie.UnsubAll("c1"); len(filters) != 0 {
+		t.Fatalf("unexpected topic filters %v", filters)
+	}
+}
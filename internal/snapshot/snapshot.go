@@ -0,0 +1,247 @@
+// Package snapshot exports the state of a broker to a portable file and restores it into the
+// badger or sql store mode, e.g. to move a broker from badger to sql or to another host. The
+// memory and redis modes keep no sessions and retained messages, they are neither backed up
+// nor restored.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Version is the version of the snapshot file format.
+const Version = 1
+
+var (
+	ErrVersion = errors.New("unsupported snapshot version")
+	// ErrNotPersisted is returned by targets that do not keep a kind of state, it is skipped.
+	ErrNotPersisted = errors.New("not persisted by the store mode")
+	ErrEncrypted    = errors.New("snapshot is encrypted, a key is required")
+	ErrTruncated    = errors.New("truncated encrypted snapshot")
+)
+
+// sealed starts an encrypted snapshot file, it is followed by the AES-GCM nonce and the sealed JSON.
+var sealed = []byte("mercury-snapshot-aes-gcm\n")
+
+// Snapshot is the state of a broker. Messages are stored with the versioned record encoding of
+// the message stores, so they are restored into either persistent store mode.
+type Snapshot struct {
+	Version       int                   `json:"version"`
+	Created       time.Time             `json:"created"`
+	Sessions      []*model.Session      `json:"sessions"`
+	Subscriptions []*model.Subscription `json:"subscriptions"`
+	Retained      []*Message            `json:"retained"`
+	// Messages are the inflight messages and the held incoming QoS 2 publishes of the sessions.
+	Messages []*Message `json:"messages"`
+}
+
+type Message struct {
+	ClientID string `json:"client_id,omitempty"`
+	// Held marks an incoming QoS 2 publish waiting for its PUBREL.
+	Held bool `json:"held,omitempty"`
+	// Record is the encoded model.Record, base64 in the file.
+	Record []byte `json:"record"`
+}
+
+// Source is the broker state a snapshot is taken of.
+type Source interface {
+	Sessions() ([]*model.Session, error)
+	Subscriptions() ([]*subscriptions.Subscriber, error)
+	Retained() ([]*mqtt.Publish, error)
+	// Records passes the inflight records of the client to fn, then the held publishes.
+	Records(cid string, fn func(r *model.Record, held bool) error) error
+}
+
+// Target is what a snapshot is restored into.
+type Target interface {
+	SaveSession(s *model.Session) error
+	SaveSubscription(s *subscriptions.Subscriber) error
+	SaveRetained(p *mqtt.Publish) error
+	Restore(cid string, r *model.Record, held bool) error
+}
+
+// Summary counts the restored state.
+type Summary struct {
+	Sessions      int `json:"sessions"`
+	Subscriptions int `json:"subscriptions"`
+	Retained      int `json:"retained"`
+	Messages      int `json:"messages"`
+	// Skipped counts what the target does not persist.
+	Skipped int `json:"skipped"`
+}
+
+// Take reads the state of src, the messages of each session.
+func Take(src Source) (*Snapshot, error) {
+	snap := &Snapshot{Version: Version, Created: time.Now()}
+	sessions, err := src.Sessions()
+	if err != nil {
+		return nil, err
+	}
+	snap.Sessions = sessions
+	subs, err := src.Subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subs {
+		snap.Subscriptions = append(snap.Subscriptions, s.Model())
+	}
+	retained, err := src.Retained()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range retained {
+		buf, err := model.NewRecord("", p, 0).Encode()
+		if err != nil {
+			return nil, err
+		}
+		snap.Retained = append(snap.Retained, &Message{Record: buf})
+	}
+	for _, session := range sessions {
+		err := src.Records(session.ClientID, func(r *model.Record, held bool) error {
+			buf, err := r.Encode()
+			if err != nil {
+				return err
+			}
+			snap.Messages = append(snap.Messages, &Message{ClientID: session.ClientID, Held: held, Record: buf})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// Restore writes the state of snap into dst, state dst does not persist is skipped.
+func Restore(snap *Snapshot, dst Target) (sum Summary, err error) {
+	if snap.Version != Version {
+		return sum, fmt.Errorf("%w: %d", ErrVersion, snap.Version)
+	}
+	// count counts a restored item, or a skipped one
+	count := func(n *int, err error) error {
+		if errors.Is(err, ErrNotPersisted) {
+			sum.Skipped++
+			return nil
+		}
+		if err == nil {
+			*n++
+		}
+		return err
+	}
+	for _, s := range snap.Sessions {
+		if err := count(&sum.Sessions, dst.SaveSession(s)); err != nil {
+			return sum, err
+		}
+	}
+	for _, s := range snap.Subscriptions {
+		if err := count(&sum.Subscriptions, dst.SaveSubscription(subscriptions.FromModel(s))); err != nil {
+			return sum, err
+		}
+	}
+	for _, m := range snap.Retained {
+		r, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			return sum, err
+		}
+		p, ok := r.Content.(*mqtt.Publish)
+		if !ok {
+			return sum, fmt.Errorf("retained message is a %T", r.Content)
+		}
+		if err := count(&sum.Retained, dst.SaveRetained(p)); err != nil {
+			return sum, err
+		}
+	}
+	for _, m := range snap.Messages {
+		r, err := model.DecodeRecord(m.Record)
+		if err != nil {
+			return sum, err
+		}
+		if err := count(&sum.Messages, dst.Restore(m.ClientID, r, m.Held)); err != nil {
+			return sum, err
+		}
+	}
+	return sum, nil
+}
+
+// Write writes snap as JSON, encrypted with AES-GCM when key is not nil. Without a key the
+// payloads of the messages are in plain text.
+func Write(w io.Writer, snap *Snapshot, key []byte) error {
+	if key == nil {
+		return json.NewEncoder(w).Encode(snap)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append(append(slices.Clone(sealed), nonce...), aead.Seal(nil, nonce, buf, sealed)...)
+	_, err = w.Write(out)
+	return err
+}
+
+// Read reads a snapshot written by Write, key decrypts an encrypted one.
+func Read(r io.Reader, key []byte) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(sealed))
+	var dec *json.Decoder
+	if bytes.Equal(head, sealed) {
+		if key == nil {
+			return nil, ErrEncrypted
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		data = data[len(sealed):]
+		if len(data) < aead.NonceSize() {
+			return nil, ErrTruncated
+		}
+		buf, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], sealed)
+		if err != nil {
+			return nil, err
+		}
+		dec = json.NewDecoder(bytes.NewReader(buf))
+	} else {
+		dec = json.NewDecoder(br)
+	}
+	snap := new(Snapshot)
+	if err := dec.Decode(snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, snap.Version)
+	}
+	return snap, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,223 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func newFactory(t *testing.T, cfg config.MessageStore) *Stores {
+	f, err := store.NewFactory(cfg, time.Hour, retry.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	stores, err := NewStores(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stores
+}
+
+func newPublish(topic string, qos mqtt.QoS) *mqtt.Publish {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Payload = []byte("payload")
+	return p
+}
+
+type records struct {
+	inflight []mqtt.PacketID
+	held     []mqtt.PacketID
+}
+
+func readRecords(t *testing.T, src Source, cid string) (got records) {
+	err := src.Records(cid, func(r *model.Record, held bool) error {
+		id := r.Content.(*mqtt.Publish).PacketID
+		if held {
+			got.held = append(got.held, id)
+		} else {
+			got.inflight = append(got.inflight, id)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// TestBadgerToSQL migrates the state of a badger broker to sql through a snapshot file.
+func TestBadgerToSQL(t *testing.T) {
+	src := newFactory(t, config.MessageStore{Mode: "badger", BadgerConfig: config.BadgerConfig{Dir: t.TempDir()}})
+	now := time.Now().Truncate(time.Second)
+	if err := src.SaveSession(&model.Session{ClientID: "c1", ConnectTime: now, KeepTime: now, Expiry: math.MaxUint32}); err != nil {
+		t.Fatal(err)
+	}
+	sub := subscriptions.NewSubscriber("c1", &mqtt.Subscription{TopicFilter: "a/#", QoS: mqtt.QoS2, NoLocal: true})
+	sub.Identifier = 7
+	if err := src.SaveSubscription(sub); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SaveRetained(newPublish("status", mqtt.QoS1)); err != nil {
+		t.Fatal(err)
+	}
+	st := src.factory.New("c1")
+	for _, qos := range []mqtt.QoS{mqtt.QoS1, mqtt.QoS2} {
+		if _, err := st.Publish(newPublish("a/b", qos)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	incoming := newPublish("in", mqtt.QoS2)
+	incoming.PacketID = 9
+	if _, err := st.Hold(incoming); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	snap, err := Take(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, snap, nil); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("payload")) {
+		t.Fatal("expected the records to be encoded")
+	}
+	read, err := Read(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newFactory(t, config.MessageStore{Mode: "sql", SQLConfig: config.Database{Type: "sqlite", DSN: filepath.Join(t.TempDir(), "mercury.db")}})
+	sum, err := Restore(read, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Summary{Sessions: 1, Subscriptions: 1, Retained: 1, Messages: 3}); sum != want {
+		t.Fatalf("expected %+v, got %+v", want, sum)
+	}
+
+	list, err := dst.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ClientID != "c1" || list[0].Expiry != math.MaxUint32 || !list[0].KeepTime.Equal(now) {
+		t.Fatalf("unexpected sessions %+v", list)
+	}
+	subs, err := dst.Subscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0].TopicFilter != "a/#" || subs[0].Qos != mqtt.QoS2 || !subs[0].NoLocal || subs[0].Identifier != 7 {
+		t.Fatalf("unexpected subscriptions %+v", subs)
+	}
+	retained, err := dst.Retained()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retained) != 1 || retained[0].Topic != "status" || string(retained[0].Payload) != "payload" {
+		t.Fatalf("unexpected retained messages %v", retained)
+	}
+	got := readRecords(t, dst, "c1")
+	if len(got.inflight) != 2 || got.inflight[0] != 1 || got.inflight[1] != 2 || len(got.held) != 1 || got.held[0] != 9 {
+		t.Fatalf("unexpected records %+v", got)
+	}
+	// the restored packet IDs are in use
+	st = dst.factory.New("c1")
+	defer st.Close()
+	r, err := st.Publish(newPublish("a/c", mqtt.QoS1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := r.Content.(*mqtt.Publish).PacketID; id != 3 {
+		t.Fatalf("expected packet ID 3, got %d", id)
+	}
+}
+
+func TestRestoreClearedRetained(t *testing.T) {
+	dst := newFactory(t, config.MessageStore{Mode: "badger", BadgerConfig: config.BadgerConfig{Dir: t.TempDir()}})
+	if err := dst.SaveRetained(newPublish("status", mqtt.QoS0)); err != nil {
+		t.Fatal(err)
+	}
+	cleared := newPublish("status", mqtt.QoS0)
+	cleared.Payload = nil
+	record, err := model.NewRecord("", cleared, 0).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := Restore(&Snapshot{Version: Version, Retained: []*Message{{Record: record}}}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Summary{Skipped: 1}); sum != want {
+		t.Fatalf("expected %+v, got %+v", want, sum)
+	}
+	if list, err := dst.Retained(); err != nil || len(list) != 0 {
+		t.Fatalf("expected no retained messages, got %v, %v", list, err)
+	}
+}
+
+func TestNoSessionStore(t *testing.T) {
+	f, err := store.NewFactory(config.MessageStore{Mode: "memory"}, time.Hour, retry.Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := NewStores(f); !errors.Is(err, ErrNoSessionStore) {
+		t.Fatalf("expected ErrNoSessionStore, got %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	if _, err := Read(strings.NewReader(`{"version": 2}`), nil); !errors.Is(err, ErrVersion) {
+		t.Fatalf("expected ErrVersion, got %v", err)
+	}
+	if _, err := Restore(&Snapshot{}, nil); !errors.Is(err, ErrVersion) {
+		t.Fatalf("expected ErrVersion, got %v", err)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	record, err := model.NewRecord("", newPublish("a/b", mqtt.QoS1), 0).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := &Snapshot{Version: Version, Sessions: []*model.Session{{ClientID: "c1"}}, Messages: []*Message{{ClientID: "c1", Record: record}}}
+	var buf bytes.Buffer
+	if err := Write(&buf, snap, key); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("c1")) {
+		t.Fatal("expected the snapshot to be encrypted")
+	}
+	data := buf.Bytes()
+	if _, err := Read(bytes.NewReader(data), nil); !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("expected ErrEncrypted, got %v", err)
+	}
+	if _, err := Read(bytes.NewReader(data), bytes.Repeat([]byte{2}, 32)); err == nil {
+		t.Fatal("expected a wrong key to fail")
+	}
+	read, err := Read(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Sessions) != 1 || read.Sessions[0].ClientID != "c1" || !bytes.Equal(read.Messages[0].Record, record) {
+		t.Fatalf("unexpected snapshot %+v", read)
+	}
+}
@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jin06/mercury/internal/model"
+	"github.com/jin06/mercury/internal/server/message/store"
+	"github.com/jin06/mercury/internal/server/subscriptions"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+var ErrNoSessionStore = errors.New("the store mode keeps no sessions and retained messages, use badger or sql")
+
+// Stores is the Source and Target of the stores of a broker that is not running, in the badger
+// or sql mode.
+type Stores struct {
+	factory *store.Factory
+}
+
+func NewStores(f *store.Factory) (*Stores, error) {
+	if f.Sessions() == nil || f.Subscriptions() == nil || f.Retained() == nil {
+		return nil, ErrNoSessionStore
+	}
+	return &Stores{factory: f}, nil
+}
+
+func (s *Stores) Sessions() ([]*model.Session, error) {
+	return s.factory.Sessions().All()
+}
+
+func (s *Stores) Subscriptions() ([]*subscriptions.Subscriber, error) {
+	return s.factory.Subscriptions().All()
+}
+
+func (s *Stores) Retained() ([]*mqtt.Publish, error) {
+	return s.factory.Retained().All()
+}
+
+func (s *Stores) Records(cid string, fn func(r *model.Record, held bool) error) error {
+	st := s.factory.New(cid)
+	defer st.Close()
+	return st.Records(fn)
+}
+
+func (s *Stores) SaveSession(session *model.Session) error {
+	return s.factory.Sessions().Save(session)
+}
+
+func (s *Stores) SaveSubscription(sub *subscriptions.Subscriber) error {
+	return s.factory.Subscriptions().Save(sub)
+}
+
+// SaveRetained saves p, a message without payload clears the topic and counts as skipped.
+func (s *Stores) SaveRetained(p *mqtt.Publish) error {
+	if len(p.Payload) == 0 {
+		if err := s.factory.Retained().Delete(p.Topic.String()); err != nil {
+			return err
+		}
+		return ErrNotPersisted
+	}
+	return s.factory.Retained().Save(p)
+}
+
+func (s *Stores) Restore(cid string, r *model.Record, held bool) error {
+	st := s.factory.New(cid)
+	defer st.Close()
+	return restore(st, r, held)
+}
+
+// restore saves a message of a snapshot in the message store of its client.
+func restore(st store.Store, r *model.Record, held bool) error {
+	if !held {
+		return st.Restore(r)
+	}
+	p, ok := r.Content.(*mqtt.Publish)
+	if !ok {
+		return fmt.Errorf("held message is a %T", r.Content)
+	}
+	_, err := st.Hold(p)
+	return err
+}
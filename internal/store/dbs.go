@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/glebarez/sqlite"
 	"github.com/jin06/mercury/internal/config"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
@@ -14,8 +15,8 @@ import (
 
 var Default *gorm.DB
 
-func Init() error {
-	db, err := NewClient(&config.Def.Database)
+func Init(cfg *config.Database) error {
+	db, err := NewClient(cfg)
 	if err != nil {
 		return err
 	}
@@ -32,6 +33,8 @@ func NewClient(cfg *config.Database) (db *gorm.DB, err error) {
 
 	case "postgres":
 		dialector = postgres.Open(cfg.DSN)
+	case "sqlite":
+		dialector = sqlite.Open(cfg.DSN)
 	default:
 		return nil, fmt.Errorf("unsupported database driver: %s", cfg.Type)
 	}
@@ -7,14 +7,17 @@ import (
 )
 
 var (
-	ErrNotConnectPacket = errors.New("not connect packet error")
-	ErrClosedChannel    = errors.New("closed channel")
-	ErrMalformedPacket  = errors.New("malformed packet")
-	ErrNotValidTopic    = errors.New("not valid topic")
-	ErrPacketIDUsed     = errors.New("packet ID is already used")
-	ErrPacketIDNotExist = errors.New("packet ID is not exist")
-	ErrTopicNotValid    = errors.New("topic not valid")
-	ErrNotValidMode     = errors.New("mode not valid")
+	ErrNotConnectPacket  = errors.New("not connect packet error")
+	ErrClosedChannel     = errors.New("closed channel")
+	ErrMalformedPacket   = errors.New("malformed packet")
+	ErrNotValidTopic     = errors.New("not valid topic")
+	ErrPacketIDUsed      = errors.New("packet ID is already used")
+	ErrPacketIDExhausted = errors.New("all packet IDs are in use")
+	ErrPacketIDNotExist  = errors.New("packet ID is not exist")
+	ErrTopicNotValid     = errors.New("topic not valid")
+	ErrNotValidMode      = errors.New("mode not valid")
+	ErrConnectRefused    = errors.New("connect refused")
+	ErrSessionQueueFull  = errors.New("session queue full")
 )
 
 func PacketError(p mqtt.Packet, err error) {
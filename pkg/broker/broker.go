@@ -0,0 +1,36 @@
+// Package broker embeds a mercury MQTT broker in another program. It uses no global state, keeps
+// messages in memory and needs no SQL database unless configured otherwise.
+package broker
+
+import (
+	"context"
+
+	"github.com/jin06/mercury/internal/broker"
+)
+
+// New creates a broker configured by opts. Without options it serves in-process clients only.
+func New(opts ...Option) (*Broker, error) {
+	s := &settings{cfg: defaultConfig()}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	b, err := broker.NewBroker(s.cfg, &broker.Options{
+		Admin:    s.admin,
+		Database: s.cfg.Database.Type != "",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Broker{broker: b}, nil
+}
+
+type Broker struct {
+	broker *broker.Broker
+}
+
+// Run serves the listeners until ctx is done, the message store is closed when it returns.
+func (b *Broker) Run(ctx context.Context) error {
+	return b.broker.Run(ctx)
+}
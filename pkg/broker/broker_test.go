@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/pkg/client"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func receive(t *testing.T, ch chan *mqtt.Publish) *mqtt.Publish {
+	select {
+	case p := <-ch:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func TestInProcess(t *testing.T) {
+	b, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	sub, err := b.NewClient("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close(ctx)
+	pub, err := b.NewClient("pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close(ctx)
+
+	ch := make(chan *mqtt.Publish, 10)
+	if code, err := sub.Subscribe(&mqtt.Subscription{TopicFilter: "sensors/+", QoS: mqtt.QoS2}, func(p *mqtt.Publish) { ch <- p }); err != nil || code != mqtt.ReasonCode(mqtt.QoS2) {
+		t.Fatalf("subscribe: %v, code %d", err, code)
+	}
+	for _, qos := range []mqtt.QoS{mqtt.QoS0, mqtt.QoS1, mqtt.QoS2} {
+		if err := pub.Publish("sensors/temp", qos, false, []byte{byte(qos)}); err != nil {
+			t.Fatalf("QoS %d: %v", qos, err)
+		}
+		if p := receive(t, ch); p.Topic != "sensors/temp" || p.Qos != qos || p.Payload[0] != byte(qos) {
+			t.Fatalf("unexpected message %v", p)
+		}
+	}
+	if err := sub.Unsubscribe("sensors/+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("sensors/temp", mqtt.QoS1, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-ch:
+		t.Fatalf("message received after unsubscribe %v", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNetworkClient(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mercury.sock")
+	b, err := New(WithUnixListener(sock), WithBadgerStore(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.Run(ctx) }()
+
+	sub, err := b.NewClient("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *mqtt.Publish, 1)
+	if _, err := sub.Subscribe(&mqtt.Subscription{TopicFilter: "jobs", QoS: mqtt.QoS1}, func(p *mqtt.Publish) { ch <- p }); err != nil {
+		t.Fatal(err)
+	}
+
+	options := client.DefaultOptions()
+	options.ClientID = "pub"
+	options.Dial = func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", sock)
+	}
+	pub, err := client.New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectCtx, connectCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer connectCancel()
+	for pub.Connect(connectCtx) != nil {
+		if connectCtx.Err() != nil {
+			t.Fatal("broker not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := pub.Publish(connectCtx, "jobs", mqtt.QoS1, false, []byte("backup")); err != nil {
+		t.Fatal(err)
+	}
+	if p := receive(t, ch); string(p.Payload) != "backup" {
+		t.Fatalf("unexpected message %v", p)
+	}
+	pub.Disconnect(context.Background())
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("broker did not stop")
+	}
+}
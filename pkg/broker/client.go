@@ -0,0 +1,280 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// ErrClosed is returned by the methods of a closed Client.
+var ErrClosed = errors.New("client closed")
+
+// queueSize is the number of messages kept for a client whose handlers are busy, the oldest
+// message is dropped when it is full.
+const queueSize = 1000
+
+// Handler is called for every message matching the subscription it was registered with. The
+// handlers of a client run one at a time in the order the messages were published.
+type Handler func(p *mqtt.Publish)
+
+// NewClient connects an in-process client with a clean session, it publishes and subscribes
+// without a network connection. A connected client with the same client ID is taken over.
+func (b *Broker) NewClient(id string) (*Client, error) {
+	c := &Client{
+		srv:      b.broker.Server,
+		id:       id,
+		uuid:     uuid.New().String(),
+		handlers: make(map[string]Handler),
+		notify:   make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+	}
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, mqtt.MQTT5)
+	cp.ClientID = id
+	cp.Clean = true
+	resp, err := c.srv.HandleConnect(cp, c)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ReasonCode != mqtt.V5_SUCCESS {
+		return nil, mqtt.NewError(resp.ReasonCode, "connection refused")
+	}
+	go c.Run(context.Background())
+	return c, nil
+}
+
+// Client is a client inside the process of the broker, it implements server.Client.
+type Client struct {
+	srv  server.Server
+	id   string
+	uuid string
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	queue    []mqtt.Packet
+	packetID mqtt.PacketID
+	closed   bool
+
+	notify    chan struct{}
+	stopping  chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+}
+
+// Publish publishes payload to topic, it returns once the broker has handled the message.
+func (c *Client) Publish(topic string, qos mqtt.QoS, retain bool, payload []byte) error {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Retain = retain
+	p.Payload = payload
+	return c.PublishPacket(p)
+}
+
+// PublishPacket publishes p, e.g. one carrying MQTT 5 properties. The packet ID is set by the client.
+func (c *Client) PublishPacket(p *mqtt.Publish) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	if p.Qos.NotZero() {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		p.PacketID = c.packetID
+	}
+	c.mu.Unlock()
+
+	resp, err := c.srv.HandlePacket(p, c.id)
+	if err != nil {
+		return err
+	}
+	switch resp := resp.(type) {
+	case *mqtt.Puback:
+		if resp.ReasonCode >= mqtt.V5_Unspecified_Error {
+			return mqtt.NewError(resp.ReasonCode, "publish refused")
+		}
+	case *mqtt.Pubrec:
+		if resp.ReasonCode >= mqtt.V5_Unspecified_Error {
+			return mqtt.NewError(resp.ReasonCode, "publish refused")
+		}
+		// the PUBREL dispatches the publish held since the PUBREC
+		_, err := c.srv.HandlePacket(resp.Response(), c.id)
+		return err
+	}
+	return nil
+}
+
+// Subscribe subscribes to sub.TopicFilter and calls handler for the matching messages, it returns
+// the granted QoS.
+func (c *Client) Subscribe(sub *mqtt.Subscription, handler Handler) (mqtt.ReasonCode, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return mqtt.V5_Unspecified_Error, ErrClosed
+	}
+	// retained messages are queued before the subscription returns
+	c.handlers[sub.TopicFilter] = handler
+	c.mu.Unlock()
+
+	p := mqtt.NewSubscribe(&mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, mqtt.MQTT5)
+	p.Subscriptions = []*mqtt.Subscription{sub}
+	resp, err := c.srv.HandlePacket(p, c.id)
+	if err == nil {
+		suback, ok := resp.(*mqtt.Suback)
+		if !ok || len(suback.ReasonCodes) != 1 {
+			err = errors.New("unexpected subscribe response")
+		} else if code := suback.ReasonCodes[0]; code >= mqtt.V5_Unspecified_Error {
+			err = mqtt.NewError(code, "subscription refused")
+		} else {
+			return code, nil
+		}
+	}
+	c.mu.Lock()
+	delete(c.handlers, sub.TopicFilter)
+	c.mu.Unlock()
+	return mqtt.V5_Unspecified_Error, err
+}
+
+func (c *Client) Unsubscribe(filters ...string) error {
+	p := mqtt.NewUnsubscribe(&mqtt.FixedHeader{PacketType: mqtt.UNSUBSCRIBE}, mqtt.MQTT5)
+	p.TopicFilters = filters
+	if _, err := c.srv.HandlePacket(p, c.id); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, filter := range filters {
+		delete(c.handlers, filter)
+	}
+	return nil
+}
+
+// Run calls the handlers of the queued messages and acknowledges them until the client is closed.
+func (c *Client) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.stopping:
+			return nil
+		case <-c.notify:
+		}
+		for {
+			p, ok := c.next()
+			if !ok {
+				break
+			}
+			if err := c.handle(p); err != nil {
+				log.Warn().Err(err).Str("client_id", c.id).Msg("in-process client error")
+			}
+		}
+	}
+}
+
+func (c *Client) next() (mqtt.Packet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.queue) == 0 {
+		return nil, false
+	}
+	p := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	return p, true
+}
+
+func (c *Client) handle(p mqtt.Packet) error {
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		for _, h := range c.matching(p) {
+			h(p)
+		}
+		resp, err := p.Response()
+		if err != nil || resp == nil {
+			return err
+		}
+		rel, err := c.srv.HandlePacket(resp, c.id)
+		if err != nil {
+			return err
+		}
+		if rel, ok := rel.(*mqtt.Pubrel); ok {
+			_, err = c.srv.HandlePacket(rel.Response(), c.id)
+		}
+		return err
+	case *mqtt.Pubrel:
+		_, err := c.srv.HandlePacket(p.Response(), c.id)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) matching(p *mqtt.Publish) []Handler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []Handler
+	for filter, h := range c.handlers {
+		if p.Topic.Match(filter) && h != nil {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// Write queues p for the handlers, it never blocks the publisher. When the queue is full the
+// oldest packet is dropped.
+func (c *Client) Write(p mqtt.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if len(c.queue) >= queueSize {
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.dropped.Add(1)
+	}
+	c.queue = append(c.queue, p)
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close disconnects the client, queued messages are discarded.
+func (c *Client) Close(ctx context.Context) (err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.queue = nil
+		c.mu.Unlock()
+		close(c.stopping)
+		err = c.srv.Deregister(c)
+	})
+	return
+}
+
+func (c *Client) ClientID() string                         { return c.id }
+func (c *Client) Username() string                         { return "" }
+func (c *Client) UUID() string                             { return c.uuid }
+func (c *Client) RemoteAddr() net.Addr                     { return nil }
+func (c *Client) PeerCredentials() *server.PeerCredentials { return nil }
+func (c *Client) Read() (mqtt.Packet, error)               { return nil, nil }
+func (c *Client) KeepAlive()                               {}
+func (c *Client) Dropped() uint64                          { return c.dropped.Load() }
+
+func (c *Client) QueueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
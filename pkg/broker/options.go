@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+)
+
+// Option configures a Broker created by New.
+type Option func(*settings) error
+
+type settings struct {
+	cfg   *config.Config
+	admin bool
+}
+
+func defaultConfig() *config.Config {
+	return &config.Config{
+		Mode:         config.MemoryMode,
+		Capabilities: config.DefaultCapabilities(),
+		MessageStore: config.MessageStore{Mode: "memory"},
+		MQTTConfig: config.MQTTConfig{
+			SlowConsumer:          config.DefaultSlowConsumer(),
+			Retry:                 config.DefaultRetry(),
+			ConnectTimeout:        time.Second * 10,
+			MessageExpiryInterval: time.Hour * 24,
+		},
+	}
+}
+
+// WithConfigFile loads the configuration of a mercury.yaml file, it replaces the settings of
+// the options before it.
+func WithConfigFile(path string) Option {
+	return func(s *settings) error {
+		cfg, err := config.Parse(path)
+		if err != nil {
+			return err
+		}
+		if cfg.MQTTConfig.MessageExpiryInterval == 0 {
+			cfg.MQTTConfig.MessageExpiryInterval = time.Hour * 24
+		}
+		s.cfg = cfg
+		return nil
+	}
+}
+
+// WithTCPListener serves MQTT on a TCP address, e.g. ":1883".
+func WithTCPListener(addr string) Option {
+	return func(s *settings) error {
+		s.cfg.Listeners = append(s.cfg.Listeners, config.Listener{Type: "tcp", Addr: addr})
+		return nil
+	}
+}
+
+// WithUnixListener serves MQTT on a unix socket.
+func WithUnixListener(path string) Option {
+	return func(s *settings) error {
+		s.cfg.Listeners = append(s.cfg.Listeners, config.Listener{Type: "unix", Addr: path})
+		return nil
+	}
+}
+
+// WithMemoryStore keeps the inflight messages in memory, it is the default.
+func WithMemoryStore() Option {
+	return func(s *settings) error {
+		s.cfg.MessageStore = config.MessageStore{Mode: "memory"}
+		return nil
+	}
+}
+
+// WithBadgerStore keeps the inflight messages in a badger database in dir.
+func WithBadgerStore(dir string) Option {
+	return func(s *settings) error {
+		s.cfg.MessageStore = config.MessageStore{Mode: "badger", BadgerConfig: config.BadgerConfig{Dir: dir}}
+		return nil
+	}
+}
+
+// WithRedisStore keeps the inflight messages in the redis server at addr.
+func WithRedisStore(addr string) Option {
+	return func(s *settings) error {
+		s.cfg.MessageStore = config.MessageStore{Mode: "redis", RedisConfig: config.RedisConfig{Addr: addr}}
+		return nil
+	}
+}
+
+// WithSQLStore keeps the inflight messages in a mysql, postgres or sqlite database.
+func WithSQLStore(driver, dsn string) Option {
+	return func(s *settings) error {
+		s.cfg.MessageStore = config.MessageStore{Mode: "sql", SQLConfig: config.Database{Type: driver, DSN: dsn}}
+		return nil
+	}
+}
+
+// WithMessageExpiry drops stored messages not delivered within d.
+func WithMessageExpiry(d time.Duration) Option {
+	return func(s *settings) error {
+		s.cfg.MQTTConfig.MessageExpiryInterval = d
+		return nil
+	}
+}
+
+// WithMaxConnections limits the number of network connections, 0 means no limit.
+func WithMaxConnections(n int) Option {
+	return func(s *settings) error {
+		s.cfg.MQTTConfig.MaxConnections = n
+		return nil
+	}
+}
+
+// WithDatabase connects a mysql, postgres or sqlite database, which the admin user service needs.
+func WithDatabase(driver, dsn string) Option {
+	return func(s *settings) error {
+		s.cfg.Database = config.Database{Type: driver, DSN: dsn}
+		return nil
+	}
+}
+
+// WithAdmin runs the admin HTTP API.
+func WithAdmin() Option {
+	return func(s *settings) error {
+		s.admin = true
+		return nil
+	}
+}
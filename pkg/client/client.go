@@ -0,0 +1,661 @@
+// Package client is an MQTT 3.1.1 and 5 client built on the packets and connection of pkg/mqtt.
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+var (
+	ErrNotConnected = errors.New("client is not connected")
+	ErrClosed       = errors.New("client is closed")
+	ErrNoPacketID   = errors.New("no packet id available")
+)
+
+// Handler is called for every received message. The handlers of a client run one at a time in the order
+// the messages arrive, QoS 1 and 2 messages are acknowledged once the handler returns.
+type Handler func(c *Client, p *mqtt.Publish)
+
+func New(options *Options) (*Client, error) {
+	if options == nil {
+		options = DefaultOptions()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		options:  options,
+		store:    options.Store,
+		clientID: options.ClientID,
+		inflight: make(map[mqtt.PacketID]*token),
+		received: make(map[mqtt.PacketID]struct{}),
+		messages: make(chan incoming, 100),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if c.store == nil {
+		c.store = NewMemoryStore()
+	}
+	// messages left by a previous run are sent once connected
+	packets, err := c.store.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packets {
+		c.seq++
+		c.inflight[packetID(p)] = newToken(p, c.seq)
+	}
+	go c.handle()
+	return c, nil
+}
+
+type Client struct {
+	options *Options
+	store   Store
+
+	mu       sync.Mutex
+	conn     *conn
+	running  bool
+	clientID string
+	lastID   mqtt.PacketID
+	seq      uint64
+	// inflight are the packets waiting for their acknowledgement, by packet ID
+	inflight      map[mqtt.PacketID]*token
+	subscriptions []*subscription
+	// received are the QoS 2 messages handled and waiting for PUBREL
+	received map[mqtt.PacketID]struct{}
+
+	messages chan incoming
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+type conn struct {
+	*mqtt.Connection
+	mu        sync.Mutex
+	keepAlive time.Duration
+}
+
+func (c *conn) write(p mqtt.Packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.WritePacket(p)
+}
+
+type subscription struct {
+	sub     *mqtt.Subscription
+	handler Handler
+}
+
+type incoming struct {
+	conn *conn
+	p    *mqtt.Publish
+}
+
+// token tracks a packet until it is acknowledged.
+type token struct {
+	packet mqtt.Packet
+	// seq keeps the order packets are sent again after a reconnect
+	seq  uint64
+	done chan struct{}
+	resp mqtt.Packet
+	err  error
+}
+
+func newToken(p mqtt.Packet, seq uint64) *token {
+	return &token{packet: p, seq: seq, done: make(chan struct{})}
+}
+
+func (t *token) complete(resp mqtt.Packet, err error) {
+	t.resp, t.err = resp, err
+	close(t.done)
+}
+
+// Connect connects to the broker, once connected the client reconnects by itself until Disconnect is called.
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	running := c.running
+	c.mu.Unlock()
+	if running {
+		return errors.New("client is already connected")
+	}
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.running = true
+	c.mu.Unlock()
+	go c.run(conn)
+	return nil
+}
+
+// ClientID returns the client ID, assigned by the broker when the options have none.
+func (c *Client) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+func (c *Client) connect(ctx context.Context) (*conn, error) {
+	o := c.options
+	if o.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.ConnectTimeout)
+		defer cancel()
+	}
+	nc, err := o.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	conn := &conn{Connection: mqtt.NewConnection(nc), keepAlive: o.KeepAlive}
+	conn.Version = o.Version
+	connack, err := c.handshake(conn)
+	if !stop() {
+		err = errors.Join(err, ctx.Err())
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if props := connack.Properties; props != nil && o.Version.IsMQTT5() {
+		if props.ServerKeepAlive != nil {
+			conn.keepAlive = time.Duration(*props.ServerKeepAlive) * time.Second
+		}
+		if props.AssignedClientID != nil {
+			c.mu.Lock()
+			c.clientID = *props.AssignedClientID
+			c.mu.Unlock()
+		}
+	}
+	c.resume(conn, connack.SessionPresent)
+	if o.OnConnect != nil {
+		go o.OnConnect(c, connack)
+	}
+	return conn, nil
+}
+
+func (c *Client) handshake(conn *conn) (*mqtt.Connack, error) {
+	o := c.options
+	cp := mqtt.NewConnect(&mqtt.FixedHeader{PacketType: mqtt.CONNECT}, o.Version)
+	cp.ProtocolName = "MQTT"
+	if o.Version == mqtt.MQTT3 {
+		cp.ProtocolName = "MQIsdp"
+	}
+	cp.ClientID = c.ClientID()
+	cp.Clean = o.CleanStart
+	cp.KeepAlive = uint16(o.KeepAlive / time.Second)
+	cp.Username, cp.UserNameFlag = o.Username, o.Username != ""
+	cp.Password, cp.PasswordFlag = o.Password, o.Password != ""
+	cp.Will, cp.WillFlag = o.Will, o.Will != nil
+	if o.Properties != nil {
+		cp.Properties = o.Properties
+	}
+	if err := conn.write(cp); err != nil {
+		return nil, err
+	}
+	p, err := conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	connack, ok := p.(*mqtt.Connack)
+	if !ok {
+		return nil, mqtt.ErrProtocol
+	}
+	if connack.ReasonCode != mqtt.V5_SUCCESS {
+		return nil, mqtt.NewError(connack.ReasonCode, "connection refused")
+	}
+	return connack, nil
+}
+
+// resume sends the packets of the session again on a new connection. A broker without the session
+// gets the subscriptions again, it has also forgotten the QoS 2 messages waiting for PUBREL.
+// Subscriptions made again on a connection lost before their SUBACK are made again in any case.
+func (c *Client) resume(conn *conn, sessionPresent bool) {
+	c.mu.Lock()
+	c.conn = conn
+	var packets []mqtt.Packet
+	// the subscriptions made again on the previous connection are not waited for any more
+	stale := false
+	for id, t := range c.inflight {
+		if t.seq == 0 {
+			delete(c.inflight, id)
+			stale = true
+		}
+	}
+	if !sessionPresent || stale {
+		c.received = make(map[mqtt.PacketID]struct{})
+		for _, s := range c.subscriptions {
+			id, err := c.nextID()
+			if err != nil {
+				break
+			}
+			p := c.subscribePacket(s.sub)
+			p.PacketID = id
+			c.inflight[id] = newToken(p, 0)
+			packets = append(packets, p)
+		}
+	}
+	tokens := make([]*token, 0, len(c.inflight))
+	for _, t := range c.inflight {
+		if t.seq > 0 {
+			tokens = append(tokens, t)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b *token) int { return cmp.Compare(a.seq, b.seq) })
+	for _, t := range tokens {
+		if p, ok := t.packet.(*mqtt.Publish); ok {
+			p.Dup = true
+		}
+		packets = append(packets, t.packet)
+	}
+	c.mu.Unlock()
+	for _, p := range packets {
+		if err := conn.write(p); err != nil {
+			return
+		}
+	}
+}
+
+// run serves the connection and reconnects with backoff when it is lost.
+func (c *Client) run(conn *conn) {
+	defer close(c.done)
+	for {
+		err := c.serve(conn)
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		if c.ctx.Err() != nil {
+			return
+		}
+		if c.options.OnConnectionLost != nil {
+			c.options.OnConnectionLost(c, err)
+		}
+		if conn = c.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) reconnect() *conn {
+	delay := c.options.MinBackoff
+	for {
+		// jitter spreads the reconnects of many clients after a broker restart
+		wait := delay + rand.N(delay/4+1)
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		if conn, err := c.connect(c.ctx); err == nil {
+			return conn
+		}
+		delay = min(delay*2, c.options.MaxBackoff)
+	}
+}
+
+// serve reads from conn and keeps it alive until it fails or the client is closed.
+func (c *Client) serve(conn *conn) error {
+	defer conn.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.read(conn)
+	}()
+	var tick <-chan time.Time
+	if conn.keepAlive > 0 {
+		ticker := time.NewTicker(conn.keepAlive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-tick:
+			if err := conn.write(mqtt.NewPingreq(&mqtt.FixedHeader{PacketType: mqtt.PINGREQ}, c.options.Version)); err != nil {
+				return err
+			}
+		case <-c.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+func (c *Client) read(conn *conn) error {
+	for {
+		// PINGREQ is sent every keep alive, a broker silent for longer is gone
+		if conn.keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(conn.keepAlive * 3 / 2))
+		}
+		p, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if err := c.receive(conn, p); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) receive(conn *conn, p mqtt.Packet) error {
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		return c.receivePublish(conn, p)
+	case *mqtt.Pubrel:
+		c.mu.Lock()
+		delete(c.received, p.PacketID)
+		c.mu.Unlock()
+		return conn.write(p.Response())
+	case *mqtt.Puback:
+		return c.ack(p.PacketID, p, p.ReasonCode)
+	case *mqtt.Pubrec:
+		if p.ReasonCode >= mqtt.V5_Unspecified_Error {
+			return c.ack(p.PacketID, p, p.ReasonCode)
+		}
+		pubrel := p.Response()
+		c.mu.Lock()
+		t, ok := c.inflight[p.PacketID]
+		if ok {
+			t.packet = pubrel
+		}
+		c.mu.Unlock()
+		if ok {
+			if err := c.store.Put(pubrel); err != nil {
+				return err
+			}
+		}
+		return conn.write(pubrel)
+	case *mqtt.Pubcomp:
+		// the message was delivered once PUBREC was received, whatever PUBCOMP says
+		return c.ack(p.PacketID, p, mqtt.V5_SUCCESS)
+	case *mqtt.Suback:
+		return c.ack(p.PacketID, p, mqtt.V5_SUCCESS)
+	case *mqtt.Unsuback:
+		return c.ack(p.PacketID, p, mqtt.V5_SUCCESS)
+	case *mqtt.Disconnect:
+		return mqtt.NewError(p.ResionCode, "disconnected by the broker")
+	}
+	return nil
+}
+
+func (c *Client) receivePublish(conn *conn, p *mqtt.Publish) error {
+	if p.Qos == mqtt.QoS2 {
+		c.mu.Lock()
+		_, handled := c.received[p.PacketID]
+		c.received[p.PacketID] = struct{}{}
+		c.mu.Unlock()
+		if handled {
+			resp, _ := p.Response()
+			return conn.write(resp)
+		}
+	}
+	select {
+	case c.messages <- incoming{conn: conn, p: p}:
+	case <-c.ctx.Done():
+		return ErrClosed
+	}
+	return nil
+}
+
+// handle calls the handlers of the received messages and acknowledges them.
+func (c *Client) handle() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case m := <-c.messages:
+			for _, h := range c.handlers(m.p) {
+				h(c, m.p)
+			}
+			// a failed acknowledgement is fine, the broker sends the message again after a reconnect
+			if resp, _ := m.p.Response(); resp != nil {
+				m.conn.write(resp)
+			}
+		}
+	}
+}
+
+func (c *Client) handlers(p *mqtt.Publish) []Handler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []Handler
+	for _, s := range c.subscriptions {
+		if p.Topic.Match(s.sub.TopicFilter) && s.handler != nil {
+			list = append(list, s.handler)
+		}
+	}
+	if len(list) == 0 && c.options.DefaultHandler != nil {
+		list = append(list, c.options.DefaultHandler)
+	}
+	return list
+}
+
+func (c *Client) ack(id mqtt.PacketID, resp mqtt.Packet, code mqtt.ReasonCode) error {
+	c.mu.Lock()
+	t, ok := c.inflight[id]
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var err error
+	switch t.packet.(type) {
+	case *mqtt.Publish, *mqtt.Pubrel:
+		err = c.store.Delete(id)
+	}
+	if code >= mqtt.V5_Unspecified_Error {
+		t.complete(resp, mqtt.NewError(code, "publish refused"))
+	} else {
+		t.complete(resp, nil)
+	}
+	return err
+}
+
+// nextID returns a packet ID not in flight, c.mu must be held.
+func (c *Client) nextID() (mqtt.PacketID, error) {
+	for range mqtt.MAX_PACKET_ID {
+		c.lastID++
+		if c.lastID == 0 {
+			c.lastID = mqtt.MIN_PACKET_ID
+		}
+		if _, ok := c.inflight[c.lastID]; !ok {
+			return c.lastID, nil
+		}
+	}
+	return 0, ErrNoPacketID
+}
+
+// request sends p with a new packet ID and returns the token completed by its acknowledgement,
+// until then p is sent again after every reconnect.
+func (c *Client) request(p mqtt.Packet) (*token, error) {
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id, err := c.nextID()
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		p.PacketID = id
+		if err := c.store.Put(p); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+	case *mqtt.Subscribe:
+		p.PacketID = id
+	case *mqtt.Unsubscribe:
+		p.PacketID = id
+	}
+	c.seq++
+	t := newToken(p, c.seq)
+	c.inflight[id] = t
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		// a failed write is sent again after the reconnect
+		conn.write(p)
+	}
+	return t, nil
+}
+
+func (c *Client) wait(ctx context.Context, t *token) (mqtt.Packet, error) {
+	select {
+	case <-t.done:
+		return t.resp, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Publish sends a message and waits until the broker acknowledged it, QoS 0 messages return once written.
+func (c *Client) Publish(ctx context.Context, topic string, qos mqtt.QoS, retain bool, payload []byte) error {
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, c.options.Version)
+	p.Topic = mqtt.Topic(topic)
+	p.Qos = qos
+	p.Retain = retain
+	p.Payload = payload
+	return c.PublishPacket(ctx, p)
+}
+
+// PublishPacket is Publish for a packet carrying MQTT 5 properties, e.g. the message expiry or user properties.
+// A QoS 1 or 2 message whose ctx is done is still delivered, after a reconnect if need be.
+func (c *Client) PublishPacket(ctx context.Context, p *mqtt.Publish) error {
+	if err := p.Topic.Valid(); err != nil || p.Topic.IsWild() {
+		return mqtt.ErrNotValidTopic
+	}
+	p.Version = c.options.Version
+	if p.Qos.Zero() {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn == nil {
+			return ErrNotConnected
+		}
+		return conn.write(p)
+	}
+	t, err := c.request(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.wait(ctx, t)
+	return err
+}
+
+// Subscribe subscribes to sub and calls handler for the messages matching its topic filter. The subscription
+// is made again when the client reconnects to a broker that lost the session.
+func (c *Client) Subscribe(ctx context.Context, sub *mqtt.Subscription, handler Handler) (mqtt.ReasonCode, error) {
+	c.mu.Lock()
+	// retained messages may arrive before SUBACK
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s *subscription) bool {
+		return s.sub.TopicFilter == sub.TopicFilter
+	})
+	s := &subscription{sub: sub, handler: handler}
+	c.subscriptions = append(c.subscriptions, s)
+	c.mu.Unlock()
+
+	t, err := c.request(c.subscribePacket(sub))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.wait(ctx, t)
+	if err != nil {
+		return 0, err
+	}
+	suback, ok := resp.(*mqtt.Suback)
+	if !ok || len(suback.ReasonCodes) != 1 {
+		return 0, mqtt.ErrProtocol
+	}
+	code := suback.ReasonCodes[0]
+	if code >= mqtt.V5_Unspecified_Error {
+		c.removeSubscription(s)
+		return code, mqtt.NewError(code, "subscription refused")
+	}
+	return code, nil
+}
+
+func (c *Client) subscribePacket(sub *mqtt.Subscription) *mqtt.Subscribe {
+	p := mqtt.NewSubscribe(&mqtt.FixedHeader{PacketType: mqtt.SUBSCRIBE}, c.options.Version)
+	p.Subscriptions = []*mqtt.Subscription{sub}
+	return p
+}
+
+func (c *Client) removeSubscription(s *subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(v *subscription) bool { return v == s })
+}
+
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	c.mu.Lock()
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(s *subscription) bool {
+		return slices.Contains(filters, s.sub.TopicFilter)
+	})
+	c.mu.Unlock()
+
+	p := mqtt.NewUnsubscribe(&mqtt.FixedHeader{PacketType: mqtt.UNSUBSCRIBE}, c.options.Version)
+	p.TopicFilters = filters
+	t, err := c.request(p)
+	if err != nil {
+		return err
+	}
+	resp, err := c.wait(ctx, t)
+	if err != nil {
+		return err
+	}
+	if unsuback, ok := resp.(*mqtt.Unsuback); ok {
+		for _, code := range unsuback.ReasonCodes {
+			if code >= mqtt.V5_Unspecified_Error {
+				return mqtt.NewError(code, "unsubscribe refused")
+			}
+		}
+	}
+	return nil
+}
+
+// Disconnect sends DISCONNECT and closes the client. Messages not yet acknowledged stay in the store,
+// a new client with the same store and client ID delivers them.
+func (c *Client) Disconnect(ctx context.Context) error {
+	c.mu.Lock()
+	conn, running := c.conn, c.running
+	c.mu.Unlock()
+	var err error
+	if conn != nil {
+		err = conn.write(mqtt.NewDisconnect(&mqtt.FixedHeader{PacketType: mqtt.DISCONNECT}, c.options.Version))
+	}
+	c.cancel()
+	if running {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, t := range c.inflight {
+		delete(c.inflight, id)
+		t.complete(nil, ErrClosed)
+	}
+	return err
+}
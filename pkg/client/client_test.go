@@ -0,0 +1,238 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jin06/mercury/internal/config"
+	"github.com/jin06/mercury/internal/server"
+	"github.com/jin06/mercury/internal/server/clients"
+	"github.com/jin06/mercury/internal/server/message/retry"
+	"github.com/jin06/mercury/internal/server/message/store"
+	memStore "github.com/jin06/mercury/internal/server/message/store/memory"
+	"github.com/jin06/mercury/internal/server/servers"
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// startBroker serves MQTT on a loopback port with an in-memory server.
+func startBroker(t *testing.T) (string, server.Server) {
+	cfg := &config.Config{
+		Mode:         config.MemoryMode,
+		Capabilities: config.DefaultCapabilities(),
+	}
+	newStore := func(cid string) store.Store { return memStore.New(cid, 0, retry.Policy{}) }
+	srv, err := servers.NewServer(cfg, newStore, servers.Persistence{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			options := clients.DefaultOptions()
+			options.Config = cfg
+			go clients.NewClient(srv, conn, options).Run(ctx)
+		}
+	}()
+	return l.Addr().String(), srv
+}
+
+func newClient(t *testing.T, addr, id string, configure func(*Options)) *Client {
+	options := DefaultOptions()
+	options.Addr = addr
+	options.ClientID = id
+	options.MinBackoff = 10 * time.Millisecond
+	if configure != nil {
+		configure(options)
+	}
+	c, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect(context.Background()) })
+	return c
+}
+
+func connect(t *testing.T, c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func subscribe(t *testing.T, c *Client, filter string, qos mqtt.QoS) chan *mqtt.Publish {
+	ch := make(chan *mqtt.Publish, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	code, err := c.Subscribe(ctx, &mqtt.Subscription{TopicFilter: filter, QoS: qos}, func(c *Client, p *mqtt.Publish) {
+		ch <- p
+	})
+	if err != nil || code != mqtt.ReasonCode(qos) {
+		t.Fatalf("subscribe: %v, code %d", err, code)
+	}
+	return ch
+}
+
+func receive(t *testing.T, ch chan *mqtt.Publish) *mqtt.Publish {
+	select {
+	case p := <-ch:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for _, version := range []mqtt.ProtocolVersion{mqtt.MQTT4, mqtt.MQTT5} {
+		t.Run(version.String(), func(t *testing.T) {
+			addr, _ := startBroker(t)
+			setVersion := func(o *Options) { o.Version = version }
+			sub, pub := newClient(t, addr, "sub", setVersion), newClient(t, addr, "pub", setVersion)
+			connect(t, sub)
+			connect(t, pub)
+			ch := subscribe(t, sub, "sensors/+", mqtt.QoS2)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for _, qos := range []mqtt.QoS{mqtt.QoS0, mqtt.QoS1, mqtt.QoS2} {
+				if err := pub.Publish(ctx, "sensors/temp", qos, false, []byte{byte(qos)}); err != nil {
+					t.Fatalf("QoS %d: %v", qos, err)
+				}
+				if p := receive(t, ch); p.Topic != "sensors/temp" || p.Qos != qos || p.Payload[0] != byte(qos) {
+					t.Fatalf("unexpected message %v", p)
+				}
+			}
+			if err := sub.Unsubscribe(ctx, "sensors/+"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUserProperties(t *testing.T) {
+	addr, _ := startBroker(t)
+	sub, pub := newClient(t, addr, "sub", nil), newClient(t, addr, "pub", nil)
+	connect(t, sub)
+	connect(t, pub)
+	ch := subscribe(t, sub, "orders/#", mqtt.QoS1)
+
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic = "orders/1"
+	p.Qos = mqtt.QoS1
+	p.Properties.UserProperties = mqtt.UserProperties{{Key: "region", Val: "eu"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pub.PublishPacket(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, ch).Properties.UserProperties
+	if len(got) != 1 || got[0] != (mqtt.UserProperty{Key: "region", Val: "eu"}) {
+		t.Errorf("unexpected user properties %v", got)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	addr, srv := startBroker(t)
+	lost := make(chan error, 1)
+	sub := newClient(t, addr, "sub", func(o *Options) {
+		o.OnConnectionLost = func(c *Client, err error) { lost <- err }
+	})
+	pub := newClient(t, addr, "pub", nil)
+	connect(t, sub)
+	connect(t, pub)
+	ch := subscribe(t, sub, "alerts", mqtt.QoS1)
+
+	for _, c := range srv.Clients() {
+		if c.ClientID() == "sub" {
+			c.Close(context.Background())
+		}
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection loss not reported")
+	}
+	// the clean session is gone, the subscription is made again
+	deadline := time.Now().Add(5 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		if err := pub.Publish(ctx, "alerts", mqtt.QoS1, false, []byte("fire")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p := <-ch:
+			if string(p.Payload) != "fire" {
+				t.Fatalf("unexpected message %v", p)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription not restored")
+		}
+	}
+}
+
+func TestStoreResent(t *testing.T) {
+	addr, _ := startBroker(t)
+	sub := newClient(t, addr, "sub", nil)
+	connect(t, sub)
+	ch := subscribe(t, sub, "jobs", mqtt.QoS1)
+
+	// a message left unacknowledged by a previous run of the publisher
+	store := NewMemoryStore()
+	p := mqtt.NewPublish(&mqtt.FixedHeader{PacketType: mqtt.PUBLISH}, mqtt.MQTT5)
+	p.Topic, p.Qos, p.PacketID, p.Payload = "jobs", mqtt.QoS1, 7, []byte("backup")
+	store.Put(p)
+
+	pub := newClient(t, addr, "pub", func(o *Options) { o.Store = store })
+	connect(t, pub)
+	if got := receive(t, ch); string(got.Payload) != "backup" {
+		t.Fatalf("unexpected message %v", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if packets, _ := store.All(); len(packets) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("acknowledged message not removed from the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeDropsStaleSubscribes(t *testing.T) {
+	c := newClient(t, "127.0.0.1:0", "c1", nil)
+	c.subscriptions = []*subscription{{sub: &mqtt.Subscription{TopicFilter: "a", QoS: mqtt.QoS1}}}
+	for range 3 {
+		local, peer := net.Pipe()
+		go io.Copy(io.Discard, peer)
+		// the connection is lost before the SUBACK
+		c.resume(&conn{Connection: mqtt.NewConnection(local)}, false)
+		local.Close()
+		peer.Close()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.inflight) != 1 {
+		t.Errorf("expected 1 subscribe in flight, got %d", len(c.inflight))
+	}
+}
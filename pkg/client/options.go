@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+func DefaultOptions() *Options {
+	return &Options{
+		Version:        mqtt.MQTT5,
+		CleanStart:     true,
+		KeepAlive:      time.Minute,
+		ConnectTimeout: time.Second * 10,
+		MinBackoff:     time.Second,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+type Options struct {
+	// Addr is the host and port of the broker, used when Dial is nil.
+	Addr string
+	// Dial opens the connection to the broker, e.g. over TLS or a unix socket.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	Version    mqtt.ProtocolVersion
+	ClientID   string
+	Username   string
+	Password   string
+	CleanStart bool
+	// KeepAlive is the interval of PINGREQ packets, 0 disables them.
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+	Will           *mqtt.Will
+	// Properties are sent with CONNECT, MQTT 5 only.
+	Properties *mqtt.Properties
+
+	// MinBackoff is the delay before the first reconnect, it doubles after every failed attempt up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Store holds the outgoing QoS 1 and 2 messages until they are acknowledged, nil keeps them in memory.
+	Store Store
+	// DefaultHandler receives the messages matching no subscription, e.g. those of a resumed session.
+	DefaultHandler Handler
+	// OnConnect is called after every successful connect, including reconnects.
+	OnConnect func(c *Client, connack *mqtt.Connack)
+	// OnConnectionLost is called when an established connection fails, before reconnecting.
+	OnConnectionLost func(c *Client, err error)
+}
+
+func (o *Options) dial(ctx context.Context) (net.Conn, error) {
+	if o.Dial != nil {
+		return o.Dial(ctx)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", o.Addr)
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/jin06/mercury/pkg/mqtt"
+)
+
+// Store persists the outgoing QoS 1 and 2 packets of a session until they are acknowledged. A store that
+// outlives the process lets a restarted client with the same client ID finish their delivery.
+type Store interface {
+	// Put saves a PUBLISH, or the PUBREL replacing the PUBLISH of the same packet ID once it is received.
+	Put(p mqtt.Packet) error
+	Delete(id mqtt.PacketID) error
+	// All returns the saved packets in the order their packet IDs were first put.
+	All() ([]mqtt.Packet, error)
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{packets: make(map[mqtt.PacketID]mqtt.Packet)}
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	packets map[mqtt.PacketID]mqtt.Packet
+	order   []mqtt.PacketID
+}
+
+func (s *memoryStore) Put(p mqtt.Packet) error {
+	id := packetID(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.packets[id]; !ok {
+		s.order = append(s.order, id)
+	}
+	s.packets[id] = p
+	return nil
+}
+
+func (s *memoryStore) Delete(id mqtt.PacketID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.packets[id]; ok {
+		delete(s.packets, id)
+		s.order = slices.DeleteFunc(s.order, func(v mqtt.PacketID) bool { return v == id })
+	}
+	return nil
+}
+
+func (s *memoryStore) All() ([]mqtt.Packet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]mqtt.Packet, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.packets[id])
+	}
+	return list, nil
+}
+
+func packetID(p mqtt.Packet) mqtt.PacketID {
+	switch p := p.(type) {
+	case *mqtt.Publish:
+		return p.PacketID
+	case *mqtt.Pubrel:
+		return p.PacketID
+	case *mqtt.Subscribe:
+		return p.PacketID
+	case *mqtt.Unsubscribe:
+		return p.PacketID
+	}
+	return 0
+}
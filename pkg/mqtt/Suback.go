@@ -67,12 +67,19 @@ func (s *Suback) Decode(data []byte) (int, error) {
 }
 
 func (s *Suback) DecodeBody(data []byte) (int, error) {
+	if err := s.PacketID.Decode(data); err != nil {
+		return 0, err
+	}
+	start := 2
 
 	// Decode Properties (MQTT 5.0 only)
-	s.Properties = new(Properties)
-	start, err := s.Properties.Decode(data)
-	if err != nil {
-		return start, err
+	if s.Version == MQTT5 {
+		s.Properties = new(Properties)
+		n, err := s.Properties.Decode(data[start:])
+		if err != nil {
+			return start, err
+		}
+		start += n
 	}
 	for len(data) > start {
 		reason := ReasonCode(data[start])
@@ -1,6 +1,9 @@
 package mqtt
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type Connection struct {
 	conn io.ReadWriteCloser
@@ -19,3 +22,19 @@ func NewConnection(c io.ReadWriteCloser) *Connection {
 func (c *Connection) Close() error {
 	return c.conn.Close()
 }
+
+// SetReadDeadline sets the read deadline if the underlying connection supports one, the zero time clears it.
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	if d, ok := c.conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline if the underlying connection supports one, the zero time clears it.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
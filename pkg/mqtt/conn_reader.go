@@ -16,14 +16,18 @@ type Reader struct {
 	raw io.Reader
 	*bufio.Reader
 	Version ProtocolVersion
+	// MaximumPacketSize rejects packets larger than this many bytes, 0 means no limit.
+	MaximumPacketSize uint32
 }
 
 func (r *Reader) Read(n int) ([]byte, error) {
 	p := make([]byte, n)
-	if rn, err := r.Reader.Read(p); err != nil {
+	// a single read returns at most what is buffered, large packets need several
+	if rn, err := io.ReadFull(r.Reader, p); err != nil {
+		if rn > 0 && err == io.ErrUnexpectedEOF {
+			return nil, ErrReadNotEnoughBytes
+		}
 		return nil, err
-	} else if rn != n {
-		return nil, ErrReadNotEnoughBytes
 	}
 	return p, nil
 }
@@ -33,6 +37,9 @@ func (r *Reader) ReadPacket() (Packet, error) {
 	if err := header.Read(r); err != nil {
 		return nil, err
 	}
+	if r.MaximumPacketSize > 0 && header.Size() > int(r.MaximumPacketSize) {
+		return nil, Err_V5_Packet_Too_Large
+	}
 	var packet Packet
 	switch header.PacketType {
 	case CONNECT:
@@ -42,10 +42,13 @@ func (c *Connack) EncodeBody() ([]byte, error) {
 	result := make([]byte, 0)
 	result = append(result, encodeBool(c.SessionPresent))
 	result = append(result, byte(c.ReasonCode))
-	if data, err := c.Properties.Encode(); err != nil {
-		return nil, err
-	} else {
-		result = append(result, data...)
+	// Encode Properties (MQTT 5.0 only)
+	if c.Version.IsMQTT5() {
+		if data, err := c.Properties.Encode(); err != nil {
+			return nil, err
+		} else {
+			result = append(result, data...)
+		}
 	}
 	return result, nil
 }
@@ -69,6 +72,9 @@ func (c *Connack) DecodeBody(data []byte) (int, error) {
 	i++
 	c.ReasonCode = ReasonCode(data[i])
 	i++
+	if !c.Version.IsMQTT5() {
+		return i, nil
+	}
 	if c.Properties == nil {
 		c.Properties = &Properties{}
 	}
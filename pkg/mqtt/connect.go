@@ -281,14 +281,17 @@ func (c *Connect) WriteBody(w *Writer) error {
 func (c *Connect) encodeFlag() (byte, error) {
 	var flag byte
 	if c.UserNameFlag {
-		flag = flag | 0b1000000
+		flag = flag | 0b10000000
 	}
 	if c.PasswordFlag {
 		flag = flag | 0b01000000
 	}
 	if c.WillFlag && c.Will != nil {
-		flag = flag | 0b00100100
-		flag = flag | byte((c.Will.QoS&0b00011000)<<3)
+		flag = flag | 0b00000100
+		flag = flag | byte(c.Will.QoS&0b11)<<3
+		if c.Will.Retain {
+			flag = flag | 0b00100000
+		}
 	}
 	if c.Clean {
 		flag = flag | 0b00000010
@@ -297,19 +300,14 @@ func (c *Connect) encodeFlag() (byte, error) {
 }
 
 func (c *Connect) decodeFlag(flag byte) {
-	c.UserNameFlag = (flag&0b1000000 == 0b1000000)
+	c.UserNameFlag = (flag&0b10000000 == 0b10000000)
 	c.PasswordFlag = (flag&0b01000000 == 0b01000000)
-	if flag&0b00000100 == 0b00000100 {
-		c.Will = &Will{}
-		c.Will.Retain = (flag&0b00100000 == 0b00100000)
-		c.Will.QoS = QoS((flag & 0b00011000) >> 3)
-	}
 	c.Clean = (flag&0b00000010 == 0b00000010)
 	c.WillFlag = (flag&0b00000100 == 0b00000100)
 	if c.WillFlag {
 		c.Will = &Will{
 			Retain:     flag&0b00100000 == 0b00100000,
-			QoS:        QoS(flag & 0b00011000),
+			QoS:        QoS((flag & 0b00011000) >> 3),
 			Properties: new(Properties),
 		}
 	}
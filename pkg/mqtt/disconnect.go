@@ -13,12 +13,17 @@ type Disconnect struct {
 	Properties *Properties
 }
 
-func (d *Disconnect) Encode() (result []byte, err error) {
-	result = toHeader(DISCONNECT)
-	if d.Version == MQTT5 {
-		result = append(result, byte(d.ResionCode))
+func (d *Disconnect) Encode() ([]byte, error) {
+	body, err := d.EncodeBody()
+	if err != nil {
+		return nil, err
+	}
+	length, err := encodeVariableByteInteger(len(body))
+	if err != nil {
+		return nil, err
 	}
-	return
+	result := append([]byte{byte(DISCONNECT) << 4}, length...)
+	return append(result, body...), nil
 }
 
 func (d *Disconnect) Decode(data []byte) (int, error) {
@@ -36,6 +41,13 @@ func (d *Disconnect) EncodeBody() ([]byte, error) {
 	var data []byte
 	if d.Version == MQTT5 {
 		data = append(data, byte(d.ResionCode))
+		if d.Properties != nil {
+			propertiesData, err := d.Properties.Encode()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, propertiesData...)
+		}
 	}
 	return data, nil
 }
@@ -25,6 +25,12 @@ func (f *FixedHeader) Length() int {
 	return f.RemainingLength.Int()
 }
 
+// Size returns the size in bytes of the whole packet, including the fixed header.
+func (f *FixedHeader) Size() int {
+	length, _ := encodeVariableByteInteger(f.RemainingLength)
+	return 1 + len(length) + f.Length()
+}
+
 func (f *FixedHeader) Encode() ([]byte, error) {
 	var data []byte
 	// data = append(data, byte(f.PacketType<<4))
@@ -5,3 +5,28 @@ import "testing"
 func TestPacketType(t *testing.T) {
 
 }
+
+func TestConnectFlags(t *testing.T) {
+	c := NewConnect(&FixedHeader{PacketType: CONNECT}, MQTT4)
+	c.ProtocolName = "MQTT"
+	c.ClientID = "c1"
+	c.Clean = true
+	c.UserNameFlag, c.Username = true, "user"
+	c.WillFlag = true
+	c.Will = &Will{Topic: "status", Message: "offline", QoS: QoS1, Retain: true}
+	data, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Decode(MQTT4, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := p.(*Connect)
+	if !d.UserNameFlag || d.PasswordFlag || d.Username != "user" || !d.Clean {
+		t.Errorf("unexpected flags %+v", d)
+	}
+	if d.Will == nil || d.Will.QoS != QoS1 || !d.Will.Retain || d.Will.Topic != "status" {
+		t.Errorf("unexpected will %+v", d.Will)
+	}
+}
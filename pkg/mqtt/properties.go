@@ -1,6 +1,9 @@
 package mqtt
 
-import "fmt"
+import (
+	"fmt"
+	"slices"
+)
 
 const (
 	ID_PayloadFormat                   byte = 0x01
@@ -62,7 +65,8 @@ type Properties struct {
 
 	// SubscriptionIdentifier is an identifier for the subscription.
 	// It can be used to relate a subscription to a specific client or purpose.
-	SubscriptionIdentifier *VariableByteInteger
+	// SUBSCRIBE carries at most one, a PUBLISH carries one for every matching subscription.
+	SubscriptionIdentifier []VariableByteInteger
 
 	// SessionExpiryInterval specifies the session expiry time in seconds.
 	// This defines how long the broker should keep the session alive after the client disconnects.
@@ -201,9 +205,9 @@ func (p *Properties) Encode() ([]byte, error) {
 		result = append(result, correlationData...)
 	}
 
-	if p.SubscriptionIdentifier != nil {
+	for _, id := range p.SubscriptionIdentifier {
 		result = append(result, ID_SubscriptionIdentifier)
-		encodedSubscriptionIdentifier, err := encodeVariableByteInteger(*p.SubscriptionIdentifier)
+		encodedSubscriptionIdentifier, err := encodeVariableByteInteger(id)
 		if err != nil {
 			return nil, err
 		}
@@ -365,7 +369,7 @@ func (p *Properties) Decode(data []byte) (int, error) {
 		return n, err
 	}
 	total := length.Int()
-	for i := n; i < total; {
+	for i := n; i < n+total; {
 		identifier := data[i]
 		i++
 		var vl int
@@ -399,9 +403,11 @@ func (p *Properties) Decode(data []byte) (int, error) {
 			}
 			i += vl
 		case ID_SubscriptionIdentifier:
-			if p.SubscriptionIdentifier, vl, err = decodeVariableByteIntegerPtr(data[i:]); err != nil {
+			var id VariableByteInteger
+			if vl, err = id.Decode(data[i:]); err != nil {
 				return i + total, err
 			}
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, id)
 			i += vl
 		case ID_SessionExpiryInterval:
 			if p.SessionExpiryInterval, err = decodeUint32Ptr(data[i : i+4]); err != nil {
@@ -533,7 +539,7 @@ func (p *Properties) Clone() *Properties {
 		ContentType:                     cloneStringPtr(p.ContentType),
 		ResponseTopic:                   cloneStringPtr(p.ResponseTopic),
 		CorrelationData:                 p.CorrelationData.Clone(),
-		SubscriptionIdentifier:          p.SubscriptionIdentifier.Clone(),
+		SubscriptionIdentifier:          slices.Clone(p.SubscriptionIdentifier),
 		SessionExpiryInterval:           cloneUint32Ptr(p.SessionExpiryInterval),
 		AssignedClientID:                cloneStringPtr(p.AssignedClientID),
 		ServerKeepAlive:                 cloneUint16Ptr(p.ServerKeepAlive),
@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPropertiesRequestResponse(t *testing.T) {
+	contentType := "application/json"
+	responseTopic := "reply/c1/" + strings.Repeat("x", 100)
+	format := PayloadFormatString
+	p := &Properties{
+		ContentType:     &contentType,
+		ResponseTopic:   &responseTopic,
+		CorrelationData: &BinaryData{Data: []byte{0, 1, 2, 0xff}},
+		UserProperties:  UserProperties{{"k1", "v1"}, {"k2", strings.Repeat("v", 50)}, {"k1", "v3"}},
+	}
+	data, err := p.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// append a short property last, behind the two byte property length
+	_, n, err := decodeVariableByteInteger(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append(data[n:], ID_PayloadFormat, format)
+	length, _ := encodeVariableByteInteger(len(body))
+	data = append(length, body...)
+	p.PayloadFormat = &format
+
+	decoded := new(Properties)
+	n, err = decoded.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Errorf("decoded %d of %d bytes", n, len(data))
+	}
+	if decoded.ContentType == nil || *decoded.ContentType != contentType {
+		t.Errorf("content type lost: %v", decoded.ContentType)
+	}
+	if decoded.ResponseTopic == nil || *decoded.ResponseTopic != responseTopic {
+		t.Errorf("response topic lost: %v", decoded.ResponseTopic)
+	}
+	if decoded.CorrelationData == nil || !bytes.Equal(decoded.CorrelationData.Data, p.CorrelationData.Data) {
+		t.Errorf("correlation data lost: %v", decoded.CorrelationData)
+	}
+	if !slices.Equal(decoded.UserProperties, p.UserProperties) {
+		t.Errorf("user properties lost: %v", decoded.UserProperties)
+	}
+	if decoded.PayloadFormat == nil || *decoded.PayloadFormat != format {
+		t.Errorf("payload format lost: %v", decoded.PayloadFormat)
+	}
+}
@@ -95,10 +95,13 @@ func (p *Publish) Encode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	p.FixedHeader.Flags = p.flags()
-	p.RemainingLength = VariableByteInteger(len(body))
-
-	header, err := p.FixedHeader.Encode()
+	// the header is not written back, a publish is encoded concurrently for every subscriber
+	fixed := FixedHeader{
+		PacketType:      PUBLISH,
+		Flags:           p.flags(),
+		RemainingLength: VariableByteInteger(len(body)),
+	}
+	header, err := fixed.Encode()
 	if err != nil {
 		return nil, err
 	}
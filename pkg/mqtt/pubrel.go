@@ -71,10 +71,13 @@ func (p *Pubrel) DecodeBody(data []byte) (int, error) {
 	}
 
 	// Decode Properties (MQTT 5.0 only)
-	if p.Version == MQTT5 {
+	if p.Version == MQTT5 && len(data) > start {
 		p.ReasonCode = ReasonCode(data[start])
 		start++
 		if len(data) > start {
+			if p.Properties == nil {
+				p.Properties = new(Properties)
+			}
 			n, err := p.Properties.Decode(data[start:])
 			if err != nil {
 				return start, err
@@ -1,6 +1,9 @@
 package mqtt
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type ReasonCode byte
 
@@ -21,6 +24,19 @@ func (e *Error) Code() ReasonCode {
 	return e.code
 }
 
+func NewError(code ReasonCode, msg string) *Error {
+	return &Error{code: code, msg: msg}
+}
+
+// ErrorCode returns the reason code carried by err, if err is or wraps an *Error.
+func ErrorCode(err error) (ReasonCode, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.code, true
+	}
+	return 0, false
+}
+
 // var (
 // 	BASE_SUCCESS = 0x00
 // )
@@ -39,7 +55,6 @@ var (
 	// v5
 	V5_SUCCESS                                ReasonCode = 0x00
 	V5_Normal_Disconnection                   ReasonCode = 0x00
-	Err_V5_Normal_Disconnection                          = Error{code: V5_Normal_Disconnection, msg: "Normal disconnection"}
 	V5_Granted_QoS0                           ReasonCode = 0x00
 	V5_Granted_QoS1                           ReasonCode = 0x01
 	V5_Granted_QoS2                           ReasonCode = 0x02
@@ -84,3 +99,16 @@ var (
 	V5_Subscription_Identifiers_Not_Supported ReasonCode = 0xA1
 	V5_Wildcard_Subscriptions_Not_Supported   ReasonCode = 0xA2
 )
+
+var (
+	Err_V5_Normal_Disconnection     = NewError(V5_Normal_Disconnection, "normal disconnection")
+	Err_V5_Receive_Maximum_Exceeded = NewError(V5_Receive_Maximum_Exceeded, "receive maximum exceeded")
+	Err_V5_Topic_Alias_Invalid      = NewError(V5_Topic_Alias_Invalid, "topic alias invalid")
+	Err_V5_Packet_Too_Large         = NewError(V5_Packet_Too_Large, "packet too large")
+	Err_V5_Quota_Exceeded           = NewError(V5_Quota_Exceeded, "quota exceeded")
+	Err_V5_Retain_Not_Supported     = NewError(V5_Retain_Not_Supported, "retain not supported")
+	Err_V5_QoS_Not_Supported        = NewError(V5_QoS_Not_Supported, "QoS not supported")
+	Err_V5_Message_Rate_Too_High    = NewError(V5_Message_Rate_Too_High, "message rate too high")
+	Err_V5_Administrative_Action    = NewError(V5_Administrative_Action, "administrative action")
+	Err_V5_Maximum_Connect_Time     = NewError(V5_Maximum_Connect_Time, "maximum connect time")
+)
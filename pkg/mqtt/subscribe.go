@@ -133,12 +133,11 @@ func (s *Subscribe) EncodeBody() ([]byte, error) {
 
 	// Encode Payload
 	for _, subscription := range s.Subscriptions {
-		if topicData, err := encodeUTF8Str(string(subscription.TopicFilter)); err != nil {
+		if subData, err := subscription.Encode(); err != nil {
 			return nil, err
 		} else {
-			data = append(data, topicData...)
+			data = append(data, subData...)
 		}
-		data = append(data, byte(subscription.QoS))
 	}
 
 	return data, nil
@@ -161,8 +160,21 @@ type Subscription struct {
 	QoS               QoS
 }
 
-func (s *Subscription) Encode() []byte {
-	return nil
+// Encode returns the topic filter followed by the subscription options byte.
+func (s *Subscription) Encode() ([]byte, error) {
+	data, err := encodeUTF8Str(s.TopicFilter)
+	if err != nil {
+		return nil, err
+	}
+	options := byte(s.QoS) & 0b00000011
+	if s.NoLocal {
+		options |= 0b00000100
+	}
+	if s.RetainAsPublished {
+		options |= 0b00001000
+	}
+	options |= (s.RetainHandling & 0b11) << 4
+	return append(data, options), nil
 }
 
 func (s *Subscription) Decode(data []byte) (int, error) {
@@ -178,6 +190,7 @@ func (s *Subscription) Decode(data []byte) (int, error) {
 	s.QoS = QoS(options & 0b00000011)
 	s.NoLocal = (options & 0b00000100) != 0
 	s.RetainAsPublished = (options & 0b00001000) != 0
+	s.RetainHandling = (options & 0b00110000) >> 4
 	n++
 	return n, nil
 }
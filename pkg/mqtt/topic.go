@@ -112,3 +112,22 @@ func (t *Topic) Split() []string {
 	tf := t.TopicFilter()
 	return strings.Split(tf, "/")
 }
+
+// Match reports whether the topic name matches filter, shared subscriptions match by their topic filter.
+func (t *Topic) Match(filter string) bool {
+	f := Topic(filter)
+	filters, names := f.Split(), strings.Split(string(*t), "/")
+	// wildcards at the first level do not match topics starting with $
+	if strings.HasPrefix(string(*t), "$") && (filters[0] == "+" || filters[0] == "#") {
+		return false
+	}
+	for i, part := range filters {
+		if part == "#" {
+			return true
+		}
+		if i >= len(names) || (part != "+" && part != names[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(names)
+}
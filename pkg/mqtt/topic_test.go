@@ -0,0 +1,22 @@
+package mqtt
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		topic, filter string
+		match         bool
+	}{
+		{"a/b", "a/+", true},
+		{"a/b/c", "a/+", false},
+		{"a", "a/#", true},
+		{"a/b/c", "#", true},
+		{"$SYS/x", "#", false},
+		{"a/b", "$share/g/a/b", true},
+	} {
+		topic := Topic(c.topic)
+		if topic.Match(c.filter) != c.match {
+			t.Errorf("%s matching %s: expected %t", c.topic, c.filter, c.match)
+		}
+	}
+}
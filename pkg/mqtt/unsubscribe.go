@@ -39,6 +39,7 @@ func (u *Unsubscribe) Encode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	u.FixedHeader.Flags = 0b0010
 	u.FixedHeader.RemainingLength = VariableByteInteger(len(body))
 	header, err := u.FixedHeader.Encode()
 	if err != nil {
@@ -0,0 +1,373 @@
+package mqttsn
+
+type Advertise struct {
+	GatewayID byte
+	Duration  uint16
+}
+
+func (m *Advertise) Type() MsgType { return ADVERTISE }
+
+func (m *Advertise) body() []byte {
+	return appendUint16([]byte{m.GatewayID}, m.Duration)
+}
+
+func (m *Advertise) decode(data []byte) error {
+	if err := minLength(data, 3); err != nil {
+		return err
+	}
+	m.GatewayID, m.Duration = data[0], uint16At(data, 1)
+	return nil
+}
+
+type SearchGW struct {
+	Radius byte
+}
+
+func (m *SearchGW) Type() MsgType { return SEARCHGW }
+func (m *SearchGW) body() []byte  { return []byte{m.Radius} }
+
+func (m *SearchGW) decode(data []byte) error {
+	if err := minLength(data, 1); err != nil {
+		return err
+	}
+	m.Radius = data[0]
+	return nil
+}
+
+type GWInfo struct {
+	GatewayID byte
+	// Address is only set when a client answers for a gateway
+	Address []byte
+}
+
+func (m *GWInfo) Type() MsgType { return GWINFO }
+func (m *GWInfo) body() []byte  { return append([]byte{m.GatewayID}, m.Address...) }
+
+func (m *GWInfo) decode(data []byte) error {
+	if err := minLength(data, 1); err != nil {
+		return err
+	}
+	m.GatewayID, m.Address = data[0], data[1:]
+	return nil
+}
+
+type Connect struct {
+	Flags      Flags
+	ProtocolID byte
+	// Duration is the keep alive in seconds
+	Duration uint16
+	ClientID string
+}
+
+func (m *Connect) Type() MsgType { return CONNECT }
+
+func (m *Connect) body() []byte {
+	data := appendUint16([]byte{byte(m.Flags), m.ProtocolID}, m.Duration)
+	return append(data, m.ClientID...)
+}
+
+func (m *Connect) decode(data []byte) error {
+	if err := minLength(data, 4); err != nil {
+		return err
+	}
+	m.Flags, m.ProtocolID, m.Duration, m.ClientID = Flags(data[0]), data[1], uint16At(data, 2), string(data[4:])
+	return nil
+}
+
+type Connack struct {
+	ReturnCode ReturnCode
+}
+
+func (m *Connack) Type() MsgType { return CONNACK }
+func (m *Connack) body() []byte  { return []byte{byte(m.ReturnCode)} }
+
+func (m *Connack) decode(data []byte) error {
+	if err := minLength(data, 1); err != nil {
+		return err
+	}
+	m.ReturnCode = ReturnCode(data[0])
+	return nil
+}
+
+type WillTopicReq struct{}
+
+func (m *WillTopicReq) Type() MsgType            { return WILLTOPICREQ }
+func (m *WillTopicReq) body() []byte             { return nil }
+func (m *WillTopicReq) decode(data []byte) error { return nil }
+
+// WillTopic without a topic deletes the will.
+type WillTopic struct {
+	Flags Flags
+	Topic string
+}
+
+func (m *WillTopic) Type() MsgType { return WILLTOPIC }
+
+func (m *WillTopic) body() []byte {
+	if m.Topic == "" {
+		return nil
+	}
+	return append([]byte{byte(m.Flags)}, m.Topic...)
+}
+
+func (m *WillTopic) decode(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	m.Flags, m.Topic = Flags(data[0]), string(data[1:])
+	return nil
+}
+
+type WillMsgReq struct{}
+
+func (m *WillMsgReq) Type() MsgType            { return WILLMSGREQ }
+func (m *WillMsgReq) body() []byte             { return nil }
+func (m *WillMsgReq) decode(data []byte) error { return nil }
+
+type WillMsg struct {
+	Message []byte
+}
+
+func (m *WillMsg) Type() MsgType { return WILLMSG }
+func (m *WillMsg) body() []byte  { return m.Message }
+
+func (m *WillMsg) decode(data []byte) error {
+	m.Message = data
+	return nil
+}
+
+type Register struct {
+	TopicID   uint16
+	MsgID     uint16
+	TopicName string
+}
+
+func (m *Register) Type() MsgType { return REGISTER }
+
+func (m *Register) body() []byte {
+	return append(appendUint16(appendUint16(nil, m.TopicID), m.MsgID), m.TopicName...)
+}
+
+func (m *Register) decode(data []byte) error {
+	if err := minLength(data, 4); err != nil {
+		return err
+	}
+	m.TopicID, m.MsgID, m.TopicName = uint16At(data, 0), uint16At(data, 2), string(data[4:])
+	return nil
+}
+
+type Regack struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+func (m *Regack) Type() MsgType { return REGACK }
+
+func (m *Regack) body() []byte {
+	return append(appendUint16(appendUint16(nil, m.TopicID), m.MsgID), byte(m.ReturnCode))
+}
+
+func (m *Regack) decode(data []byte) error {
+	if err := minLength(data, 5); err != nil {
+		return err
+	}
+	m.TopicID, m.MsgID, m.ReturnCode = uint16At(data, 0), uint16At(data, 2), ReturnCode(data[4])
+	return nil
+}
+
+type Publish struct {
+	Flags   Flags
+	TopicID uint16
+	MsgID   uint16
+	Data    []byte
+}
+
+func (m *Publish) Type() MsgType { return PUBLISH }
+
+func (m *Publish) body() []byte {
+	data := appendUint16(appendUint16([]byte{byte(m.Flags)}, m.TopicID), m.MsgID)
+	return append(data, m.Data...)
+}
+
+func (m *Publish) decode(data []byte) error {
+	if err := minLength(data, 5); err != nil {
+		return err
+	}
+	m.Flags, m.TopicID, m.MsgID, m.Data = Flags(data[0]), uint16At(data, 1), uint16At(data, 3), data[5:]
+	return nil
+}
+
+type Puback struct {
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+func (m *Puback) Type() MsgType { return PUBACK }
+
+func (m *Puback) body() []byte {
+	return append(appendUint16(appendUint16(nil, m.TopicID), m.MsgID), byte(m.ReturnCode))
+}
+
+func (m *Puback) decode(data []byte) error {
+	if err := minLength(data, 5); err != nil {
+		return err
+	}
+	m.TopicID, m.MsgID, m.ReturnCode = uint16At(data, 0), uint16At(data, 2), ReturnCode(data[4])
+	return nil
+}
+
+type Pubrec struct {
+	MsgID uint16
+}
+
+func (m *Pubrec) Type() MsgType            { return PUBREC }
+func (m *Pubrec) body() []byte             { return appendUint16(nil, m.MsgID) }
+func (m *Pubrec) decode(data []byte) error { return decodeMsgID(data, &m.MsgID) }
+
+type Pubrel struct {
+	MsgID uint16
+}
+
+func (m *Pubrel) Type() MsgType            { return PUBREL }
+func (m *Pubrel) body() []byte             { return appendUint16(nil, m.MsgID) }
+func (m *Pubrel) decode(data []byte) error { return decodeMsgID(data, &m.MsgID) }
+
+type Pubcomp struct {
+	MsgID uint16
+}
+
+func (m *Pubcomp) Type() MsgType            { return PUBCOMP }
+func (m *Pubcomp) body() []byte             { return appendUint16(nil, m.MsgID) }
+func (m *Pubcomp) decode(data []byte) error { return decodeMsgID(data, &m.MsgID) }
+
+func decodeMsgID(data []byte, id *uint16) error {
+	if err := minLength(data, 2); err != nil {
+		return err
+	}
+	*id = uint16At(data, 0)
+	return nil
+}
+
+// Subscribe carries a topic name for normal and short topics, a topic ID for predefined ones.
+type Subscribe struct {
+	Flags     Flags
+	MsgID     uint16
+	TopicName string
+	TopicID   uint16
+}
+
+func (m *Subscribe) Type() MsgType { return SUBSCRIBE }
+func (m *Subscribe) body() []byte  { return topicBody(m.Flags, m.MsgID, m.TopicName, m.TopicID) }
+
+func (m *Subscribe) decode(data []byte) error {
+	return decodeTopic(data, &m.Flags, &m.MsgID, &m.TopicName, &m.TopicID)
+}
+
+type Unsubscribe struct {
+	Flags     Flags
+	MsgID     uint16
+	TopicName string
+	TopicID   uint16
+}
+
+func (m *Unsubscribe) Type() MsgType { return UNSUBSCRIBE }
+func (m *Unsubscribe) body() []byte  { return topicBody(m.Flags, m.MsgID, m.TopicName, m.TopicID) }
+
+func (m *Unsubscribe) decode(data []byte) error {
+	return decodeTopic(data, &m.Flags, &m.MsgID, &m.TopicName, &m.TopicID)
+}
+
+func topicBody(flags Flags, msgID uint16, name string, id uint16) []byte {
+	data := appendUint16([]byte{byte(flags)}, msgID)
+	if flags.TopicIDType() == TopicPredefined {
+		return appendUint16(data, id)
+	}
+	return append(data, name...)
+}
+
+func decodeTopic(data []byte, flags *Flags, msgID *uint16, name *string, id *uint16) error {
+	if err := minLength(data, 4); err != nil {
+		return err
+	}
+	*flags, *msgID = Flags(data[0]), uint16At(data, 1)
+	if flags.TopicIDType() == TopicPredefined {
+		if err := minLength(data, 5); err != nil {
+			return err
+		}
+		*id = uint16At(data, 3)
+		return nil
+	}
+	*name = string(data[3:])
+	return nil
+}
+
+type Suback struct {
+	Flags      Flags
+	TopicID    uint16
+	MsgID      uint16
+	ReturnCode ReturnCode
+}
+
+func (m *Suback) Type() MsgType { return SUBACK }
+
+func (m *Suback) body() []byte {
+	return append(appendUint16(appendUint16([]byte{byte(m.Flags)}, m.TopicID), m.MsgID), byte(m.ReturnCode))
+}
+
+func (m *Suback) decode(data []byte) error {
+	if err := minLength(data, 6); err != nil {
+		return err
+	}
+	m.Flags, m.TopicID, m.MsgID, m.ReturnCode = Flags(data[0]), uint16At(data, 1), uint16At(data, 3), ReturnCode(data[5])
+	return nil
+}
+
+type Unsuback struct {
+	MsgID uint16
+}
+
+func (m *Unsuback) Type() MsgType            { return UNSUBACK }
+func (m *Unsuback) body() []byte             { return appendUint16(nil, m.MsgID) }
+func (m *Unsuback) decode(data []byte) error { return decodeMsgID(data, &m.MsgID) }
+
+// Pingreq carries the client ID when a sleeping client wakes up.
+type Pingreq struct {
+	ClientID string
+}
+
+func (m *Pingreq) Type() MsgType { return PINGREQ }
+func (m *Pingreq) body() []byte  { return []byte(m.ClientID) }
+
+func (m *Pingreq) decode(data []byte) error {
+	m.ClientID = string(data)
+	return nil
+}
+
+type Pingresp struct{}
+
+func (m *Pingresp) Type() MsgType            { return PINGRESP }
+func (m *Pingresp) body() []byte             { return nil }
+func (m *Pingresp) decode(data []byte) error { return nil }
+
+// Disconnect with a duration puts the client to sleep for that many seconds.
+type Disconnect struct {
+	Duration uint16
+}
+
+func (m *Disconnect) Type() MsgType { return DISCONNECT }
+
+func (m *Disconnect) body() []byte {
+	if m.Duration == 0 {
+		return nil
+	}
+	return appendUint16(nil, m.Duration)
+}
+
+func (m *Disconnect) decode(data []byte) error {
+	if len(data) >= 2 {
+		m.Duration = uint16At(data, 0)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Package mqttsn encodes and decodes MQTT-SN 1.2 messages.
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMalformedMessage = errors.New("malformed mqtt-sn message")
+	ErrUnsupportedType  = errors.New("unsupported mqtt-sn message type")
+)
+
+type MsgType byte
+
+const (
+	ADVERTISE    MsgType = 0x00
+	SEARCHGW     MsgType = 0x01
+	GWINFO       MsgType = 0x02
+	CONNECT      MsgType = 0x04
+	CONNACK      MsgType = 0x05
+	WILLTOPICREQ MsgType = 0x06
+	WILLTOPIC    MsgType = 0x07
+	WILLMSGREQ   MsgType = 0x08
+	WILLMSG      MsgType = 0x09
+	REGISTER     MsgType = 0x0A
+	REGACK       MsgType = 0x0B
+	PUBLISH      MsgType = 0x0C
+	PUBACK       MsgType = 0x0D
+	PUBCOMP      MsgType = 0x0E
+	PUBREC       MsgType = 0x0F
+	PUBREL       MsgType = 0x10
+	SUBSCRIBE    MsgType = 0x12
+	SUBACK       MsgType = 0x13
+	UNSUBSCRIBE  MsgType = 0x14
+	UNSUBACK     MsgType = 0x15
+	PINGREQ      MsgType = 0x16
+	PINGRESP     MsgType = 0x17
+	DISCONNECT   MsgType = 0x18
+)
+
+type ReturnCode byte
+
+const (
+	Accepted       ReturnCode = 0x00
+	Congestion     ReturnCode = 0x01
+	InvalidTopicID ReturnCode = 0x02
+	NotSupported   ReturnCode = 0x03
+)
+
+// TopicIDType tells how the topic of PUBLISH, SUBSCRIBE and UNSUBSCRIBE is given.
+type TopicIDType byte
+
+const (
+	TopicNormal     TopicIDType = 0b00
+	TopicPredefined TopicIDType = 0b01
+	TopicShort      TopicIDType = 0b10
+)
+
+// Flags of CONNECT, WILLTOPIC, PUBLISH, SUBSCRIBE, SUBACK and UNSUBSCRIBE.
+type Flags byte
+
+const (
+	FlagDUP          Flags = 0b10000000
+	FlagRetain       Flags = 0b00010000
+	FlagWill         Flags = 0b00001000
+	FlagCleanSession Flags = 0b00000100
+)
+
+func (f Flags) DUP() bool          { return f&FlagDUP != 0 }
+func (f Flags) Retain() bool       { return f&FlagRetain != 0 }
+func (f Flags) Will() bool         { return f&FlagWill != 0 }
+func (f Flags) CleanSession() bool { return f&FlagCleanSession != 0 }
+
+func (f Flags) TopicIDType() TopicIDType {
+	return TopicIDType(f & 0b11)
+}
+
+// QoS is 0, 1, 2 or -1 for publishes sent without a connection.
+func (f Flags) QoS() int {
+	qos := int(f>>5) & 0b11
+	if qos == 3 {
+		return -1
+	}
+	return qos
+}
+
+// NewFlags returns flags with the QoS and topic ID type set.
+func NewFlags(qos int, retain bool, t TopicIDType) Flags {
+	f := Flags(t & 0b11)
+	if qos < 0 {
+		qos = 3
+	}
+	f |= Flags(qos&0b11) << 5
+	if retain {
+		f |= FlagRetain
+	}
+	return f
+}
+
+// ShortTopic returns the two character topic name carried in a topic ID.
+func ShortTopic(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+// ShortTopicID returns the topic ID carrying a two character topic name.
+func ShortTopicID(name string) (uint16, bool) {
+	if len(name) != 2 {
+		return 0, false
+	}
+	return uint16(name[0])<<8 | uint16(name[1]), true
+}
+
+// Message is an MQTT-SN message.
+type Message interface {
+	Type() MsgType
+	// body is the encoded message after the header
+	body() []byte
+	decode(data []byte) error
+}
+
+// Encode returns the message with its length and type header.
+func Encode(m Message) []byte {
+	body := m.body()
+	var data []byte
+	if n := len(body) + 2; n < 256 {
+		data = append(data, byte(n))
+	} else {
+		// three octets length, the first octet is 0x01
+		data = append(data, 0x01)
+		data = binary.BigEndian.AppendUint16(data, uint16(n+2))
+	}
+	data = append(data, byte(m.Type()))
+	return append(data, body...)
+}
+
+// Decode decodes one message from a datagram.
+func Decode(data []byte) (Message, error) {
+	if len(data) < 2 {
+		return nil, ErrMalformedMessage
+	}
+	length, offset := int(data[0]), 1
+	if data[0] == 0x01 {
+		if len(data) < 4 {
+			return nil, ErrMalformedMessage
+		}
+		length, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+	}
+	if length > len(data) || length <= offset {
+		return nil, ErrMalformedMessage
+	}
+	m, err := newMessage(MsgType(data[offset]))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.decode(data[offset+1 : length]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMessage(t MsgType) (Message, error) {
+	switch t {
+	case ADVERTISE:
+		return &Advertise{}, nil
+	case SEARCHGW:
+		return &SearchGW{}, nil
+	case GWINFO:
+		return &GWInfo{}, nil
+	case CONNECT:
+		return &Connect{}, nil
+	case CONNACK:
+		return &Connack{}, nil
+	case WILLTOPICREQ:
+		return &WillTopicReq{}, nil
+	case WILLTOPIC:
+		return &WillTopic{}, nil
+	case WILLMSGREQ:
+		return &WillMsgReq{}, nil
+	case WILLMSG:
+		return &WillMsg{}, nil
+	case REGISTER:
+		return &Register{}, nil
+	case REGACK:
+		return &Regack{}, nil
+	case PUBLISH:
+		return &Publish{}, nil
+	case PUBACK:
+		return &Puback{}, nil
+	case PUBCOMP:
+		return &Pubcomp{}, nil
+	case PUBREC:
+		return &Pubrec{}, nil
+	case PUBREL:
+		return &Pubrel{}, nil
+	case SUBSCRIBE:
+		return &Subscribe{}, nil
+	case SUBACK:
+		return &Suback{}, nil
+	case UNSUBSCRIBE:
+		return &Unsubscribe{}, nil
+	case UNSUBACK:
+		return &Unsuback{}, nil
+	case PINGREQ:
+		return &Pingreq{}, nil
+	case PINGRESP:
+		return &Pingresp{}, nil
+	case DISCONNECT:
+		return &Disconnect{}, nil
+	}
+	return nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedType, byte(t))
+}
+
+func uint16At(data []byte, i int) uint16 {
+	return binary.BigEndian.Uint16(data[i : i+2])
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	return binary.BigEndian.AppendUint16(data, v)
+}
+
+func minLength(data []byte, n int) error {
+	if len(data) < n {
+		return ErrMalformedMessage
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package mqttsn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	messages := []Message{
+		&SearchGW{Radius: 2},
+		&Connect{Flags: FlagCleanSession | FlagWill, ProtocolID: 1, Duration: 30, ClientID: "sensor"},
+		&Register{TopicID: 3, MsgID: 4, TopicName: "a/b"},
+		&Publish{Flags: NewFlags(2, true, TopicNormal) | FlagDUP, TopicID: 3, MsgID: 5, Data: []byte("x")},
+		&Publish{TopicID: 3, MsgID: 6, Data: bytes.Repeat([]byte("y"), 300)},
+		&Subscribe{Flags: NewFlags(1, false, TopicPredefined), MsgID: 7, TopicID: 9},
+		&Subscribe{Flags: NewFlags(-1, false, TopicNormal), MsgID: 8, TopicName: "a/#"},
+		&Suback{Flags: NewFlags(1, false, TopicNormal), TopicID: 3, MsgID: 7, ReturnCode: Accepted},
+		&Pingreq{ClientID: "sensor"},
+		&Disconnect{Duration: 60},
+	}
+	for _, m := range messages {
+		decoded, err := Decode(Encode(m))
+		if err != nil {
+			t.Fatalf("%T: %v", m, err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("expected %#v, got %#v", m, decoded)
+		}
+	}
+}
+
+func TestFlags(t *testing.T) {
+	f := NewFlags(-1, true, TopicShort)
+	if f.QoS() != -1 || !f.Retain() || f.TopicIDType() != TopicShort || f.DUP() {
+		t.Errorf("unexpected flags %08b", f)
+	}
+	if id, ok := ShortTopicID("ab"); !ok || ShortTopic(id) != "ab" {
+		t.Error("short topic round trip failed")
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, data := range [][]byte{{0x01}, {0x05, 0x0C}, {0x03, 0x0C, 0x00}, {0x02, 0x11}} {
+		if _, err := Decode(data); err == nil {
+			t.Errorf("expected error for %x", data)
+		}
+	}
+	if _, err := Decode([]byte{0x02, 0x11}); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("expected unsupported type, got %v", err)
+	}
+}